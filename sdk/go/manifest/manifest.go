@@ -80,11 +80,14 @@ func unescapeSeq(seq string) string {
 	return string([]byte{byte(i)})
 }
 
+// EscapeName returns s with whitespace, control characters and
+// backslashes replaced by octal escape sequences (like "\040"), so it
+// can be used as a token in a manifest and unescaped by UnescapeName.
 func EscapeName(s string) string {
 	raw := []byte(s)
 	escaped := make([]byte, 0, len(s))
 	for _, c := range raw {
-		if c <= 32 {
+		if c <= 32 || c == '\\' || c == 0x7f {
 			oct := fmt.Sprintf("\\%03o", c)
 			escaped = append(escaped, []byte(oct)...)
 		} else {
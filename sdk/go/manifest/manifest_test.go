@@ -180,6 +180,26 @@ func TestUnescape(t *testing.T) {
 	}
 }
 
+func TestEscape(t *testing.T) {
+	for _, testCase := range [][]string{
+		{`a b`, `a\040b`},
+		{"new\nline\ttab", `new\012line\011tab`},
+		{`back\slash`, `back\134slash`},
+		{`\040`, `\134040`},
+		{"del\x7f", `del\177`},
+	} {
+		in := testCase[0]
+		expect := testCase[1]
+		got := EscapeName(in)
+		if expect != got {
+			t.Errorf("For %q got %q instead of %q", in, got, expect)
+		}
+		if back := UnescapeName(got); back != in {
+			t.Errorf("For %q got %q after unescaping %q", in, back, got)
+		}
+	}
+}
+
 type fsegtest struct {
 	mt   string        // manifest text
 	f    string        // filename
@@ -1166,7 +1166,7 @@ func (runner *ContainerRunner) UploadOutputFile(
 	}
 
 	if info.Mode().IsRegular() {
-		return "", walkUpload.UploadFile(relocated, tgt)
+		return "", walkUpload.UploadFile(tgt, relocated[len(runner.HostOutputDir):])
 	}
 
 	if info.Mode().IsDir() {
@@ -1235,8 +1235,8 @@ func (runner *ContainerRunner) CaptureOutput() error {
 	if err != nil {
 		// Regular directory
 
-		cw := CollectionWriter{0, runner.Kc, nil, nil, sync.Mutex{}}
-		walkUpload := cw.BeginUpload(runner.HostOutputDir, runner.CrunchLog.Logger)
+		cw := CollectionWriter{IKeepClient: runner.Kc}
+		walkUpload := cw.BeginUpload(context.TODO(), runner.HostOutputDir, runner.CrunchLog.Logger)
 
 		var m string
 		err = filepath.Walk(runner.HostOutputDir, func(path string, info os.FileInfo, err error) error {
@@ -1247,17 +1247,16 @@ func (runner *ContainerRunner) CaptureOutput() error {
 			return err
 		})
 
-		cw.EndUpload(walkUpload)
-
-		if err != nil {
-			return fmt.Errorf("While uploading output files: %v", err)
+		m, summary, enderr := cw.FinishUpload(walkUpload)
+		if err == nil {
+			err = enderr
 		}
 
-		m, err = cw.ManifestText()
-		manifestText = manifestText + m
 		if err != nil {
 			return fmt.Errorf("While uploading output files: %v", err)
 		}
+		runner.CrunchLog.Printf("Uploaded output: %v", summary)
+		manifestText = manifestText + m
 	} else {
 		// FUSE mount directory
 		file, openerr := os.Open(collectionMetafile)
@@ -1681,7 +1680,7 @@ func NewContainerRunner(api IArvadosClient,
 	cr.NewLogWriter = cr.NewArvLogWriter
 	cr.RunArvMount = cr.ArvMountCmd
 	cr.MkTempDir = ioutil.TempDir
-	cr.LogCollection = &CollectionWriter{0, kc, nil, nil, sync.Mutex{}}
+	cr.LogCollection = &CollectionWriter{IKeepClient: kc}
 	cr.Container.UUID = containerUUID
 	cr.CrunchLog = NewThrottledLogger(cr.NewLogWriter("crunch-run"))
 	cr.CrunchLog.Immediate = log.New(os.Stderr, containerUUID+" ", 0)
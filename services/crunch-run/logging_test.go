@@ -111,8 +111,7 @@ func (s *LoggingTestSuite) TestWriteMultipleLogs(c *C) {
 	mt, err := cr.LogCollection.ManifestText()
 	c.Check(err, IsNil)
 	c.Check(mt, Equals, ""+
-		". 408672f5b5325f7d20edfbf899faee42+83 0:83:crunch-run.txt\n"+
-		". c556a293010069fa79a6790a931531d5+80 0:80:stdout.txt\n")
+		". 408672f5b5325f7d20edfbf899faee42+83 c556a293010069fa79a6790a931531d5+80 0:83:crunch-run.txt 83:80:stdout.txt\n")
 }
 
 func (s *LoggingTestSuite) TestWriteLogsWithRateLimitThrottleBytes(c *C) {
@@ -15,15 +15,22 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"crypto/md5"
+	"crypto/sha256"
 	"errors"
 	"fmt"
+	"hash"
 	"io"
 	"log"
 	"os"
 	"path/filepath"
+	"regexp"
+	"sort"
 	"strings"
 	"sync"
+	"syscall"
+	"time"
 
 	"git.curoverse.com/arvados.git/sdk/go/keepclient"
 	"git.curoverse.com/arvados.git/sdk/go/manifest"
@@ -33,6 +40,74 @@ import (
 type Block struct {
 	data   []byte
 	offset int64
+	path   string // first file with data in this block
+
+	// Source file and offset of the block's data, if it all came
+	// from a single source file.
+	source       string
+	sourceOffset int64
+	sourceInfo   os.FileInfo
+
+	// Locator of a block that is already stored, see
+	// CollectionWriter.CheckpointFile.
+	locator string
+
+	// File holding the data of a block that was spilled to
+	// CollectionWriter.SpillDir.
+	spill string
+
+	// Sequence number of the block's BlockFlushed event, see
+	// reserveEvent.
+	event int
+}
+
+// Phases of an upload reported in UploadError.
+const (
+	UploadPhaseRead = "read" // reading the source file
+	UploadPhasePack = "pack" // packing file data into blocks
+	UploadPhasePut  = "put"  // writing a block to Keep
+)
+
+// UploadError describes a failure to upload a file.
+type UploadError struct {
+	// Path of the file in the collection.  For UploadPhasePut,
+	// this is the first file with data in the block that could not
+	// be written.
+	Path  string
+	Phase string
+	Err   error
+}
+
+func (e *UploadError) Error() string {
+	return fmt.Sprintf("Upload %s failed for %q: %v", e.Phase, e.Path, e.Err)
+}
+
+// Unwrap returns the underlying error.
+func (e *UploadError) Unwrap() error {
+	return e.Err
+}
+
+// UploadWarning describes a file or directory that was left out of the
+// collection without failing the upload, see WalkUpload.Warnings.
+type UploadWarning struct {
+	// Path of the file in the collection.
+	Path   string
+	Reason string
+}
+
+func (w UploadWarning) Error() string {
+	return fmt.Sprintf("Skipped %q: %s", w.Path, w.Reason)
+}
+
+// UploadErrors is returned by Finish when more than one error occurred.
+type UploadErrors []error
+
+func (errs UploadErrors) Error() string {
+	var msgs []string
+	for _, err := range errs {
+		msgs = append(msgs, err.Error())
+	}
+	return strings.Join(msgs, "\n")
 }
 
 // CollectionFileWriter is a Writer that permits writing to a file in a Keep Collection.
@@ -44,7 +119,30 @@ type CollectionFileWriter struct {
 	*Block
 	uploader chan *Block
 	finish   chan []error
+	errs     []error // errors reported by goUpload
 	fn       string
+	ctx      context.Context
+	cw       *CollectionWriter
+
+	// Source (if any) of the current file
+	source     string
+	sourceInfo os.FileInfo
+
+	checkpoint *uploadCheckpoint
+
+	// Logger for diagnostics
+	status Logger
+
+	// Bytes added to the CollectionWriter's packedBytes
+	packed int64
+
+	// Rolling hash of the current block, see
+	// ContentDefinedChunking
+	chunkHash uint64
+
+	// Position of the stream in CollectionWriter.Streams, in the
+	// order the streams were started.
+	index int
 }
 
 // Write to a file in a keep collection
@@ -58,16 +156,46 @@ func (m *CollectionFileWriter) ReadFrom(r io.Reader) (n int64, err error) {
 	var total int64
 	var count int
 
+	blockSize := m.cw.blockSize()
 	for err == nil {
+		if err = m.ctx.Err(); err != nil {
+			break
+		}
 		if m.Block == nil {
-			m.Block = &Block{make([]byte, keepclient.BLOCKSIZE), 0}
+			var data []byte
+			if data, err = m.cw.allocBuffer(m.ctx); err != nil {
+				break
+			}
+			m.Block = &Block{data: data}
+			m.chunkHash = 0
 		}
 		count, err = r.Read(m.Block.data[m.Block.offset:])
+		if count > 0 && m.Block.path == "" {
+			m.Block.path = streamPath(m.StreamName, m.fn)
+			m.Block.source = m.source
+			m.Block.sourceOffset = int64(m.length) + total
+			m.Block.sourceInfo = m.sourceInfo
+		} else if count > 0 && m.Block.source != m.source {
+			m.Block.source = ""
+		}
 		total += int64(count)
 		m.Block.offset += int64(count)
-		if m.Block.offset == keepclient.BLOCKSIZE {
-			m.uploader <- m.Block
-			m.Block = nil
+		m.packed += int64(count)
+		if lerr := m.cw.addPackedBytes(count); lerr != nil {
+			err = lerr
+		}
+		if m.cw.ContentDefinedChunking && count > 0 {
+			if cerr := m.cutChunks(m.Block.offset-int64(count), int64(m.length)+total); cerr != nil {
+				err = cerr
+			}
+			if m.Block == nil {
+				continue
+			}
+		}
+		if m.Block.offset == int64(blockSize) {
+			if err = m.sendBlock(m.Block); err == nil {
+				m.Block = nil
+			}
 		}
 	}
 
@@ -79,6 +207,33 @@ func (m *CollectionFileWriter) ReadFrom(r io.Reader) (n int64, err error) {
 	return total, err
 }
 
+// flushBlock sends the current block to the uploader even if it is not
+// full, so the next data written starts a new block.
+func (m *CollectionFileWriter) flushBlock() error {
+	if m.Block == nil || m.Block.offset == 0 {
+		return nil
+	}
+	if err := m.sendBlock(m.Block); err != nil {
+		return err
+	}
+	m.Block = nil
+	return nil
+}
+
+// sendBlock hands block to the uploader, reserving the sequence number
+// of its BlockFlushed event so the event is sent in the order the
+// blocks were filled.
+func (m *CollectionFileWriter) sendBlock(block *Block) error {
+	block.event = m.cw.reserveEvent()
+	select {
+	case m.uploader <- block:
+		return nil
+	case <-m.ctx.Done():
+		m.cw.deliverEvent(block.event, nil)
+		return m.ctx.Err()
+	}
+}
+
 // Close stops writing a file and adds it to the parent manifest.
 func (m *CollectionFileWriter) Close() error {
 	m.ManifestStream.FileStreamSegments = append(m.ManifestStream.FileStreamSegments,
@@ -92,250 +247,2887 @@ func (m *CollectionFileWriter) NewFile(fn string) {
 	m.fn = fn
 }
 
-func (m *CollectionFileWriter) goUpload(workers chan struct{}) {
+func (m *CollectionFileWriter) goUpload(uploader chan *Block, finish chan []error, workers chan struct{}) {
 	var mtx sync.Mutex
 	var wg sync.WaitGroup
 
 	var errors []error
-	uploader := m.uploader
-	finish := m.finish
-	for block := range uploader {
-		mtx.Lock()
-		m.ManifestStream.Blocks = append(m.ManifestStream.Blocks, "")
-		blockIndex := len(m.ManifestStream.Blocks) - 1
-		mtx.Unlock()
+	done := m.ctx.Done()
+	reporter := m.cw.reporter()
 
-		workers <- struct{}{} // wait for an available worker slot
+	// upload writes block to Keep, as ManifestStream.Blocks[blockIndex],
+	// using the worker slot already taken from workers.
+	upload := func(block *Block, blockIndex int) {
 		wg.Add(1)
-
 		go func(block *Block, blockIndex int) {
-			hash := fmt.Sprintf("%x", md5.Sum(block.data[0:block.offset]))
-			signedHash, _, err := m.IKeepClient.PutHB(hash, block.data[0:block.offset])
+			data, err := m.blockData(block)
+			hash := m.cw.hash(data)
+			var signedHash string
+			var cperr error
+			var stored bool
+			if err == nil && m.checkpoint != nil {
+				signedHash, stored = m.checkpoint.lookupHash(hash)
+				if stored {
+					stored, err = m.reusable(signedHash)
+				}
+			}
+			if err == nil && !stored {
+				t0 := time.Now()
+				signedHash, err = m.putBlock(hash, data)
+				reporter.ObserveBlockLatency(time.Since(t0))
+				if err == nil && m.checkpoint != nil {
+					cperr = m.checkpoint.record(newCheckpointEntry(hash, signedHash, block))
+				}
+			}
 			<-workers
+			m.releaseBlock(block)
 
 			mtx.Lock()
 			if err != nil {
-				errors = append(errors, err)
+				errors = append(errors, &UploadError{Path: block.path, Phase: UploadPhasePut, Err: err})
+				reporter.IncErrors(1)
 			} else {
 				m.ManifestStream.Blocks[blockIndex] = signedHash
+				m.cw.countBlock(signedHash, block.offset)
+			}
+			if cperr != nil {
+				errors = append(errors, fmt.Errorf("While writing upload checkpoint: %v", cperr))
+				reporter.IncErrors(1)
 			}
 			mtx.Unlock()
+			if err == nil {
+				m.cw.deliverEvent(block.event, &UploadEvent{Type: BlockFlushed, Path: block.path, Size: block.offset, Locator: signedHash})
+			} else {
+				m.cw.deliverEvent(block.event, nil)
+			}
 
 			wg.Done()
 		}(block, blockIndex)
 	}
+
+	// Blocks spilled to SpillDir wait here for a worker, so that full
+	// blocks can still be taken from the uploader while they wait.
+	var spilled []spilledBlock
+	for {
+		// Stop taking new blocks as soon as the upload is
+		// cancelled, instead of waiting for the uploader channel
+		// to be closed.
+		var dispatch chan struct{}
+		if len(spilled) > 0 {
+			dispatch = workers
+		}
+		var block *Block
+		select {
+		case block = <-uploader:
+		case dispatch <- struct{}{}:
+			upload(spilled[0].block, spilled[0].index)
+			spilled = spilled[1:]
+			continue
+		case <-done:
+		}
+		if block == nil {
+			break
+		}
+
+		if block.locator != "" {
+			mtx.Lock()
+			m.ManifestStream.Blocks = append(m.ManifestStream.Blocks, block.locator)
+			mtx.Unlock()
+			m.cw.countBlock(block.locator, block.offset)
+			m.cw.deliverEvent(block.event, &UploadEvent{Type: BlockFlushed, Path: block.path, Size: block.offset, Locator: block.locator})
+			continue
+		}
+
+		mtx.Lock()
+		m.ManifestStream.Blocks = append(m.ManifestStream.Blocks, "")
+		blockIndex := len(m.ManifestStream.Blocks) - 1
+		mtx.Unlock()
+
+		// If all workers are busy, the block can wait on disk
+		// instead of holding a buffer.
+		if m.cw.SpillDir != "" {
+			select {
+			case workers <- struct{}{}:
+				upload(block, blockIndex)
+				continue
+			default:
+				m.spillBlock(block)
+			}
+			if block.spill != "" {
+				spilled = append(spilled, spilledBlock{block, blockIndex})
+				continue
+			}
+		}
+		select {
+		case workers <- struct{}{}: // wait for an available worker slot
+			upload(block, blockIndex)
+			continue
+		case <-done:
+			m.cw.deliverEvent(block.event, nil)
+			m.releaseBlock(block)
+		}
+		break
+	}
+	for _, sb := range spilled {
+		if m.ctx.Err() == nil {
+			select {
+			case workers <- struct{}{}:
+				upload(sb.block, sb.index)
+				continue
+			case <-done:
+			}
+		}
+		m.cw.deliverEvent(sb.block.event, nil)
+		m.releaseBlock(sb.block)
+	}
 	wg.Wait()
 
+	if err := m.ctx.Err(); err != nil {
+		errors = append(errors, err)
+	}
 	finish <- errors
 }
 
+// SymlinkMode determines how BeginUpload/UploadFile treat symbolic links.
+type SymlinkMode int
+
+const (
+	// SymlinkFollow uploads the content of the link target.  The
+	// target must be inside the upload root.
+	SymlinkFollow SymlinkMode = iota
+	// SymlinkSkip ignores symbolic links.
+	SymlinkSkip
+	// SymlinkStore records the link target verbatim (see
+	// CollectionWriter.Symlinks) instead of copying its content.
+	SymlinkStore
+)
+
+// SpecialFilePolicy determines how uploads treat files that are
+// neither regular files, directories, nor symbolic links, such as named
+// pipes, sockets, and device files.
+type SpecialFilePolicy int
+
+const (
+	// SpecialFileSkip ignores special files, recording an
+	// UploadWarning for each.
+	SpecialFileSkip SpecialFilePolicy = iota
+	// SpecialFileError fails the upload of a special file.
+	SpecialFileError
+	// SpecialFileRecord records the type of the special file in
+	// its FileMetadata.  The file does not appear in the manifest.
+	SpecialFileRecord
+)
+
+// SizeChangePolicy determines what happens when the size of a file
+// changes between the time UploadFile checks its size and the time it
+// finishes reading the file.
+type SizeChangePolicy int
+
+const (
+	// SizeChangeRecordActual stores the data actually read, and
+	// logs a message.
+	SizeChangeRecordActual SizeChangePolicy = iota
+	// SizeChangeError fails the upload of the file.
+	SizeChangeError
+)
+
+// ConflictPolicy determines what happens when an upload stores a file
+// at a path where it has already stored another one (e.g., when
+// UploadFile is called twice with the same destination, or a
+// FileFilter maps two files to the same path).
+type ConflictPolicy int
+
+const (
+	// ConflictError fails the upload of the second file.
+	ConflictError ConflictPolicy = iota
+	// ConflictOverwrite replaces the earlier file with the new
+	// one.
+	ConflictOverwrite
+	// ConflictRename stores the new file under a different name,
+	// made by adding "~1" (or "~2", etc., whichever is not taken
+	// yet) before the file's extension.
+	ConflictRename
+)
+
+// UnderReplicationPolicy determines what happens when Keep stores
+// fewer replicas of a block than DesiredReplication (or the
+// replication of its StreamPolicy).
+type UnderReplicationPolicy int
+
+const (
+	// UnderReplicationError fails the upload.
+	UnderReplicationError UnderReplicationPolicy = iota
+	// UnderReplicationWarn accepts the block as long as at least
+	// one replica was stored, logs a warning, and records the
+	// block in UnderReplicatedBlocks.
+	UnderReplicationWarn
+)
+
 // CollectionWriter implements creating new Keep collections by opening files
 // and writing to them.
+//
+// Several uploads (see BeginUpload) can run concurrently on the same
+// CollectionWriter, e.g., to upload different subtrees in parallel.
+// EndUpload adds the files of each upload to the collection, and
+// ManifestText merges them into one normalized manifest, which does not
+// depend on the order the uploads finish in.  The options (the
+// exported fields) must not be changed while uploads are running.
 type CollectionWriter struct {
+	// MaxWriters is the maximum number of blocks that may be
+	// written to Keep concurrently.  The default is 2.  Block
+	// locators appear in the manifest in the order the blocks were
+	// filled, regardless of the order in which the writes finish.
 	MaxWriters int
 	IKeepClient
 	Streams []*CollectionFileWriter
 	workers chan struct{}
 	mtx     sync.Mutex
-}
 
-// Open a new file for writing in the Keep collection.
-func (m *CollectionWriter) Open(path string) io.WriteCloser {
-	var dir string
-	var fn string
+	// Session, if not nil, provides the Keep client for each
+	// upload (see BeginUpload, Open, and PutFile) instead of
+	// IKeepClient, so CollectionWriters sharing a session also
+	// share its connections and list of Keep services.
+	Session *KeepSession
 
-	i := strings.Index(path, "/")
-	if i > -1 {
-		dir = "./" + path[0:i]
-		fn = path[i+1:]
-	} else {
-		dir = "."
-		fn = path
-	}
+	// BlockCache, if not nil, remembers the blocks stored by
+	// this CollectionWriter, and by the others sharing the same
+	// cache, so later uploads reuse their locators instead of
+	// storing the same blocks again.
+	BlockCache *BlockCache
 
-	fw := &CollectionFileWriter{
-		m.IKeepClient,
-		&manifest.ManifestStream{StreamName: dir},
-		0,
-		0,
-		nil,
-		make(chan *Block),
-		make(chan []error),
-		fn}
+	// BlockStore, if not nil, stores the data blocks instead of
+	// IKeepClient and Session, e.g., to upload to a different
+	// kind of storage, or to memory in tests.
+	BlockStore BlockStore
 
-	m.mtx.Lock()
-	defer m.mtx.Unlock()
-	if m.workers == nil {
-		if m.MaxWriters < 1 {
-			m.MaxWriters = 2
-		}
-		m.workers = make(chan struct{}, m.MaxWriters)
-	}
+	// MaxReaders is the maximum number of small files that
+	// WalkUpload.Walk reads concurrently.  The default is 1.
+	// Reading many small files concurrently can be much faster
+	// than reading them one at a time.  If it is greater than 1,
+	// concurrent WalkUpload.UploadFile calls also read up to
+	// MaxReaders small files ahead while they wait their turn.
+	MaxReaders int
 
-	go fw.goUpload(m.workers)
+	// SymlinkMode determines how uploads treat symbolic links.  The
+	// default is SymlinkFollow.
+	SymlinkMode SymlinkMode
 
-	m.Streams = append(m.Streams, fw)
+	// MaxSymlinkDepth is the maximum length of a chain of
+	// symbolic links (a link to a link to ...) that SymlinkFollow
+	// follows.  Longer chains are an error.  The default is 40.
+	MaxSymlinkDepth int
 
-	return fw
-}
+	// SpecialFilePolicy determines how uploads treat special
+	// files.  The default is SpecialFileSkip.
+	SpecialFilePolicy SpecialFilePolicy
 
-// Finish writing the collection, wait for all blocks to complete uploading.
-func (m *CollectionWriter) Finish() error {
-	var errstring string
-	m.mtx.Lock()
-	defer m.mtx.Unlock()
+	// SizeChangePolicy determines how uploads treat files that
+	// grow or shrink while they are being read (e.g., logs that
+	// are still being written).  The default is
+	// SizeChangeRecordActual.
+	SizeChangePolicy SizeChangePolicy
 
-	for _, stream := range m.Streams {
-		if stream.uploader == nil {
-			continue
-		}
-		if stream.Block != nil {
-			stream.uploader <- stream.Block
-		}
-		close(stream.uploader)
-		stream.uploader = nil
+	// ConflictPolicy determines how uploads treat a file stored at
+	// the same path as an earlier file of the same upload.  The
+	// default is ConflictError.  Files stored by different uploads
+	// (see BeginUpload) are not checked against each other.
+	ConflictPolicy ConflictPolicy
 
-		errors := <-stream.finish
-		close(stream.finish)
-		stream.finish = nil
+	// Exclude is a list of gitignore-style patterns for files and
+	// directories that WalkUpload.Walk should skip.  Patterns are
+	// matched against paths relative to the upload root.  A pattern
+	// with a trailing slash matches only directories (and thereby
+	// excludes everything below them), and a pattern starting with
+	// "!" re-includes paths excluded by an earlier pattern.
+	Exclude []string
 
-		for _, r := range errors {
-			errstring = fmt.Sprintf("%v%v\n", errstring, r.Error())
-		}
-	}
-	if errstring != "" {
-		return errors.New(errstring)
+	// KeepIgnoreFiles makes WalkUpload.Walk read a .keepignore
+	// file in each directory that has one, and skip the files and
+	// directories under it matching its patterns, which have the
+	// same format as Exclude but are relative to the directory
+	// containing the .keepignore file.  As with nested .gitignore
+	// files, patterns in deeper directories override those above
+	// them and Exclude.  The .keepignore files themselves are
+	// uploaded, unless they are excluded.
+	KeepIgnoreFiles bool
+
+	// ModifiedSince, if not zero, makes WalkUpload.Walk skip
+	// files last modified before this time (for a symlink that
+	// is followed, the modification time of its target).
+	// Directories are walked regardless of their own
+	// modification times, so newer files inside them are still
+	// found.  Together with BaseManifest, this makes an
+	// incremental upload of the files changed since an earlier
+	// one.
+	ModifiedSince time.Time
+
+	// StrictReadability makes WalkUpload.Walk fail as soon as a
+	// file or directory cannot be read because permission is
+	// denied, instead of leaving it out of the collection with an
+	// UploadWarning (see WalkUpload.Warnings).  Other errors
+	// reading files always make the upload fail.
+	StrictReadability bool
+
+	// PreserveMode records the permission bits of each uploaded
+	// file in its FileMetadata.
+	PreserveMode bool
+
+	// PreserveXattrs records the extended attributes of each
+	// uploaded file (e.g., "user.checksum") in its FileMetadata.
+	// Files without extended attributes, and files read from a
+	// FileSystem that is not an XattrFileSystem, get no Xattrs.
+	PreserveXattrs bool
+
+	// PreserveMtime records the modification time of each
+	// uploaded file in its FileMetadata.
+	PreserveMtime bool
+
+	// RecordSHA256 computes the SHA-256 digest of each file
+	// uploaded with WalkUpload while it is read, and records it
+	// (see SHA256Digests).  Checkpoints (see CheckpointFile) then
+	// save writing blocks, but not reading files.
+	RecordSHA256 bool
+
+	// RecordMD5 computes the MD5 digest of the whole content of
+	// each file uploaded with WalkUpload while it is read, and
+	// records it with the file's size (see FileChecksums), for
+	// checking files independently of their blocks (whose hashes
+	// only match a file's digest if the file is a single block).
+	// Like RecordSHA256, it makes checkpoints save writing
+	// blocks, but not reading files.
+	RecordMD5 bool
+
+	// NameSanitizer, if not nil, is called with the name of each
+	// file and directory (a single path component, after
+	// NormalizeUnicode) before it is stored in the manifest, and
+	// returns the name to store instead, e.g., to enforce a
+	// cluster's rules for names.  The result is escaped for the
+	// manifest as usual.  If NameSanitizer returns an error (or
+	// an empty name, "." or "..", or a name containing "/"), the
+	// file is not stored, and the upload fails with an
+	// *UploadError naming it.  Files whose names sanitize to the
+	// same name are handled according to ConflictPolicy.
+	// Exclude patterns and FileFilter see the names before
+	// sanitizing.
+	NameSanitizer func(name string) (string, error)
+
+	// NormalizeUnicode stores file and directory names in Unicode
+	// Normalization Form C (NFC), the form used on Linux, so the
+	// same tree uploaded from a file system storing names in
+	// another form (like NFD on macOS) gets the same manifest and
+	// portable data hash.  Exclude patterns and FileFilter see the
+	// normalized names.  By default, names are stored exactly as
+	// they are read from the file system.
+	NormalizeUnicode bool
+
+	// PreserveEmptyDirs records empty directories (directories
+	// with no entries at all) in the manifest, using the Arvados
+	// convention of a stream containing an empty file named "."
+	// (written as "\056").  By default, empty directories are
+	// left out.
+	PreserveEmptyDirs bool
+
+	// AvoidPageCache tells the kernel that files are read
+	// sequentially, and asks it to drop each file from the page
+	// cache as it is read, so uploading large files does not push
+	// other data out of the cache.  It only has an effect on
+	// Linux, and not on small files read ahead with MaxReaders.
+	AvoidPageCache bool
+
+	// BlockSize is the maximum size of the data blocks written to
+	// Keep.  The default is keepclient.BLOCKSIZE (64 MiB).  Each
+	// stream (directory) is packed into blocks of its own, so the
+	// first file of a stream always starts a new block, and
+	// reading one directory never reads the tail of another.
+	BlockSize int
+
+	// ContentDefinedChunking ends blocks where the data matches a
+	// pattern (found with a rolling hash), instead of only when
+	// they are full, making blocks between BlockSize/16 and
+	// BlockSize bytes long.  Inserting or removing data in a file
+	// then changes a few blocks around the edit, instead of all
+	// of the file's blocks after it, so successive versions of a
+	// file share most of their blocks.
+	ContentDefinedChunking bool
+
+	// MaxBufferedBlocks, if greater than zero, is the maximum
+	// number of block buffers (BlockSize bytes each) in memory at
+	// a time, counting blocks being filled and blocks waiting to
+	// be written to Keep.  Writers wait for a buffer when the
+	// limit is reached.  A walk keeps at most one partially
+	// filled block, writing it out early when it moves on to
+	// another stream.  Streams opened with Open, and concurrent
+	// uploads, each hold a buffer for their partially filled
+	// block until they are finished.
+	MaxBufferedBlocks int
+
+	// SpillDir, if not empty, is a directory where full blocks
+	// wait for a free writer (see MaxWriters) when all writers
+	// are busy, instead of holding a buffer.  This lets readers
+	// go on filling blocks without using more memory, at the cost
+	// of writing each waiting block to local disk and reading it
+	// back.  Spill files are removed when the block has been
+	// written, or the upload fails or is cancelled.  If a block
+	// cannot be spilled, it waits in memory as usual.
+	SpillDir string
+
+	// MaxCollectionBytes, if greater than zero, is the maximum
+	// total size of the file data written to the collection.
+	// Writing more fails with a *CollectionSizeError as soon as
+	// the limit is exceeded, and so does ManifestText.  Files in
+	// BaseManifest are not counted.
+	MaxCollectionBytes int64
+
+	// MaxFiles, if greater than zero, is the maximum number of
+	// files stored in the collection by uploads.  Storing more
+	// fails with a *FileCountError before the file is read, which
+	// ends WalkUpload.Walk, and ManifestText fails the same way.
+	// Symlinks and special files that are not stored as files,
+	// and files in BaseManifest, are not counted.
+	MaxFiles int
+
+	// NoSplitSmallFiles avoids splitting files no larger than
+	// SmallFileSize between two blocks: if such a file does not
+	// fit in the rest of the current block, it starts a new one.
+	// This makes reading small files faster at the cost of some
+	// unused space in blocks.  Larger files are still split.
+	NoSplitSmallFiles bool
+
+	// SmallFileSize is the size of the largest file that
+	// NoSplitSmallFiles does not split.  The default (and
+	// maximum) is BlockSize.
+	SmallFileSize int64
+
+	// CheckpointFile, if not empty, is a file where uploads log the
+	// blocks they have written to Keep.  If the file already exists
+	// (e.g., because a previous attempt to upload the same tree was
+	// interrupted), blocks listed there are not written again, and
+	// file data that was stored in whole blocks is not read again as
+	// long as the file's size and modification time are unchanged.
+	// A listed block is written again if its locator's permission
+	// signature is close to expiring, or if the Keep client can
+	// check (see BlockAsker) and the block is no longer stored.
+	CheckpointFile string
+	checkpoint     *uploadCheckpoint
+
+	// DesiredReplication, if greater than zero, is the number of
+	// replicas to store of each block.  It is passed to Keep
+	// clients that implement ReplicationKeepClient.  Writing a
+	// block fails if the client reports fewer replicas stored.
+	DesiredReplication int
+
+	// UnderReplicationPolicy determines whether writing a block
+	// with fewer replicas than desired fails the upload.  The
+	// default is UnderReplicationError.
+	UnderReplicationPolicy UnderReplicationPolicy
+
+	// StreamPolicies, if not empty, sets the replication and
+	// storage classes of the blocks of the streams under each
+	// given stream (e.g., "./raw"), overriding
+	// DesiredReplication.  If several apply to a stream, the
+	// longest one is used.  Blocks with the same content are
+	// stored separately for streams with different policies.
+	StreamPolicies map[string]StreamPolicy
+
+	// MaxRetries is the number of times to retry writing a block
+	// (or saving the collection record, see SaveCollection) after
+	// a temporary error.  The default is 0 (no retries beyond
+	// those done by the Keep client itself).  Errors with a
+	// Temporary method that returns false are not retried.  With
+	// a ServiceKeepClient, each attempt goes to a different Keep
+	// service.
+	MaxRetries int
+
+	// RetryDelay is the delay before the first retry.  It doubles
+	// after each attempt.  The default is one second.  Retries
+	// stop when the upload's context is cancelled.
+	RetryDelay time.Duration
+
+	// PutTimeout, if greater than zero, is the time allowed for
+	// each attempt to write a block to Keep.  An attempt that
+	// takes longer is abandoned and logged (with the block
+	// locator and the time elapsed), and fails with a temporary
+	// error, so it is retried if MaxRetries allows.  Keep clients
+	// cannot be interrupted, so the abandoned write goes on in the
+	// background, and its buffer is not counted in
+	// MaxBufferedBlocks once it is abandoned.
+	PutTimeout time.Duration
+
+	// BytesPerSecond, if greater than zero, limits the rate at
+	// which block data is sent to Keep, to avoid saturating the
+	// network on a shared node.  Each block write (including
+	// retries) waits until the blocks written before it, and the
+	// block itself, fit in the limit.  The default is no limit.
+	BytesPerSecond int64
+
+	// SignatureTTL is the lifetime of the permission signatures
+	// added to block locators if the Keep client is a
+	// LocatorSigner.  The signatures are made when the manifest
+	// text is generated, so they are valid for SignatureTTL after
+	// each call to ManifestText.  The default is two weeks.
+	SignatureTTL time.Duration
+
+	// Logger, if not nil, receives the messages logged by
+	// uploads, with fields identifying the file or block
+	// concerned, instead of the *log.Logger passed to
+	// BeginUpload.
+	Logger Logger
+
+	// BaseManifest is the manifest text of an existing collection
+	// to add the uploaded files to.  ManifestText returns the
+	// files in BaseManifest and the uploaded files, normalized.  An
+	// uploaded file replaces a file with the same path in
+	// BaseManifest.
+	BaseManifest string
+
+	// Properties, if not empty, are stored as the properties of
+	// the collection by SaveCollection (e.g., the UUID of the
+	// container that produced it).  Properties given to
+	// SaveCollection in attrs["properties"] are added to these,
+	// replacing those with the same keys.
+	Properties map[string]interface{}
+
+	// DiffBase is the manifest text of a collection to compare
+	// the uploaded files with, see Diff.
+	DiffBase string
+
+	// Reporter, if not nil, receives metrics about uploads.
+	Reporter Reporter
+
+	// VerifyAfterWrite makes ManifestText read back each block
+	// written to the collection from Keep, and fail if its content
+	// does not match the hash in its locator.  The Keep client
+	// must be a BlockGetter.  This is expensive: each block is
+	// read once.
+	VerifyAfterWrite bool
+
+	// Hasher, if not nil, returns the hash function used to
+	// compute the content addresses of blocks, for Keep services
+	// that use one other than MD5.  The manifest normalization
+	// done by the SDK only understands MD5 locators, so with a
+	// different hash ManifestText does not normalize the manifest
+	// (it returns the same as RawManifestText), and BaseManifest
+	// cannot be used.
+	Hasher func() hash.Hash
+
+	// DryRun computes the manifest without writing anything to
+	// Keep.  The manifest has the same content locators a real
+	// upload would produce, but without permission signatures.
+	// CheckpointFile is ignored.
+	DryRun bool
+
+	// SkipExistingBlocks checks whether each block is already
+	// stored in Keep before writing it, if the Keep client is a
+	// BlockAsker, and does not write the blocks that are.  This
+	// saves writes when re-uploading output that has not changed.
+	// Blocks found this way are not written with
+	// DesiredReplication, and their locators have no permission
+	// signatures unless the Keep client is a LocatorSigner.
+	SkipExistingBlocks bool
+
+	// BlockTransform, if not nil, is applied to each block before
+	// it is written to Keep, e.g., to compress it.  It returns the
+	// data to store and a locator hint identifying the
+	// transformation, which must start with "Z" (e.g., "Zgzip").
+	// The hint is added to the block's locator, whose size remains
+	// the size of the original data so the file positions in the
+	// manifest are unchanged.  Other Arvados clients do not know
+	// about transformed blocks, so their content can only be read
+	// with ReadTransformedBlock.
+	BlockTransform func(data []byte) ([]byte, string, error)
+
+	// Split limits the size of the collections returned by
+	// FinishSplit.
+	Split SplitPolicy
+
+	// MaxLocatorsPerLine and MaxFilesPerLine, if greater than
+	// zero, limit the number of block locators and file segments
+	// on each line of the manifest, for manifest readers that
+	// cannot handle very long lines.  A stream that exceeds them
+	// is written as several lines with the same stream name, each
+	// with the blocks its segments refer to.  A file is split
+	// into several segments only if it spans more than
+	// MaxLocatorsPerLine blocks.  Splitting changes the portable
+	// data hash, but not the content of the collection.
+	MaxLocatorsPerLine int
+	MaxFilesPerLine    int
+
+	// BareStreamNames makes ManifestText, WriteManifest, and
+	// RawManifestText write the names of streams below the top
+	// level without the leading "./" (e.g., "subdir" instead of
+	// "./subdir"), for older tools that expect them that way.
+	// The top level stream is still ".", since a manifest line
+	// cannot start with an empty name.  Such manifests do not
+	// follow the manifest format, and the API server rejects
+	// them: SaveCollection, PortableDataHash, and the other
+	// methods using the manifest internally always use the
+	// standard names.
+	BareStreamNames bool
+
+	// WriteIndex adds a file named .arv-index.json to the top of
+	// the collection, listing every other file in the collection
+	// (including BaseManifest) with its size and the block ranges
+	// holding its data, so readers can find a file without parsing
+	// the whole manifest.  It is written when the manifest text is
+	// first generated, and reflects the files written before then.
+	// The index is the same for collections with the same content.
+	// An empty collection has no index.
+	WriteIndex bool
+
+	// OnProgress, if not nil, is called by UploadFile as it reads
+	// each file, and once more when the file is complete.
+	// bytesUploaded is the number of bytes of path read so far, and
+	// bytesTotal is the file size reported by stat (-1 for
+	// UploadReader, where the size is not known).  It is called
+	// from the goroutine that called UploadFile.
+	OnProgress func(path string, bytesUploaded, bytesTotal int64)
+
+	// Events, if not nil, receives an UploadEvent as each file is
+	// started and completed, each block is stored, and each
+	// upload ends (see UploadEventType).  Events are sent from
+	// the goroutines doing the work, which wait until the event
+	// is received: the channel must be buffered or drained
+	// promptly, or the upload slows down or stops.  The channel
+	// is never closed.
+	//
+	// Events arrive in the order the upload got to them, not the
+	// order the work finished in: a block's BlockFlushed event
+	// takes the place of the moment the block was filled, and is
+	// held back (along with the events after it) until the block
+	// is stored.  An upload run from a single goroutine therefore
+	// sends the same events in the same order every time.
+	Events chan<- UploadEvent
+
+	symlinks map[string]string
+	metadata map[string]*FileMetadata
+
+	// The index file has been written, see WriteIndex.
+	indexWritten bool
+
+	// Content hashes of uploaded files, by path (only with
+	// DiffBase).
+	hashes map[string]string
+
+	// SHA-256 digests of uploaded files, by path (only with
+	// RecordSHA256).
+	sha256s map[string]string
+
+	// MD5 digests and sizes of uploaded files, by path (only with
+	// RecordMD5).
+	md5s map[string]string
+
+	// Blocks written (or being written) to Keep by this
+	// CollectionWriter, by hash, replication, and storage
+	// classes (see storedKey).
+	stored    map[string]*storedBlock
+	storedMtx sync.Mutex
+
+	// Blocks read back by VerifyAfterWrite, by hash, also
+	// protected by storedMtx.
+	verified map[string]bool
+
+	// Events waiting to be sent to Events, see deliverEvent.
+	events eventQueue
+
+	// Number of streams started so far, protected by mtx.
+	streamCount int
+
+	// Upload statistics, also protected by storedMtx.
+	bytesWritten  int64
+	blocksWritten int
+	uniqueBytes   int64
+
+	// Locators of the blocks counted in blocksWritten, by hash
+	// and size, also protected by storedMtx.
+	locators map[string]string
+
+	// Replicas stored of each block written with fewer replicas
+	// than desired, by locator, also protected by storedMtx.
+	underReplicated map[string]int
+
+	// Block buffers in use, see MaxBufferedBlocks.  buffers is
+	// created on first use; it, buffersInUse, and peakBuffers are
+	// protected by storedMtx.
+	buffers      chan struct{}
+	buffersInUse int
+	peakBuffers  int
+
+	// File data written so far, see MaxCollectionBytes, also
+	// protected by storedMtx.
+	packedBytes int64
+
+	// Files stored so far, see MaxFiles, also protected by
+	// storedMtx.
+	fileCount int
+
+	// Hash of a block of zeros, and the locators of the stored
+	// blocks of zeros by storedKey, for sparse files, also
+	// protected by storedMtx.
+	zeroHash     string
+	zeroLocators map[string]string
+
+	// Time when the data written so far fits in BytesPerSecond,
+	// also protected by storedMtx.
+	throttleNext time.Time
+}
+
+// CollectionSizeError is the error returned when an upload exceeds
+// CollectionWriter.MaxCollectionBytes.
+type CollectionSizeError struct {
+	Limit int64 // MaxCollectionBytes
+	Size  int64 // bytes written when the limit was exceeded
+}
+
+func (e *CollectionSizeError) Error() string {
+	return fmt.Sprintf("Collection size limit exceeded: wrote %d bytes, limit is %d bytes", e.Size, e.Limit)
+}
+
+// addPackedBytes adds n bytes to the size of the file data written to
+// the collection, and returns a *CollectionSizeError if the total
+// exceeds MaxCollectionBytes.
+func (m *CollectionWriter) addPackedBytes(n int) error {
+	m.storedMtx.Lock()
+	defer m.storedMtx.Unlock()
+	m.packedBytes += int64(n)
+	if m.MaxCollectionBytes > 0 && m.packedBytes > m.MaxCollectionBytes {
+		return &CollectionSizeError{Limit: m.MaxCollectionBytes, Size: m.packedBytes}
 	}
 	return nil
 }
 
-// ManifestText returns the manifest text of the collection.  Calls Finish()
-// first to ensure that all blocks are written and that signed locators and
-// available.
-func (m *CollectionWriter) ManifestText() (mt string, err error) {
-	err = m.Finish()
-	if err != nil {
-		return "", err
+// FileCountError is the error returned when an upload exceeds
+// CollectionWriter.MaxFiles.
+type FileCountError struct {
+	Limit int // MaxFiles
+}
+
+func (e *FileCountError) Error() string {
+	return fmt.Sprintf("File count limit exceeded: more than %d files", e.Limit)
+}
+
+// addFiles adds n to the number of files stored in the collection, and
+// returns a *FileCountError if the total exceeds MaxFiles.
+func (m *CollectionWriter) addFiles(n int) error {
+	m.storedMtx.Lock()
+	defer m.storedMtx.Unlock()
+	m.fileCount += n
+	if m.MaxFiles > 0 && m.fileCount > m.MaxFiles {
+		return &FileCountError{Limit: m.MaxFiles}
 	}
+	return nil
+}
 
-	var buf bytes.Buffer
+// storedBlock is the result of writing a block to Keep.  done is closed
+// when the write has finished.
+type storedBlock struct {
+	done    chan struct{}
+	locator string
+	err     error
+}
+
+// FileMetadata holds information about an uploaded file that cannot be
+// represented in a manifest.  Callers that want to keep it can store it
+// elsewhere, e.g., as collection properties.
+type FileMetadata struct {
+	Mode os.FileMode `json:"mode,omitempty"`
+
+	// Type is the kind of special file ("fifo", "socket",
+	// "char-device", or "block-device") recorded with
+	// SpecialFileRecord.  It is empty for regular files.
+	Type string `json:"type,omitempty"`
+
+	// Xattrs are the extended attributes of the file, recorded
+	// with PreserveXattrs.
+	Xattrs map[string]string `json:"xattrs,omitempty"`
+
+	// Mtime is the modification time of the file, recorded with
+	// PreserveMtime.
+	Mtime *time.Time `json:"mtime,omitempty"`
+}
 
+// getCheckpoint loads CheckpointFile, if configured.
+func (m *CollectionWriter) getCheckpoint() (*uploadCheckpoint, error) {
+	if m.CheckpointFile == "" || m.DryRun {
+		return nil, nil
+	}
 	m.mtx.Lock()
 	defer m.mtx.Unlock()
-	for _, v := range m.Streams {
-		if len(v.FileStreamSegments) == 0 {
+	if m.checkpoint == nil {
+		cp, err := loadCheckpoint(m.CheckpointFile)
+		if err != nil {
+			return nil, fmt.Errorf("While loading upload checkpoint: %v", err)
+		}
+		m.checkpoint = cp
+	}
+	return m.checkpoint, nil
+}
+
+// putBlock writes data to Keep, unless a block with the same hash has
+// already been written by the same CollectionWriter (or is in
+// BlockCache), in which case the existing locator is returned.
+// Identical files that start at a block boundary (e.g., copies of the
+// same file in different directories) therefore only store their
+// content once.
+func (m *CollectionFileWriter) putBlock(hash string, data []byte) (string, error) {
+	cw := m.cw
+	key := m.storedKey(hash)
+	for {
+		cw.storedMtx.Lock()
+		if cw.stored == nil {
+			cw.stored = make(map[string]*storedBlock)
+		}
+		sb, ok := cw.stored[key]
+		if !ok {
+			sb = &storedBlock{done: make(chan struct{})}
+			cw.stored[key] = sb
+		}
+		cw.storedMtx.Unlock()
+
+		if ok {
+			<-sb.done
+			if sb.err == nil {
+				return sb.locator, nil
+			}
+			// The earlier write failed and has been
+			// forgotten; try again.
 			continue
 		}
-		k := v.StreamName
-		if k == "." {
-			buf.WriteString(".")
-		} else {
-			k = strings.Replace(k, " ", "\\040", -1)
-			k = strings.Replace(k, "\n", "", -1)
-			buf.WriteString("./" + k)
+
+		var found bool
+		var size int
+		if !cw.DryRun && cw.BlockCache != nil {
+			sb.locator, found = cw.BlockCache.get(key)
 		}
-		if len(v.Blocks) > 0 {
-			for _, b := range v.Blocks {
-				buf.WriteString(" ")
-				buf.WriteString(b)
+		if !cw.DryRun && !found {
+			sb.locator, found, sb.err = m.findBlock(hash, len(data))
+		}
+		if !found && sb.err == nil {
+			sb.locator, size, sb.err = m.storeBlock(hash, data)
+			if sb.err == nil && !cw.DryRun && cw.BlockCache != nil {
+				cw.BlockCache.add(key, sb.locator)
 			}
-		} else {
-			buf.WriteString(" d41d8cd98f00b204e9800998ecf8427e+0")
 		}
-		for _, f := range v.FileStreamSegments {
-			buf.WriteString(" ")
-			name := strings.Replace(f.Name, " ", "\\040", -1)
-			name = strings.Replace(name, "\n", "", -1)
-			buf.WriteString(fmt.Sprintf("%v:%v:%v", f.SegPos, f.SegLen, name))
+		cw.storedMtx.Lock()
+		if sb.err != nil {
+			delete(cw.stored, key)
+		} else if !found {
+			cw.uniqueBytes += int64(size)
 		}
-		buf.WriteString("\n")
+		cw.storedMtx.Unlock()
+		close(sb.done)
+		return sb.locator, sb.err
 	}
-	return buf.String(), nil
 }
 
-type WalkUpload struct {
-	MaxWriters  int
-	kc          IKeepClient
-	stripPrefix string
-	streamMap   map[string]*CollectionFileWriter
-	status      *log.Logger
-	workers     chan struct{}
-	mtx         sync.Mutex
+// BlockAsker is implemented by Keep clients that can check whether a
+// block is stored without reading it, like keepclient.KeepClient.
+// Return values are the same as for keepclient.KeepClient.Ask.
+type BlockAsker interface {
+	Ask(locator string) (int64, string, error)
 }
 
-func (m *WalkUpload) UploadFile(path string, sourcePath string) error {
-	var dir string
-	basename := filepath.Base(path)
-	if len(path) > (len(m.stripPrefix) + len(basename) + 1) {
-		dir = path[len(m.stripPrefix)+1 : (len(path) - len(basename) - 1)]
+// findBlock returns the locator of the block with the given hash and
+// size, and true, if SkipExistingBlocks is set and the block is already
+// stored in Keep.  It only returns an error if the upload is cancelled
+// while waiting for the answer.
+func (m *CollectionFileWriter) findBlock(hash string, size int) (string, bool, error) {
+	asker, ok := unwrapClient(m.IKeepClient).(BlockAsker)
+	if !m.cw.SkipExistingBlocks || !ok {
+		return "", false, nil
 	}
-	if dir == "" {
-		dir = "."
+	locator := fmt.Sprintf("%s+%d", hash, size)
+	found := make(chan bool, 1)
+	go func() {
+		n, _, err := asker.Ask(locator)
+		found <- err == nil && n == int64(size)
+	}()
+	select {
+	case ok := <-found:
+		return locator, ok, nil
+	case <-m.ctx.Done():
+		return "", false, m.ctx.Err()
 	}
+}
 
-	fn := path[(len(path) - len(basename)):]
+// ReplicationKeepClient is implemented by Keep clients that can store
+// a block with a given number of replicas.  Return values are the same
+// as for PutHB.
+type ReplicationKeepClient interface {
+	PutHBReplicas(hash string, buf []byte, replicas int) (string, int, error)
+}
 
-	info, err := os.Stat(sourcePath)
-	if err != nil {
+// putReplicas writes a block to Keep with DesiredReplication replicas,
+// if set, or as specified by the stream's policy.  It is an error if
+// the client reports that fewer replicas were stored, unless
+// UnderReplicationPolicy allows it.
+func (m *CollectionFileWriter) putReplicas(kc IKeepClient, hash string, data []byte) (string, error) {
+	cw := m.cw
+	want := cw.DesiredReplication
+	var classes []string
+	if policy := m.policy(); policy != nil {
+		if policy.Replication > 0 {
+			want = policy.Replication
+		}
+		classes = policy.StorageClasses
+	}
+	var locator string
+	var replicas int
+	var err error
+	if len(classes) > 0 {
+		sckc, ok := kc.(StorageClassKeepClient)
+		if !ok {
+			return "", fmt.Errorf("Cannot write block with storage classes %v: Keep client does not support storage classes", classes)
+		}
+		locator, replicas, err = sckc.PutHBStorageClasses(hash, data, want, classes)
+	} else if want < 1 {
+		locator, _, err = kc.PutHB(hash, data)
+		return locator, err
+	} else if rkc, ok := kc.(ReplicationKeepClient); ok {
+		locator, replicas, err = rkc.PutHBReplicas(hash, data, want)
+	} else {
+		locator, replicas, err = kc.PutHB(hash, data)
+	}
+	if err == nil && replicas < want {
+		if cw.UnderReplicationPolicy != UnderReplicationWarn || replicas < 1 {
+			return locator, fmt.Errorf("Could not write sufficient replicas: wanted %d, wrote %d", want, replicas)
+		}
+		m.status.WithField("locator", locator).Warnf("Block %s is under-replicated: wanted %d replicas, wrote %d", locator, want, replicas)
+		cw.storedMtx.Lock()
+		if cw.underReplicated == nil {
+			cw.underReplicated = make(map[string]int)
+		}
+		cw.underReplicated[locator] = replicas
+		cw.storedMtx.Unlock()
+	}
+	return locator, err
+}
+
+// UnderReplicatedBlocks returns the number of replicas stored of each
+// block that was written with fewer replicas than desired, by locator,
+// when UnderReplicationPolicy is UnderReplicationWarn.
+func (m *CollectionWriter) UnderReplicatedBlocks() map[string]int {
+	m.storedMtx.Lock()
+	defer m.storedMtx.Unlock()
+	blocks := make(map[string]int, len(m.underReplicated))
+	for locator, replicas := range m.underReplicated {
+		blocks[locator] = replicas
+	}
+	return blocks
+}
+
+// defaultRetryDelay is the default delay before the first retry of a
+// failed block write.
+const defaultRetryDelay = time.Second
+
+// putRetry writes a block to Keep, retrying up to MaxRetries times
+// after temporary errors.  The delay between attempts starts at
+// RetryDelay and doubles after each attempt.
+func (m *CollectionFileWriter) putRetry(hash string, data []byte) (string, error) {
+	delay := m.cw.RetryDelay
+	if delay <= 0 {
+		delay = defaultRetryDelay
+	}
+	for attempt := 0; ; attempt++ {
+		if err := m.cw.throttle(m.ctx, len(data)); err != nil {
+			return "", err
+		}
+		locator, err := m.putTimeout(m.attemptClient(hash, attempt), hash, data)
+		if err == nil || attempt >= m.cw.MaxRetries || !temporary(err) {
+			return locator, err
+		}
+		select {
+		case <-time.After(delay):
+		case <-m.ctx.Done():
+			return "", err
+		}
+		delay *= 2
+	}
+}
+
+// throttle waits until n more bytes can be written without exceeding
+// BytesPerSecond, or until ctx is cancelled.
+func (m *CollectionWriter) throttle(ctx context.Context, n int) error {
+	if m.BytesPerSecond <= 0 {
+		return nil
+	}
+	m.storedMtx.Lock()
+	now := time.Now()
+	if m.throttleNext.Before(now) {
+		m.throttleNext = now
+	}
+	m.throttleNext = m.throttleNext.Add(time.Duration(n) * time.Second / time.Duration(m.BytesPerSecond))
+	wait := m.throttleNext.Sub(now)
+	m.storedMtx.Unlock()
+
+	select {
+	case <-time.After(wait):
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// putTimeoutError is the error for an attempt to write a block that
+// took longer than PutTimeout.
+type putTimeoutError struct {
+	locator string
+	elapsed time.Duration
+}
+
+func (e *putTimeoutError) Error() string {
+	return fmt.Sprintf("Timed out writing block %s after %v", e.locator, e.elapsed)
+}
+
+// Temporary reports that the write may succeed if retried.
+func (e *putTimeoutError) Temporary() bool {
+	return true
+}
+
+// putTimeout makes one attempt to write a block to Keep with kc,
+// giving up after PutTimeout.
+func (m *CollectionFileWriter) putTimeout(kc IKeepClient, hash string, data []byte) (string, error) {
+	if m.cw.PutTimeout <= 0 {
+		return m.putReplicas(kc, hash, data)
+	}
+	type result struct {
+		locator string
+		err     error
+	}
+	done := make(chan result, 1)
+	t0 := time.Now()
+	go func() {
+		locator, err := m.putReplicas(kc, hash, data)
+		done <- result{locator, err}
+	}()
+	timer := time.NewTimer(m.cw.PutTimeout)
+	defer timer.Stop()
+	select {
+	case r := <-done:
+		return r.locator, r.err
+	case <-timer.C:
+		err := &putTimeoutError{
+			locator: fmt.Sprintf("%s+%d", hash, len(data)),
+			elapsed: time.Since(t0),
+		}
+		m.status.WithField("locator", err.locator).WithField("elapsed", err.elapsed).Warnf("%v", err)
+		return "", err
+	}
+}
+
+// temporary reports whether err might go away if the operation is
+// retried, i.e., it does not say otherwise by having a Temporary method
+// (like keepclient.Error and net.Error) that returns false.
+func temporary(err error) bool {
+	if terr, ok := err.(interface {
+		Temporary() bool
+	}); ok {
+		return terr.Temporary()
+	}
+	return true
+}
+
+// countBlock adds a block with the given locator and size, which has
+// been stored (or found to be stored already), to the upload
+// statistics.
+func (m *CollectionWriter) countBlock(locator string, size int64) {
+	m.storedMtx.Lock()
+	defer m.storedMtx.Unlock()
+	m.bytesWritten += size
+	m.blocksWritten++
+	if m.locators == nil {
+		m.locators = make(map[string]string)
+	}
+	if key := blockKey(locator); m.locators[key] == "" {
+		m.locators[key] = locator
+	}
+	m.reporter().IncBytes(size)
+	m.reporter().IncBlocks(1)
+}
+
+// Reporter receives upload metrics, e.g., for export to a monitoring
+// system.  Its methods may be called concurrently.
+type Reporter interface {
+	// IncBytes is called with the size of each block added to
+	// the collection.
+	IncBytes(n int64)
+	// IncBlocks is called for each block added to the
+	// collection.
+	IncBlocks(n int)
+	// IncErrors is called for each failed block or file.
+	IncErrors(n int)
+	// ObserveBlockLatency is called with the time taken to
+	// store each block.
+	ObserveBlockLatency(d time.Duration)
+}
+
+type nopReporter struct{}
+
+func (nopReporter) IncBytes(int64)                    {}
+func (nopReporter) IncBlocks(int)                     {}
+func (nopReporter) IncErrors(int)                     {}
+func (nopReporter) ObserveBlockLatency(time.Duration) {}
+
+func (m *CollectionWriter) reporter() Reporter {
+	if m.Reporter != nil {
+		return m.Reporter
+	}
+	return nopReporter{}
+}
+
+// BytesWritten returns the total size of the blocks in the collection,
+// including blocks whose content was already stored by an earlier block
+// or a previous upload.
+func (m *CollectionWriter) BytesWritten() int64 {
+	m.storedMtx.Lock()
+	defer m.storedMtx.Unlock()
+	return m.bytesWritten
+}
+
+// BlocksWritten returns the number of blocks in the collection.
+func (m *CollectionWriter) BlocksWritten() int {
+	m.storedMtx.Lock()
+	defer m.storedMtx.Unlock()
+	return m.blocksWritten
+}
+
+// UniqueLocators returns the locators of the distinct blocks stored
+// by uploads so far (like BlocksWritten, including blocks that were
+// already stored), sorted.  Blocks are listed as soon as they are
+// stored, and blocks with the same hash and size (but, e.g., different
+// permission signatures) are listed once.  Blocks of BaseManifest are
+// not listed.
+func (m *CollectionWriter) UniqueLocators() []string {
+	m.storedMtx.Lock()
+	defer m.storedMtx.Unlock()
+	locators := make([]string, 0, len(m.locators))
+	for _, locator := range m.locators {
+		locators = append(locators, locator)
+	}
+	sort.Strings(locators)
+	return locators
+}
+
+// blockKey returns the hash and size part of locator.
+func blockKey(locator string) string {
+	return locatorHintsRe.ReplaceAllString(locator, "$1")
+}
+
+// UniqueBytesStored returns the number of bytes actually written to
+// Keep, i.e., BytesWritten minus the savings from deduplication and
+// checkpoints.
+func (m *CollectionWriter) UniqueBytesStored() int64 {
+	m.storedMtx.Lock()
+	defer m.storedMtx.Unlock()
+	return m.uniqueBytes
+}
+
+func (m *CollectionWriter) newHash() hash.Hash {
+	if m.Hasher != nil {
+		return m.Hasher()
+	}
+	return md5.New()
+}
+
+// hash returns the hex digest of data, which is used as the hash part
+// of its locator.
+func (m *CollectionWriter) hash(data []byte) string {
+	h := m.newHash()
+	h.Write(data)
+	return fmt.Sprintf("%x", h.Sum(nil))
+}
+
+// noSplit reports whether a file of the given size should start a new
+// block instead of being split between the current block and the
+// next.
+func (m *CollectionWriter) noSplit(block *Block, size int64) bool {
+	if !m.NoSplitSmallFiles || block == nil || block.offset == 0 {
+		return false
+	}
+	smallFileSize := m.SmallFileSize
+	if smallFileSize <= 0 || smallFileSize > int64(m.blockSize()) {
+		smallFileSize = int64(m.blockSize())
+	}
+	return size <= smallFileSize && block.offset+size > int64(m.blockSize())
+}
+
+func (m *CollectionWriter) blockSize() int {
+	if m.BlockSize > 0 {
+		return m.BlockSize
+	}
+	return keepclient.BLOCKSIZE
+}
+
+// allocBuffer returns a new block buffer, waiting while
+// MaxBufferedBlocks buffers are in use.
+func (m *CollectionWriter) allocBuffer(ctx context.Context) ([]byte, error) {
+	m.storedMtx.Lock()
+	if m.buffers == nil && m.MaxBufferedBlocks > 0 {
+		m.buffers = make(chan struct{}, m.MaxBufferedBlocks)
+	}
+	buffers := m.buffers
+	m.storedMtx.Unlock()
+	if buffers != nil {
+		select {
+		case buffers <- struct{}{}:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+
+	m.storedMtx.Lock()
+	m.buffersInUse++
+	if m.buffersInUse > m.peakBuffers {
+		m.peakBuffers = m.buffersInUse
+	}
+	m.storedMtx.Unlock()
+	return make([]byte, m.blockSize()), nil
+}
+
+// releaseBuffer releases a buffer returned by allocBuffer.
+func (m *CollectionWriter) releaseBuffer() {
+	m.storedMtx.Lock()
+	m.buffersInUse--
+	buffers := m.buffers
+	m.storedMtx.Unlock()
+	if buffers != nil {
+		<-buffers
+	}
+}
+
+// releaseBlock releases the buffer of block, if it has one, and
+// removes its spill file, if any.
+func (m *CollectionFileWriter) releaseBlock(block *Block) {
+	if block.data != nil {
+		block.data = nil
+		m.cw.releaseBuffer()
+	}
+	if block.spill != "" {
+		os.Remove(block.spill)
+		block.spill = ""
+	}
+}
+
+// PutFile stores the content of the file at path in Keep, without
+// adding it to the collection, and returns the locators of the blocks
+// written, separated by spaces.
+func (m *CollectionWriter) PutFile(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", &UploadError{Path: path, Phase: UploadPhaseRead, Err: err}
+	}
+	defer file.Close()
+
+	fw := &CollectionFileWriter{
+		IKeepClient: m.keepClient(),
+		ctx:         context.Background(),
+		cw:          m,
+		status:      m.logger(nil),
+	}
+	buf := make([]byte, m.blockSize())
+	var locators []string
+	for {
+		n, err := io.ReadFull(file, buf)
+		if err == io.EOF {
+			break
+		} else if err != nil && err != io.ErrUnexpectedEOF {
+			return "", &UploadError{Path: path, Phase: UploadPhaseRead, Err: err}
+		}
+		hash := m.hash(buf[:n])
+		locator, err := fw.putBlock(hash, buf[:n])
+		if err != nil {
+			return "", &UploadError{Path: path, Phase: UploadPhasePut, Err: err}
+		}
+		locators = append(locators, locator)
+	}
+	if len(locators) == 0 {
+		return "d41d8cd98f00b204e9800998ecf8427e+0", nil
+	}
+	return strings.Join(locators, " "), nil
+}
+
+// Open a new file for writing in the Keep collection.
+func (m *CollectionWriter) Open(path string) io.WriteCloser {
+	var dir string
+	var fn string
+
+	i := strings.Index(path, "/")
+	if i > -1 {
+		dir = "./" + path[0:i]
+		fn = path[i+1:]
+	} else {
+		dir = "."
+		fn = path
+	}
+
+	fw := &CollectionFileWriter{
+		IKeepClient:    m.keepClient(),
+		ManifestStream: &manifest.ManifestStream{StreamName: dir},
+		uploader:       make(chan *Block),
+		finish:         make(chan []error, 1),
+		fn:             fn,
+		ctx:            context.Background(),
+		cw:             m,
+		status:         m.logger(nil),
+	}
+
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	if m.workers == nil {
+		if m.MaxWriters < 1 {
+			m.MaxWriters = 2
+		}
+		m.workers = make(chan struct{}, m.MaxWriters)
+	}
+	fw.index = m.streamCount
+	m.streamCount++
+
+	go fw.goUpload(fw.uploader, fw.finish, m.workers)
+
+	m.Streams = append(m.Streams, fw)
+
+	return fw
+}
+
+// Finish writing the collection, wait for all blocks to complete uploading.
+// If a single error occurred, it is returned as is (typically an
+// *UploadError); if there were several, they are returned as
+// UploadErrors.
+func (m *CollectionWriter) Finish() error {
+	var errs UploadErrors
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	for _, stream := range m.Streams {
+		errs = append(errs, stream.finishUpload()...)
+	}
+	return errs.err()
+}
+
+// err returns nil if errs is empty, the only error if there is one, and
+// errs itself otherwise.
+func (errs UploadErrors) err() error {
+	switch len(errs) {
+	case 0:
+		return nil
+	case 1:
+		return errs[0]
+	default:
+		return errs
+	}
+}
+
+// finishUpload writes the last block of the stream, waits for all of
+// the stream's blocks to be written, and returns the errors
+// encountered.  It is safe to call more than once.
+func (m *CollectionFileWriter) finishUpload() []error {
+	if m.uploader == nil {
+		return m.errs
+	}
+	if m.Block != nil && m.Block.offset > 0 && m.ctx.Err() == nil {
+		if m.sendBlock(m.Block) == nil {
+			m.Block = nil
+		}
+	}
+	if m.Block != nil {
+		m.releaseBlock(m.Block)
+		m.Block = nil
+	}
+	close(m.uploader)
+	m.uploader = nil
+
+	m.errs = <-m.finish
+	close(m.finish)
+	m.finish = nil
+	return m.errs
+}
+
+// ManifestText returns the manifest text of the collection.  Calls Finish()
+// first to ensure that all blocks are written and that signed locators and
+// available.
+//
+// The manifest is normalized: streams are sorted by name, each stream
+// appears once, and files are sorted within each stream.  This makes the
+// result (and therefore the portable data hash) independent of the order
+// in which files and streams were written.
+func (m *CollectionWriter) ManifestText() (mt string, err error) {
+	return m.manifestText(m.BareStreamNames)
+}
+
+// manifestText returns the manifest text of the collection, with bare
+// stream names if bare is true (see BareStreamNames).
+func (m *CollectionWriter) manifestText(bare bool) (string, error) {
+	var buf bytes.Buffer
+	if err := m.writeManifest(&buf, bare); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+// WriteManifest writes the same manifest text as ManifestText to w, one
+// normalized stream at a time, instead of building the whole text in
+// memory.
+func (m *CollectionWriter) WriteManifest(w io.Writer) error {
+	return m.writeManifest(w, m.BareStreamNames)
+}
+
+func (m *CollectionWriter) writeManifest(w io.Writer, bare bool) error {
+	if err := m.finishManifest(); err != nil {
+		return err
+	}
+	if bare {
+		w = bareStreamNameWriter{w}
+	}
+
+	lines := m.rawStreamTexts()
+	if m.Hasher != nil {
+		if m.BaseManifest != "" {
+			return fmt.Errorf("BaseManifest cannot be used with a custom Hasher")
+		}
+		for _, line := range lines {
+			if err := m.writeStreamLines(w, line); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if m.BaseManifest != "" {
+		base, err := m.baseStreamTexts()
+		if err != nil {
+			return err
+		}
+		lines = append(base, lines...)
+	}
+	return m.writeNormalized(w, lines)
+}
+
+// writeNormalized writes the normalized manifest text of the streams in
+// lines to w, split as configured by MaxLocatorsPerLine and
+// MaxFilesPerLine.
+func (m *CollectionWriter) writeNormalized(w io.Writer, lines []string) error {
+	// Split the streams by the stream each file ends up in after
+	// normalization (a file name may contain "/"), and normalize
+	// one resulting stream at a time.
+	split := make(map[string][]string)
+	for i, line := range lines {
+		streams, err := ParseManifest(line)
+		if err != nil {
+			return err
+		}
+		lines[i] = ""
+		for _, st := range streams {
+			for name, files := range splitStream(st) {
+				split[name] = append(split[name], files)
+			}
+		}
+	}
+	var names []string
+	for name := range split {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		normalized := manifest.Manifest{Text: strings.Join(split[name], "")}.Extract(".", ".")
+		if normalized.Err != nil {
+			return normalized.Err
+		}
+		delete(split, name)
+		if err := m.writeStreamLines(w, escapeEmptyDirMarkers(normalized.Text)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// RawManifestText returns the manifest text of the collection without
+// normalizing it: streams appear in the order they were started, each
+// with its files in the order they were written, and streams written by
+// different uploads (or opened more than once with Open) are not
+// merged.  BaseManifest is not included.  Like ManifestText, it calls
+// Finish first.
+func (m *CollectionWriter) RawManifestText() (string, error) {
+	if err := m.finishManifest(); err != nil {
+		return "", err
+	}
+	mt := strings.Join(m.rawStreamTexts(), "")
+	if m.BareStreamNames {
+		mt = bareStreamNames(mt)
+	}
+	return mt, nil
+}
+
+// finishManifest finishes writing the collection, and checks the
+// result, before the manifest text is generated.
+func (m *CollectionWriter) finishManifest() error {
+	if err := m.Finish(); err != nil {
+		return err
+	}
+	if m.WriteIndex && !m.indexWritten {
+		m.indexWritten = true
+		if err := m.writeIndex(); err != nil {
+			return err
+		}
+	}
+	if err := m.addPackedBytes(0); err != nil {
+		return err
+	}
+	if err := m.addFiles(0); err != nil {
+		return err
+	}
+	if m.VerifyAfterWrite {
+		return m.verifyBlocks()
+	}
+	return nil
+}
+
+// splitStream returns the manifest text of st split by the name of the
+// stream that each file belongs to when the manifest is normalized.
+// Each piece refers to all of the blocks of st.
+func splitStream(st manifest.ManifestStream) map[string]string {
+	sn := strings.TrimSuffix(st.StreamName, "/")
+	files := make(map[string][]string)
+	var names []string
+	for _, seg := range st.FileStreamSegments {
+		name := sn
+		if i := strings.LastIndex(seg.Name, "/"); i >= 0 {
+			name = sn + "/" + seg.Name[:i]
+		}
+		if files[name] == nil {
+			names = append(names, name)
+		}
+		files[name] = append(files[name], fmt.Sprintf("%v:%v:%v", seg.SegPos, seg.SegLen, manifest.EscapeName(seg.Name)))
+	}
+	split := make(map[string]string)
+	for _, name := range names {
+		split[name] = manifest.EscapeName(st.StreamName) + " " + strings.Join(st.Blocks, " ") + " " + strings.Join(files[name], " ") + "\n"
+	}
+	return split
+}
+
+// emptyDirMarker is the name of the empty file that marks an empty
+// directory, see PreserveEmptyDirs.
+const emptyDirMarker = "."
+
+// escapeEmptyDirMarkers escapes the names of empty directory markers
+// in manifest text that has been normalized by the manifest package,
+// which does not escape ".".
+func escapeEmptyDirMarkers(mt string) string {
+	return emptyDirMarkerRe.ReplaceAllString(mt, `$1\056$2`)
+}
+
+var emptyDirMarkerRe = regexp.MustCompile(`( [0-9]+:0:)\.([ \n])`)
+
+// rawStreamTexts returns the manifest text of each stream of the
+// collection, in the order the streams were created.
+func (m *CollectionWriter) rawStreamTexts() []string {
+	var lines []string
+
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	expiry := time.Now().Add(m.signatureTTL())
+	for _, v := range m.Streams {
+		if len(v.FileStreamSegments) == 0 {
+			continue
+		}
+		var buf bytes.Buffer
+		k := v.StreamName
+		if k == "." {
+			buf.WriteString(".")
+		} else {
+			buf.WriteString(manifest.EscapeName("./" + strings.TrimPrefix(k, "./")))
+		}
+		if len(v.Blocks) > 0 {
+			for _, b := range v.Blocks {
+				buf.WriteString(" ")
+				buf.WriteString(m.signLocator(b, expiry))
+			}
+		} else {
+			buf.WriteString(" d41d8cd98f00b204e9800998ecf8427e+0")
+		}
+		for _, f := range v.FileStreamSegments {
+			buf.WriteString(" ")
+			name := manifest.EscapeName(f.Name)
+			if f.Name == emptyDirMarker {
+				name = "\\056"
+			}
+			buf.WriteString(fmt.Sprintf("%v:%v:%v", f.SegPos, f.SegLen, name))
+		}
+		buf.WriteString("\n")
+		lines = append(lines, buf.String())
+	}
+	return lines
+}
+
+// LocatorSigner is implemented by Keep clients that can add permission
+// signatures to block locators.
+type LocatorSigner interface {
+	// SignLocator returns locator (which has no permission
+	// signature) with a signature that expires at the given time.
+	SignLocator(locator string, expiry time.Time) string
+}
+
+// defaultSignatureTTL is the default lifetime of the signatures added
+// by a LocatorSigner, the same as the API server's default
+// blob_signature_ttl.
+const defaultSignatureTTL = 14 * 24 * time.Hour
+
+func (m *CollectionWriter) signatureTTL() time.Duration {
+	if m.SignatureTTL > 0 {
+		return m.SignatureTTL
+	}
+	return defaultSignatureTTL
+}
+
+// signLocator replaces any permission signature on locator with a new
+// one, if the Keep client is a LocatorSigner.
+func (m *CollectionWriter) signLocator(locator string, expiry time.Time) string {
+	signer, ok := unwrapClient(m.keepClient()).(LocatorSigner)
+	if !ok {
+		return locator
+	}
+	parts := strings.Split(locator, "+")
+	unsigned := parts[:1]
+	for _, hint := range parts[1:] {
+		if !strings.HasPrefix(hint, "A") {
+			unsigned = append(unsigned, hint)
+		}
+	}
+	return signer.SignLocator(strings.Join(unsigned, "+"), expiry)
+}
+
+// ParseManifest parses manifest text into streams, each with its block
+// locators and file segments.  Stream and file names are unescaped.
+// Segment positions are offsets within the stream, as in the manifest
+// text.
+func ParseManifest(text string) ([]manifest.ManifestStream, error) {
+	var streams []manifest.ManifestStream
+	var err error
+	m := manifest.Manifest{Text: text}
+	for st := range m.StreamIter() {
+		if st.Err != nil {
+			if err == nil {
+				err = st.Err
+			}
+			continue
+		}
+		streams = append(streams, st)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return streams, nil
+}
+
+// baseStreamTexts returns the manifest text of each stream of
+// BaseManifest, without the files that have been replaced by uploaded
+// files.
+func (m *CollectionWriter) baseStreamTexts() ([]string, error) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	uploaded := make(map[string]bool)
+	for _, st := range m.Streams {
+		for _, seg := range st.FileStreamSegments {
+			uploaded[streamPath(st.StreamName, seg.Name)] = true
+		}
+	}
+
+	streams, err := ParseManifest(m.BaseManifest)
+	if err != nil {
+		return nil, fmt.Errorf("While parsing base manifest: %v", err)
+	}
+
+	var lines []string
+	expiry := time.Now().Add(m.signatureTTL())
+	for _, st := range streams {
+		var files []string
+		for _, seg := range st.FileStreamSegments {
+			if !uploaded[streamPath(st.StreamName, seg.Name)] {
+				files = append(files, fmt.Sprintf("%v:%v:%v", seg.SegPos, seg.SegLen, manifest.EscapeName(seg.Name)))
+			}
+		}
+		if len(files) == 0 {
+			continue
+		}
+		var buf bytes.Buffer
+		buf.WriteString(manifest.EscapeName(st.StreamName))
+		for _, b := range st.Blocks {
+			buf.WriteString(" ")
+			buf.WriteString(m.signLocator(b, expiry))
+		}
+		buf.WriteString(" ")
+		buf.WriteString(strings.Join(files, " "))
+		buf.WriteString("\n")
+		lines = append(lines, buf.String())
+	}
+	return lines, nil
+}
+
+// WalkUpload is an upload of files to a CollectionWriter, started by
+// BeginUpload.  Files are added with Walk (everything under the upload
+// root), UploadFile, UploadReader, and UploadTar; EndUpload then waits
+// for the data to be stored and adds the files to the collection, or
+// Abort discards them.  Warnings and Err report the files that were
+// left out without failing the upload.
+//
+// The methods adding files may be called from several goroutines at
+// once, e.g., by a caller with its own pool of workers.  Files are
+// packed into blocks one at a time, in the order the calls get to
+// them, but UploadFile reads a small file (up to 1 MiB) before waiting
+// for other calls to finish, so concurrent calls read small files in
+// parallel.  EndUpload must not be called until they have all
+// returned.
+//
+// The exported fields are options, which must be set before the first
+// file is added.
+type WalkUpload struct {
+	// MaxWriters is the maximum number of the upload's blocks
+	// that may be written to Keep concurrently.  BeginUpload
+	// sets it to CollectionWriter.MaxWriters.
+	MaxWriters int
+
+	// FileSystem, if not nil, is the file system to read the
+	// upload root and its contents from, instead of the local
+	// file system.
+	FileSystem FileSystem
+
+	// TargetPrefix, if not empty, is the stream (e.g.,
+	// "./results") where the upload root appears in the
+	// collection.  The default is the top level stream ".".
+	TargetPrefix string
+
+	// FileFilter, if not nil, is called by Walk for each file
+	// (anything but a directory) that is not excluded, with the
+	// result of Lstat and the file's path relative to the upload
+	// root.  It returns the path where the file should appear in
+	// the collection (relative to TargetPrefix, if set) and
+	// whether to upload it at all.  Returning relPath unchanged
+	// uploads the file as usual.  Files passed to UploadFile are
+	// not filtered.
+	FileFilter func(info os.FileInfo, relPath string) (newRelPath string, include bool)
+
+	kc          IKeepClient
+	stripPrefix string
+	streamMap   map[string]*CollectionFileWriter
+	streams     []*CollectionFileWriter // in the order they were started
+	status      Logger
+	workers     chan struct{}
+	mtx         sync.Mutex
+	ctx         context.Context
+	cancel      context.CancelFunc
+	cw          *CollectionWriter
+	symlinks    map[string]string
+	metadata    map[string]*FileMetadata
+	exclude     []excludePattern
+	hardlinks   map[fileID]hardlink
+	hashes      map[string]string
+	sha256s     map[string]string
+	md5s        map[string]string
+	uploaded    map[string]bool // paths of the files stored so far
+	files       int             // files counted against MaxFiles
+	started     time.Time       // when BeginUpload was called
+
+	// Held while files are added, so calls from different
+	// goroutines add them one at a time.
+	addMtx sync.Mutex
+
+	// Read-ahead slots of UploadFile calls, MaxReaders of them
+	// (nil if MaxReaders is not greater than 1).
+	prefetching chan struct{}
+
+	// Stream that copyFile last wrote to.
+	current *CollectionFileWriter
+
+	growing []*GrowingUpload // started by UploadGrowing
+
+	// Walking the tree only to count its files, see EstimateUpload.
+	estimating bool
+
+	warnings []UploadWarning // protected by mtx
+
+	// Result of EndUpload
+	endOnce sync.Once
+	endErr  error
+}
+
+// hardlink records where the content of a file with multiple links was
+// stored, so other links to the same file can refer to it.
+type hardlink struct {
+	dir            string
+	offset, length uint64
+	path           string // path of the stored file
+}
+
+// Walk uploads the regular files and symbolic links in the directory
+// tree under the upload root.  Other kinds of files are handled
+// according to SpecialFilePolicy.  With SymlinkFollow, symlinks to
+// directories are walked as if they were the directories themselves; a
+// link to one of its own ancestors is an error.  If the upload root is
+// a file rather than a directory, Walk uploads just that file, at the
+// top of the collection (under TargetPrefix if set) with its own name.
+//
+// If MaxReaders is greater than 1, Walk lists the whole tree before
+// uploading anything, and then reads small files concurrently.  The
+// resulting manifest is the same either way.
+func (m *WalkUpload) Walk() error {
+	m.addMtx.Lock()
+	defer m.addMtx.Unlock()
+	if m.cw.MaxReaders <= 1 {
+		return m.walk(m.stripPrefix, m.stripPrefix, m.rootScopes(), make(map[fileID]bool), func(path, sourcePath string) error {
+			return m.uploadFile(path, sourcePath, nil)
+		})
+	}
+	var entries []walkEntry
+	err := m.walk(m.stripPrefix, m.stripPrefix, m.rootScopes(), make(map[fileID]bool), func(path, sourcePath string) error {
+		entries = append(entries, walkEntry{path, sourcePath})
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return m.uploadEntries(entries, m.cw.MaxReaders)
+}
+
+// fileID identifies a file by device and inode number.
+type fileID struct {
+	dev uint64
+	ino uint64
+}
+
+func getFileID(info os.FileInfo) (id fileID, ok bool) {
+	st, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return
+	}
+	return fileID{uint64(st.Dev), uint64(st.Ino)}, true
+}
+
+// rootScopes returns the exclude patterns that apply to the whole
+// upload.
+func (m *WalkUpload) rootScopes() []ignoreScope {
+	return []ignoreScope{{patterns: m.exclude}}
+}
+
+// walk uploads the tree at sourcePath so that it appears at path,
+// calling upload for each file that is not a directory.  scopes holds
+// the exclude patterns that apply to path.  "visited" holds the
+// directories currently being walked, i.e., path and its ancestors.
+func (m *WalkUpload) walk(path string, sourcePath string, scopes []ignoreScope, visited map[fileID]bool, upload func(path, sourcePath string) error) error {
+	info, err := m.fs().Lstat(sourcePath)
+	if os.IsPermission(err) && path != m.stripPrefix {
+		return m.unreadablePath(path, err)
+	} else if err != nil {
+		return err
+	}
+	modTime := info.ModTime()
+	if info.Mode()&os.ModeSymlink != 0 && m.cw.SymlinkMode == SymlinkFollow {
+		tgt, err := m.followSymlink(sourcePath)
+		if err != nil {
+			return err
+		}
+		tgtinfo, err := m.fs().Stat(tgt)
+		if err != nil {
+			return err
+		}
+		if tgtinfo.IsDir() {
+			sourcePath, info = tgt, tgtinfo
+		}
+		modTime = tgtinfo.ModTime()
+	}
+	if path == m.stripPrefix && !info.IsDir() {
+		// The upload root is a single file, which appears at
+		// the top of the collection.
+		path += "/" + filepath.Base(path)
+	}
+	if path != m.stripPrefix && excludedInScopes(scopes, m.relPath(path), info.IsDir()) {
+		return nil
+	}
+	if !info.IsDir() {
+		if modTime.Before(m.cw.ModifiedSince) {
+			return nil
+		}
+		if m.FileFilter != nil {
+			relPath, include := m.FileFilter(info, m.relPath(path))
+			if !include {
+				return nil
+			}
+			dest := cleanDestPath(relPath)
+			if dest == "/" {
+				return fmt.Errorf("FileFilter returned invalid path %q for %q", relPath, path)
+			}
+			path = m.stripPrefix + dest
+		}
+		return upload(path, sourcePath)
+	}
+
+	if id, ok := getFileID(info); ok {
+		if visited[id] {
+			return fmt.Errorf("Symlink loop detected at %q", path)
+		}
+		visited[id] = true
+		defer delete(visited, id)
+	}
+
+	var names []string
+	dir, err := m.fs().Open(sourcePath)
+	if err == nil {
+		names, err = dir.Readdirnames(-1)
+		dir.Close()
+	}
+	if os.IsPermission(err) && path != m.stripPrefix {
+		// Upload the rest of the tree, but let the caller
+		// know this directory is missing.
+		return m.unreadablePath(path, err)
+	} else if err != nil {
+		return err
+	}
+	if len(names) == 0 && m.cw.PreserveEmptyDirs && path != m.stripPrefix {
+		return m.addEmptyDir(path)
+	}
+	if m.cw.KeepIgnoreFiles {
+		scopes, err = m.readKeepIgnore(scopes, m.relPath(path), sourcePath, names)
+		if err != nil {
+			return err
+		}
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if os.PathSeparator == '\\' && isWindowsReservedName(name) {
+			err = m.skipPath(path+"/"+name, "reserved file name on Windows")
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		err = m.walk(path+"/"+name, sourcePath+"/"+name, scopes, visited, upload)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// skipPath records an UploadWarning for the file or directory at path
+// (the upload root followed by the path in the collection), which is
+// left out of the collection.
+func (m *WalkUpload) skipPath(path, reason string) error {
+	parent, fn := splitManifestPath(m.relPath(path))
+	return m.skipFile(m.targetDir(parent), fn, reason)
+}
+
+// unreadablePath handles the unreadable file or directory at path (the
+// upload root followed by the path in the collection), like
+// unreadable.
+func (m *WalkUpload) unreadablePath(path string, err error) error {
+	parent, fn := splitManifestPath(m.relPath(path))
+	return m.unreadable(m.targetDir(parent), fn, err)
+}
+
+// unreadable handles the error err (which says permission was denied)
+// from reading file fn in stream dir: it is skipped, with an
+// UploadWarning, or with StrictReadability, it is an error.
+func (m *WalkUpload) unreadable(dir, fn string, err error) error {
+	if m.cw.StrictReadability {
+		return m.fileError(dir, fn, UploadPhaseRead, err)
+	}
+	return m.skipFile(dir, fn, err.Error())
+}
+
+// countFile counts file fn in stream dir against MaxFiles.
+func (m *WalkUpload) countFile(dir, fn string) error {
+	m.files++
+	if err := m.cw.addFiles(1); err != nil {
+		return m.fileError(dir, fn, UploadPhasePack, err)
+	}
+	return nil
+}
+
+// addEmptyDir records the empty directory at path, see
+// PreserveEmptyDirs.
+func (m *WalkUpload) addEmptyDir(path string) error {
+	if m.estimating {
+		return nil
+	}
+	return m.addEmptyStream(m.targetDir(m.relPath(path)))
+}
+
+// addEmptyStream records the empty directory dir (a stream name,
+// e.g., "subdir"), see PreserveEmptyDirs.
+func (m *WalkUpload) addEmptyStream(dir string) error {
+	dir, err := m.sanitizeDir(dir)
+	if err != nil {
 		return err
 	}
-	file, err := os.Open(sourcePath)
+	fileWriter, err := m.getStream(dir)
 	if err != nil {
 		return err
 	}
-	defer file.Close()
+	fileWriter.NewFile(emptyDirMarker)
+	fileWriter.source, fileWriter.sourceInfo = "", nil
+	return fileWriter.Close()
+}
 
-	if m.streamMap[dir] == nil {
-		m.streamMap[dir] = &CollectionFileWriter{
-			m.kc,
-			&manifest.ManifestStream{StreamName: dir},
-			0,
-			0,
-			nil,
-			make(chan *Block),
-			make(chan []error),
-			""}
-
-		m.mtx.Lock()
-		if m.workers == nil {
-			if m.MaxWriters < 1 {
-				m.MaxWriters = 2
-			}
-			m.workers = make(chan struct{}, m.MaxWriters)
+// progressReader reports the number of bytes read so far after each
+// Read.
+type progressReader struct {
+	io.Reader
+	path   string
+	n      int64
+	total  int64
+	report func(path string, bytesUploaded, bytesTotal int64)
+}
+
+func (r *progressReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	if n > 0 {
+		r.n += int64(n)
+		r.report(r.path, r.n, r.total)
+	}
+	return n, err
+}
+
+// followSymlink returns the final target of the symlink at path, which
+// must exist and be located inside the upload root.
+func (m *WalkUpload) followSymlink(path string) (string, error) {
+	if err := m.checkSymlinkDepth(path); err != nil {
+		return "", err
+	}
+	tgt, err := m.fs().EvalSymlinks(path)
+	if err != nil {
+		return "", fmt.Errorf("Cannot follow symlink %q: %v", path, err)
+	}
+	root, err := m.fs().EvalSymlinks(m.stripPrefix)
+	if err != nil {
+		return "", err
+	}
+	if tgt != root && !strings.HasPrefix(tgt, root+"/") {
+		return "", fmt.Errorf("Symlink %q points to %q, which is outside the upload root %q", path, tgt, m.stripPrefix)
+	}
+	return tgt, nil
+}
+
+// defaultMaxSymlinkDepth is the default MaxSymlinkDepth, the same as
+// the limit on Linux.
+const defaultMaxSymlinkDepth = 40
+
+// checkSymlinkDepth returns an error if the chain of symlinks starting
+// at path is longer than MaxSymlinkDepth.  Other problems (e.g., a
+// dangling link) are left for EvalSymlinks to report.
+func (m *WalkUpload) checkSymlinkDepth(path string) error {
+	max := m.cw.MaxSymlinkDepth
+	if max <= 0 {
+		max = defaultMaxSymlinkDepth
+	}
+	fs := m.fs()
+	for depth, p := 0, path; ; depth++ {
+		info, err := fs.Lstat(p)
+		if err != nil || info.Mode()&os.ModeSymlink == 0 {
+			return nil
+		}
+		if depth >= max {
+			return fmt.Errorf("Cannot follow symlink %q: more than %d links in chain", path, max)
+		}
+		tgt, err := fs.Readlink(p)
+		if err != nil {
+			return nil
+		}
+		if !filepath.IsAbs(tgt) {
+			tgt = filepath.Join(filepath.Dir(p), tgt)
+		}
+		p = tgt
+	}
+}
+
+// targetDir returns the stream name for directory dir (relative to the
+// upload root, "" for the root itself).
+func (m *WalkUpload) targetDir(dir string) string {
+	prefix := m.normalizeName(strings.Trim(strings.TrimPrefix(m.TargetPrefix, "./"), "/"))
+	switch {
+	case prefix == "" || prefix == ".":
+		if dir == "" {
+			return "."
+		}
+		return dir
+	case dir == "":
+		return prefix
+	default:
+		return prefix + "/" + dir
+	}
+}
+
+// UploadFile uploads the file at srcPath so that it appears in the
+// collection at destPath, e.g., "subdir/file.txt" (under TargetPrefix
+// if set).  A leading "./" or "/" in destPath is ignored, and the OS
+// path separator is accepted in place of "/".  The source file does not
+// have to be inside the upload root, and its name does not have to
+// match destPath.  If the upload's context has been cancelled,
+// UploadFile returns the context's error without reading the file.
+//
+// On Linux, the holes in sparse files are found with SEEK_HOLE and
+// SEEK_DATA, and are not read: whole blocks of zeros refer to a single
+// stored block of zeros instead.  The manifest is the same as if the
+// holes had been read.
+func (m *WalkUpload) UploadFile(srcPath, destPath string) error {
+	dest := cleanDestPath(destPath)
+	if dest == "/" {
+		return fmt.Errorf("Invalid destination path %q", destPath)
+	}
+	// Start reading a small file before waiting for other calls
+	// to finish adding their files, if a read-ahead slot is free.
+	// The slot is held until the data has been added.
+	var pf *prefetchedFile
+	if m.ctx.Err() == nil {
+		select {
+		case m.prefetching <- struct{}{}:
+			defer func() { <-m.prefetching }()
+			pf = m.startPrefetch(srcPath, make(chan struct{}, 1))
+		default:
 		}
-		m.mtx.Unlock()
+	}
+	m.addMtx.Lock()
+	defer m.addMtx.Unlock()
+	return m.uploadFile(m.stripPrefix+dest, srcPath, pf)
+}
+
+// uploadFile uploads the file at sourcePath so that it appears at path
+// (the upload root followed by the path in the collection), using the
+// file content in pf if it is not nil.
+func (m *WalkUpload) uploadFile(path string, sourcePath string, pf *prefetchedFile) error {
+	if err := m.ctx.Err(); err != nil {
+		return err
+	}
+
+	dir, fn := splitManifestPath(m.relPath(path))
+	dir, fn, err := m.sanitizePath(m.targetDir(dir), fn)
+	if err != nil {
+		return err
+	}
 
-		go m.streamMap[dir].goUpload(m.workers)
+	info, err := m.fs().Lstat(sourcePath)
+	if err != nil {
+		return err
+	}
+	if info.Mode()&os.ModeSymlink != 0 {
+		switch m.cw.SymlinkMode {
+		case SymlinkSkip:
+			return nil
+		case SymlinkStore:
+			target, err := m.fs().Readlink(sourcePath)
+			if err != nil {
+				return err
+			}
+			m.symlinks[streamPath(dir, fn)] = target
+			return nil
+		}
+		sourcePath, err = m.followSymlink(sourcePath)
+		if err != nil {
+			return err
+		}
+		info, err = m.fs().Stat(sourcePath)
+		if err != nil {
+			return err
+		}
+	}
+	if !info.Mode().IsRegular() {
+		return m.specialFile(dir, fn, info)
+	}
+	fileWriter, err := m.getStream(dir)
+	if err != nil {
+		return err
 	}
 
-	fileWriter := m.streamMap[dir]
+	// If this is another link to a file already stored in the same
+	// stream, refer to the stored content instead of reading it
+	// again.  (Links in different streams are read again, but
+	// block deduplication still avoids storing the content twice
+	// if it is aligned the same way.)
+	id, isLink := getFileID(info)
+	isLink = isLink && info.Sys().(*syscall.Stat_t).Nlink > 1
+	if hl, ok := m.hardlinks[id]; isLink && ok && hl.dir == dir {
+		fn, err = m.resolveConflict(fileWriter, dir, fn)
+		if err != nil {
+			return err
+		}
+		if err := m.countFile(dir, fn); err != nil {
+			return err
+		}
+		m.status.WithField("path", streamPath(dir, fn)).Infof("Uploading %v/%v (hard link)", dir, fn)
+		fileWriter.ManifestStream.FileStreamSegments = append(fileWriter.ManifestStream.FileStreamSegments,
+			manifest.FileStreamSegment{hl.offset, hl.length, fn})
+		if hash, ok := m.hashes[hl.path]; ok {
+			m.hashes[streamPath(dir, fn)] = hash
+		}
+		if digest, ok := m.sha256s[hl.path]; ok {
+			m.sha256s[streamPath(dir, fn)] = digest
+		}
+		if sum, ok := m.md5s[hl.path]; ok {
+			m.md5s[streamPath(dir, fn)] = sum
+		}
+		m.cw.sendEvent(UploadEvent{Type: FileStarted, Path: streamPath(dir, fn), Size: info.Size()})
+		m.cw.sendEvent(UploadEvent{Type: FileCompleted, Path: streamPath(dir, fn), Size: int64(hl.length)})
+		return m.recordMetadata(dir, fn, sourcePath, info)
+	}
+	var file io.ReadSeeker
+	if pf != nil {
+		data, err := pf.wait()
+		if os.IsPermission(err) {
+			return m.unreadable(dir, fn, err)
+		} else if err != nil {
+			return m.fileError(dir, fn, UploadPhaseRead, err)
+		}
+		file = bytes.NewReader(data)
+	} else {
+		f, err := m.fs().Open(sourcePath)
+		if os.IsPermission(err) {
+			return m.unreadable(dir, fn, err)
+		} else if err != nil {
+			return m.fileError(dir, fn, UploadPhaseRead, err)
+		}
+		defer f.Close()
+		file = f
+	}
+	// Only claim the path and count the file once it is known to
+	// be readable, so files skipped by unreadable neither take the
+	// path from a later file nor count against MaxFiles.
+	fn, err = m.resolveConflict(fileWriter, dir, fn)
+	if err != nil {
+		return err
+	}
+	if err := m.countFile(dir, fn); err != nil {
+		return err
+	}
 
 	// Reset the CollectionFileWriter for a new file
 	fileWriter.NewFile(fn)
+	fileWriter.source, fileWriter.sourceInfo = sourcePath, info
+
+	if m.cw.noSplit(fileWriter.Block, info.Size()) {
+		if err := fileWriter.flushBlock(); err != nil {
+			return m.fileError(dir, fn, UploadPhasePack, err)
+		}
+	}
+
+	if fileWriter.checkpoint != nil && !m.cw.RecordSHA256 && !m.cw.RecordMD5 {
+		err = fileWriter.skipCheckpointed(fileWriter.checkpoint, file, info)
+		if err != nil {
+			return m.fileError(dir, fn, UploadPhaseRead, err)
+		}
+	}
+
+	m.status.WithField("path", streamPath(dir, fn)).WithField("size", info.Size()).Infof("Uploading %v/%v (%v bytes)", dir, fn, info.Size())
+
+	err = m.copyFile(fileWriter, dir, fn, file, info.Size())
+	if err != nil {
+		return err
+	}
+	if isLink {
+		m.hardlinks[id] = hardlink{dir: dir, offset: fileWriter.offset, length: fileWriter.length, path: streamPath(dir, fn)}
+	}
+
+	return m.recordMetadata(dir, fn, sourcePath, info)
+}
+
+// recordMetadata records the FileMetadata of an uploaded file, as
+// configured by PreserveMode, PreserveMtime, and PreserveXattrs.
+func (m *WalkUpload) recordMetadata(dir, fn, sourcePath string, info os.FileInfo) error {
+	path := streamPath(dir, fn)
+	m.recordFileInfo(path, info)
+	if m.cw.PreserveXattrs {
+		if err := m.recordXattrs(path, sourcePath); err != nil {
+			return m.fileError(dir, fn, UploadPhaseRead, err)
+		}
+	}
+	return nil
+}
+
+// recordFileInfo records the mode and modification time in info in the
+// FileMetadata of the file at path, as configured by PreserveMode and
+// PreserveMtime.
+func (m *WalkUpload) recordFileInfo(path string, info os.FileInfo) {
+	if m.cw.PreserveMode {
+		m.fileMetadata(path).Mode = info.Mode().Perm()
+	}
+	if m.cw.PreserveMtime {
+		mtime := info.ModTime().UTC()
+		m.fileMetadata(path).Mtime = &mtime
+	}
+}
 
-	m.status.Printf("Uploading %v/%v (%v bytes)", dir, fn, info.Size())
+// UploadReader stores the data read from r (until EOF) as file fileName
+// in stream streamName (e.g., "." or "./subdir", relative to the
+// collection root).  The data goes through the same block packing as
+// UploadFile, so the length of the data need not be known in advance.
+func (m *WalkUpload) UploadReader(streamName, fileName string, r io.Reader) error {
+	if err := m.ctx.Err(); err != nil {
+		return err
+	}
+
+	dir := m.normalizeName(strings.Trim(strings.TrimPrefix(streamName, "./"), "/"))
+	if dir == "" {
+		dir = "."
+	}
+	m.addMtx.Lock()
+	defer m.addMtx.Unlock()
+	dir, fn, err := m.sanitizePath(dir, m.normalizeName(fileName))
+	if err != nil {
+		return err
+	}
+	return m.uploadReader(dir, fn, r, -1)
+}
 
-	_, err = io.Copy(fileWriter, file)
+// uploadReader stores the data read from r as file fileName in stream
+// dir.  size is the expected size of the data, or -1 if not known.
+func (m *WalkUpload) uploadReader(dir, fileName string, r io.Reader, size int64) error {
+	fileWriter, err := m.getStream(dir)
+	if err != nil {
+		return err
+	}
+	fileName, err = m.resolveConflict(fileWriter, dir, fileName)
 	if err != nil {
-		m.status.Printf("Uh oh")
 		return err
 	}
+	if err := m.countFile(dir, fileName); err != nil {
+		return err
+	}
+	fileWriter.NewFile(fileName)
+	fileWriter.source, fileWriter.sourceInfo = "", nil
+
+	if size >= 0 {
+		m.status.WithField("path", streamPath(dir, fileName)).WithField("size", size).Infof("Uploading %v/%v (%v bytes)", dir, fileName, size)
+	} else {
+		m.status.WithField("path", streamPath(dir, fileName)).Infof("Uploading %v/%v", dir, fileName)
+	}
+
+	return m.copyFile(fileWriter, dir, fileName, r, size)
+}
+
+// resolveConflict returns the name to store a file as, when it is
+// about to be stored as fn in stream dir (written by fw), according to
+// ConflictPolicy.
+func (m *WalkUpload) resolveConflict(fw *CollectionFileWriter, dir, fn string) (string, error) {
+	path := streamPath(dir, fn)
+	if !m.uploaded[path] {
+		m.uploaded[path] = true
+		return fn, nil
+	}
+	switch m.cw.ConflictPolicy {
+	case ConflictOverwrite:
+		m.status.WithField("path", path).Warnf("Replacing %v/%v", dir, fn)
+		segs := fw.ManifestStream.FileStreamSegments[:0]
+		for _, seg := range fw.ManifestStream.FileStreamSegments {
+			if seg.Name != fn {
+				segs = append(segs, seg)
+			}
+		}
+		fw.ManifestStream.FileStreamSegments = segs
+		delete(m.metadata, path)
+		delete(m.hashes, path)
+		delete(m.sha256s, path)
+		delete(m.md5s, path)
+		// The replaced file no longer counts against MaxFiles.
+		m.files--
+		m.cw.addFiles(-1)
+		return fn, nil
+	case ConflictRename:
+		ext := filepath.Ext(fn)
+		base := strings.TrimSuffix(fn, ext)
+		for i := 1; ; i++ {
+			name := fmt.Sprintf("%s~%d%s", base, i, ext)
+			if !m.uploaded[streamPath(dir, name)] {
+				m.status.WithField("path", path).Warnf("Storing %v/%v as %v", dir, fn, name)
+				m.uploaded[streamPath(dir, name)] = true
+				return name, nil
+			}
+		}
+	default:
+		return "", m.fileError(dir, fn, UploadPhasePack, fmt.Errorf("Another file was already stored at %s", path))
+	}
+}
+
+// specialFile handles a file that is neither a regular file nor a
+// directory, according to SpecialFilePolicy.
+func (m *WalkUpload) specialFile(dir, fn string, info os.FileInfo) error {
+	switch m.cw.SpecialFilePolicy {
+	case SpecialFileError:
+		return m.fileError(dir, fn, UploadPhaseRead, fmt.Errorf("Cannot upload special file (%s)", specialFileType(info.Mode())))
+	case SpecialFileRecord:
+		m.status.WithField("path", streamPath(dir, fn)).Infof("Recording %v/%v (%s)", dir, fn, specialFileType(info.Mode()))
+		m.fileMetadata(streamPath(dir, fn)).Type = specialFileType(info.Mode())
+	default:
+		return m.skipFile(dir, fn, fmt.Sprintf("special file (%s)", specialFileType(info.Mode())))
+	}
+	return nil
+}
+
+// skipFile records an UploadWarning for file fn in stream dir, which is
+// left out of the collection.
+func (m *WalkUpload) skipFile(dir, fn, reason string) error {
+	m.status.WithField("path", streamPath(dir, fn)).Warnf("Skipping %v/%v: %s", dir, fn, reason)
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	m.warnings = append(m.warnings, UploadWarning{Path: streamPath(dir, fn), Reason: reason})
+	return nil
+}
+
+// Warnings returns the files that were left out of the collection
+// without failing the upload: special files (with SpecialFileSkip), and
+// files and directories that could not be read due to missing
+// permissions, unless StrictReadability is set.  (If the upload root
+// itself cannot be read, Walk fails instead.)  A directory that cannot
+// be listed is left out with everything in it.
+func (m *WalkUpload) Warnings() []UploadWarning {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	return append([]UploadWarning(nil), m.warnings...)
+}
+
+// Err returns the warnings (see Warnings) as an error, or nil if there
+// were none.  Unlike the errors returned by Walk and EndUpload, these
+// do not make the collection unusable, but it is incomplete.
+func (m *WalkUpload) Err() error {
+	var errs UploadErrors
+	for _, w := range m.Warnings() {
+		errs = append(errs, w)
+	}
+	return errs.err()
+}
+
+// specialFileType returns the FileMetadata.Type of a special file.
+func specialFileType(mode os.FileMode) string {
+	switch {
+	case mode&os.ModeNamedPipe != 0:
+		return "fifo"
+	case mode&os.ModeSocket != 0:
+		return "socket"
+	case mode&os.ModeCharDevice != 0:
+		return "char-device"
+	case mode&os.ModeDevice != 0:
+		return "block-device"
+	default:
+		return "unknown"
+	}
+}
+
+// fileError returns an UploadError for file fn in stream dir, and
+// reports it to the Reporter (unless only estimating).
+func (m *WalkUpload) fileError(dir, fn, phase string, err error) error {
+	if !m.estimating {
+		m.cw.reporter().IncErrors(1)
+	}
+	return &UploadError{Path: streamPath(dir, fn), Phase: phase, Err: err}
+}
+
+// getStream returns the CollectionFileWriter for stream dir, starting a
+// new one if needed.
+func (m *WalkUpload) getStream(dir string) (*CollectionFileWriter, error) {
+	if fw := m.streamMap[dir]; fw != nil {
+		return fw, nil
+	}
+	fw, err := m.newStream(dir)
+	if err != nil {
+		return nil, err
+	}
+	m.streamMap[dir] = fw
+	return fw, nil
+}
+
+// newStream starts a new CollectionFileWriter for stream dir, which is
+// added to the collection by EndUpload.
+func (m *WalkUpload) newStream(dir string) (*CollectionFileWriter, error) {
+	checkpoint, err := m.cw.getCheckpoint()
+	if err != nil {
+		return nil, err
+	}
+	fw := &CollectionFileWriter{
+		IKeepClient:    m.kc,
+		ManifestStream: &manifest.ManifestStream{StreamName: dir},
+		uploader:       make(chan *Block),
+		finish:         make(chan []error, 1),
+		ctx:            m.ctx,
+		cw:             m.cw,
+		checkpoint:     checkpoint,
+		status:         m.status,
+	}
+	m.streams = append(m.streams, fw)
+
+	m.cw.mtx.Lock()
+	fw.index = m.cw.streamCount
+	m.cw.streamCount++
+	m.cw.mtx.Unlock()
+
+	m.mtx.Lock()
+	if m.workers == nil {
+		if m.MaxWriters < 1 {
+			m.MaxWriters = 2
+		}
+		m.workers = make(chan struct{}, m.MaxWriters)
+	}
+	m.mtx.Unlock()
+
+	go fw.goUpload(fw.uploader, fw.finish, m.workers)
+	return fw, nil
+}
+
+// copyFile copies r to the current file of fileWriter and commits the
+// file.  size is the expected size of the file, or -1 if unknown.
+func (m *WalkUpload) copyFile(fileWriter *CollectionFileWriter, dir, fn string, r io.Reader, size int64) error {
+	// With a limited number of buffers, writing to this stream
+	// could wait forever for the buffer of the partially filled
+	// block in the previous one.
+	if m.cw.MaxBufferedBlocks > 0 && m.current != nil && m.current != fileWriter {
+		if err := m.current.flushBlock(); err != nil {
+			return m.fileError(dir, fn, UploadPhasePack, err)
+		}
+	}
+	m.current = fileWriter
+	m.cw.sendEvent(UploadEvent{Type: FileStarted, Path: streamPath(dir, fn), Size: size})
+
+	// Find the holes in a sparse file before wrapping r.
+	file := r
+	holes := findHoles(file, int64(fileWriter.length), size)
+
+	var cr *cacheDropReader
+	if m.cw.AvoidPageCache {
+		cr = newCacheDropReader(r, file)
+		if cr != nil {
+			r = cr
+		}
+	}
+
+	var pr *progressReader
+	if m.cw.OnProgress != nil {
+		pr = &progressReader{
+			Reader: r,
+			path:   streamPath(dir, fn),
+			n:      int64(fileWriter.length),
+			total:  size,
+			report: m.cw.OnProgress,
+		}
+		r = pr
+	}
+	// Hash the content for Diff, RecordSHA256 and RecordMD5,
+	// unless part of the file was skipped by skipCheckpointed.
+	var h, sha, sum hash.Hash
+	var hashers []io.Writer
+	if m.cw.DiffBase != "" && fileWriter.length == 0 {
+		h = m.cw.newHash()
+		hashers = append(hashers, h)
+	}
+	if m.cw.RecordSHA256 && fileWriter.length == 0 {
+		sha = sha256.New()
+		hashers = append(hashers, sha)
+	}
+	if m.cw.RecordMD5 && fileWriter.length == 0 {
+		sum = md5.New()
+		hashers = append(hashers, sum)
+	}
+	var hw io.Writer
+	if len(hashers) > 0 {
+		hw = io.MultiWriter(hashers...)
+		r = io.TeeReader(r, hw)
+	}
+	var err error
+	if len(holes) > 0 {
+		err = copySparse(fileWriter, r, file.(io.Seeker), holes, hw, pr)
+	} else {
+		_, err = io.Copy(fileWriter, r)
+	}
+	if cr != nil {
+		cr.drop()
+	}
+	if err != nil {
+		m.status.WithField("path", streamPath(dir, fn)).Errorf("Uh oh")
+		phase := UploadPhaseRead
+		if _, ok := err.(*CollectionSizeError); ok || err == m.ctx.Err() {
+			phase = UploadPhasePack
+		}
+		return m.fileError(dir, fn, phase, err)
+	}
+
+	if size >= 0 && int64(fileWriter.length) != size {
+		if m.cw.SizeChangePolicy == SizeChangeError {
+			return m.fileError(dir, fn, UploadPhaseRead, fmt.Errorf("File size changed during upload: expected %d bytes, read %d", size, fileWriter.length))
+		}
+		m.status.WithField("path", streamPath(dir, fn)).Warnf("File %v/%v changed size during upload: expected %d bytes, read %d", dir, fn, size, fileWriter.length)
+	}
 
 	// Commits the current file.  Legal to call this repeatedly.
 	fileWriter.Close()
 
+	if h != nil {
+		m.hashes[streamPath(dir, fn)] = fmt.Sprintf("%x", h.Sum(nil))
+	}
+	if sha != nil {
+		m.sha256s[streamPath(dir, fn)] = fmt.Sprintf("%x", sha.Sum(nil))
+	}
+	if sum != nil {
+		m.md5s[streamPath(dir, fn)] = fmt.Sprintf("%x:%d", sum.Sum(nil), fileWriter.length)
+	}
+
+	if m.cw.OnProgress != nil {
+		m.cw.OnProgress(streamPath(dir, fn), int64(fileWriter.length), size)
+	}
+	m.cw.sendEvent(UploadEvent{Type: FileCompleted, Path: streamPath(dir, fn), Size: int64(fileWriter.length)})
 	return nil
 }
 
-func (cw *CollectionWriter) BeginUpload(root string, status *log.Logger) *WalkUpload {
+// logger returns the Logger for uploads that would otherwise log to
+// status.
+func (cw *CollectionWriter) logger(status *log.Logger) Logger {
+	if cw.Logger != nil {
+		return cw.Logger
+	}
+	return NewLogLogger(status)
+}
+
+// BeginUpload starts a new upload of files under root.  Cancelling ctx
+// aborts the upload: subsequent UploadFile calls fail, buffered blocks
+// are discarded instead of being written to Keep, and ManifestText
+// returns an error.  Progress messages are logged to status, unless
+// cw.Logger is set.
+func (cw *CollectionWriter) BeginUpload(ctx context.Context, root string, status *log.Logger) *WalkUpload {
 	streamMap := make(map[string]*CollectionFileWriter)
-	return &WalkUpload{0, cw.IKeepClient, root, streamMap, status, nil, sync.Mutex{}}
+	ctx, cancel := context.WithCancel(ctx)
+	wu := &WalkUpload{
+		MaxWriters:  cw.MaxWriters,
+		kc:          cw.keepClient(),
+		stripPrefix: root,
+		streamMap:   streamMap,
+		status:      cw.logger(status),
+		ctx:         ctx,
+		cancel:      cancel,
+		cw:          cw,
+		symlinks:    make(map[string]string),
+		metadata:    make(map[string]*FileMetadata),
+		exclude:     parseExcludePatterns(cw.Exclude),
+		hardlinks:   make(map[fileID]hardlink),
+		hashes:      make(map[string]string),
+		sha256s:     make(map[string]string),
+		md5s:        make(map[string]string),
+		uploaded:    make(map[string]bool),
+		started:     time.Now(),
+	}
+	if cw.MaxReaders > 1 {
+		wu.prefetching = make(chan struct{}, cw.MaxReaders)
+	}
+	return wu
+}
+
+// EndUpload waits for the blocks written by wu to be stored, and adds
+// wu's streams to the collection.  If the upload's context was
+// cancelled, EndUpload returns the context's error; otherwise it
+// returns the errors encountered while storing blocks, if any.
+//
+// Calling EndUpload again (e.g., in a deferred cleanup after an
+// explicit call) does nothing, and returns the same result as the
+// first call.
+func (cw *CollectionWriter) EndUpload(wu *WalkUpload) error {
+	wu.endOnce.Do(func() {
+		wu.endErr = cw.endUpload(wu)
+		cw.sendEvent(UploadEvent{Type: UploadFinished, Err: wu.endErr})
+	})
+	return wu.endErr
+}
+
+// UploadTree is a directory tree to upload with UploadTrees.
+type UploadTree struct {
+	SrcRoot    string // upload root, see BeginUpload
+	DestPrefix string // stream where SrcRoot appears, see WalkUpload.TargetPrefix
+}
+
+// UploadTrees uploads each of the given trees with WalkUpload.Walk, in
+// order, and returns the manifest text of the collection.  If an
+// upload fails, its files are left out of the collection (see
+// WalkUpload.Abort) and the trees after it are not uploaded.  Since
+// the manifest is normalized, uploading the same trees in a different
+// order gives the same result, unless several trees have a file at the
+// same path.
+func (cw *CollectionWriter) UploadTrees(ctx context.Context, trees []UploadTree, status *log.Logger) (string, error) {
+	for _, tree := range trees {
+		wu := cw.BeginUpload(ctx, tree.SrcRoot, status)
+		wu.TargetPrefix = tree.DestPrefix
+		if err := wu.Walk(); err != nil {
+			wu.Abort()
+			return "", err
+		}
+		if err := cw.EndUpload(wu); err != nil {
+			return "", err
+		}
+	}
+	return cw.ManifestText()
+}
+
+// Abort stops the upload without adding any of its files to the
+// collection, e.g., when the caller decides partway through that the
+// upload is not wanted after all.  Blocks that are still waiting to be
+// written are discarded, writes in progress are waited for, and the
+// upload's buffers are released, so the CollectionWriter can go on
+// with other uploads (see BeginUpload).  Blocks already written to
+// Keep are not deleted.
+//
+// Abort must not be called while Walk, UploadFile, or UploadReader is
+// running; cancel the upload's context to interrupt those.  After
+// Abort, EndUpload returns an error.  After EndUpload, Abort does
+// nothing.
+func (wu *WalkUpload) Abort() {
+	wu.endOnce.Do(func() {
+		wu.cancel()
+		for _, g := range wu.growing {
+			g.abort()
+		}
+		var packed int64
+		for _, st := range wu.streams {
+			st.finishUpload()
+			packed += st.packed
+		}
+		wu.cw.storedMtx.Lock()
+		wu.cw.packedBytes -= packed
+		wu.cw.fileCount -= wu.files
+		wu.cw.storedMtx.Unlock()
+		wu.endErr = errors.New("Upload was aborted")
+		wu.cw.sendEvent(UploadEvent{Type: UploadFinished, Err: wu.endErr})
+	})
 }
 
-func (cw *CollectionWriter) EndUpload(wu *WalkUpload) {
+func (cw *CollectionWriter) endUpload(wu *WalkUpload) error {
+	var errs UploadErrors
+	for _, g := range wu.growing {
+		if err := g.end(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	for _, st := range wu.streams {
+		errs = append(errs, st.finishUpload()...)
+	}
+
 	cw.mtx.Lock()
-	for _, st := range wu.streamMap {
-		cw.Streams = append(cw.Streams, st)
+	cw.Streams = append(cw.Streams, wu.streams...)
+	// Uploads may end in any order, but their streams keep the
+	// order they were started in.
+	sort.SliceStable(cw.Streams, func(i, j int) bool {
+		return cw.Streams[i].index < cw.Streams[j].index
+	})
+	if len(wu.symlinks) > 0 && cw.symlinks == nil {
+		cw.symlinks = make(map[string]string)
+	}
+	for path, target := range wu.symlinks {
+		cw.symlinks[path] = target
+	}
+	if len(wu.metadata) > 0 && cw.metadata == nil {
+		cw.metadata = make(map[string]*FileMetadata)
+	}
+	for path, md := range wu.metadata {
+		cw.metadata[path] = md
+	}
+	if len(wu.hashes) > 0 && cw.hashes == nil {
+		cw.hashes = make(map[string]string)
+	}
+	for path, hash := range wu.hashes {
+		cw.hashes[path] = hash
+	}
+	if len(wu.sha256s) > 0 && cw.sha256s == nil {
+		cw.sha256s = make(map[string]string)
+	}
+	for path, digest := range wu.sha256s {
+		cw.sha256s[path] = digest
+	}
+	if len(wu.md5s) > 0 && cw.md5s == nil {
+		cw.md5s = make(map[string]string)
+	}
+	for path, sum := range wu.md5s {
+		cw.md5s[path] = sum
 	}
 	cw.mtx.Unlock()
+	err := wu.ctx.Err()
+	wu.cancel()
+	if err != nil {
+		return err
+	}
+	return errs.err()
+}
+
+// Symlinks returns the symbolic links recorded by uploads using
+// SymlinkStore, as a map from path (relative to the collection root) to
+// link target.  Manifests have no way to represent symlinks, so callers
+// that want to keep them must store this map elsewhere, e.g., as a
+// collection property.
+func (cw *CollectionWriter) Symlinks() map[string]string {
+	cw.mtx.Lock()
+	defer cw.mtx.Unlock()
+	symlinks := make(map[string]string, len(cw.symlinks))
+	for path, target := range cw.symlinks {
+		symlinks[path] = target
+	}
+	return symlinks
+}
+
+// FileMetadata returns the metadata recorded for uploaded files (see
+// PreserveMode, PreserveMtime, and PreserveXattrs), keyed by path
+// relative to the collection root.  Files with no recorded metadata
+// are not listed.
+func (cw *CollectionWriter) FileMetadata() map[string]*FileMetadata {
+	cw.mtx.Lock()
+	defer cw.mtx.Unlock()
+	metadata := make(map[string]*FileMetadata, len(cw.metadata))
+	for path, md := range cw.metadata {
+		copied := *md
+		if md.Xattrs != nil {
+			copied.Xattrs = make(map[string]string, len(md.Xattrs))
+			for name, value := range md.Xattrs {
+				copied.Xattrs[name] = value
+			}
+		}
+		if md.Mtime != nil {
+			mtime := *md.Mtime
+			copied.Mtime = &mtime
+		}
+		metadata[path] = &copied
+	}
+	return metadata
+}
+
+// SHA256Digests returns the SHA-256 digests (in hex) of the files
+// uploaded with RecordSHA256, keyed by path relative to the collection
+// root, e.g., to store as a collection property.
+func (cw *CollectionWriter) SHA256Digests() map[string]string {
+	cw.mtx.Lock()
+	defer cw.mtx.Unlock()
+	digests := make(map[string]string, len(cw.sha256s))
+	for path, digest := range cw.sha256s {
+		digests[path] = digest
+	}
+	return digests
+}
+
+// FileChecksums returns the MD5 digest (in hex) and size of each file
+// uploaded with RecordMD5, as "digest:size", keyed by path relative to
+// the collection root, e.g., to store as a collection property (see
+// Properties) for auditing.
+func (cw *CollectionWriter) FileChecksums() map[string]string {
+	cw.mtx.Lock()
+	defer cw.mtx.Unlock()
+	checksums := make(map[string]string, len(cw.md5s))
+	for path, sum := range cw.md5s {
+		checksums[path] = sum
+	}
+	return checksums
+}
+
+// fileMetadata returns the metadata entry for path, creating it if
+// needed.
+func (m *WalkUpload) fileMetadata(path string) *FileMetadata {
+	md := m.metadata[path]
+	if md == nil {
+		md = &FileMetadata{}
+		m.metadata[path] = md
+	}
+	return md
+}
+
+// streamPath returns the path of file fn in stream dir, relative to the
+// collection root.
+func streamPath(dir, fn string) string {
+	if dir == "." {
+		return fn
+	}
+	return strings.TrimPrefix(dir, "./") + "/" + fn
 }
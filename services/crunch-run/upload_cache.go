@@ -0,0 +1,106 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package main
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+// defaultBlockCacheSize is the default BlockCache.MaxEntries.
+const defaultBlockCacheSize = 100000
+
+// defaultBlockCacheTTL is the default BlockCache.TTL, well within the
+// lifetime of the signatures on the locators returned by Keep.
+const defaultBlockCacheTTL = 24 * time.Hour
+
+// BlockCache remembers the locators of the blocks stored by the
+// CollectionWriters that share it (see CollectionWriter.BlockCache),
+// so a block written again by a later upload in the same process is
+// not sent to Keep a second time.  The writers sharing a cache must
+// write to the same Keep cluster, and use the same Hasher and
+// BlockTransform.  A block is only reused by writers that store it
+// with the same replication and storage classes (see
+// DesiredReplication and StreamPolicies).
+//
+// A BlockCache is safe for concurrent use.
+type BlockCache struct {
+	// MaxEntries is the number of locators to remember.  When
+	// the cache is full, the least recently used locator is
+	// forgotten.  The default is 100000.
+	MaxEntries int
+
+	// TTL is how long a locator is reused after the block was
+	// stored.  It must be shorter than the lifetime of the
+	// locators' signatures.  The default is 24 hours.
+	TTL time.Duration
+
+	mtx     sync.Mutex
+	lru     *list.List // of *blockCacheEntry, most recently used first
+	entries map[string]*list.Element
+}
+
+type blockCacheEntry struct {
+	key     string
+	locator string
+	expires time.Time
+}
+
+// get returns the locator remembered for key, if any.
+func (c *BlockCache) get(key string) (string, bool) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	elt, ok := c.entries[key]
+	if !ok {
+		return "", false
+	}
+	ent := elt.Value.(*blockCacheEntry)
+	if time.Now().After(ent.expires) {
+		c.lru.Remove(elt)
+		delete(c.entries, key)
+		return "", false
+	}
+	c.lru.MoveToFront(elt)
+	return ent.locator, true
+}
+
+// add remembers that the block identified by key was stored with the
+// given locator.
+func (c *BlockCache) add(key, locator string) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	if c.entries == nil {
+		c.entries = make(map[string]*list.Element)
+		c.lru = list.New()
+	}
+	ttl := c.TTL
+	if ttl <= 0 {
+		ttl = defaultBlockCacheTTL
+	}
+	ent := &blockCacheEntry{key: key, locator: locator, expires: time.Now().Add(ttl)}
+	if elt, ok := c.entries[key]; ok {
+		elt.Value = ent
+		c.lru.MoveToFront(elt)
+		return
+	}
+	c.entries[key] = c.lru.PushFront(ent)
+	max := c.MaxEntries
+	if max <= 0 {
+		max = defaultBlockCacheSize
+	}
+	for c.lru.Len() > max {
+		elt := c.lru.Back()
+		c.lru.Remove(elt)
+		delete(c.entries, elt.Value.(*blockCacheEntry).key)
+	}
+}
+
+// Len returns the number of locators in the cache.
+func (c *BlockCache) Len() int {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	return len(c.entries)
+}
@@ -0,0 +1,70 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package main
+
+import (
+	"io/ioutil"
+	"log"
+	"os"
+	"time"
+
+	. "gopkg.in/check.v1"
+)
+
+func (s *TestSuite) TestUploadBlockCache(c *C) {
+	tmpdir, _ := ioutil.TempDir("", "")
+	defer func() {
+		os.RemoveAll(tmpdir)
+	}()
+
+	ioutil.WriteFile(tmpdir+"/"+"file1.txt", []byte("foo"), 0600)
+
+	// The second upload finds the block in the cache.
+	cache := &BlockCache{}
+	for _, puts := range []int{1, 0} {
+		kc := &KeepCountTestClient{}
+		cw := CollectionWriter{IKeepClient: kc, BlockCache: cache}
+		str, err := writeTree(&cw, tmpdir, log.New(os.Stdout, "", 0))
+		c.Check(err, IsNil)
+		c.Check(str, Equals, ". acbd18db4cc2f85cedef654fccc4a4d8+3 0:3:file1.txt\n")
+		c.Check(kc.puts, Equals, puts)
+	}
+	c.Check(cache.Len(), Equals, 1)
+
+	// Blocks stored with a different policy are not reused.
+	kc := &KeepCountTestClient{}
+	cw := CollectionWriter{IKeepClient: kc, BlockCache: cache, StreamPolicies: map[string]StreamPolicy{".": {Replication: 3}}}
+	_, err := writeTree(&cw, tmpdir, log.New(os.Stdout, "", 0))
+	c.Check(err, IsNil)
+	c.Check(kc.puts, Equals, 1)
+	c.Check(cache.Len(), Equals, 2)
+
+	// So are blocks stored with a different DesiredReplication.
+	kc = &KeepCountTestClient{}
+	cw = CollectionWriter{IKeepClient: kc, BlockCache: cache, DesiredReplication: 2}
+	_, err = writeTree(&cw, tmpdir, log.New(os.Stdout, "", 0))
+	c.Check(err, IsNil)
+	c.Check(kc.puts, Equals, 1)
+	c.Check(cache.Len(), Equals, 3)
+
+	// Expired and least recently used entries are forgotten.
+	cache.add("a", "a+1")
+	cache.add("b", "b+1")
+	cache.MaxEntries = 4
+	cache.add("c", "c+1")
+	c.Check(cache.Len(), Equals, 4)
+	_, ok := cache.get("acbd18db4cc2f85cedef654fccc4a4d8 0 ")
+	c.Check(ok, Equals, false)
+	loc, ok := cache.get("a")
+	c.Check(loc, Equals, "a+1")
+	c.Check(ok, Equals, true)
+
+	cache = &BlockCache{TTL: time.Nanosecond}
+	cache.add("a", "a+1")
+	time.Sleep(time.Millisecond)
+	_, ok = cache.get("a")
+	c.Check(ok, Equals, false)
+	c.Check(cache.Len(), Equals, 0)
+}
@@ -0,0 +1,200 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"os"
+	"regexp"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// checkpointEntry records a block that has been written to Keep.  If
+// the block was filled from a single source file, the entry also
+// records where in the file the data came from, so a resumed upload can
+// skip reading that part of the file.
+type checkpointEntry struct {
+	Hash    string `json:"hash"`
+	Locator string `json:"locator"`
+	Path    string `json:"path,omitempty"`
+	Offset  int64  `json:"offset"`
+	Size    int64  `json:"size"`
+
+	// Size and modification time of the source file at the time
+	// the block was read.
+	FileSize  int64 `json:"file_size,omitempty"`
+	FileMtime int64 `json:"file_mtime,omitempty"`
+}
+
+func newCheckpointEntry(hash, locator string, block *Block) checkpointEntry {
+	e := checkpointEntry{Hash: hash, Locator: locator, Size: block.offset}
+	if block.source != "" && block.sourceInfo != nil {
+		e.Path = block.source
+		e.Offset = block.sourceOffset
+		e.FileSize = block.sourceInfo.Size()
+		e.FileMtime = block.sourceInfo.ModTime().UnixNano()
+	}
+	return e
+}
+
+type checkpointSource struct {
+	path   string
+	offset int64
+}
+
+// uploadCheckpoint is a log of the blocks written to Keep, stored as
+// JSON lines in a file so an interrupted upload can be resumed.
+type uploadCheckpoint struct {
+	filename string
+	mtx      sync.Mutex
+	byHash   map[string]checkpointEntry
+	bySource map[checkpointSource]checkpointEntry
+}
+
+// loadCheckpoint reads the checkpoint file at filename, if it exists.
+// Lines that cannot be parsed (e.g., a partial line written just
+// before a crash) are ignored.
+func loadCheckpoint(filename string) (*uploadCheckpoint, error) {
+	cp := &uploadCheckpoint{
+		filename: filename,
+		byHash:   make(map[string]checkpointEntry),
+		bySource: make(map[checkpointSource]checkpointEntry),
+	}
+	f, err := os.Open(filename)
+	if os.IsNotExist(err) {
+		return cp, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var e checkpointEntry
+		if json.Unmarshal(scanner.Bytes(), &e) != nil || e.Hash == "" || e.Locator == "" {
+			continue
+		}
+		cp.add(e)
+	}
+	return cp, scanner.Err()
+}
+
+func (cp *uploadCheckpoint) add(e checkpointEntry) {
+	cp.byHash[e.Hash] = e
+	if e.Path != "" {
+		cp.bySource[checkpointSource{e.Path, e.Offset}] = e
+	}
+}
+
+// record appends e to the checkpoint file.
+func (cp *uploadCheckpoint) record(e checkpointEntry) error {
+	cp.mtx.Lock()
+	defer cp.mtx.Unlock()
+	cp.add(e)
+	f, err := os.OpenFile(cp.filename, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	err = json.NewEncoder(f).Encode(e)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// lookupHash returns the locator of a previously written block with
+// the given hash.
+func (cp *uploadCheckpoint) lookupHash(hash string) (string, bool) {
+	cp.mtx.Lock()
+	defer cp.mtx.Unlock()
+	e, ok := cp.byHash[hash]
+	return e.Locator, ok
+}
+
+// lookupSource returns the entry for a block starting at offset in the
+// source file at path, provided the file has not changed since the
+// block was written.
+func (cp *uploadCheckpoint) lookupSource(path string, offset int64, info os.FileInfo) (checkpointEntry, bool) {
+	cp.mtx.Lock()
+	defer cp.mtx.Unlock()
+	e, ok := cp.bySource[checkpointSource{path, offset}]
+	if !ok || e.FileSize != info.Size() || e.FileMtime != info.ModTime().UnixNano() {
+		return checkpointEntry{}, false
+	}
+	return e, true
+}
+
+// signatureExpiryRe matches the permission signature hint of a block
+// locator, capturing its expiry time (seconds since the epoch, in hex).
+var signatureExpiryRe = regexp.MustCompile(`\+A[0-9a-f]+@([0-9a-f]+)(\+|$)`)
+
+// reusable returns whether the block that the checkpoint lists with
+// the given locator can be referred to instead of being written again.
+// Unless the Keep client re-signs locators (see LocatorSigner), the
+// locator's permission signature must be valid for at least half of
+// SignatureTTL.  If the Keep client can check (see BlockAsker), the
+// block must still be stored.  It only returns an error if the upload
+// is cancelled while waiting for the answer.
+func (m *CollectionFileWriter) reusable(locator string) (bool, error) {
+	kc := unwrapClient(m.IKeepClient)
+	if _, ok := kc.(LocatorSigner); !ok {
+		if sig := signatureExpiryRe.FindStringSubmatch(locator); sig != nil {
+			expiry, err := strconv.ParseInt(sig[1], 16, 64)
+			if err != nil || time.Unix(expiry, 0).Before(time.Now().Add(m.cw.signatureTTL()/2)) {
+				return false, nil
+			}
+		}
+	}
+	asker, ok := kc.(BlockAsker)
+	if !ok {
+		return true, nil
+	}
+	found := make(chan bool, 1)
+	go func() {
+		_, _, err := asker.Ask(locator)
+		found <- err == nil
+	}()
+	select {
+	case ok := <-found:
+		return ok, nil
+	case <-m.ctx.Done():
+		return false, m.ctx.Err()
+	}
+}
+
+// skipCheckpointed hands the uploader any blocks of file (starting at
+// the current file offset) that the checkpoint says are already
+// stored, and seeks file past them.  This only works when the current
+// block is empty, i.e., the stored block started at the same offset.
+func (m *CollectionFileWriter) skipCheckpointed(cp *uploadCheckpoint, file io.Seeker, info os.FileInfo) error {
+	for m.Block == nil || m.Block.offset == 0 {
+		e, ok := cp.lookupSource(m.source, int64(m.length), info)
+		if !ok {
+			return nil
+		}
+		if ok, err := m.reusable(e.Locator); err != nil {
+			return err
+		} else if !ok {
+			return nil
+		}
+		block := &Block{
+			offset:  e.Size,
+			path:    streamPath(m.StreamName, m.fn),
+			locator: e.Locator,
+		}
+		if err := m.sendBlock(block); err != nil {
+			return err
+		}
+		m.length += uint64(e.Size)
+		if _, err := file.Seek(int64(m.length), io.SeekStart); err != nil {
+			return err
+		}
+	}
+	return nil
+}
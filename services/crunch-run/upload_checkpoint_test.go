@@ -0,0 +1,216 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	. "gopkg.in/check.v1"
+)
+
+// KeepFailAfterTestClient fails all PutHB calls after the first "ok"
+// calls.
+type KeepFailAfterTestClient struct {
+	KeepCountTestClient
+	ok int
+}
+
+func (client *KeepFailAfterTestClient) PutHB(hash string, buf []byte) (string, int, error) {
+	client.mtx.Lock()
+	fail := client.puts >= client.ok
+	client.mtx.Unlock()
+	if fail {
+		return "", 0, errors.New("KeepError")
+	}
+	return client.KeepCountTestClient.PutHB(hash, buf)
+}
+
+func (s *TestSuite) TestUploadResumeFromCheckpoint(c *C) {
+	tmpdir, _ := ioutil.TempDir("", "")
+	defer func() {
+		os.RemoveAll(tmpdir)
+	}()
+	cpdir, _ := ioutil.TempDir("", "")
+	defer func() {
+		os.RemoveAll(cpdir)
+	}()
+
+	data := make([]byte, 5*1024)
+	for i := range data {
+		data[i] = byte(i / 1024)
+	}
+	ioutil.WriteFile(tmpdir+"/"+"file1.txt", data, 0600)
+	ioutil.WriteFile(tmpdir+"/"+"file2.txt", []byte("bar"), 0600)
+
+	cw := CollectionWriter{IKeepClient: &KeepCountTestClient{}, BlockSize: 1024}
+	expect, err := writeTree(&cw, tmpdir, log.New(os.Stdout, "", 0))
+	c.Assert(err, IsNil)
+
+	// Interrupted after 3 blocks are written
+	failing := &KeepFailAfterTestClient{ok: 3}
+	cw = CollectionWriter{IKeepClient: failing, BlockSize: 1024, MaxWriters: 1, CheckpointFile: cpdir + "/checkpoint"}
+	_, err = writeTree(&cw, tmpdir, log.New(os.Stdout, "", 0))
+	c.Assert(err, NotNil)
+	c.Check(failing.puts, Equals, 3)
+
+	kc := &KeepCountTestClient{}
+	cw = CollectionWriter{IKeepClient: kc, BlockSize: 1024, CheckpointFile: cpdir + "/checkpoint"}
+	str, err := writeTree(&cw, tmpdir, log.New(os.Stdout, "", 0))
+	c.Check(err, IsNil)
+	c.Check(str, Equals, expect)
+	c.Check(kc.puts, Equals, 3)
+
+	// Everything is in the checkpoint now
+	kc = &KeepCountTestClient{}
+	cw = CollectionWriter{IKeepClient: kc, BlockSize: 1024, CheckpointFile: cpdir + "/checkpoint"}
+	str, err = writeTree(&cw, tmpdir, log.New(os.Stdout, "", 0))
+	c.Check(err, IsNil)
+	c.Check(str, Equals, expect)
+	c.Check(kc.puts, Equals, 0)
+}
+
+func (s *TestSuite) TestUploadCheckpointModifiedFile(c *C) {
+	tmpdir, _ := ioutil.TempDir("", "")
+	defer func() {
+		os.RemoveAll(tmpdir)
+	}()
+	cpdir, _ := ioutil.TempDir("", "")
+	defer func() {
+		os.RemoveAll(cpdir)
+	}()
+
+	ioutil.WriteFile(tmpdir+"/"+"file1.txt", []byte("foo"), 0600)
+
+	cw := CollectionWriter{IKeepClient: &KeepCountTestClient{}, CheckpointFile: cpdir + "/checkpoint"}
+	_, err := writeTree(&cw, tmpdir, log.New(os.Stdout, "", 0))
+	c.Assert(err, IsNil)
+
+	// Same size, different content: the file must be read again
+	ioutil.WriteFile(tmpdir+"/"+"file1.txt", []byte("bar"), 0600)
+	info, _ := os.Stat(tmpdir + "/file1.txt")
+	os.Chtimes(tmpdir+"/file1.txt", info.ModTime(), info.ModTime().Add(1))
+
+	kc := &KeepCountTestClient{}
+	cw = CollectionWriter{IKeepClient: kc, CheckpointFile: cpdir + "/checkpoint"}
+	str, err := writeTree(&cw, tmpdir, log.New(os.Stdout, "", 0))
+	c.Check(err, IsNil)
+	c.Check(str, Equals, ". 37b51d194a7513e45b56f6524f2d51f2+3 0:3:file1.txt\n")
+	c.Check(kc.puts, Equals, 1)
+}
+
+// KeepExpiringTestClient signs the locators it returns with a
+// permission signature that expires at expiry.
+type KeepExpiringTestClient struct {
+	KeepCountTestClient
+	expiry time.Time
+}
+
+func (client *KeepExpiringTestClient) PutHB(hash string, buf []byte) (string, int, error) {
+	locator, n, err := client.KeepCountTestClient.PutHB(hash, buf)
+	return fmt.Sprintf("%s+A0123456789abcdef0123456789abcdef01234567@%x", locator, client.expiry.Unix()), n, err
+}
+
+func (s *TestSuite) TestUploadCheckpointStaleBlocks(c *C) {
+	tmpdir, _ := ioutil.TempDir("", "")
+	defer func() {
+		os.RemoveAll(tmpdir)
+	}()
+	cpdir, _ := ioutil.TempDir("", "")
+	defer func() {
+		os.RemoveAll(cpdir)
+	}()
+
+	data := make([]byte, 5*1024)
+	for i := range data {
+		data[i] = byte(i / 1024)
+	}
+	ioutil.WriteFile(tmpdir+"/"+"file1.txt", data, 0600)
+	ioutil.WriteFile(tmpdir+"/"+"file2.txt", []byte("bar"), 0600)
+
+	// Signatures expire soon: every block is written again
+	expiring := &KeepExpiringTestClient{expiry: time.Now().Add(time.Hour)}
+	cw := CollectionWriter{IKeepClient: expiring, BlockSize: 1024, CheckpointFile: cpdir + "/checkpoint"}
+	_, err := writeTree(&cw, tmpdir, log.New(os.Stdout, "", 0))
+	c.Assert(err, IsNil)
+	c.Check(expiring.puts, Equals, 6)
+
+	kc := &KeepCountTestClient{}
+	cw = CollectionWriter{IKeepClient: kc, BlockSize: 1024, CheckpointFile: cpdir + "/checkpoint"}
+	expect, err := writeTree(&cw, tmpdir, log.New(os.Stdout, "", 0))
+	c.Check(err, IsNil)
+	c.Check(kc.puts, Equals, 6)
+
+	// Blocks are no longer in Keep: every block is written again
+	asker := &KeepAskTestClient{existing: map[string]bool{}}
+	cw = CollectionWriter{IKeepClient: asker, BlockSize: 1024, CheckpointFile: cpdir + "/checkpoint"}
+	str, err := writeTree(&cw, tmpdir, log.New(os.Stdout, "", 0))
+	c.Check(err, IsNil)
+	c.Check(str, Equals, expect)
+	c.Check(asker.asks > 0, Equals, true)
+	c.Check(asker.puts, Equals, 6)
+
+	// Blocks are still in Keep: nothing is written
+	asker = &KeepAskTestClient{existing: map[string]bool{}}
+	for _, token := range strings.Fields(expect) {
+		if len(token) > 33 && token[32] == '+' {
+			asker.existing[token] = true
+		}
+	}
+	cw = CollectionWriter{IKeepClient: asker, BlockSize: 1024, CheckpointFile: cpdir + "/checkpoint"}
+	str, err = writeTree(&cw, tmpdir, log.New(os.Stdout, "", 0))
+	c.Check(err, IsNil)
+	c.Check(str, Equals, expect)
+	c.Check(asker.puts, Equals, 0)
+}
+
+// KeepHangAskTestClient never answers Ask calls.
+type KeepHangAskTestClient struct {
+	KeepCountTestClient
+}
+
+func (client *KeepHangAskTestClient) Ask(locator string) (int64, string, error) {
+	select {}
+}
+
+func (s *TestSuite) TestUploadCheckpointCancelAsk(c *C) {
+	tmpdir, _ := ioutil.TempDir("", "")
+	defer func() {
+		os.RemoveAll(tmpdir)
+	}()
+	cpdir, _ := ioutil.TempDir("", "")
+	defer func() {
+		os.RemoveAll(cpdir)
+	}()
+
+	ioutil.WriteFile(tmpdir+"/"+"file1.txt", make([]byte, 2048), 0600)
+	cw := CollectionWriter{IKeepClient: &KeepCountTestClient{}, BlockSize: 1024, CheckpointFile: cpdir + "/checkpoint"}
+	_, err := writeTree(&cw, tmpdir, log.New(os.Stdout, "", 0))
+	c.Assert(err, IsNil)
+
+	// Checking the checkpointed blocks stops when the upload is
+	// cancelled.
+	ctx, cancel := context.WithCancel(context.Background())
+	cw = CollectionWriter{IKeepClient: &KeepHangAskTestClient{}, BlockSize: 1024, CheckpointFile: cpdir + "/checkpoint"}
+	walkUpload := cw.BeginUpload(ctx, tmpdir, log.New(os.Stdout, "", 0))
+	time.AfterFunc(10*time.Millisecond, cancel)
+	finished := make(chan error, 1)
+	go func() {
+		walkUpload.Walk()
+		finished <- cw.EndUpload(walkUpload)
+	}()
+	select {
+	case err := <-finished:
+		c.Check(err, Equals, context.Canceled)
+	case <-time.After(10 * time.Second):
+		c.Error("upload was not cancelled")
+	}
+}
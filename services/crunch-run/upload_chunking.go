@@ -0,0 +1,91 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package main
+
+// gearTable holds a fixed pseudo-random number for each byte value,
+// for the rolling hash used by ContentDefinedChunking.
+var gearTable = func() (t [256]uint64) {
+	// splitmix64, so the table (and thereby the block
+	// boundaries) never changes.
+	x := uint64(0x2545f4914f6cdd1d)
+	for i := range t {
+		x += 0x9e3779b97f4a7c15
+		z := x
+		z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+		z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+		t[i] = z ^ (z >> 31)
+	}
+	return
+}()
+
+// chunkMask returns the mask that selects the top bits of the rolling
+// hash that must be zero at a block boundary.  Past the minimum block
+// size, a boundary is found after blockSize/4 bytes on average.
+func chunkMask(blockSize int) uint64 {
+	bits := uint(0)
+	for n := blockSize / 4; n > 1; n >>= 1 {
+		bits++
+	}
+	return ^uint64(0) << (64 - bits)
+}
+
+// chunkBoundary updates the rolling hash with the data of the current
+// block from offset from to the end of the data written so far, and
+// returns the offset just after the first block boundary, or -1 if
+// there is none.  The hash only covers the data past the minimum
+// block size, so the boundaries depend only on the data since the
+// previous one.
+func (m *CollectionFileWriter) chunkBoundary(from int64) int64 {
+	blockSize := m.cw.blockSize()
+	if min := int64(blockSize / 16); from < min {
+		from = min
+	}
+	mask := chunkMask(blockSize)
+	data := m.Block.data[:m.Block.offset]
+	for i := from; i < int64(len(data)); i++ {
+		m.chunkHash = m.chunkHash<<1 + gearTable[data[i]]
+		if m.chunkHash&mask == 0 {
+			return i + 1
+		}
+	}
+	return -1
+}
+
+// cutChunks ends the current block at each block boundary in the data
+// written to it from offset from, moving the data after the boundary
+// to a new block.  fileOffset is the position in the current file
+// corresponding to the end of the data written so far.
+func (m *CollectionFileWriter) cutChunks(from, fileOffset int64) error {
+	for {
+		cut := m.chunkBoundary(from)
+		if cut < 0 {
+			return nil
+		}
+		tail := append([]byte(nil), m.Block.data[cut:m.Block.offset]...)
+		m.Block.offset = cut
+		if err := m.sendBlock(m.Block); err != nil {
+			return err
+		}
+		m.Block = nil
+		if len(tail) == 0 {
+			return nil
+		}
+
+		data, err := m.cw.allocBuffer(m.ctx)
+		if err != nil {
+			return err
+		}
+		m.Block = &Block{
+			data:         data,
+			offset:       int64(copy(data, tail)),
+			path:         streamPath(m.StreamName, m.fn),
+			source:       m.source,
+			sourceOffset: fileOffset - int64(len(tail)),
+			sourceInfo:   m.sourceInfo,
+		}
+		m.chunkHash = 0
+		from = 0
+	}
+}
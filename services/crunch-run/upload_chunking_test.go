@@ -0,0 +1,82 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package main
+
+import (
+	"io/ioutil"
+	"log"
+	"math/rand"
+	"os"
+	"strconv"
+	"strings"
+
+	. "gopkg.in/check.v1"
+)
+
+func (s *TestSuite) TestUploadContentDefinedChunking(c *C) {
+	tmpdir, _ := ioutil.TempDir("", "")
+	defer func() {
+		os.RemoveAll(tmpdir)
+	}()
+
+	data := make([]byte, 1<<20)
+	rand.New(rand.NewSource(1)).Read(data)
+	edited := append(append(append([]byte(nil), data[:300000]...), []byte("inserted text")...), data[300000:]...)
+
+	// upload returns the locators of the blocks of a file with
+	// the given content.
+	upload := func(content []byte, cdc bool) map[string]bool {
+		ioutil.WriteFile(tmpdir+"/"+"file1.txt", content, 0600)
+		cw := CollectionWriter{IKeepClient: &KeepTestClient{}, BlockSize: 1 << 16, ContentDefinedChunking: cdc}
+		str, err := writeTree(&cw, tmpdir, log.New(os.Stdout, "", 0))
+		c.Assert(err, IsNil)
+		c.Check(str, Matches, `\. .* 0:[0-9]+:file1\.txt\n`)
+		locators := make(map[string]bool)
+		for _, locator := range cw.UniqueLocators() {
+			locators[locator] = true
+		}
+		return locators
+	}
+	shared := func(a, b map[string]bool) int {
+		n := 0
+		for locator := range a {
+			if b[locator] {
+				n++
+			}
+		}
+		return n
+	}
+
+	before := upload(data, true)
+	after := upload(edited, true)
+	c.Check(len(before) > 16, Equals, true)
+	c.Check(shared(before, after) >= len(before)-2, Equals, true, Commentf("%d of %d blocks unchanged", shared(before, after), len(before)))
+
+	// With fixed size blocks, the blocks after the edit all
+	// change.
+	before = upload(data, false)
+	after = upload(edited, false)
+	c.Check(before, HasLen, 16)
+	c.Check(shared(before, after), Equals, 4)
+
+	// The blocks hold all of the data, in blocks of at least
+	// BlockSize/16 except at the end of the file.
+	ioutil.WriteFile(tmpdir+"/"+"file1.txt", edited, 0600)
+	cw := CollectionWriter{IKeepClient: &KeepTestClient{}, BlockSize: 1 << 16, ContentDefinedChunking: true}
+	str, err := writeTree(&cw, tmpdir, log.New(os.Stdout, "", 0))
+	c.Assert(err, IsNil)
+	fields := strings.Fields(str)
+	total, short := 0, 0
+	for _, locator := range fields[1 : len(fields)-1] {
+		size, _ := strconv.Atoi(strings.Split(locator, "+")[1])
+		total += size
+		if size < 1<<12 {
+			short++
+		}
+		c.Check(size <= 1<<16, Equals, true)
+	}
+	c.Check(total, Equals, len(edited))
+	c.Check(short <= 1, Equals, true)
+}
@@ -0,0 +1,255 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	"git.curoverse.com/arvados.git/sdk/go/arvados"
+	"git.curoverse.com/arvados.git/sdk/go/arvadosclient"
+	"git.curoverse.com/arvados.git/sdk/go/manifest"
+)
+
+// locatorHintsRe matches the hints (e.g., permission signatures)
+// following the size of a block locator.
+var locatorHintsRe = regexp.MustCompile(`^([0-9a-f]+\+[0-9]+)\+.*`)
+
+// PortableDataHash returns the portable data hash of the collection,
+// computed from ManifestText the same way as by the API server: the MD5
+// hash of the manifest with all locator hints except the sizes removed,
+// followed by "+" and the size of that manifest.  This can be used to
+// look for an existing collection with the same content before saving
+// it.
+func (m *CollectionWriter) PortableDataHash() (string, error) {
+	mt, err := m.manifestText(false)
+	if err != nil {
+		return "", err
+	}
+	return portableDataHash(mt), nil
+}
+
+// portableDataHash returns the portable data hash of the collection
+// with manifest text mt.
+func portableDataHash(mt string) string {
+	portable := portableManifestText(mt)
+	return fmt.Sprintf("%x+%d", md5.Sum([]byte(portable)), len(portable))
+}
+
+// portableManifestText returns mt with the hints removed from its block
+// locators.
+func portableManifestText(mt string) string {
+	lines := strings.SplitAfter(mt, "\n")
+	for i, line := range lines {
+		words := strings.Split(strings.TrimSuffix(line, "\n"), " ")
+		for j := 1; j < len(words); j++ {
+			if strings.Contains(words[j], ":") {
+				break
+			}
+			words[j] = locatorHintsRe.ReplaceAllString(words[j], "$1")
+		}
+		lines[i] = strings.Join(words, " ")
+		if strings.HasSuffix(line, "\n") {
+			lines[i] += "\n"
+		}
+	}
+	return strings.Join(lines, "")
+}
+
+// SplitPolicy limits the size of the collections produced by
+// FinishSplit.  A zero limit means no limit.
+type SplitPolicy struct {
+	// MaxBytesPerCollection is the maximum total size of the
+	// files in each collection.  A single file larger than this
+	// gets a collection of its own.
+	MaxBytesPerCollection int64
+
+	// MaxFilesPerCollection is the maximum number of files in
+	// each collection.
+	MaxFilesPerCollection int
+}
+
+// CollectionPart is one of the collections produced by FinishSplit.
+type CollectionPart struct {
+	ManifestText     string
+	PortableDataHash string
+
+	// Number and total size of the files in the collection
+	Files int
+	Bytes int64
+}
+
+// FinishSplit finishes writing the collection like Finish, and returns
+// its content split into collections according to Split, each with a
+// valid normalized manifest.  The files are taken in the order they
+// appear in ManifestText, and each collection gets as many files as fit
+// in the limits; a file is never split between collections.  Without
+// limits, FinishSplit returns one collection with the same manifest as
+// ManifestText.  It cannot be used with a custom Hasher.
+func (m *CollectionWriter) FinishSplit() ([]CollectionPart, error) {
+	if m.Hasher != nil {
+		return nil, fmt.Errorf("FinishSplit cannot be used with a custom Hasher")
+	}
+	mt, err := m.manifestText(false)
+	if err != nil {
+		return nil, err
+	}
+	streams, err := ParseManifest(mt)
+	if err != nil {
+		return nil, err
+	}
+
+	var parts []CollectionPart
+	var part CollectionPart
+	var lines []string // streams of the current part
+	finishPart := func() error {
+		var buf bytes.Buffer
+		if err := m.writeNormalized(&buf, lines); err != nil {
+			return err
+		}
+		part.ManifestText = buf.String()
+		part.PortableDataHash = portableDataHash(part.ManifestText)
+		parts = append(parts, part)
+		part, lines = CollectionPart{}, nil
+		return nil
+	}
+
+	limit := m.Split
+	for _, st := range streams {
+		// Normalized streams list the segments of each file
+		// together.
+		var files []splitFile
+		for _, seg := range st.FileStreamSegments {
+			if n := len(files); n == 0 || files[n-1].name != seg.Name {
+				files = append(files, splitFile{name: seg.Name})
+			}
+			f := &files[len(files)-1]
+			f.tokens = append(f.tokens, fmt.Sprintf("%d:%d:%s", seg.SegPos, seg.SegLen, manifest.EscapeName(seg.Name)))
+			f.size += int64(seg.SegLen)
+		}
+
+		// File tokens of st in the current part
+		var tokens []string
+		addStream := func() {
+			if len(tokens) > 0 {
+				lines = append(lines, manifest.EscapeName(st.StreamName)+" "+strings.Join(st.Blocks, " ")+" "+strings.Join(tokens, " ")+"\n")
+				tokens = nil
+			}
+		}
+		for _, f := range files {
+			if part.Files > 0 && (limit.MaxFilesPerCollection > 0 && part.Files >= limit.MaxFilesPerCollection ||
+				limit.MaxBytesPerCollection > 0 && part.Bytes+f.size > limit.MaxBytesPerCollection) {
+				addStream()
+				if err := finishPart(); err != nil {
+					return nil, err
+				}
+			}
+			tokens = append(tokens, f.tokens...)
+			part.Files++
+			part.Bytes += f.size
+		}
+		addStream()
+	}
+	if len(parts) == 0 || part.Files > 0 {
+		if err := finishPart(); err != nil {
+			return nil, err
+		}
+	}
+	return parts, nil
+}
+
+// splitFile is a file in a normalized stream, see FinishSplit.
+type splitFile struct {
+	name   string
+	tokens []string
+	size   int64
+}
+
+// SaveCollection stores the collection's manifest in an Arvados
+// collection record, creating a new record if uuid is empty and
+// updating the record with the given uuid otherwise.  Other collection
+// attributes (e.g., "name") can be given in attrs, and are stored along
+// with Properties.  The returned
+// collection has the UUID and portable data hash assigned by the API
+// server.
+//
+// Server errors (5xx) and other temporary errors are retried up to
+// MaxRetries times, with the same backoff as block writes.  Client
+// errors (4xx) are returned immediately.
+func (m *CollectionWriter) SaveCollection(ctx context.Context, arv IArvadosClient, uuid string, attrs arvadosclient.Dict) (arvados.Collection, error) {
+	var coll arvados.Collection
+	mt, err := m.manifestText(false)
+	if err != nil {
+		return coll, err
+	}
+	collAttrs := arvadosclient.Dict{}
+	for k, v := range attrs {
+		collAttrs[k] = v
+	}
+	collAttrs["manifest_text"] = mt
+	if len(m.Properties) > 0 {
+		props := make(map[string]interface{})
+		for k, v := range m.Properties {
+			props[k] = v
+		}
+		var extra map[string]interface{}
+		switch p := attrs["properties"].(type) {
+		case nil:
+		case map[string]interface{}:
+			extra = p
+		case arvadosclient.Dict:
+			extra = p
+		default:
+			return coll, fmt.Errorf("Cannot add Properties to collection properties of type %T", p)
+		}
+		for k, v := range extra {
+			props[k] = v
+		}
+		collAttrs["properties"] = props
+	}
+	params := arvadosclient.Dict{"collection": collAttrs}
+	if uuid == "" {
+		params["ensure_unique_name"] = true
+	}
+
+	delay := m.RetryDelay
+	if delay <= 0 {
+		delay = defaultRetryDelay
+	}
+	for attempt := 0; ; attempt++ {
+		if uuid == "" {
+			err = arv.Create("collections", params, &coll)
+		} else {
+			err = arv.Update("collections", uuid, params, &coll)
+		}
+		if err == nil {
+			return coll, nil
+		}
+		if attempt >= m.MaxRetries || !retryableAPIError(err) {
+			break
+		}
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return coll, fmt.Errorf("While saving collection: %v", err)
+		}
+		delay *= 2
+	}
+	return coll, fmt.Errorf("While saving collection: %v", err)
+}
+
+// retryableAPIError reports whether an API request that failed with err
+// might succeed if retried.
+func retryableAPIError(err error) bool {
+	if apierr, ok := err.(arvadosclient.APIServerError); ok {
+		return apierr.HttpStatusCode >= 500
+	}
+	return temporary(err)
+}
@@ -0,0 +1,261 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"log"
+	"os"
+	"time"
+
+	"git.curoverse.com/arvados.git/sdk/go/arvados"
+	"git.curoverse.com/arvados.git/sdk/go/arvadosclient"
+	. "gopkg.in/check.v1"
+)
+
+// CollectionAPITestClient records collection create/update requests,
+// failing the first few with the errors in errs.
+type CollectionAPITestClient struct {
+	IArvadosClient
+	errs   []error
+	calls  []string
+	params []arvadosclient.Dict
+}
+
+func (a *CollectionAPITestClient) respond(call string, parameters arvadosclient.Dict, output interface{}) error {
+	a.calls = append(a.calls, call)
+	a.params = append(a.params, parameters)
+	if len(a.errs) > 0 {
+		err := a.errs[0]
+		a.errs = a.errs[1:]
+		return err
+	}
+	*output.(*arvados.Collection) = arvados.Collection{
+		UUID:             "zzzzz-4zz18-zzzzzzzzzzzzzzz",
+		PortableDataHash: "fa7aeb5140e2848d39b416daeef4ffc5+45",
+	}
+	return nil
+}
+
+func (a *CollectionAPITestClient) Create(resourceType string, parameters arvadosclient.Dict, output interface{}) error {
+	return a.respond("create "+resourceType, parameters, output)
+}
+
+func (a *CollectionAPITestClient) Update(resourceType string, uuid string, parameters arvadosclient.Dict, output interface{}) error {
+	return a.respond("update "+resourceType+" "+uuid, parameters, output)
+}
+
+func (s *TestSuite) TestPortableDataHash(c *C) {
+	tmpdir, _ := ioutil.TempDir("", "")
+	defer func() {
+		os.RemoveAll(tmpdir)
+	}()
+
+	ioutil.WriteFile(tmpdir+"/"+"file1.txt", []byte("foo"), 0600)
+
+	cw := CollectionWriter{IKeepClient: &KeepTestClient{}}
+	_, err := writeTree(&cw, tmpdir, log.New(os.Stdout, "", 0))
+	c.Check(err, IsNil)
+	pdh, err := cw.PortableDataHash()
+	c.Check(err, IsNil)
+	c.Check(pdh, Equals, "0dc5fd28e36bb5eb02a21de5c1ff868c+51")
+
+	// Permission signatures are not part of the portable manifest.
+	cw = CollectionWriter{IKeepClient: &KeepSignTestClient{}}
+	mt, err := writeTree(&cw, tmpdir, log.New(os.Stdout, "", 0))
+	c.Check(err, IsNil)
+	c.Check(mt, Equals, ". acbd18db4cc2f85cedef654fccc4a4d8+3+Asignature@12345678 0:3:file1.txt\n")
+	pdh, err = cw.PortableDataHash()
+	c.Check(err, IsNil)
+	c.Check(pdh, Equals, "0dc5fd28e36bb5eb02a21de5c1ff868c+51")
+
+	cw = CollectionWriter{IKeepClient: &KeepTestClient{}}
+	c.Check(cw.EndUpload(cw.BeginUpload(context.Background(), tmpdir, log.New(os.Stdout, "", 0))), IsNil)
+	pdh, err = cw.PortableDataHash()
+	c.Check(err, IsNil)
+	c.Check(pdh, Equals, "d41d8cd98f00b204e9800998ecf8427e+0")
+}
+
+func (s *TestSuite) TestFinishSplit(c *C) {
+	tmpdir, _ := ioutil.TempDir("", "")
+	defer func() {
+		os.RemoveAll(tmpdir)
+	}()
+
+	os.Mkdir(tmpdir+"/subdir", 0700)
+	ioutil.WriteFile(tmpdir+"/"+"a.txt", []byte("aaa"), 0600)
+	ioutil.WriteFile(tmpdir+"/"+"b.txt", []byte("bbb"), 0600)
+	ioutil.WriteFile(tmpdir+"/"+"c.txt", []byte("ccc"), 0600)
+	ioutil.WriteFile(tmpdir+"/subdir/d.txt", []byte("ddd"), 0600)
+
+	// With 4-byte blocks, b.txt and c.txt are split between
+	// blocks, and share one.
+	cw := CollectionWriter{IKeepClient: &KeepTestClient{}, BlockSize: 4, Split: SplitPolicy{MaxBytesPerCollection: 6}}
+	mt, err := writeTree(&cw, tmpdir, log.New(os.Stdout, "", 0))
+	c.Assert(err, IsNil)
+	c.Check(mt, Equals, `. 4c189b020ceb022e0ecc42482802e2b8+4 37928464fe5c171a77608f69cc0a5e40+4 4a8a08f09d37b73795649038408b5f33+1 0:3:a.txt 3:3:b.txt 6:3:c.txt
+./subdir 77963b7a931377ad4ab5ad6a9cd718aa+3 0:3:d.txt
+`)
+
+	parts, err := cw.FinishSplit()
+	c.Assert(err, IsNil)
+	c.Check(parts, DeepEquals, []CollectionPart{
+		{
+			ManifestText:     ". 4c189b020ceb022e0ecc42482802e2b8+4 37928464fe5c171a77608f69cc0a5e40+4 0:3:a.txt 3:3:b.txt\n",
+			PortableDataHash: "c2cfa5b39b850c888926ea786ba5b9b7+92",
+			Files:            2,
+			Bytes:            6,
+		},
+		{
+			ManifestText:     ". 37928464fe5c171a77608f69cc0a5e40+4 4a8a08f09d37b73795649038408b5f33+1 2:3:c.txt\n./subdir 77963b7a931377ad4ab5ad6a9cd718aa+3 0:3:d.txt\n",
+			PortableDataHash: "0ba081b3f35adc61622b4b18adb0006e+136",
+			Files:            2,
+			Bytes:            6,
+		},
+	})
+
+	// Each file is in exactly one collection, with all of its data.
+	sizes := make(map[string][]uint64)
+	for _, part := range parts {
+		streams, err := ParseManifest(part.ManifestText)
+		c.Assert(err, IsNil)
+		for _, st := range streams {
+			for _, seg := range st.FileStreamSegments {
+				path := streamPath(st.StreamName, seg.Name)
+				sizes[path] = append(sizes[path], seg.SegLen)
+			}
+		}
+	}
+	c.Check(sizes, DeepEquals, map[string][]uint64{
+		"a.txt":        {3},
+		"b.txt":        {3},
+		"c.txt":        {3},
+		"subdir/d.txt": {3},
+	})
+
+	// Without limits, there is one collection.
+	cw.Split = SplitPolicy{}
+	parts, err = cw.FinishSplit()
+	c.Assert(err, IsNil)
+	c.Assert(parts, HasLen, 1)
+	c.Check(parts[0].ManifestText, Equals, mt)
+	c.Check(parts[0].Files, Equals, 4)
+
+	cw.Split = SplitPolicy{MaxFilesPerCollection: 3}
+	parts, err = cw.FinishSplit()
+	c.Assert(err, IsNil)
+	c.Assert(parts, HasLen, 2)
+	c.Check(parts[0].ManifestText, Equals, ". 4c189b020ceb022e0ecc42482802e2b8+4 37928464fe5c171a77608f69cc0a5e40+4 4a8a08f09d37b73795649038408b5f33+1 0:3:a.txt 3:3:b.txt 6:3:c.txt\n")
+	c.Check(parts[1].ManifestText, Equals, "./subdir 77963b7a931377ad4ab5ad6a9cd718aa+3 0:3:d.txt\n")
+}
+
+func (s *TestSuite) TestSaveCollection(c *C) {
+	tmpdir, _ := ioutil.TempDir("", "")
+	defer os.RemoveAll(tmpdir)
+	ioutil.WriteFile(tmpdir+"/file1.txt", []byte("foo"), 0600)
+
+	cw := CollectionWriter{IKeepClient: &KeepTestClient{}}
+	_, err := writeTree(&cw, tmpdir, log.New(os.Stdout, "", 0))
+	c.Assert(err, IsNil)
+
+	arv := &CollectionAPITestClient{}
+	coll, err := cw.SaveCollection(context.Background(), arv, "", arvadosclient.Dict{"name": "output"})
+	c.Assert(err, IsNil)
+	c.Check(coll.UUID, Equals, "zzzzz-4zz18-zzzzzzzzzzzzzzz")
+	c.Check(coll.PortableDataHash, Equals, "fa7aeb5140e2848d39b416daeef4ffc5+45")
+	c.Check(arv.calls, DeepEquals, []string{"create collections"})
+	c.Check(arv.params[0], DeepEquals, arvadosclient.Dict{
+		"ensure_unique_name": true,
+		"collection": arvadosclient.Dict{
+			"name":          "output",
+			"manifest_text": ". acbd18db4cc2f85cedef654fccc4a4d8+3 0:3:file1.txt\n",
+		},
+	})
+
+	arv = &CollectionAPITestClient{}
+	coll, err = cw.SaveCollection(context.Background(), arv, "zzzzz-4zz18-zzzzzzzzzzzzzzz", nil)
+	c.Assert(err, IsNil)
+	c.Check(arv.calls, DeepEquals, []string{"update collections zzzzz-4zz18-zzzzzzzzzzzzzzz"})
+	c.Check(arv.params[0], DeepEquals, arvadosclient.Dict{
+		"collection": arvadosclient.Dict{
+			"manifest_text": ". acbd18db4cc2f85cedef654fccc4a4d8+3 0:3:file1.txt\n",
+		},
+	})
+}
+
+func (s *TestSuite) TestSaveCollectionProperties(c *C) {
+	tmpdir, _ := ioutil.TempDir("", "")
+	defer os.RemoveAll(tmpdir)
+	ioutil.WriteFile(tmpdir+"/file1.txt", []byte("foo"), 0600)
+
+	cw := CollectionWriter{IKeepClient: &KeepTestClient{}, Properties: map[string]interface{}{
+		"container_uuid": "zzzzz-dz642-zzzzzzzzzzzzzzz",
+		"tool_version":   "1.2.3",
+	}}
+	_, err := writeTree(&cw, tmpdir, log.New(os.Stdout, "", 0))
+	c.Assert(err, IsNil)
+	c.Check(cw.Properties, HasLen, 2)
+
+	arv := &CollectionAPITestClient{}
+	_, err = cw.SaveCollection(context.Background(), arv, "", arvadosclient.Dict{"name": "output"})
+	c.Assert(err, IsNil)
+	c.Check(arv.params[0]["collection"], DeepEquals, arvadosclient.Dict{
+		"name":          "output",
+		"manifest_text": ". acbd18db4cc2f85cedef654fccc4a4d8+3 0:3:file1.txt\n",
+		"properties": map[string]interface{}{
+			"container_uuid": "zzzzz-dz642-zzzzzzzzzzzzzzz",
+			"tool_version":   "1.2.3",
+		},
+	})
+
+	// Properties given to SaveCollection are added.
+	arv = &CollectionAPITestClient{}
+	_, err = cw.SaveCollection(context.Background(), arv, "zzzzz-4zz18-zzzzzzzzzzzzzzz", arvadosclient.Dict{
+		"properties": arvadosclient.Dict{"tool_version": "1.2.4", "run_timestamp": "2017-11-28T12:00:00Z"},
+	})
+	c.Assert(err, IsNil)
+	c.Check(arv.params[0]["collection"].(arvadosclient.Dict)["properties"], DeepEquals, map[string]interface{}{
+		"container_uuid": "zzzzz-dz642-zzzzzzzzzzzzzzz",
+		"tool_version":   "1.2.4",
+		"run_timestamp":  "2017-11-28T12:00:00Z",
+	})
+	c.Check(cw.Properties["tool_version"], Equals, "1.2.3")
+
+	_, err = cw.SaveCollection(context.Background(), arv, "", arvadosclient.Dict{"properties": "x"})
+	c.Check(err, ErrorMatches, `Cannot add Properties to collection properties of type string`)
+}
+
+func (s *TestSuite) TestSaveCollectionRetry(c *C) {
+	cw := CollectionWriter{IKeepClient: &KeepTestClient{}, MaxRetries: 2, RetryDelay: time.Millisecond}
+
+	// Server errors are retried.
+	arv := &CollectionAPITestClient{errs: []error{
+		arvadosclient.APIServerError{HttpStatusCode: 502},
+		arvadosclient.APIServerError{HttpStatusCode: 503},
+	}}
+	coll, err := cw.SaveCollection(context.Background(), arv, "", nil)
+	c.Check(err, IsNil)
+	c.Check(coll.UUID, Equals, "zzzzz-4zz18-zzzzzzzzzzzzzzz")
+	c.Check(arv.calls, HasLen, 3)
+
+	// ...up to MaxRetries times.
+	arv = &CollectionAPITestClient{errs: []error{
+		arvadosclient.APIServerError{HttpStatusCode: 500},
+		arvadosclient.APIServerError{HttpStatusCode: 500},
+		arvadosclient.APIServerError{HttpStatusCode: 500},
+	}}
+	_, err = cw.SaveCollection(context.Background(), arv, "", nil)
+	c.Check(err, ErrorMatches, "While saving collection: .*500.*")
+	c.Check(arv.calls, HasLen, 3)
+
+	// Client errors are not retried.
+	arv = &CollectionAPITestClient{errs: []error{
+		arvadosclient.APIServerError{HttpStatusCode: 422, ErrorDetails: []string{"Manifest invalid"}},
+	}}
+	_, err = cw.SaveCollection(context.Background(), arv, "", nil)
+	c.Check(err, ErrorMatches, "While saving collection: .*Manifest invalid.*422.*")
+	c.Check(arv.calls, HasLen, 1)
+}
@@ -0,0 +1,258 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// ManifestDiff lists the differences between the files in a collection
+// and a base collection.  Paths are relative to the collection root, and
+// each list is sorted.
+type ManifestDiff struct {
+	Added     []string
+	Modified  []string
+	Removed   []string
+	Unchanged []string
+
+	// Renamed maps the new path of each file that appears in the
+	// base collection with the same content under a different
+	// name to its old path.  Renamed files are not listed as
+	// added or removed.
+	Renamed map[string]string
+}
+
+// manifestFile is the content of a file in a manifest, as a list of
+// ranges of blocks.
+type manifestFile struct {
+	size  uint64
+	spans []blockSpan
+}
+
+type blockSpan struct {
+	locator string
+	offset  uint64
+	length  uint64
+}
+
+// Diff compares the files in the collection with those in DiffBase,
+// and returns the differences along with the collection's manifest text
+// (as returned by ManifestText).
+//
+// Files are compared by content.  The content hashes of uploaded files
+// are computed while they are uploaded.  Files are found to be
+// unchanged without reading anything from Keep if they are stored in
+// the same block ranges as in the base collection; otherwise the base
+// file is read back from Keep, which requires a BlockGetter Keep client.
+// With DryRun, nothing is read from Keep, and files stored in different
+// block ranges are reported as modified (or as added and removed).
+func (m *CollectionWriter) Diff() (*ManifestDiff, string, error) {
+	mt, err := m.manifestText(false)
+	if err != nil {
+		return nil, "", err
+	}
+	base, err := manifestFiles(m.DiffBase)
+	if err != nil {
+		return nil, "", fmt.Errorf("While parsing base manifest: %v", err)
+	}
+	current, err := manifestFiles(mt)
+	if err != nil {
+		return nil, "", err
+	}
+
+	m.mtx.Lock()
+	hashes := make(map[string]string, len(m.hashes))
+	for path, hash := range m.hashes {
+		hashes[path] = hash
+	}
+	m.mtx.Unlock()
+
+	// hashOf returns the hash of the given file in the base or
+	// current collection.
+	baseHashes := make(map[string]string)
+	hashOf := func(path string, f *manifestFile, cache map[string]string) (string, error) {
+		if hash, ok := cache[path]; ok {
+			return hash, nil
+		}
+		hash, err := m.readHash(f)
+		if err != nil {
+			return "", fmt.Errorf("While reading %q: %v", path, err)
+		}
+		cache[path] = hash
+		return hash, nil
+	}
+	sameContent := func(path string, f *manifestFile, basePath string, bf *manifestFile) (bool, error) {
+		if f.size != bf.size {
+			return false, nil
+		}
+		if sameSpans(f.spans, bf.spans) {
+			return true, nil
+		} else if m.DryRun {
+			return false, nil
+		}
+		hash, err := hashOf(path, f, hashes)
+		if err != nil {
+			return false, err
+		}
+		baseHash, err := hashOf(basePath, bf, baseHashes)
+		if err != nil {
+			return false, err
+		}
+		return hash == baseHash, nil
+	}
+
+	diff := &ManifestDiff{Renamed: make(map[string]string)}
+	for _, path := range sortedPaths(current) {
+		bf, ok := base[path]
+		if !ok {
+			diff.Added = append(diff.Added, path)
+			continue
+		}
+		same, err := sameContent(path, current[path], path, bf)
+		if err != nil {
+			return nil, "", err
+		}
+		if same {
+			diff.Unchanged = append(diff.Unchanged, path)
+		} else {
+			diff.Modified = append(diff.Modified, path)
+		}
+	}
+	for _, path := range sortedPaths(base) {
+		if _, ok := current[path]; !ok {
+			diff.Removed = append(diff.Removed, path)
+		}
+	}
+
+	// Look for added files with the same content as removed files.
+	var added []string
+	for _, path := range diff.Added {
+		renamed := false
+		for i, oldPath := range diff.Removed {
+			same, err := sameContent(path, current[path], oldPath, base[oldPath])
+			if err != nil {
+				return nil, "", err
+			}
+			if same {
+				diff.Renamed[path] = oldPath
+				diff.Removed = append(diff.Removed[:i], diff.Removed[i+1:]...)
+				renamed = true
+				break
+			}
+		}
+		if !renamed {
+			added = append(added, path)
+		}
+	}
+	diff.Added = added
+	return diff, mt, nil
+}
+
+// readHash reads the content of f from Keep and returns its hash.
+func (m *CollectionWriter) readHash(f *manifestFile) (string, error) {
+	getter, ok := unwrapClient(m.keepClient()).(BlockGetter)
+	if !ok {
+		return "", fmt.Errorf("Keep client does not support reading blocks")
+	}
+	h := m.newHash()
+	for _, span := range f.spans {
+		rdr, _, _, err := getter.Get(span.locator)
+		if err != nil {
+			return "", err
+		}
+		_, err = io.CopyN(ioutil.Discard, rdr, int64(span.offset))
+		if err == nil {
+			_, err = io.CopyN(h, rdr, int64(span.length))
+		}
+		rdr.Close()
+		if err != nil {
+			return "", err
+		}
+	}
+	return fmt.Sprintf("%x", h.Sum(nil)), nil
+}
+
+// manifestFiles returns the files in the given manifest text, by path.
+func manifestFiles(text string) (map[string]*manifestFile, error) {
+	streams, err := ParseManifest(text)
+	if err != nil {
+		return nil, err
+	}
+	files := make(map[string]*manifestFile)
+	for _, st := range streams {
+		// Position of each block in the stream
+		var starts, sizes []uint64
+		var pos uint64
+		for _, locator := range st.Blocks {
+			size, err := strconv.ParseUint(strings.Split(locator, "+")[1], 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("Invalid locator %q", locator)
+			}
+			starts = append(starts, pos)
+			sizes = append(sizes, size)
+			pos += size
+		}
+		for _, seg := range st.FileStreamSegments {
+			path := streamPath(st.StreamName, seg.Name)
+			f := files[path]
+			if f == nil {
+				f = &manifestFile{}
+				files[path] = f
+			}
+			f.size += seg.SegLen
+			for i, locator := range st.Blocks {
+				start := maxUint64(seg.SegPos, starts[i])
+				end := minUint64(seg.SegPos+seg.SegLen, starts[i]+sizes[i])
+				if start < end {
+					f.spans = append(f.spans, blockSpan{locator, start - starts[i], end - start})
+				}
+			}
+		}
+	}
+	return files, nil
+}
+
+// sameSpans reports whether a and b refer to the same block ranges,
+// ignoring locator hints such as permission signatures.
+func sameSpans(a, b []blockSpan) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i].offset != b[i].offset || a[i].length != b[i].length ||
+			strings.Split(a[i].locator, "+")[0] != strings.Split(b[i].locator, "+")[0] {
+			return false
+		}
+	}
+	return true
+}
+
+func sortedPaths(files map[string]*manifestFile) []string {
+	var paths []string
+	for path := range files {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	return paths
+}
+
+func maxUint64(a, b uint64) uint64 {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+func minUint64(a, b uint64) uint64 {
+	if a < b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,75 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package main
+
+import (
+	"io/ioutil"
+	"log"
+	"os"
+
+	. "gopkg.in/check.v1"
+)
+
+func (s *TestSuite) TestUploadDiff(c *C) {
+	tmpdir, _ := ioutil.TempDir("", "")
+	defer func() {
+		os.RemoveAll(tmpdir)
+	}()
+
+	os.Mkdir(tmpdir+"/subdir", 0700)
+	ioutil.WriteFile(tmpdir+"/"+"file1.txt", []byte("foo"), 0600)
+	ioutil.WriteFile(tmpdir+"/"+"file2.txt", []byte("bar"), 0600)
+	ioutil.WriteFile(tmpdir+"/subdir/file3.txt", []byte("baz"), 0600)
+
+	kc := &KeepStoreTestClient{}
+	cw := CollectionWriter{IKeepClient: kc}
+	base, err := writeTree(&cw, tmpdir, log.New(os.Stdout, "", 0))
+	c.Assert(err, IsNil)
+
+	ioutil.WriteFile(tmpdir+"/"+"file2.txt", []byte("BAR"), 0600)
+
+	cw = CollectionWriter{IKeepClient: kc, DiffBase: base}
+	expect, err := writeTree(&cw, tmpdir, log.New(os.Stdout, "", 0))
+	c.Assert(err, IsNil)
+	diff, mt, err := cw.Diff()
+	c.Check(err, IsNil)
+	c.Check(mt, Equals, expect)
+	c.Check(diff.Modified, DeepEquals, []string{"file2.txt"})
+	c.Check(diff.Unchanged, DeepEquals, []string{"file1.txt", "subdir/file3.txt"})
+	c.Check(diff.Added, HasLen, 0)
+	c.Check(diff.Removed, HasLen, 0)
+	c.Check(diff.Renamed, HasLen, 0)
+}
+
+func (s *TestSuite) TestUploadDiffAddRemoveRename(c *C) {
+	tmpdir, _ := ioutil.TempDir("", "")
+	defer func() {
+		os.RemoveAll(tmpdir)
+	}()
+
+	ioutil.WriteFile(tmpdir+"/"+"file1.txt", []byte("foo"), 0600)
+	ioutil.WriteFile(tmpdir+"/"+"file2.txt", []byte("bar"), 0600)
+	ioutil.WriteFile(tmpdir+"/"+"file3.txt", []byte("baz"), 0600)
+
+	kc := &KeepStoreTestClient{}
+	cw := CollectionWriter{IKeepClient: kc}
+	base, err := writeTree(&cw, tmpdir, log.New(os.Stdout, "", 0))
+	c.Assert(err, IsNil)
+
+	os.Rename(tmpdir+"/file2.txt", tmpdir+"/moved.txt")
+	os.Remove(tmpdir + "/file3.txt")
+	ioutil.WriteFile(tmpdir+"/"+"file4.txt", []byte("new"), 0600)
+
+	cw = CollectionWriter{IKeepClient: kc, DiffBase: base}
+	_, err = writeTree(&cw, tmpdir, log.New(os.Stdout, "", 0))
+	c.Assert(err, IsNil)
+	diff, _, err := cw.Diff()
+	c.Check(err, IsNil)
+	c.Check(diff.Unchanged, DeepEquals, []string{"file1.txt"})
+	c.Check(diff.Added, DeepEquals, []string{"file4.txt"})
+	c.Check(diff.Removed, DeepEquals, []string{"file3.txt"})
+	c.Check(diff.Renamed, DeepEquals, map[string]string{"moved.txt": "file2.txt"})
+	c.Check(diff.Modified, HasLen, 0)
+}
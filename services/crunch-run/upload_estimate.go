@@ -0,0 +1,105 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"log"
+	"os"
+	"syscall"
+)
+
+// EstimateUpload returns the number of files that uploading the tree
+// under root (see BeginUpload and WalkUpload.Walk) would store, their
+// total size, and an estimate of the number of blocks they would be
+// stored in, e.g., to size buffers or report progress before starting
+// the upload.  The tree is walked with the same Exclude,
+// KeepIgnoreFiles, ModifiedSince, SymlinkMode, and SpecialFilePolicy
+// as the upload, and files that cannot be opened are left out (or
+// with StrictReadability, returned as an error) just like the upload
+// does, but their content is not read.
+//
+// The block count assumes that each stream's files are packed into
+// full blocks, which is what happens unless NoSplitSmallFiles,
+// ContentDefinedChunking, or sparse files change the packing.  The
+// WalkUpload options (FileSystem, FileFilter) are not applied.
+func (cw *CollectionWriter) EstimateUpload(root string) (files int, size int64, blocks int, err error) {
+	wu := &WalkUpload{
+		stripPrefix: root,
+		status:      NewLogLogger(log.New(ioutil.Discard, "", 0)),
+		ctx:         context.Background(),
+		cw:          cw,
+		exclude:     parseExcludePatterns(cw.Exclude),
+		estimating:  true,
+	}
+	return wu.estimate()
+}
+
+// estimate walks the upload's tree for EstimateUpload.
+func (m *WalkUpload) estimate() (files int, size int64, blocks int, err error) {
+	streamSizes := make(map[string]int64)
+	linkDirs := make(map[fileID]string)
+	err = m.walk(m.stripPrefix, m.stripPrefix, m.rootScopes(), make(map[fileID]bool), func(path, sourcePath string) error {
+		dir, fn := splitManifestPath(m.relPath(path))
+		dir, fn, err := m.sanitizePath(m.targetDir(dir), fn)
+		if err != nil {
+			return err
+		}
+
+		info, err := m.fs().Lstat(sourcePath)
+		if err != nil {
+			return err
+		}
+		if info.Mode()&os.ModeSymlink != 0 {
+			if m.cw.SymlinkMode != SymlinkFollow {
+				return nil
+			}
+			sourcePath, err = m.followSymlink(sourcePath)
+			if err != nil {
+				return err
+			}
+			info, err = m.fs().Stat(sourcePath)
+			if err != nil {
+				return err
+			}
+		}
+		if !info.Mode().IsRegular() {
+			if m.cw.SpecialFilePolicy == SpecialFileError {
+				return m.specialFile(dir, fn, info)
+			}
+			return nil
+		}
+		if id, ok := getFileID(info); ok && info.Sys().(*syscall.Stat_t).Nlink > 1 {
+			// Another link to a file in the same stream
+			// refers to the content already stored.
+			if linkDir, seen := linkDirs[id]; seen && linkDir == dir {
+				files++
+				return nil
+			} else if !seen {
+				linkDirs[id] = dir
+			}
+		}
+		f, err := m.fs().Open(sourcePath)
+		if os.IsPermission(err) {
+			return m.unreadable(dir, fn, err)
+		} else if err != nil {
+			return err
+		}
+		f.Close()
+		files++
+		size += info.Size()
+		streamSizes[dir] += info.Size()
+		return nil
+	})
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	blockSize := int64(m.cw.blockSize())
+	for _, n := range streamSizes {
+		blocks += int((n + blockSize - 1) / blockSize)
+	}
+	return files, size, blocks, nil
+}
@@ -0,0 +1,58 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"log"
+	"os"
+	"syscall"
+
+	. "gopkg.in/check.v1"
+)
+
+func (s *TestSuite) TestEstimateUpload(c *C) {
+	tmpdir, _ := ioutil.TempDir("", "")
+	defer func() {
+		os.RemoveAll(tmpdir)
+	}()
+	os.MkdirAll(tmpdir+"/subdir/empty", 0700)
+	ioutil.WriteFile(tmpdir+"/file1.txt", []byte("foo"), 0600)
+	ioutil.WriteFile(tmpdir+"/subdir/file2.txt", make([]byte, 2500), 0600)
+	ioutil.WriteFile(tmpdir+"/subdir/file3.txt", []byte("bar"), 0600)
+	ioutil.WriteFile(tmpdir+"/build.log", []byte("excluded"), 0600)
+	c.Assert(os.Symlink("file1.txt", tmpdir+"/link1.txt"), IsNil)
+	c.Assert(syscall.Mkfifo(tmpdir+"/pipe", 0600), IsNil)
+
+	for _, trial := range []struct {
+		symlinks SymlinkMode
+		files    int
+		size     int64
+	}{
+		{SymlinkFollow, 4, 2509},
+		{SymlinkSkip, 3, 2506},
+	} {
+		cw := CollectionWriter{IKeepClient: &KeepTestClient{}, Exclude: []string{"*.log"}, SymlinkMode: trial.symlinks, BlockSize: 1024, PreserveEmptyDirs: true}
+		files, size, blocks, err := cw.EstimateUpload(tmpdir)
+		c.Assert(err, IsNil)
+		c.Check(files, Equals, trial.files)
+		c.Check(size, Equals, trial.size)
+
+		wu := cw.BeginUpload(context.Background(), tmpdir, log.New(os.Stdout, "", 0))
+		c.Assert(wu.Walk(), IsNil)
+		_, summary, err := cw.FinishUpload(wu)
+		c.Assert(err, IsNil)
+		c.Check(files, Equals, summary.Files)
+		c.Check(size, Equals, summary.TotalBytes)
+		c.Check(blocks, Equals, summary.Blocks)
+	}
+
+	// Errors the upload would fail with are found without
+	// uploading.
+	cw := CollectionWriter{IKeepClient: &KeepTestClient{}, SpecialFilePolicy: SpecialFileError}
+	_, _, _, err := cw.EstimateUpload(tmpdir)
+	c.Check(err, ErrorMatches, `.*pipe.*special file.*`)
+}
@@ -0,0 +1,112 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package main
+
+import (
+	"sync"
+)
+
+// UploadEventType is the kind of an UploadEvent.
+type UploadEventType int
+
+const (
+	// FileStarted is sent before a file is read.  Size is the
+	// file size reported by stat (-1 for UploadReader).
+	FileStarted UploadEventType = iota
+
+	// BlockFlushed is sent when a block has been stored (or found
+	// to be stored already).  Path is the first file with data in
+	// the block, Locator is the block's locator, and Size is the
+	// size of the block.
+	BlockFlushed
+
+	// FileCompleted is sent when a file has been read and added
+	// to its stream (its last block may not be stored yet).  Size
+	// is the number of bytes stored.
+	FileCompleted
+
+	// UploadFinished is sent by EndUpload (or Abort) when all of
+	// the upload's blocks are stored or discarded.  Err is the
+	// result of EndUpload.
+	UploadFinished
+)
+
+var uploadEventNames = map[UploadEventType]string{
+	FileStarted:    "FileStarted",
+	BlockFlushed:   "BlockFlushed",
+	FileCompleted:  "FileCompleted",
+	UploadFinished: "UploadFinished",
+}
+
+func (t UploadEventType) String() string {
+	return uploadEventNames[t]
+}
+
+// UploadEvent is sent to CollectionWriter.Events as the upload
+// progresses.
+type UploadEvent struct {
+	Type    UploadEventType
+	Path    string // file path relative to the collection root, e.g., "subdir/file.txt"
+	Size    int64
+	Locator string
+	Err     error
+}
+
+// eventQueue puts the events sent to CollectionWriter.Events in the
+// order of their sequence numbers, which are assigned (by reserveEvent)
+// as the upload proceeds, rather than the order the work finishes in.
+type eventQueue struct {
+	mtx     sync.Mutex
+	next    int // sequence number of the next event to send
+	count   int // sequence numbers reserved so far
+	pending map[int]*UploadEvent
+}
+
+// reserveEvent returns the sequence number of an event to be sent
+// later by deliverEvent, or -1 if Events is not set.
+func (m *CollectionWriter) reserveEvent() int {
+	if m.Events == nil {
+		return -1
+	}
+	q := &m.events
+	q.mtx.Lock()
+	defer q.mtx.Unlock()
+	q.count++
+	return q.count - 1
+}
+
+// deliverEvent sends ev, with sequence number seq, to Events after all
+// of the events before it.  If ev is nil, no event is sent for seq
+// (e.g., because the block was not stored), but the events after it are
+// no longer held up.
+func (m *CollectionWriter) deliverEvent(seq int, ev *UploadEvent) {
+	if seq < 0 {
+		return
+	}
+	q := &m.events
+	q.mtx.Lock()
+	defer q.mtx.Unlock()
+	if q.pending == nil {
+		q.pending = make(map[int]*UploadEvent)
+	}
+	q.pending[seq] = ev
+	for {
+		ev, ok := q.pending[q.next]
+		if !ok {
+			return
+		}
+		delete(q.pending, q.next)
+		q.next++
+		if ev != nil {
+			m.Events <- *ev
+		}
+	}
+}
+
+// sendEvent sends ev to Events, if set, after the events reserved
+// before it.
+func (m *CollectionWriter) sendEvent(ev UploadEvent) {
+	m.deliverEvent(m.reserveEvent(), &ev)
+}
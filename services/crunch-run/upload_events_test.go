@@ -0,0 +1,111 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math/rand"
+	"os"
+	"time"
+
+	. "gopkg.in/check.v1"
+)
+
+func (s *TestSuite) TestUploadEvents(c *C) {
+	tmpdir, _ := ioutil.TempDir("", "")
+	defer func() {
+		os.RemoveAll(tmpdir)
+	}()
+
+	ioutil.WriteFile(tmpdir+"/"+"file1.txt", []byte("foo"), 0600)
+	os.Mkdir(tmpdir+"/subdir", 0700)
+	ioutil.WriteFile(tmpdir+"/subdir/file2.txt", []byte("bar"), 0600)
+
+	events := make(chan UploadEvent, 100)
+	cw := CollectionWriter{IKeepClient: &KeepTestClient{}, Events: events}
+	_, err := writeTree(&cw, tmpdir, log.New(os.Stdout, "", 0))
+	c.Check(err, IsNil)
+	close(events)
+
+	var got []UploadEvent
+	for ev := range events {
+		got = append(got, ev)
+	}
+	c.Check(got, DeepEquals, []UploadEvent{
+		{Type: FileStarted, Path: "file1.txt", Size: 3},
+		{Type: FileCompleted, Path: "file1.txt", Size: 3},
+		{Type: FileStarted, Path: "subdir/file2.txt", Size: 3},
+		{Type: FileCompleted, Path: "subdir/file2.txt", Size: 3},
+		{Type: BlockFlushed, Path: "file1.txt", Size: 3, Locator: "acbd18db4cc2f85cedef654fccc4a4d8+3"},
+		{Type: BlockFlushed, Path: "subdir/file2.txt", Size: 3, Locator: "37b51d194a7513e45b56f6524f2d51f2+3"},
+		{Type: UploadFinished},
+	})
+	c.Check(FileStarted.String(), Equals, "FileStarted")
+}
+
+// KeepRandomDelayTestClient takes a random time to write each block,
+// so concurrent writes finish in a different order each time.
+type KeepRandomDelayTestClient struct {
+	KeepTestClient
+}
+
+func (client *KeepRandomDelayTestClient) PutHB(hash string, buf []byte) (string, int, error) {
+	time.Sleep(time.Duration(rand.Intn(1000)) * time.Microsecond)
+	return fmt.Sprintf("%x+%d", md5.Sum(buf), len(buf)), 1, nil
+}
+
+func (s *TestSuite) TestUploadEventsDeterministic(c *C) {
+	tmpdir, _ := ioutil.TempDir("", "")
+	defer func() {
+		os.RemoveAll(tmpdir)
+	}()
+
+	for _, dir := range []string{"a", "b", "b/c"} {
+		os.Mkdir(tmpdir+"/"+dir, 0700)
+		for i := 0; i < 3; i++ {
+			ioutil.WriteFile(fmt.Sprintf("%s/%s/file%d.txt", tmpdir, dir, i), bytes.Repeat([]byte(dir), 100+i), 0600)
+		}
+	}
+
+	var firstManifest, firstRaw string
+	var firstEvents []UploadEvent
+	for i := 0; i < 20; i++ {
+		events := make(chan UploadEvent, 1000)
+		cw := CollectionWriter{IKeepClient: &KeepRandomDelayTestClient{}, BlockSize: 64, MaxWriters: 8, Events: events}
+		wus := make([]*WalkUpload, 2)
+		for j, root := range []string{"a", "b"} {
+			wus[j] = cw.BeginUpload(context.Background(), tmpdir+"/"+root, log.New(ioutil.Discard, "", 0))
+			wus[j].TargetPrefix = "./" + root
+			c.Assert(wus[j].Walk(), IsNil)
+		}
+		// The uploads end in a different order than they
+		// were started in.
+		c.Assert(cw.EndUpload(wus[1]), IsNil)
+		c.Assert(cw.EndUpload(wus[0]), IsNil)
+		mt, err := cw.ManifestText()
+		c.Assert(err, IsNil)
+		raw, err := cw.RawManifestText()
+		c.Assert(err, IsNil)
+		close(events)
+		var got []UploadEvent
+		for ev := range events {
+			got = append(got, ev)
+		}
+		if i == 0 {
+			firstManifest, firstRaw, firstEvents = mt, raw, got
+			c.Check(raw, Matches, `(?s)\./a .*\n\./b/c .*\n\./b .*\n`)
+			c.Check(len(got) > 24, Equals, true)
+			continue
+		}
+		c.Check(mt, Equals, firstManifest)
+		c.Check(raw, Equals, firstRaw)
+		c.Check(got, DeepEquals, firstEvents)
+	}
+}
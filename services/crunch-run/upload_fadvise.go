@@ -0,0 +1,57 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package main
+
+import (
+	"io"
+)
+
+// cacheDropInterval is how much of a file is read between requests to
+// drop it from the page cache, see AvoidPageCache.
+const cacheDropInterval = 8 << 20
+
+// cacheDropReader reads from an open file, asking the kernel to drop
+// the part of the file read so far from the page cache after every
+// cacheDropInterval bytes.
+type cacheDropReader struct {
+	io.Reader
+	file interface {
+		io.Seeker
+		Fd() uintptr
+	}
+	unread int64 // bytes read since the last drop
+}
+
+// newCacheDropReader returns a cacheDropReader for r, which reads from
+// file, or nil if file is not an open file.
+func newCacheDropReader(r, file io.Reader) *cacheDropReader {
+	f, ok := file.(interface {
+		io.Seeker
+		Fd() uintptr
+	})
+	if !ok {
+		return nil
+	}
+	adviseSequential(f.Fd())
+	return &cacheDropReader{Reader: r, file: f}
+}
+
+func (r *cacheDropReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	r.unread += int64(n)
+	if r.unread >= cacheDropInterval {
+		r.drop()
+	}
+	return n, err
+}
+
+// drop asks the kernel to drop the file from the page cache up to the
+// current file offset.
+func (r *cacheDropReader) drop() {
+	r.unread = 0
+	if pos, err := r.file.Seek(0, io.SeekCurrent); err == nil {
+		dropFileCache(r.file.Fd(), pos)
+	}
+}
@@ -0,0 +1,21 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package main
+
+import (
+	"golang.org/x/sys/unix"
+)
+
+// adviseSequential tells the kernel that the file open as fd will be
+// read sequentially.  Errors are ignored: this is only a hint.
+func adviseSequential(fd uintptr) {
+	unix.Fadvise(int(fd), 0, 0, unix.FADV_SEQUENTIAL)
+}
+
+// dropFileCache asks the kernel to drop the first length bytes of the
+// file open as fd from the page cache.  Errors are ignored.
+func dropFileCache(fd uintptr, length int64) {
+	unix.Fadvise(int(fd), 0, length, unix.FADV_DONTNEED)
+}
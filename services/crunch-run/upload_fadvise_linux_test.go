@@ -0,0 +1,37 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"log"
+	"os"
+
+	. "gopkg.in/check.v1"
+)
+
+func (s *TestSuite) TestUploadAvoidPageCache(c *C) {
+	tmpdir, _ := ioutil.TempDir("", "")
+	defer func() {
+		os.RemoveAll(tmpdir)
+	}()
+
+	// Big enough to drop the cache more than once while reading.
+	data := bytes.Repeat([]byte("0123456789abcdef"), (cacheDropInterval*5/2)/16)
+	os.Mkdir(tmpdir+"/subdir", 0700)
+	ioutil.WriteFile(tmpdir+"/"+"file1.txt", data, 0600)
+	ioutil.WriteFile(tmpdir+"/subdir/file2.txt", []byte("foo"), 0600)
+
+	cw := CollectionWriter{IKeepClient: &KeepTestClient{}, BlockSize: 1 << 20}
+	expect, err := writeTree(&cw, tmpdir, log.New(os.Stdout, "", 0))
+	c.Assert(err, IsNil)
+
+	cw = CollectionWriter{IKeepClient: &KeepTestClient{}, BlockSize: 1 << 20, AvoidPageCache: true}
+	str, err := writeTree(&cw, tmpdir, log.New(os.Stdout, "", 0))
+	c.Check(err, IsNil)
+	c.Check(str, Equals, expect)
+	c.Check(cw.BytesWritten(), Equals, int64(len(data)+3))
+}
@@ -0,0 +1,15 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+// +build !linux
+
+package main
+
+// adviseSequential does nothing: page cache advice is only supported
+// on Linux.
+func adviseSequential(fd uintptr) {}
+
+// dropFileCache does nothing: page cache advice is only supported on
+// Linux.
+func dropFileCache(fd uintptr, length int64) {}
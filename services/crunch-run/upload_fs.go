@@ -0,0 +1,83 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package main
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// FileSystem is a file system that a WalkUpload can read from instead
+// of the local file system, e.g., an archive or an in-memory tree.  Its
+// methods behave like the os and path/filepath functions with the same
+// names.  Paths are slash-separated.
+type FileSystem interface {
+	Open(name string) (FSFile, error)
+	Lstat(name string) (os.FileInfo, error)
+	Stat(name string) (os.FileInfo, error)
+	Readlink(name string) (string, error)
+	EvalSymlinks(name string) (string, error)
+}
+
+// FSFile is an open file in a FileSystem.  *os.File implements FSFile.
+type FSFile interface {
+	io.ReadSeeker
+	io.Closer
+	Readdirnames(n int) ([]string, error)
+}
+
+// osFileSystem is the local file system.
+type osFileSystem struct{}
+
+func (osFileSystem) Open(name string) (FSFile, error) {
+	return os.Open(name)
+}
+
+func (osFileSystem) Lstat(name string) (os.FileInfo, error) {
+	return os.Lstat(name)
+}
+
+func (osFileSystem) Stat(name string) (os.FileInfo, error) {
+	return os.Stat(name)
+}
+
+func (osFileSystem) Readlink(name string) (string, error) {
+	return os.Readlink(name)
+}
+
+func (osFileSystem) EvalSymlinks(name string) (string, error) {
+	return filepath.EvalSymlinks(name)
+}
+
+func (m *WalkUpload) fs() FileSystem {
+	if m.FileSystem != nil {
+		return m.FileSystem
+	}
+	return osFileSystem{}
+}
+
+// XattrFileSystem is implemented by FileSystems that can read the
+// extended attributes of files, for PreserveXattrs.  Xattrs returns
+// the attributes of the named file (following symbolic links), or nil
+// if the file system does not support them.
+type XattrFileSystem interface {
+	Xattrs(name string) (map[string]string, error)
+}
+
+// recordXattrs adds the extended attributes of the file at sourcePath,
+// if it has any, to the metadata of the uploaded file at path.
+func (m *WalkUpload) recordXattrs(path, sourcePath string) error {
+	xfs, ok := m.fs().(XattrFileSystem)
+	if !ok {
+		return nil
+	}
+	attrs, err := xfs.Xattrs(sourcePath)
+	if err != nil || len(attrs) == 0 {
+		return err
+	}
+	m.fileMetadata(path).Xattrs = attrs
+	return nil
+}
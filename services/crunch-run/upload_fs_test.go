@@ -0,0 +1,127 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	. "gopkg.in/check.v1"
+)
+
+// memFS is a FileSystem holding regular files in memory, keyed by
+// slash-separated path.  Directories are implied by the file paths.
+type memFS map[string]string
+
+type memFileInfo struct {
+	name string
+	size int64
+	dir  bool
+}
+
+func (fi memFileInfo) Name() string       { return fi.name }
+func (fi memFileInfo) Size() int64        { return fi.size }
+func (fi memFileInfo) ModTime() time.Time { return time.Time{} }
+func (fi memFileInfo) IsDir() bool        { return fi.dir }
+func (fi memFileInfo) Sys() interface{}   { return nil }
+func (fi memFileInfo) Mode() os.FileMode {
+	if fi.dir {
+		return os.ModeDir | 0755
+	}
+	return 0644
+}
+
+type memFile struct {
+	*bytes.Reader
+	names []string
+}
+
+func (f *memFile) Close() error { return nil }
+
+func (f *memFile) Readdirnames(n int) ([]string, error) {
+	return f.names, nil
+}
+
+func (fs memFS) Lstat(name string) (os.FileInfo, error) {
+	if data, ok := fs[name]; ok {
+		return memFileInfo{name: path.Base(name), size: int64(len(data))}, nil
+	}
+	for fn := range fs {
+		if strings.HasPrefix(fn, name+"/") {
+			return memFileInfo{name: path.Base(name), dir: true}, nil
+		}
+	}
+	return nil, &os.PathError{Op: "lstat", Path: name, Err: os.ErrNotExist}
+}
+
+func (fs memFS) Stat(name string) (os.FileInfo, error) {
+	return fs.Lstat(name)
+}
+
+func (fs memFS) Open(name string) (FSFile, error) {
+	if _, err := fs.Lstat(name); err != nil {
+		return nil, err
+	}
+	seen := map[string]bool{}
+	var names []string
+	for fn := range fs {
+		if !strings.HasPrefix(fn, name+"/") {
+			continue
+		}
+		child := strings.SplitN(fn[len(name)+1:], "/", 2)[0]
+		if !seen[child] {
+			seen[child] = true
+			names = append(names, child)
+		}
+	}
+	return &memFile{Reader: bytes.NewReader([]byte(fs[name])), names: names}, nil
+}
+
+func (fs memFS) Readlink(name string) (string, error) {
+	return "", &os.PathError{Op: "readlink", Path: name, Err: os.ErrInvalid}
+}
+
+func (fs memFS) EvalSymlinks(name string) (string, error) {
+	return name, nil
+}
+
+func (s *TestSuite) TestUploadFromFileSystem(c *C) {
+	files := map[string]string{
+		"file1.txt":               "foo",
+		"subdir/file2.txt":        "bar",
+		"subdir/deeper/file3.txt": "baz",
+		"subdir/empty.txt":        "",
+	}
+
+	tmpdir, _ := ioutil.TempDir("", "")
+	defer os.RemoveAll(tmpdir)
+	mfs := memFS{}
+	for fn, data := range files {
+		os.MkdirAll(path.Dir(tmpdir+"/"+fn), 0700)
+		ioutil.WriteFile(tmpdir+"/"+fn, []byte(data), 0600)
+		mfs["/mem/"+fn] = data
+	}
+
+	cw := CollectionWriter{IKeepClient: &KeepTestClient{}}
+	expect, err := writeTree(&cw, tmpdir, log.New(os.Stdout, "", 0))
+	c.Assert(err, IsNil)
+
+	for _, readers := range []int{1, 4} {
+		cw := CollectionWriter{IKeepClient: &KeepTestClient{}, MaxReaders: readers}
+		wu := cw.BeginUpload(context.Background(), "/mem", log.New(os.Stdout, "", 0))
+		wu.FileSystem = mfs
+		c.Check(wu.Walk(), IsNil)
+		c.Check(cw.EndUpload(wu), IsNil)
+		str, err := cw.ManifestText()
+		c.Check(err, IsNil)
+		c.Check(str, Equals, expect)
+	}
+}
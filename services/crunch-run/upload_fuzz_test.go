@@ -0,0 +1,31 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+//go:build go1.18
+// +build go1.18
+
+package main
+
+import (
+	"testing"
+)
+
+// FuzzManifestRoundTrip checks the manifests written for the file trees
+// of fuzzed manifests (see checkRoundTrip).  Run it with
+//
+//	go test -run=NONE -fuzz=FuzzManifestRoundTrip
+func FuzzManifestRoundTrip(f *testing.F) {
+	for _, mt := range roundTripSeeds {
+		f.Add(mt)
+	}
+	f.Fuzz(func(t *testing.T, mt string) {
+		files := seedTree(mt)
+		if files == nil {
+			return
+		}
+		if err := checkRoundTrip(files); err != nil {
+			t.Fatal(err)
+		}
+	})
+}
@@ -0,0 +1,210 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// GrowingUpload is a file that is stored while it is still being
+// written, e.g., a log file, started by WalkUpload.UploadGrowing.
+//
+// Each Sync reads the data appended to the file since the previous one
+// and adds it to the file's blocks.  Full blocks are written to Keep
+// right away; the data in the last, partially filled block stays
+// buffered until more data fills it, so blocks are never rewritten and
+// appends of a few bytes at a time still end up in full-size blocks.
+// Finish stores the rest of the file and adds it to the collection.
+type GrowingUpload struct {
+	wu      *WalkUpload
+	fw      *CollectionFileWriter
+	file    FSFile
+	dir, fn string
+
+	stop     chan struct{} // closed to stop following
+	stopped  chan struct{} // closed when the following goroutine returns
+	stopOnce sync.Once
+
+	mtx  sync.Mutex
+	done bool  // Finish was called, or the upload was aborted
+	err  error // first error reading or storing the file
+}
+
+var errGrowingFinished = errors.New("Growing upload already finished")
+
+// UploadGrowing starts storing the file at srcPath (which need not be
+// under the upload root) at destPath in the collection (relative to
+// TargetPrefix, if set), reading it as it grows.  If interval is
+// positive, the file is synced (see GrowingUpload.Sync) every interval
+// until Finish is called; otherwise the caller calls Sync when it
+// wants.  The manifest includes the file only after Finish, which
+// EndUpload calls if the caller did not.
+//
+// The file has a stream of its own (merged with the other files in the
+// same directory when the manifest is normalized), so other files can
+// be uploaded while it grows.  The upload holds the buffer of the
+// file's partially filled block until Finish, which counts against
+// MaxBufferedBlocks.  Growing files are not hashed for DiffBase,
+// RecordSHA256, or RecordMD5.
+func (m *WalkUpload) UploadGrowing(srcPath, destPath string, interval time.Duration) (*GrowingUpload, error) {
+	dest := cleanDestPath(destPath)
+	if dest == "/" {
+		return nil, fmt.Errorf("Invalid destination path %q", destPath)
+	}
+	if err := m.ctx.Err(); err != nil {
+		return nil, err
+	}
+	m.addMtx.Lock()
+	defer m.addMtx.Unlock()
+
+	dir, fn := splitManifestPath(m.relPath(m.stripPrefix + dest))
+	dir, fn, err := m.sanitizePath(m.targetDir(dir), fn)
+	if err != nil {
+		return nil, err
+	}
+	file, err := m.fs().Open(srcPath)
+	if err != nil {
+		return nil, err
+	}
+	fw, err := m.newStream(dir)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	shared := m.streamMap[dir]
+	if shared == nil {
+		shared = fw
+	}
+	fn, err = m.resolveConflict(shared, dir, fn)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	if err := m.countFile(dir, fn); err != nil {
+		file.Close()
+		return nil, err
+	}
+	fw.NewFile(fn)
+
+	g := &GrowingUpload{
+		wu:      m,
+		fw:      fw,
+		file:    file,
+		dir:     dir,
+		fn:      fn,
+		stop:    make(chan struct{}),
+		stopped: make(chan struct{}),
+	}
+	m.growing = append(m.growing, g)
+	m.status.WithField("path", streamPath(dir, fn)).Infof("Following %v/%v", dir, fn)
+	m.cw.sendEvent(UploadEvent{Type: FileStarted, Path: streamPath(dir, fn), Size: -1})
+	if interval > 0 {
+		go g.follow(interval)
+	} else {
+		close(g.stopped)
+	}
+	return g, nil
+}
+
+// follow syncs the file every interval until it is stopped, the
+// upload is cancelled, or a sync fails.
+func (g *GrowingUpload) follow(interval time.Duration) {
+	defer close(g.stopped)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-g.stop:
+			return
+		case <-g.wu.ctx.Done():
+			return
+		case <-ticker.C:
+			if _, err := g.Sync(); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// Sync reads the data appended to the file since the last Sync, and
+// returns its length.  After an error, Sync and Finish return the same
+// error without reading more.
+func (g *GrowingUpload) Sync() (int64, error) {
+	g.mtx.Lock()
+	defer g.mtx.Unlock()
+	if g.done {
+		return 0, errGrowingFinished
+	}
+	return g.sync()
+}
+
+func (g *GrowingUpload) sync() (int64, error) {
+	if g.err != nil {
+		return 0, g.err
+	}
+	n, err := g.fw.ReadFrom(g.file)
+	if err != nil {
+		phase := UploadPhaseRead
+		if _, ok := err.(*CollectionSizeError); ok || err == g.wu.ctx.Err() {
+			phase = UploadPhasePack
+		}
+		g.err = g.wu.fileError(g.dir, g.fn, phase, err)
+	}
+	return n, g.err
+}
+
+// halt stops following the file, and waits for a sync in progress.
+func (g *GrowingUpload) halt() {
+	g.stopOnce.Do(func() { close(g.stop) })
+	<-g.stopped
+}
+
+// Finish stops following the file, reads the rest of it, and adds it
+// to the collection.  Calling Finish again returns the same result.
+func (g *GrowingUpload) Finish() error {
+	g.halt()
+	g.mtx.Lock()
+	defer g.mtx.Unlock()
+	if g.done {
+		return g.err
+	}
+	g.done = true
+	g.sync()
+	g.file.Close()
+	if g.err != nil {
+		return g.err
+	}
+	g.fw.Close()
+	path := streamPath(g.dir, g.fn)
+	g.wu.status.WithField("path", path).WithField("size", g.fw.length).Infof("Uploaded %v/%v (%v bytes)", g.dir, g.fn, g.fw.length)
+	g.wu.cw.sendEvent(UploadEvent{Type: FileCompleted, Path: path, Size: int64(g.fw.length)})
+	return nil
+}
+
+// end finishes the upload of the file for EndUpload, and returns the
+// error from Finish unless the caller has already called it.
+func (g *GrowingUpload) end() error {
+	g.mtx.Lock()
+	done := g.done
+	g.mtx.Unlock()
+	if done {
+		return nil
+	}
+	return g.Finish()
+}
+
+// abort stops following the file without adding it to the collection.
+func (g *GrowingUpload) abort() {
+	g.halt()
+	g.mtx.Lock()
+	defer g.mtx.Unlock()
+	if !g.done {
+		g.done = true
+		g.file.Close()
+	}
+}
@@ -0,0 +1,101 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	. "gopkg.in/check.v1"
+)
+
+func (s *TestSuite) TestUploadGrowing(c *C) {
+	tmpdir, _ := ioutil.TempDir("", "")
+	defer func() {
+		os.RemoveAll(tmpdir)
+	}()
+	f, err := os.Create(tmpdir + "/stdout.txt")
+	c.Assert(err, IsNil)
+	defer f.Close()
+
+	kc := &KeepCountTestClient{}
+	cw := CollectionWriter{IKeepClient: kc, BlockSize: 8}
+	wu := cw.BeginUpload(context.Background(), tmpdir, log.New(os.Stdout, "", 0))
+	_, err = wu.UploadGrowing(tmpdir+"/missing.txt", "logs/stdout.txt", 0)
+	c.Check(os.IsNotExist(err), Equals, true)
+	g, err := wu.UploadGrowing(tmpdir+"/stdout.txt", "logs/stdout.txt", 0)
+	c.Assert(err, IsNil)
+
+	f.WriteString("0123")
+	n, err := g.Sync()
+	c.Check(err, IsNil)
+	c.Check(n, Equals, int64(4))
+	n, err = g.Sync()
+	c.Check(err, IsNil)
+	c.Check(n, Equals, int64(0))
+
+	// The partial block is filled up instead of being rewritten.
+	f.WriteString("456789ab")
+	n, err = g.Sync()
+	c.Check(err, IsNil)
+	c.Check(n, Equals, int64(8))
+
+	// Another file in the same directory, stored meanwhile.
+	c.Assert(wu.UploadReader("./logs", "stderr.txt", strings.NewReader("foo")), IsNil)
+
+	f.WriteString("cd")
+	c.Check(g.Finish(), IsNil)
+	c.Check(g.Finish(), IsNil)
+	_, err = g.Sync()
+	c.Check(err, NotNil)
+	c.Assert(cw.EndUpload(wu), IsNil)
+
+	mt, err := cw.ManifestText()
+	c.Check(err, IsNil)
+	c.Check(mt, Equals, "./logs acbd18db4cc2f85cedef654fccc4a4d8+3 2e9ec317e197819358fbc43afca7d837+8 53605c53aab092000992bdd4a1a9d526+6 0:3:stderr.txt 3:14:stdout.txt\n")
+	c.Check(ValidateManifest(mt), IsNil)
+	c.Check(kc.puts, Equals, 3)
+}
+
+func (s *TestSuite) TestUploadGrowingFollow(c *C) {
+	tmpdir, _ := ioutil.TempDir("", "")
+	defer func() {
+		os.RemoveAll(tmpdir)
+	}()
+	f, err := os.Create(tmpdir + "/stdout.txt")
+	c.Assert(err, IsNil)
+	defer f.Close()
+
+	cw := CollectionWriter{IKeepClient: &KeepTestClient{}, BlockSize: 8}
+	wu := cw.BeginUpload(context.Background(), tmpdir, log.New(os.Stdout, "", 0))
+	_, err = wu.UploadGrowing(tmpdir+"/stdout.txt", "stdout.txt", time.Millisecond)
+	c.Assert(err, IsNil)
+	for _, s := range []string{"0123", "4567", "89ab", "cd"} {
+		f.WriteString(s)
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	// EndUpload finishes the file.
+	c.Assert(cw.EndUpload(wu), IsNil)
+	mt, err := cw.ManifestText()
+	c.Check(err, IsNil)
+	c.Check(mt, Equals, ". 2e9ec317e197819358fbc43afca7d837+8 53605c53aab092000992bdd4a1a9d526+6 0:14:stdout.txt\n")
+
+	// Files that are not finished are left out of an aborted upload.
+	cw = CollectionWriter{IKeepClient: &KeepTestClient{}}
+	wu = cw.BeginUpload(context.Background(), tmpdir, log.New(os.Stdout, "", 0))
+	_, err = wu.UploadGrowing(tmpdir+"/stdout.txt", "stdout.txt", time.Millisecond)
+	c.Assert(err, IsNil)
+	wu.Abort()
+	mt, err = cw.ManifestText()
+	c.Check(err, IsNil)
+	c.Check(mt, Equals, "")
+	_, err = wu.UploadGrowing(tmpdir+"/stdout.txt", "stdout.txt", 0)
+	c.Check(err, Equals, context.Canceled)
+}
@@ -0,0 +1,135 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path"
+	"strings"
+)
+
+// keepIgnoreFile is the name of the files read with
+// CollectionWriter.KeepIgnoreFiles.
+const keepIgnoreFile = ".keepignore"
+
+// excludePattern is a gitignore-style pattern.
+type excludePattern struct {
+	pattern string
+	// Re-include paths matched by earlier patterns ("!pattern").
+	negate bool
+	// Match only directories ("pattern/").
+	dirOnly bool
+	// Match the whole relative path rather than the base name
+	// (the pattern contains a slash).
+	anchored bool
+}
+
+// parseExcludePatterns parses gitignore-style patterns.  Blank lines
+// and lines starting with "#" are ignored.
+func parseExcludePatterns(lines []string) (patterns []excludePattern) {
+	for _, line := range lines {
+		line = strings.TrimRight(line, " \t\r")
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		var p excludePattern
+		if strings.HasPrefix(line, "!") {
+			p.negate = true
+			line = line[1:]
+		}
+		if strings.HasSuffix(line, "/") {
+			p.dirOnly = true
+			line = strings.TrimRight(line, "/")
+		}
+		if strings.Contains(line, "/") {
+			p.anchored = true
+			line = strings.TrimPrefix(line, "/")
+		}
+		p.pattern = line
+		patterns = append(patterns, p)
+	}
+	return
+}
+
+// excluded reports whether relPath (slash-separated, relative to the
+// directory the patterns apply to) is excluded.  As with gitignore, the
+// last matching pattern wins.
+func excluded(patterns []excludePattern, relPath string, isDir bool) bool {
+	excl, _ := matchExclude(patterns, relPath, isDir)
+	return excl
+}
+
+// matchExclude is like excluded, but also reports whether any pattern
+// matched at all.
+func matchExclude(patterns []excludePattern, relPath string, isDir bool) (excl, matched bool) {
+	for _, p := range patterns {
+		if p.dirOnly && !isDir {
+			continue
+		}
+		name := relPath
+		if !p.anchored {
+			name = path.Base(relPath)
+		}
+		if ok, _ := path.Match(p.pattern, name); ok {
+			excl, matched = !p.negate, true
+		}
+	}
+	return
+}
+
+// ignoreScope holds exclude patterns that apply to the tree under dir
+// (relative to the upload root, "" for the root itself): the Exclude
+// patterns of the CollectionWriter, or the patterns of a .keepignore
+// file in dir.
+type ignoreScope struct {
+	dir      string
+	patterns []excludePattern
+}
+
+// excludedInScopes reports whether relPath (relative to the upload
+// root) is excluded by the patterns of scopes, which are ordered from
+// the upload root down.  As with nested .gitignore files, a match in a
+// deeper scope overrides the ones above it.
+func excludedInScopes(scopes []ignoreScope, relPath string, isDir bool) bool {
+	excl := false
+	for _, scope := range scopes {
+		rel := relPath
+		if scope.dir != "" {
+			rel = strings.TrimPrefix(relPath, scope.dir+"/")
+		}
+		if e, matched := matchExclude(scope.patterns, rel, isDir); matched {
+			excl = e
+		}
+	}
+	return excl
+}
+
+// readKeepIgnore returns scopes with the patterns of the .keepignore
+// file in the directory at sourcePath (the directory dir, relative to
+// the upload root) appended, if names (the entries of the directory)
+// include one.
+func (m *WalkUpload) readKeepIgnore(scopes []ignoreScope, dir, sourcePath string, names []string) ([]ignoreScope, error) {
+	found := false
+	for _, name := range names {
+		found = found || name == keepIgnoreFile
+	}
+	if !found {
+		return scopes, nil
+	}
+	f, err := m.fs().Open(sourcePath + "/" + keepIgnoreFile)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	buf, err := ioutil.ReadAll(f)
+	if err != nil {
+		return nil, fmt.Errorf("Reading %s: %v", sourcePath+"/"+keepIgnoreFile, err)
+	}
+	scope := ignoreScope{dir: dir, patterns: parseExcludePatterns(strings.Split(string(buf), "\n"))}
+	// Copy, so the scopes of sibling directories do not share
+	// an array.
+	return append(scopes[:len(scopes):len(scopes)], scope), nil
+}
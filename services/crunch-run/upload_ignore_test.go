@@ -0,0 +1,95 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package main
+
+import (
+	"io/ioutil"
+	"log"
+	"os"
+
+	. "gopkg.in/check.v1"
+)
+
+func (s *TestSuite) TestExcludePatterns(c *C) {
+	patterns := parseExcludePatterns([]string{"# comment", "*.tmp", "!keep.tmp", "scratch/", "sub/core"})
+	for _, trial := range []struct {
+		path  string
+		isDir bool
+		excl  bool
+	}{
+		{"a.tmp", false, true},
+		{"sub/a.tmp", false, true},
+		{"keep.tmp", false, false},
+		{"a.txt", false, false},
+		{"scratch", true, true},
+		{"sub/scratch", true, true},
+		{"scratch", false, false},
+		{"sub/core", false, true},
+		{"core", false, false},
+	} {
+		c.Check(excluded(patterns, trial.path, trial.isDir), Equals, trial.excl, Commentf("%+v", trial))
+	}
+}
+
+func (s *TestSuite) TestUploadExclude(c *C) {
+	tmpdir, _ := ioutil.TempDir("", "")
+	defer func() {
+		os.RemoveAll(tmpdir)
+	}()
+
+	os.Mkdir(tmpdir+"/subdir", 0700)
+	os.Mkdir(tmpdir+"/scratch", 0700)
+	ioutil.WriteFile(tmpdir+"/"+"file1.txt", []byte("foo"), 0600)
+	ioutil.WriteFile(tmpdir+"/"+"junk.tmp", []byte("junk"), 0600)
+	ioutil.WriteFile(tmpdir+"/subdir/file2.txt", []byte("bar"), 0600)
+	ioutil.WriteFile(tmpdir+"/subdir/junk.tmp", []byte("junk"), 0600)
+	ioutil.WriteFile(tmpdir+"/subdir/keep.tmp", []byte("baz"), 0600)
+	ioutil.WriteFile(tmpdir+"/scratch/file3.txt", []byte("junk"), 0600)
+
+	cw := CollectionWriter{IKeepClient: &KeepTestClient{}, Exclude: []string{"*.tmp", "!keep.tmp", "scratch/"}}
+	str, err := writeTree(&cw, tmpdir, log.New(os.Stdout, "", 0))
+	c.Check(err, IsNil)
+	c.Check(str, Equals, `. acbd18db4cc2f85cedef654fccc4a4d8+3 0:3:file1.txt
+./subdir c3c23db5285662ef7172373df0003206+6 0:3:file2.txt 3:3:keep.tmp
+`)
+}
+
+func (s *TestSuite) TestUploadKeepIgnoreFiles(c *C) {
+	tmpdir, _ := ioutil.TempDir("", "")
+	defer func() {
+		os.RemoveAll(tmpdir)
+	}()
+
+	os.MkdirAll(tmpdir+"/subdir/deeper", 0700)
+	os.Mkdir(tmpdir+"/other", 0700)
+	ioutil.WriteFile(tmpdir+"/"+"run.log", []byte("foo"), 0600)
+	ioutil.WriteFile(tmpdir+"/other/run.log", []byte("foo"), 0600)
+	ioutil.WriteFile(tmpdir+"/subdir/.keepignore", []byte("# logs\n*.log\ndeeper/junk\n"), 0600)
+	ioutil.WriteFile(tmpdir+"/subdir/run.log", []byte("bar"), 0600)
+	ioutil.WriteFile(tmpdir+"/subdir/file2.txt", []byte("bar"), 0600)
+	ioutil.WriteFile(tmpdir+"/subdir/junk", []byte("bar"), 0600)
+	ioutil.WriteFile(tmpdir+"/subdir/deeper/.keepignore", []byte("!keep.log\n"), 0600)
+	ioutil.WriteFile(tmpdir+"/subdir/deeper/keep.log", []byte("baz"), 0600)
+	ioutil.WriteFile(tmpdir+"/subdir/deeper/drop.log", []byte("baz"), 0600)
+	ioutil.WriteFile(tmpdir+"/subdir/deeper/junk", []byte("baz"), 0600)
+
+	// Patterns apply relative to the directory of the .keepignore
+	// file, and only below it; deeper files override them.
+	cw := CollectionWriter{IKeepClient: &KeepTestClient{}, KeepIgnoreFiles: true}
+	str, err := writeTree(&cw, tmpdir, log.New(os.Stdout, "", 0))
+	c.Check(err, IsNil)
+	c.Check(str, Equals, `. acbd18db4cc2f85cedef654fccc4a4d8+3 0:3:run.log
+./other acbd18db4cc2f85cedef654fccc4a4d8+3 0:3:run.log
+./subdir b38d1bea5825a5d964eb2fb6c6f510c3+31 0:25:.keepignore 25:3:file2.txt 28:3:junk
+./subdir/deeper cb760a293cad141852fa2438d5dcea24+13 0:10:.keepignore 10:3:keep.log
+`)
+
+	// Without KeepIgnoreFiles, .keepignore files are ordinary
+	// files.
+	cw = CollectionWriter{IKeepClient: &KeepTestClient{}}
+	str, err = writeTree(&cw, tmpdir, log.New(os.Stdout, "", 0))
+	c.Check(err, IsNil)
+	c.Check(str, Matches, `(?s).*\./subdir .* 31:3:run\.log\n.* 10:3:drop\.log .*`)
+}
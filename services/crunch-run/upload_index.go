@@ -0,0 +1,149 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+)
+
+// indexFileName is the name of the file written by WriteIndex.
+const indexFileName = ".arv-index.json"
+
+// CollectionIndex is the content of the index file written with
+// CollectionWriter.WriteIndex.
+type CollectionIndex struct {
+	// Files in manifest order, i.e., sorted by stream name and
+	// then by file name.
+	Files []IndexedFile `json:"files"`
+
+	// Total size of the files.
+	Size uint64 `json:"size"`
+}
+
+// IndexedFile describes a file in a CollectionIndex.
+type IndexedFile struct {
+	Path     string         `json:"path"` // e.g., "subdir/file.txt"
+	Size     uint64         `json:"size"`
+	Segments []IndexSegment `json:"segments"`
+}
+
+// IndexSegment is a range of a block holding part of a file.  Block is
+// the locator without permission signature or other hints (hash and
+// size only), so the index does not depend on when it was written.
+type IndexSegment struct {
+	Block  string `json:"block"`
+	Offset int64  `json:"offset"`
+	Length int64  `json:"length"`
+}
+
+// collectionIndex returns the index of the files in the normalized
+// manifest text mt.
+func collectionIndex(mt string) (*CollectionIndex, error) {
+	streams, err := ParseManifest(mt)
+	if err != nil {
+		return nil, err
+	}
+	idx := &CollectionIndex{Files: []IndexedFile{}}
+	for _, st := range streams {
+		starts := blockStarts(st.Blocks)
+		dir := strings.TrimPrefix(strings.TrimPrefix(st.StreamName, "."), "/")
+		if dir != "" {
+			dir += "/"
+		}
+		// A file may have several segments in a stream, which
+		// are listed in order.
+		files := make(map[string]int)
+		for _, seg := range st.FileStreamSegments {
+			if seg.Name == emptyDirMarker {
+				continue
+			}
+			i, ok := files[seg.Name]
+			if !ok {
+				i = len(idx.Files)
+				files[seg.Name] = i
+				idx.Files = append(idx.Files, IndexedFile{Path: dir + seg.Name, Segments: []IndexSegment{}})
+			}
+			f := &idx.Files[i]
+			f.Size += seg.SegLen
+			idx.Size += seg.SegLen
+			pos, end := int64(seg.SegPos), int64(seg.SegPos+seg.SegLen)
+			for b, locator := range st.Blocks {
+				lo, hi := starts[b], starts[b+1]
+				if pos > lo {
+					lo = pos
+				}
+				if end < hi {
+					hi = end
+				}
+				if lo >= hi {
+					continue
+				}
+				f.Segments = append(f.Segments, IndexSegment{Block: blockKey(locator), Offset: lo - starts[b], Length: hi - lo})
+			}
+		}
+	}
+	return idx, nil
+}
+
+// BlocksPerFile returns the number of block segments holding each file
+// of the collection (keyed by path relative to the collection root, as
+// in the index written with WriteIndex), i.e., the number of blocks the
+// file's data spans.  An empty file has none.  Like ManifestText, it
+// calls Finish first.
+func (m *CollectionWriter) BlocksPerFile() (map[string]int, error) {
+	mt, err := m.manifestText(false)
+	if err != nil {
+		return nil, err
+	}
+	idx, err := collectionIndex(mt)
+	if err != nil {
+		return nil, err
+	}
+	blocks := make(map[string]int)
+	for _, f := range idx.Files {
+		blocks[f.Path] = len(f.Segments)
+	}
+	return blocks, nil
+}
+
+// writeIndex writes the index file of the collection written so far
+// (see WriteIndex), and waits for it to be stored.
+func (m *CollectionWriter) writeIndex() error {
+	lines := m.rawStreamTexts()
+	if m.BaseManifest != "" {
+		base, err := m.baseStreamTexts()
+		if err != nil {
+			return err
+		}
+		lines = append(base, lines...)
+	}
+	var buf bytes.Buffer
+	if err := m.writeNormalized(&buf, lines); err != nil {
+		return err
+	}
+	idx, err := collectionIndex(buf.String())
+	if err != nil {
+		return err
+	}
+	if len(idx.Files) == 0 {
+		// An empty collection stays empty.
+		return nil
+	}
+	data, err := json.Marshal(idx)
+	if err != nil {
+		return err
+	}
+	w := m.Open(indexFileName)
+	if _, err := w.Write(append(data, '\n')); err != nil {
+		w.Close()
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return m.Finish()
+}
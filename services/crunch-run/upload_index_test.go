@@ -0,0 +1,121 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package main
+
+import (
+	"crypto/md5"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+
+	. "gopkg.in/check.v1"
+)
+
+func (s *TestSuite) TestUploadWriteIndex(c *C) {
+	tmpdir, _ := ioutil.TempDir("", "")
+	defer func() {
+		os.RemoveAll(tmpdir)
+	}()
+
+	ioutil.WriteFile(tmpdir+"/"+"file1.txt", []byte("foo"), 0600)
+	os.Mkdir(tmpdir+"/subdir", 0700)
+	ioutil.WriteFile(tmpdir+"/subdir/file2.txt", []byte(strings.Repeat("x", 2500)), 0600)
+
+	kc := &KeepStoreTestClient{}
+	cw := CollectionWriter{IKeepClient: kc, BlockSize: 1024, WriteIndex: true}
+	str, err := writeTree(&cw, tmpdir, log.New(os.Stdout, "", 0))
+	c.Assert(err, IsNil)
+	c.Check(str, Matches, `\. [0-9a-f]{32}\+[0-9]+ acbd18db4cc2f85cedef654fccc4a4d8\+3 0:[0-9]+:\.arv-index\.json [0-9]+:3:file1\.txt\n\./subdir .*\n`)
+
+	// Read the index back from the stored blocks.
+	var data []byte
+	for _, extent := range fileExtents(c, str)["./.arv-index.json"] {
+		var start, length int
+		fmt.Sscanf(strings.Fields(extent)[1], "%d:%d", &start, &length)
+		data = append(data, kc.blocks[extent[:32]][start:start+length]...)
+	}
+	var idx CollectionIndex
+	c.Assert(json.Unmarshal(data, &idx), IsNil, Commentf("%q", data))
+	c.Check(idx.Size, Equals, uint64(2503))
+	c.Assert(idx.Files, HasLen, 2)
+	c.Check(idx.Files[0], DeepEquals, IndexedFile{Path: "file1.txt", Size: 3, Segments: []IndexSegment{
+		{Block: "acbd18db4cc2f85cedef654fccc4a4d8+3", Offset: 0, Length: 3},
+	}})
+	c.Check(idx.Files[1].Path, Equals, "subdir/file2.txt")
+	c.Check(idx.Files[1].Size, Equals, uint64(2500))
+	c.Assert(idx.Files[1].Segments, HasLen, 3)
+	c.Check(idx.Files[1].Segments[2], DeepEquals, IndexSegment{Block: "a0a7ddd38a18638f87f6686acd4dbf39+452", Offset: 0, Length: 452})
+
+	// The index is written once, and is the same the next time.
+	again, err := cw.ManifestText()
+	c.Check(err, IsNil)
+	c.Check(again, Equals, str)
+	cw = CollectionWriter{IKeepClient: &KeepStoreTestClient{}, BlockSize: 1024, WriteIndex: true}
+	again, err = writeTree(&cw, tmpdir, log.New(os.Stdout, "", 0))
+	c.Check(err, IsNil)
+	c.Check(again, Equals, str)
+}
+
+func (s *TestSuite) TestUploadBlockBoundaries(c *C) {
+	tmpdir, _ := ioutil.TempDir("", "")
+	defer func() {
+		os.RemoveAll(tmpdir)
+	}()
+
+	locator := func(data []byte) string {
+		return fmt.Sprintf("%x+%d", md5.Sum(data), len(data))
+	}
+	for _, blockSize := range []int{1024, 1 << 26} {
+		for _, trial := range []struct {
+			size   int
+			blocks int
+		}{
+			{0, 0},
+			{1, 1},
+			{blockSize - 1, 1},
+			{blockSize, 1},
+			{blockSize + 1, 2},
+			{2 * blockSize, 2},
+			{2*blockSize + 1, 3},
+		} {
+			if blockSize > 1024 && trial.size != blockSize {
+				// Writing bigger files takes too
+				// long, and checks nothing more.
+				continue
+			}
+			data := make([]byte, trial.size)
+			for i := range data {
+				data[i] = byte(i * 7 / 3)
+			}
+			ioutil.WriteFile(tmpdir+"/"+"file1.txt", data, 0600)
+			ioutil.WriteFile(tmpdir+"/"+"file2.txt", []byte("foo"), 0600)
+
+			// The stream is the data of both files, in
+			// full blocks except the last.
+			stream := append(append([]byte(nil), data...), "foo"...)
+			var locators []string
+			for pos := 0; pos < len(stream); pos += blockSize {
+				end := pos + blockSize
+				if end > len(stream) {
+					end = len(stream)
+				}
+				locators = append(locators, locator(stream[pos:end]))
+			}
+			file2Blocks := (trial.size+2)/blockSize - trial.size/blockSize + 1
+
+			cw := CollectionWriter{IKeepClient: &KeepTestClient{}, BlockSize: blockSize}
+			str, err := writeTree(&cw, tmpdir, log.New(os.Stdout, "", 0))
+			c.Assert(err, IsNil)
+			c.Check(str, Equals, fmt.Sprintf(". %s 0:%d:file1.txt %d:3:file2.txt\n", strings.Join(locators, " "), trial.size, trial.size), Commentf("size %d", trial.size))
+
+			blocks, err := cw.BlocksPerFile()
+			c.Check(err, IsNil)
+			c.Check(blocks, DeepEquals, map[string]int{"file1.txt": trial.blocks, "file2.txt": file2Blocks}, Commentf("size %d", trial.size))
+		}
+	}
+}
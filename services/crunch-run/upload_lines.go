@@ -0,0 +1,160 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"git.curoverse.com/arvados.git/sdk/go/manifest"
+)
+
+// writeStreamLines writes the manifest text mt (one or more stream
+// lines) to w, splitting each line that exceeds MaxLocatorsPerLine or
+// MaxFilesPerLine.
+func (m *CollectionWriter) writeStreamLines(w io.Writer, mt string) error {
+	if m.MaxLocatorsPerLine <= 0 && m.MaxFilesPerLine <= 0 {
+		_, err := io.WriteString(w, mt)
+		return err
+	}
+	streams, err := ParseManifest(mt)
+	if err != nil {
+		return err
+	}
+	for _, st := range streams {
+		for _, line := range splitStreamLine(st, m.MaxLocatorsPerLine, m.MaxFilesPerLine) {
+			if _, err := io.WriteString(w, escapeEmptyDirMarkers(line)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// blockStarts returns the position in the stream of each of the given
+// blocks, followed by the size of the stream.
+func blockStarts(blocks []string) []int64 {
+	starts := make([]int64, len(blocks)+1)
+	for i, locator := range blocks {
+		size := int64(0)
+		if parts := strings.Split(locator, "+"); len(parts) > 1 {
+			size, _ = strconv.ParseInt(parts[1], 10, 64)
+		}
+		starts[i+1] = starts[i] + size
+	}
+	return starts
+}
+
+// streamLine is a line of a stream being split by splitStreamLine:
+// blocks lo through hi of the stream, and the file segments referring
+// to them (with positions relative to the whole stream).
+type streamLine struct {
+	lo, hi int
+	segs   []manifest.FileStreamSegment
+}
+
+// splitStreamLine returns the manifest text of st as lines with at
+// most maxLocators blocks and maxFiles file segments each (no limit if
+// zero).  The segments keep their order, so the files read the same
+// as in st.
+func splitStreamLine(st manifest.ManifestStream, maxLocators, maxFiles int) []string {
+	starts := blockStarts(st.Blocks)
+	// blockAt returns the block containing the data at pos (or the
+	// last block, if pos is at the end of the stream).
+	blockAt := func(pos int64) int {
+		i := sort.Search(len(st.Blocks), func(i int) bool { return starts[i+1] > pos })
+		if i == len(st.Blocks) {
+			i--
+		}
+		return i
+	}
+
+	var lines []string
+	var cur *streamLine
+	flush := func() {
+		if cur == nil {
+			return
+		}
+		var buf bytes.Buffer
+		buf.WriteString(manifest.EscapeName(st.StreamName))
+		for _, locator := range st.Blocks[cur.lo : cur.hi+1] {
+			buf.WriteString(" ")
+			buf.WriteString(locator)
+		}
+		for _, seg := range cur.segs {
+			fmt.Fprintf(&buf, " %d:%d:%s", int64(seg.SegPos)-starts[cur.lo], seg.SegLen, manifest.EscapeName(seg.Name))
+		}
+		buf.WriteString("\n")
+		lines = append(lines, buf.String())
+		cur = nil
+	}
+	for _, seg := range st.FileStreamSegments {
+		pos, length := int64(seg.SegPos), int64(seg.SegLen)
+		for {
+			first, last := blockAt(pos), blockAt(pos)
+			if length > 0 {
+				last = blockAt(pos + length - 1)
+			}
+			// A segment spanning too many blocks continues on
+			// the next line.
+			n := length
+			if maxLocators > 0 && last-first+1 > maxLocators {
+				last = first + maxLocators - 1
+				n = starts[last+1] - pos
+			}
+			if cur != nil {
+				lo, hi := cur.lo, cur.hi
+				if first < lo {
+					lo = first
+				}
+				if last > hi {
+					hi = last
+				}
+				if (maxLocators > 0 && hi-lo+1 > maxLocators) || (maxFiles > 0 && len(cur.segs) >= maxFiles) {
+					flush()
+				} else {
+					cur.lo, cur.hi = lo, hi
+				}
+			}
+			if cur == nil {
+				cur = &streamLine{lo: first, hi: last}
+			}
+			cur.segs = append(cur.segs, manifest.FileStreamSegment{uint64(pos), uint64(n), seg.Name})
+			pos, length = pos+n, length-n
+			if length == 0 {
+				break
+			}
+		}
+	}
+	flush()
+	return lines
+}
+
+var dotSlashRe = regexp.MustCompile(`(?m)^\./`)
+
+// bareStreamNames returns manifest text mt with the leading "./"
+// removed from each stream name, see BareStreamNames.
+func bareStreamNames(mt string) string {
+	return dotSlashRe.ReplaceAllString(mt, "")
+}
+
+// bareStreamNameWriter writes manifest text to w with bare stream
+// names.  Each write must be one or more whole lines, as written by
+// writeStreamLines.
+type bareStreamNameWriter struct {
+	w io.Writer
+}
+
+func (bw bareStreamNameWriter) Write(p []byte) (int, error) {
+	if _, err := io.WriteString(bw.w, bareStreamNames(string(p))); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
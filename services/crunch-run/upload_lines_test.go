@@ -0,0 +1,156 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+
+	. "gopkg.in/check.v1"
+)
+
+// fileExtents returns, for each file in the manifest text mt, the
+// block ranges holding its data, as "locator start:len" strings with
+// adjacent ranges merged.
+func fileExtents(c *C, mt string) map[string][]string {
+	streams, err := ParseManifest(mt)
+	c.Assert(err, IsNil)
+	type extent struct {
+		locator    string
+		start, len int64
+	}
+	extents := make(map[string][]extent)
+	for _, st := range streams {
+		starts := []int64{0}
+		for _, locator := range st.Blocks {
+			size, _ := strconv.ParseInt(strings.Split(locator, "+")[1], 10, 64)
+			starts = append(starts, starts[len(starts)-1]+size)
+		}
+		for _, seg := range st.FileStreamSegments {
+			name := st.StreamName + "/" + seg.Name
+			pos, end := int64(seg.SegPos), int64(seg.SegPos+seg.SegLen)
+			for i, locator := range st.Blocks {
+				lo, hi := starts[i], starts[i+1]
+				if pos > lo {
+					lo = pos
+				}
+				if end < hi {
+					hi = end
+				}
+				if lo >= hi {
+					continue
+				}
+				e := extent{locator, lo - starts[i], hi - lo}
+				if n := len(extents[name]); n > 0 && extents[name][n-1].locator == locator && extents[name][n-1].start+extents[name][n-1].len == e.start {
+					extents[name][n-1].len += e.len
+				} else {
+					extents[name] = append(extents[name], e)
+				}
+			}
+		}
+	}
+	result := make(map[string][]string)
+	for name, es := range extents {
+		for _, e := range es {
+			result[name] = append(result[name], fmt.Sprintf("%s %d:%d", e.locator, e.start, e.len))
+		}
+	}
+	return result
+}
+
+func (s *TestSuite) TestUploadMaxPerLine(c *C) {
+	tmpdir, _ := ioutil.TempDir("", "")
+	defer func() {
+		os.RemoveAll(tmpdir)
+	}()
+
+	var buf bytes.Buffer
+	for i := 0; i < 1000; i++ {
+		fmt.Fprintf(&buf, "%04d\n", i)
+	}
+	ioutil.WriteFile(tmpdir+"/"+"file1.txt", buf.Bytes(), 0600)
+	ioutil.WriteFile(tmpdir+"/"+"file2.txt", []byte("foo"), 0600)
+	ioutil.WriteFile(tmpdir+"/"+"file3.txt", []byte("bar"), 0600)
+	ioutil.WriteFile(tmpdir+"/"+"file4.txt", []byte("baz"), 0600)
+	os.Mkdir(tmpdir+"/empty", 0700)
+
+	cw := CollectionWriter{IKeepClient: &KeepTestClient{}, BlockSize: 1024, PreserveEmptyDirs: true}
+	unsplit, err := writeTree(&cw, tmpdir, log.New(os.Stdout, "", 0))
+	c.Assert(err, IsNil)
+	c.Check(strings.Count(unsplit, "\n"), Equals, 2)
+
+	cw = CollectionWriter{IKeepClient: &KeepTestClient{}, BlockSize: 1024, PreserveEmptyDirs: true, MaxLocatorsPerLine: 2, MaxFilesPerLine: 2}
+	split, err := writeTree(&cw, tmpdir, log.New(os.Stdout, "", 0))
+	c.Assert(err, IsNil)
+
+	lines := strings.Split(strings.TrimSuffix(split, "\n"), "\n")
+	c.Check(len(lines) > 3, Equals, true)
+	for _, line := range lines {
+		fields := strings.Fields(line)
+		locators, files := 0, 0
+		for _, field := range fields[1:] {
+			if strings.Count(field, ":") >= 2 {
+				files++
+			} else {
+				locators++
+			}
+		}
+		c.Check(locators <= 2, Equals, true, Commentf("%q", line))
+		c.Check(files <= 2, Equals, true, Commentf("%q", line))
+	}
+	c.Check(lines[len(lines)-1], Equals, `./empty d41d8cd98f00b204e9800998ecf8427e+0 0:0:\056`)
+
+	// Every file still reads the same data from the same blocks.
+	c.Check(fileExtents(c, split), DeepEquals, fileExtents(c, unsplit))
+
+	// The split manifest normalizes to the unsplit one.
+	var norm bytes.Buffer
+	c.Check((&CollectionWriter{}).writeNormalized(&norm, []string{split}), IsNil)
+	c.Check(norm.String(), Equals, unsplit)
+}
+
+func (s *TestSuite) TestUploadBareStreamNames(c *C) {
+	tmpdir, _ := ioutil.TempDir("", "")
+	defer func() {
+		os.RemoveAll(tmpdir)
+	}()
+
+	os.MkdirAll(tmpdir+"/subdir/deeper", 0700)
+	ioutil.WriteFile(tmpdir+"/file1.txt", []byte("foo"), 0600)
+	ioutil.WriteFile(tmpdir+"/subdir/file2.txt", []byte("bar"), 0600)
+	ioutil.WriteFile(tmpdir+"/subdir/deeper/file3.txt", []byte("baz"), 0600)
+
+	for _, bare := range []bool{false, true} {
+		cw := CollectionWriter{IKeepClient: &KeepTestClient{}, BareStreamNames: bare, MaxFilesPerLine: 1}
+		str, err := writeTree(&cw, tmpdir, log.New(os.Stdout, "", 0))
+		c.Check(err, IsNil)
+		raw, err := cw.RawManifestText()
+		c.Check(err, IsNil)
+		if bare {
+			c.Check(str, Equals, `. acbd18db4cc2f85cedef654fccc4a4d8+3 0:3:file1.txt
+subdir 37b51d194a7513e45b56f6524f2d51f2+3 0:3:file2.txt
+subdir/deeper 73feffa4b7f6bb68e44cf984c85f6e88+3 0:3:file3.txt
+`)
+			c.Check(raw, Matches, `\. .*\nsubdir/deeper .*\nsubdir .*\n`)
+		} else {
+			c.Check(str, Equals, `. acbd18db4cc2f85cedef654fccc4a4d8+3 0:3:file1.txt
+./subdir 37b51d194a7513e45b56f6524f2d51f2+3 0:3:file2.txt
+./subdir/deeper 73feffa4b7f6bb68e44cf984c85f6e88+3 0:3:file3.txt
+`)
+			c.Check(ValidateManifest(str), IsNil)
+		}
+
+		// The portable data hash is that of the standard
+		// manifest either way.
+		pdh, err := cw.PortableDataHash()
+		c.Check(err, IsNil)
+		c.Check(pdh, Equals, "eeaa4b28a064ff687249ed3b96f527b0+174")
+	}
+}
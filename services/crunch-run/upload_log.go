@@ -0,0 +1,54 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package main
+
+import (
+	"log"
+)
+
+// Logger receives the messages logged by uploads (see
+// CollectionWriter.Logger).  Messages about a particular file or block
+// are logged via a Logger returned by WithField, with fields such as
+// "path", "size", and "locator", so implementations can emit them as
+// structured data.  A Logger for logrus can be written as a thin
+// wrapper around logrus.FieldLogger.
+type Logger interface {
+	// WithField returns a Logger that adds the given field to
+	// each message.
+	WithField(key string, value interface{}) Logger
+	Infof(format string, args ...interface{})
+	Warnf(format string, args ...interface{})
+	Errorf(format string, args ...interface{})
+}
+
+// NewLogLogger returns a Logger that writes messages to l, without
+// their fields and level, which is how uploads log when
+// CollectionWriter.Logger is nil.  If l is nil, messages are
+// discarded.
+func NewLogLogger(l *log.Logger) Logger {
+	return logLogger{l}
+}
+
+type logLogger struct {
+	*log.Logger
+}
+
+func (l logLogger) WithField(string, interface{}) Logger {
+	return l
+}
+
+func (l logLogger) Infof(format string, args ...interface{}) {
+	if l.Logger != nil {
+		l.Printf(format, args...)
+	}
+}
+
+func (l logLogger) Warnf(format string, args ...interface{}) {
+	l.Infof(format, args...)
+}
+
+func (l logLogger) Errorf(format string, args ...interface{}) {
+	l.Infof(format, args...)
+}
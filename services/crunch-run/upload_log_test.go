@@ -0,0 +1,104 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"sync"
+
+	. "gopkg.in/check.v1"
+)
+
+type testLogEntry struct {
+	level   string
+	message string
+	fields  map[string]interface{}
+}
+
+// testLogger is a Logger that remembers the messages logged to it.
+type testLogger struct {
+	mtx     *sync.Mutex
+	entries *[]testLogEntry
+	fields  map[string]interface{}
+}
+
+func newTestLogger() *testLogger {
+	return &testLogger{mtx: &sync.Mutex{}, entries: &[]testLogEntry{}}
+}
+
+func (l *testLogger) WithField(key string, value interface{}) Logger {
+	fields := map[string]interface{}{key: value}
+	for k, v := range l.fields {
+		fields[k] = v
+	}
+	return &testLogger{mtx: l.mtx, entries: l.entries, fields: fields}
+}
+
+func (l *testLogger) log(level, format string, args ...interface{}) {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	*l.entries = append(*l.entries, testLogEntry{level, fmt.Sprintf(format, args...), l.fields})
+}
+
+func (l *testLogger) Infof(format string, args ...interface{})  { l.log("info", format, args...) }
+func (l *testLogger) Warnf(format string, args ...interface{})  { l.log("warn", format, args...) }
+func (l *testLogger) Errorf(format string, args ...interface{}) { l.log("error", format, args...) }
+
+func (s *TestSuite) TestUploadLogger(c *C) {
+	tmpdir, _ := ioutil.TempDir("", "")
+	defer func() {
+		os.RemoveAll(tmpdir)
+	}()
+
+	os.Mkdir(tmpdir+"/subdir", 0700)
+	ioutil.WriteFile(tmpdir+"/"+"file1.txt", []byte("foo"), 0600)
+	ioutil.WriteFile(tmpdir+"/subdir/file2.txt", []byte("barbaz"), 0600)
+	ioutil.WriteFile(tmpdir+"/subdir/file3.txt", []byte("secret"), 0600)
+	deny := denyFileSystem{deny: map[string]bool{tmpdir + "/subdir/file3.txt": true}}
+
+	// The *log.Logger passed to BeginUpload is not used when
+	// Logger is set.
+	var logbuf bytes.Buffer
+	logger := newTestLogger()
+	cw := CollectionWriter{IKeepClient: &KeepTestClient{}, Logger: logger.WithField("container_uuid", "zzzzz-dz642-zzzzzzzzzzzzzzz")}
+	walkUpload := cw.BeginUpload(context.Background(), tmpdir, log.New(&logbuf, "", 0))
+	walkUpload.FileSystem = deny
+	c.Check(walkUpload.Walk(), IsNil)
+	c.Check(cw.EndUpload(walkUpload), IsNil)
+	c.Check(logbuf.String(), Equals, "")
+
+	c.Check(*logger.entries, DeepEquals, []testLogEntry{
+		{"info", "Uploading ./file1.txt (3 bytes)", map[string]interface{}{
+			"container_uuid": "zzzzz-dz642-zzzzzzzzzzzzzzz",
+			"path":           "file1.txt",
+			"size":           int64(3),
+		}},
+		{"info", "Uploading subdir/file2.txt (6 bytes)", map[string]interface{}{
+			"container_uuid": "zzzzz-dz642-zzzzzzzzzzzzzzz",
+			"path":           "subdir/file2.txt",
+			"size":           int64(6),
+		}},
+		{"warn", "Skipping subdir/file3.txt: open " + tmpdir + "/subdir/file3.txt: permission denied", map[string]interface{}{
+			"container_uuid": "zzzzz-dz642-zzzzzzzzzzzzzzz",
+			"path":           "subdir/file3.txt",
+		}},
+	})
+
+	// Without Logger, messages go to the *log.Logger.
+	cw = CollectionWriter{IKeepClient: &KeepTestClient{}}
+	walkUpload = cw.BeginUpload(context.Background(), tmpdir, log.New(&logbuf, "", 0))
+	walkUpload.FileSystem = deny
+	c.Check(walkUpload.Walk(), IsNil)
+	c.Check(cw.EndUpload(walkUpload), IsNil)
+	c.Check(logbuf.String(), Matches, `Uploading ./file1.txt \(3 bytes\)
+Uploading subdir/file2.txt \(6 bytes\)
+Skipping subdir/file3.txt: .*permission denied
+`)
+}
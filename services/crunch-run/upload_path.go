@@ -0,0 +1,163 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package main
+
+import (
+	"fmt"
+	"os"
+	pathpkg "path"
+	"strings"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+// manifestPath returns the OS-specific relative path p as a manifest
+// path, which always uses "/" as its separator.  On Windows, a volume
+// name at the start of p (a drive letter like "C:", or a UNC share like
+// \\host\share) is removed, since it cannot be part of a manifest path.
+func manifestPath(p string) string {
+	return slashPath(p, os.PathSeparator)
+}
+
+// slashPath is manifestPath for an OS whose path separator is sep.
+func slashPath(p string, sep byte) string {
+	if sep != '\\' {
+		return p
+	}
+	p = p[len(windowsVolumeName(p)):]
+	return strings.Replace(p, `\`, "/", -1)
+}
+
+// windowsVolumeName returns the volume name at the start of the
+// Windows path p: a drive letter followed by ":", or the host and
+// share of a UNC path.  Windows accepts both "\" and "/" as
+// separators.
+func windowsVolumeName(p string) string {
+	isSep := func(c byte) bool { return c == '\\' || c == '/' }
+	if len(p) >= 2 && p[1] == ':' && ('a' <= p[0]|0x20 && p[0]|0x20 <= 'z') {
+		return p[:2]
+	}
+	if len(p) < 5 || !isSep(p[0]) || !isSep(p[1]) || isSep(p[2]) {
+		return ""
+	}
+	// \\host\share: find the end of host, then of share.
+	n := 2
+	for i := 0; i < 2; i++ {
+		for n < len(p) && !isSep(p[n]) {
+			n++
+		}
+		if i == 0 {
+			if n == len(p) {
+				return ""
+			}
+			n++
+		}
+	}
+	return p[:n]
+}
+
+// windowsReservedNames are the names of devices on Windows.  A file
+// with one of these names (with or without an extension) cannot be
+// opened there by name, since the name refers to the device instead.
+var windowsReservedNames = map[string]bool{
+	"CON": true, "PRN": true, "AUX": true, "NUL": true,
+	"COM1": true, "COM2": true, "COM3": true, "COM4": true, "COM5": true,
+	"COM6": true, "COM7": true, "COM8": true, "COM9": true,
+	"LPT1": true, "LPT2": true, "LPT3": true, "LPT4": true, "LPT5": true,
+	"LPT6": true, "LPT7": true, "LPT8": true, "LPT9": true,
+}
+
+// isWindowsReservedName returns true if the file name fn refers to a
+// device on Windows, e.g., "NUL" or "com1.txt".
+func isWindowsReservedName(fn string) bool {
+	if i := strings.Index(fn, "."); i >= 0 {
+		fn = fn[:i]
+	}
+	return windowsReservedNames[strings.ToUpper(strings.TrimRight(fn, " "))]
+}
+
+// cleanDestPath returns the destination path p, given by the caller in
+// either manifest or OS-specific form, as a clean manifest path with a
+// leading "/".  A leading "./" in p is ignored.
+func cleanDestPath(p string) string {
+	return pathpkg.Clean("/" + strings.TrimPrefix(manifestPath(p), "./"))
+}
+
+// splitManifestPath splits the manifest path p into the directory and
+// the file name.  dir is empty if p has no directory.
+func splitManifestPath(p string) (dir, fn string) {
+	if i := strings.LastIndex(p, "/"); i >= 0 {
+		return p[:i], p[i+1:]
+	}
+	return "", p
+}
+
+// relPath returns the manifest path of path (the upload root followed
+// by the path in the collection) relative to the upload root.
+func (m *WalkUpload) relPath(path string) string {
+	if len(path) <= len(m.stripPrefix) {
+		return ""
+	}
+	return m.normalizeName(manifestPath(path[len(m.stripPrefix)+1:]))
+}
+
+// sanitizePath applies NameSanitizer to the name of each directory in
+// stream dir and to file name fn, and returns the names to store.
+func (m *WalkUpload) sanitizePath(dir, fn string) (string, string, error) {
+	if m.cw.NameSanitizer == nil {
+		return dir, fn, nil
+	}
+	sdir, err := m.sanitizeDir(dir)
+	if err != nil {
+		return "", "", err
+	}
+	sfn, err := m.sanitizeName(dir, fn)
+	if err != nil {
+		return "", "", err
+	}
+	return sdir, sfn, nil
+}
+
+// sanitizeDir applies NameSanitizer to the name of each directory in
+// stream dir.
+func (m *WalkUpload) sanitizeDir(dir string) (string, error) {
+	if m.cw.NameSanitizer == nil || dir == "." {
+		return dir, nil
+	}
+	parts := strings.Split(dir, "/")
+	for i, name := range parts {
+		var err error
+		parts[i], err = m.sanitizeName(strings.Join(parts[:i], "/"), name)
+		if err != nil {
+			return "", err
+		}
+	}
+	return strings.Join(parts, "/"), nil
+}
+
+// sanitizeName returns the name NameSanitizer gives for file or
+// directory name in stream dir.
+func (m *WalkUpload) sanitizeName(dir, name string) (string, error) {
+	if dir == "" {
+		dir = "."
+	}
+	clean, err := m.cw.NameSanitizer(name)
+	if err == nil && (clean == "" || clean == "." || clean == ".." || strings.Contains(clean, "/")) {
+		err = fmt.Errorf("invalid result %q", clean)
+	}
+	if err != nil {
+		return "", m.fileError(dir, name, UploadPhasePack, fmt.Errorf("Name %q rejected by NameSanitizer: %v", name, err))
+	}
+	return clean, nil
+}
+
+// normalizeName returns the file or directory name (or path) s in NFC,
+// if NormalizeUnicode is set, otherwise s itself.
+func (m *WalkUpload) normalizeName(s string) string {
+	if !m.cw.NormalizeUnicode {
+		return s
+	}
+	return norm.NFC.String(s)
+}
@@ -0,0 +1,171 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package main
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"git.curoverse.com/arvados.git/sdk/go/manifest"
+	. "gopkg.in/check.v1"
+)
+
+func (s *TestSuite) TestSlashPath(c *C) {
+	for _, trial := range []struct {
+		in, out string
+	}{
+		{`subdir\file1.txt`, "subdir/file1.txt"},
+		{`a\b/c\file1.txt`, "a/b/c/file1.txt"},
+		{`C:\data\file1.txt`, "/data/file1.txt"},
+		{`c:file1.txt`, "file1.txt"},
+		{`\\host\share\dir\file1.txt`, "/dir/file1.txt"},
+		{`//host/share`, ""},
+		{`\\host`, "//host"},
+		{`file1.txt`, "file1.txt"},
+	} {
+		c.Check(slashPath(trial.in, '\\'), Equals, trial.out, Commentf("%q", trial.in))
+	}
+
+	// Elsewhere, a backslash is part of the file name.
+	c.Check(slashPath(`subdir\file1.txt`, '/'), Equals, `subdir\file1.txt`)
+
+	for _, fn := range []string{"NUL", "con", "Com1.txt", "aux.tar.gz", "LPT9 "} {
+		c.Check(isWindowsReservedName(fn), Equals, true, Commentf("%q", fn))
+	}
+	for _, fn := range []string{"NULL", "com0", "file1.txt", "xcon.txt"} {
+		c.Check(isWindowsReservedName(fn), Equals, false, Commentf("%q", fn))
+	}
+}
+
+func (s *TestSuite) TestUploadFileOSPath(c *C) {
+	tmpdir, _ := ioutil.TempDir("", "")
+	defer func() {
+		os.RemoveAll(tmpdir)
+	}()
+
+	ioutil.WriteFile(tmpdir+"/"+"file1.txt", []byte("foo"), 0600)
+
+	cw := CollectionWriter{IKeepClient: &KeepTestClient{}}
+	walkUpload := cw.BeginUpload(context.Background(), tmpdir, log.New(os.Stdout, "", 0))
+	c.Check(walkUpload.UploadFile(filepath.Join(tmpdir, "file1.txt"), filepath.Join("subdir", "deeper", "file1.txt")), IsNil)
+	c.Check(cw.EndUpload(walkUpload), IsNil)
+	str, err := cw.ManifestText()
+	c.Check(err, IsNil)
+	c.Check(str, Equals, "./subdir/deeper acbd18db4cc2f85cedef654fccc4a4d8+3 0:3:file1.txt\n")
+}
+
+func (s *TestSuite) TestUploadNormalizeUnicode(c *C) {
+	tmpdir, _ := ioutil.TempDir("", "")
+	defer func() {
+		os.RemoveAll(tmpdir)
+	}()
+
+	// NFD: "e" followed by a combining acute accent.
+	os.Mkdir(tmpdir+"/re\u0301sume\u0301", 0700)
+	ioutil.WriteFile(tmpdir+"/re\u0301sume\u0301/cafe\u0301.txt", []byte("foo"), 0600)
+
+	cw := CollectionWriter{IKeepClient: &KeepTestClient{}}
+	str, err := writeTree(&cw, tmpdir, log.New(os.Stdout, "", 0))
+	c.Check(err, IsNil)
+	c.Check(str, Equals, "./re\u0301sume\u0301 acbd18db4cc2f85cedef654fccc4a4d8+3 0:3:cafe\u0301.txt\n")
+
+	cw = CollectionWriter{IKeepClient: &KeepTestClient{}, NormalizeUnicode: true}
+	str, err = writeTree(&cw, tmpdir, log.New(os.Stdout, "", 0))
+	c.Check(err, IsNil)
+	c.Check(str, Equals, "./r\u00e9sum\u00e9 acbd18db4cc2f85cedef654fccc4a4d8+3 0:3:caf\u00e9.txt\n")
+}
+
+func (s *TestSuite) TestUploadControlCharacters(c *C) {
+	tmpdir, _ := ioutil.TempDir("", "")
+	defer func() {
+		os.RemoveAll(tmpdir)
+	}()
+
+	// Names with characters that would otherwise end a token or a
+	// line, or start an escape sequence, in the manifest.
+	os.Mkdir(tmpdir+"/tab\tdir", 0700)
+	ioutil.WriteFile(tmpdir+"/tab\tdir/new\nline.txt", []byte("foo"), 0600)
+	ioutil.WriteFile(tmpdir+"/a\\040b", []byte("foo"), 0600)
+	ioutil.WriteFile(tmpdir+"/del\x7f", []byte("foo"), 0600)
+
+	cw := CollectionWriter{IKeepClient: &KeepTestClient{}}
+	str, err := writeTree(&cw, tmpdir, log.New(os.Stdout, "", 0))
+	c.Assert(err, IsNil)
+	c.Check(str, Equals, ". fdba98970961edb29f88241b9d99d890+6 0:3:a\\134040b 3:3:del\\177\n"+
+		"./tab\\011dir acbd18db4cc2f85cedef654fccc4a4d8+3 0:3:new\\012line.txt\n")
+	c.Check(ValidateManifest(str), IsNil)
+
+	streams, err := ParseManifest(str)
+	c.Assert(err, IsNil)
+	c.Assert(streams, HasLen, 2)
+	c.Check(streams[0].FileStreamSegments, DeepEquals, []manifest.FileStreamSegment{
+		{0, 3, "a\\040b"},
+		{3, 3, "del\x7f"},
+	})
+	c.Check(streams[1].StreamName, Equals, "./tab\tdir")
+	c.Check(streams[1].FileStreamSegments, DeepEquals, []manifest.FileStreamSegment{{0, 3, "new\nline.txt"}})
+}
+
+func (s *TestSuite) TestUploadNameSanitizer(c *C) {
+	tmpdir, _ := ioutil.TempDir("", "")
+	defer func() {
+		os.RemoveAll(tmpdir)
+	}()
+	os.MkdirAll(tmpdir+"/SubDir/Empty", 0700)
+	ioutil.WriteFile(tmpdir+"/File1.TXT", []byte("foo"), 0600)
+	ioutil.WriteFile(tmpdir+"/SubDir/File2.txt", []byte("bar"), 0600)
+
+	var names []string
+	cw := CollectionWriter{
+		IKeepClient:       &KeepTestClient{},
+		PreserveEmptyDirs: true,
+		NameSanitizer: func(name string) (string, error) {
+			names = append(names, name)
+			return strings.ToLower(name), nil
+		},
+	}
+	walkUpload := cw.BeginUpload(context.Background(), tmpdir, log.New(os.Stdout, "", 0))
+	c.Assert(walkUpload.Walk(), IsNil)
+	c.Assert(walkUpload.UploadReader("./Extra Dir", "README", strings.NewReader("baz")), IsNil)
+	c.Assert(cw.EndUpload(walkUpload), IsNil)
+	str, err := cw.ManifestText()
+	c.Check(err, IsNil)
+	c.Check(str, Equals, ". acbd18db4cc2f85cedef654fccc4a4d8+3 0:3:file1.txt\n"+
+		"./extra\\040dir 73feffa4b7f6bb68e44cf984c85f6e88+3 0:3:readme\n"+
+		"./subdir 37b51d194a7513e45b56f6524f2d51f2+3 0:3:file2.txt\n"+
+		"./subdir/empty d41d8cd98f00b204e9800998ecf8427e+0 0:0:\\056\n")
+	sort.Strings(names)
+	c.Check(names, DeepEquals, []string{"Empty", "Extra Dir", "File1.TXT", "File2.txt", "README", "SubDir", "SubDir"})
+
+	// A name the sanitizer rejects fails the upload.
+	cw = CollectionWriter{
+		IKeepClient: &KeepTestClient{},
+		NameSanitizer: func(name string) (string, error) {
+			if strings.ToLower(name) != name {
+				return "", errors.New("upper case")
+			}
+			return name, nil
+		},
+	}
+	walkUpload = cw.BeginUpload(context.Background(), tmpdir, log.New(os.Stdout, "", 0))
+	err = walkUpload.Walk()
+	c.Check(err, ErrorMatches, `.*"File1.TXT" rejected by NameSanitizer: upper case.*`)
+	uerr, ok := err.(*UploadError)
+	c.Assert(ok, Equals, true)
+	c.Check(uerr.Path, Equals, "File1.TXT")
+
+	// So does an invalid name.
+	cw.NameSanitizer = func(name string) (string, error) {
+		return "a/" + name, nil
+	}
+	walkUpload = cw.BeginUpload(context.Background(), tmpdir, log.New(os.Stdout, "", 0))
+	c.Check(walkUpload.Walk(), ErrorMatches, `.*"File1.TXT" rejected by NameSanitizer: invalid result "a/File1.TXT".*`)
+}
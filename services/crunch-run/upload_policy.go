@@ -0,0 +1,82 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// StreamPolicy is how the blocks of some of the streams of a
+// collection are stored, see CollectionWriter.StreamPolicies.
+type StreamPolicy struct {
+	// Replication, if greater than zero, is the number of
+	// replicas to store, instead of DesiredReplication.
+	Replication int
+
+	// StorageClasses, if not empty, are the Keep storage classes
+	// (e.g., "archive") to store the blocks in.  Writing a block
+	// fails if the Keep client is not a StorageClassKeepClient.
+	StorageClasses []string
+}
+
+// StorageClassKeepClient is implemented by Keep clients that can store
+// a block in given storage classes.  replicas is the number of replicas
+// to store, or 0 for the client's default.  Return values are the same
+// as for PutHB.
+type StorageClassKeepClient interface {
+	PutHBStorageClasses(hash string, buf []byte, replicas int, classes []string) (string, int, error)
+}
+
+// streamPolicy returns the StreamPolicy for the stream with the given
+// name (e.g., "." or "./subdir"), or nil if there is none.
+func (m *CollectionWriter) streamPolicy(name string) *StreamPolicy {
+	name = strings.TrimPrefix(strings.TrimPrefix(name, "."), "/")
+	var best *StreamPolicy
+	bestLen := -1
+	for prefix, policy := range m.StreamPolicies {
+		prefix := strings.Trim(strings.TrimPrefix(strings.TrimPrefix(prefix, "."), "/"), "/")
+		if prefix != "" && name != prefix && !strings.HasPrefix(name, prefix+"/") {
+			continue
+		}
+		if len(prefix) > bestLen {
+			policy := policy
+			best, bestLen = &policy, len(prefix)
+		}
+	}
+	return best
+}
+
+// policy returns the StreamPolicy of the stream, or nil if there is
+// none (or the writer is not writing a stream, as in PutFile).
+func (m *CollectionFileWriter) policy() *StreamPolicy {
+	if m.ManifestStream == nil {
+		return nil
+	}
+	return m.cw.streamPolicy(m.StreamName)
+}
+
+// storedKey returns the key in CollectionWriter.stored (and
+// BlockCache) of the block with the given hash, stored with
+// p.Replication replicas in p.StorageClasses.
+func (p *StreamPolicy) storedKey(hash string) string {
+	return fmt.Sprintf("%s %d %s", hash, p.Replication, strings.Join(p.StorageClasses, ","))
+}
+
+// storedKey returns the key in CollectionWriter.stored (and
+// BlockCache) of the block with the given hash, including the
+// replication and storage classes the stream's blocks are written
+// with, so that blocks are only reused by writers and streams that
+// store them the same way.
+func (m *CollectionFileWriter) storedKey(hash string) string {
+	p := StreamPolicy{Replication: m.cw.DesiredReplication}
+	if policy := m.policy(); policy != nil {
+		if policy.Replication > 0 {
+			p.Replication = policy.Replication
+		}
+		p.StorageClasses = policy.StorageClasses
+	}
+	return p.storedKey(hash)
+}
@@ -0,0 +1,80 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package main
+
+import (
+	"io/ioutil"
+	"log"
+	"os"
+	"sort"
+	"sync"
+
+	. "gopkg.in/check.v1"
+)
+
+// KeepClassTestClient records the storage classes and replication
+// requested for each block written.
+type KeepClassTestClient struct {
+	KeepTestClient
+	mtx  sync.Mutex
+	puts []string
+}
+
+func (client *KeepClassTestClient) PutHB(hash string, buf []byte) (string, int, error) {
+	return client.PutHBStorageClasses(hash, buf, 0, nil)
+}
+
+func (client *KeepClassTestClient) PutHBStorageClasses(hash string, buf []byte, replicas int, classes []string) (string, int, error) {
+	client.mtx.Lock()
+	client.puts = append(client.puts, (&StreamPolicy{replicas, classes}).storedKey(hash))
+	client.mtx.Unlock()
+	if replicas == 0 {
+		replicas = 2
+	}
+	locator, _, err := client.KeepTestClient.PutHB(hash, buf)
+	return locator, replicas, err
+}
+
+func (s *TestSuite) TestUploadStreamPolicies(c *C) {
+	tmpdir, _ := ioutil.TempDir("", "")
+	defer func() {
+		os.RemoveAll(tmpdir)
+	}()
+
+	os.MkdirAll(tmpdir+"/raw/deeper", 0700)
+	os.Mkdir(tmpdir+"/rawish", 0700)
+	ioutil.WriteFile(tmpdir+"/summary.txt", []byte("foo"), 0600)
+	ioutil.WriteFile(tmpdir+"/raw/data.txt", []byte("foo"), 0600)
+	ioutil.WriteFile(tmpdir+"/raw/deeper/data.txt", []byte("bar"), 0600)
+	ioutil.WriteFile(tmpdir+"/rawish/data.txt", []byte("baz"), 0600)
+
+	kc := &KeepClassTestClient{}
+	cw := CollectionWriter{IKeepClient: kc, StreamPolicies: map[string]StreamPolicy{
+		"./raw":        {StorageClasses: []string{"archive"}},
+		"./raw/deeper": {Replication: 3, StorageClasses: []string{"archive", "offsite"}},
+	}}
+	str, err := writeTree(&cw, tmpdir, log.New(os.Stdout, "", 0))
+	c.Check(err, IsNil)
+	c.Check(str, Equals, `. acbd18db4cc2f85cedef654fccc4a4d8+3 0:3:summary.txt
+./raw acbd18db4cc2f85cedef654fccc4a4d8+3 0:3:data.txt
+./raw/deeper 37b51d194a7513e45b56f6524f2d51f2+3 0:3:data.txt
+./rawish 73feffa4b7f6bb68e44cf984c85f6e88+3 0:3:data.txt
+`)
+	// The same content is written once for each policy.
+	sort.Strings(kc.puts)
+	c.Check(kc.puts, DeepEquals, []string{
+		"37b51d194a7513e45b56f6524f2d51f2 3 archive,offsite",
+		"73feffa4b7f6bb68e44cf984c85f6e88 0 ",
+		"acbd18db4cc2f85cedef654fccc4a4d8 0 ",
+		"acbd18db4cc2f85cedef654fccc4a4d8 0 archive",
+	})
+
+	// Storage classes need a client that supports them.
+	cw = CollectionWriter{IKeepClient: &KeepTestClient{}, StreamPolicies: map[string]StreamPolicy{
+		"./raw": {StorageClasses: []string{"archive"}},
+	}}
+	_, err = writeTree(&cw, tmpdir, log.New(os.Stdout, "", 0))
+	c.Check(err, ErrorMatches, `(?s).*Keep client does not support storage classes.*`)
+}
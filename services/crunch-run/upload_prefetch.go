@@ -0,0 +1,80 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package main
+
+import (
+	"io/ioutil"
+)
+
+// maxPrefetchSize is the size of the largest file that is read ahead of
+// time by uploadEntries.
+const maxPrefetchSize = 1 << 20
+
+// walkEntry is a file found by WalkUpload.walk.
+type walkEntry struct {
+	path       string
+	sourcePath string
+}
+
+// prefetchedFile is the content of a file being read in the
+// background.
+type prefetchedFile struct {
+	done chan struct{}
+	data []byte
+	err  error
+}
+
+func (pf *prefetchedFile) wait() ([]byte, error) {
+	<-pf.done
+	return pf.data, pf.err
+}
+
+// uploadEntries uploads the given files in order, reading small regular
+// files ahead of time, up to "readers" at a time.
+func (m *WalkUpload) uploadEntries(entries []walkEntry, readers int) error {
+	sem := make(chan struct{}, readers)
+	prefetch := make([]*prefetchedFile, len(entries))
+	next := 0
+	for i, e := range entries {
+		// Keep up to 2*readers files in memory, so the readers
+		// stay busy while the blocks are being packed.
+		for ; next < len(entries) && next < i+2*readers; next++ {
+			prefetch[next] = m.startPrefetch(entries[next].sourcePath, sem)
+		}
+		err := m.uploadFile(e.path, e.sourcePath, prefetch[i])
+		prefetch[i] = nil
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func readFile(fs FileSystem, name string) ([]byte, error) {
+	f, err := fs.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ioutil.ReadAll(f)
+}
+
+// startPrefetch starts reading the file at sourcePath in the background,
+// if it is a small regular file.  Otherwise it returns nil.
+func (m *WalkUpload) startPrefetch(sourcePath string, sem chan struct{}) *prefetchedFile {
+	fs := m.fs()
+	info, err := fs.Lstat(sourcePath)
+	if err != nil || !info.Mode().IsRegular() || info.Size() > maxPrefetchSize {
+		return nil
+	}
+	pf := &prefetchedFile{done: make(chan struct{})}
+	go func() {
+		sem <- struct{}{}
+		pf.data, pf.err = readFile(fs, sourcePath)
+		<-sem
+		close(pf.done)
+	}()
+	return pf
+}
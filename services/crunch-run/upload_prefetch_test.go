@@ -0,0 +1,153 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	. "gopkg.in/check.v1"
+)
+
+// makeSmallFileTree creates n small files in a few subdirectories of a
+// new temporary directory.
+func makeSmallFileTree(c *C, n int) string {
+	tmpdir, err := ioutil.TempDir("", "")
+	c.Assert(err, IsNil)
+	for i := 0; i < 10; i++ {
+		c.Assert(os.Mkdir(fmt.Sprintf("%s/dir%d", tmpdir, i), 0700), IsNil)
+	}
+	for i := 0; i < n; i++ {
+		fn := fmt.Sprintf("%s/dir%d/file%d.txt", tmpdir, i%10, i)
+		c.Assert(ioutil.WriteFile(fn, []byte(fmt.Sprintf("content of file %d\n", i)), 0600), IsNil)
+	}
+	return tmpdir
+}
+
+func (s *TestSuite) TestUploadConcurrentReaders(c *C) {
+	tmpdir := makeSmallFileTree(c, 1000)
+	defer os.RemoveAll(tmpdir)
+	ioutil.WriteFile(tmpdir+"/large.txt", make([]byte, maxPrefetchSize+1), 0600)
+	os.Symlink("dir0/file0.txt", tmpdir+"/link.txt")
+
+	cw := CollectionWriter{IKeepClient: &KeepCountTestClient{}, BlockSize: 4096}
+	expect, err := writeTree(&cw, tmpdir, log.New(ioutil.Discard, "", 0))
+	c.Assert(err, IsNil)
+
+	cw = CollectionWriter{IKeepClient: &KeepCountTestClient{}, BlockSize: 4096, MaxReaders: 8}
+	str, err := writeTree(&cw, tmpdir, log.New(ioutil.Discard, "", 0))
+	c.Check(err, IsNil)
+	c.Check(str, Equals, expect)
+}
+
+func (s *TestSuite) TestUploadConcurrentReadersError(c *C) {
+	tmpdir := makeSmallFileTree(c, 20)
+	defer os.RemoveAll(tmpdir)
+	os.Chmod(tmpdir+"/dir3/file13.txt", 0)
+	if _, err := ioutil.ReadFile(tmpdir + "/dir3/file13.txt"); err == nil {
+		c.Skip("cannot test read errors as root")
+	}
+
+	cw := CollectionWriter{IKeepClient: &KeepCountTestClient{}, MaxReaders: 4}
+	_, err := writeTree(&cw, tmpdir, log.New(ioutil.Discard, "", 0))
+	c.Check(err, ErrorMatches, `Upload read failed for "dir3/file13.txt": .*permission denied`)
+}
+
+// openCountFileSystem opens files slowly, and records the largest
+// number of files open at once.
+type openCountFileSystem struct {
+	osFileSystem
+	mtx     *sync.Mutex
+	open    *int
+	maxOpen *int
+}
+
+func (fs openCountFileSystem) Open(name string) (FSFile, error) {
+	fs.mtx.Lock()
+	*fs.open++
+	if *fs.open > *fs.maxOpen {
+		*fs.maxOpen = *fs.open
+	}
+	fs.mtx.Unlock()
+	time.Sleep(5 * time.Millisecond)
+	f, err := os.Open(name)
+	if err != nil {
+		fs.close()
+		return nil, err
+	}
+	return openCountFile{f, fs}, nil
+}
+
+func (fs openCountFileSystem) close() {
+	fs.mtx.Lock()
+	*fs.open--
+	fs.mtx.Unlock()
+}
+
+type openCountFile struct {
+	*os.File
+	fs openCountFileSystem
+}
+
+func (f openCountFile) Close() error {
+	f.fs.close()
+	return f.File.Close()
+}
+
+func (s *TestSuite) TestUploadFileConcurrentReaders(c *C) {
+	tmpdir := makeSmallFileTree(c, 20)
+	defer os.RemoveAll(tmpdir)
+
+	for _, readers := range []int{0, 2} {
+		var mtx sync.Mutex
+		var open, maxOpen int
+		cw := CollectionWriter{IKeepClient: &KeepCountTestClient{}, MaxReaders: readers}
+		walkUpload := cw.BeginUpload(context.Background(), tmpdir, log.New(ioutil.Discard, "", 0))
+		walkUpload.FileSystem = openCountFileSystem{mtx: &mtx, open: &open, maxOpen: &maxOpen}
+		var wg sync.WaitGroup
+		for i := 0; i < 20; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				fn := fmt.Sprintf("dir%d/file%d.txt", i%10, i)
+				c.Check(walkUpload.UploadFile(tmpdir+"/"+fn, fn), IsNil)
+			}(i)
+		}
+		wg.Wait()
+		c.Check(cw.EndUpload(walkUpload), IsNil)
+		str, err := cw.ManifestText()
+		c.Check(err, IsNil)
+		c.Check(strings.Count(str, ".txt"), Equals, 20)
+		// Files are read ahead only in the MaxReaders slots,
+		// besides the one being added.
+		c.Check(maxOpen <= readers+1, Equals, true, Commentf("readers %d, open %d", readers, maxOpen))
+	}
+}
+
+func (s *TestSuite) BenchmarkUploadSmallFilesSerial(c *C) {
+	s.benchmarkUploadSmallFiles(c, 1)
+}
+
+func (s *TestSuite) BenchmarkUploadSmallFilesConcurrent(c *C) {
+	s.benchmarkUploadSmallFiles(c, 8)
+}
+
+func (s *TestSuite) benchmarkUploadSmallFiles(c *C, readers int) {
+	c.StopTimer()
+	tmpdir := makeSmallFileTree(c, 1000)
+	defer os.RemoveAll(tmpdir)
+	c.StartTimer()
+	for i := 0; i < c.N; i++ {
+		cw := CollectionWriter{IKeepClient: &KeepCountTestClient{}, MaxReaders: readers}
+		_, err := writeTree(&cw, tmpdir, log.New(ioutil.Discard, "", 0))
+		c.Assert(err, IsNil)
+	}
+}
@@ -0,0 +1,183 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"math/rand"
+	"reflect"
+	"sort"
+	"strings"
+
+	. "gopkg.in/check.v1"
+)
+
+// roundTripSeeds are the manifests of the tests elsewhere, whose file
+// trees make a starting point for TestManifestRoundTrip and
+// FuzzManifestRoundTrip.
+var roundTripSeeds = []string{
+	"",
+	hwManifest,
+	otherManifest,
+	normalizedManifestWithSubdirs,
+	denormalizedManifestWithSubdirs,
+	". acbd18db4cc2f85cedef654fccc4a4d8+3 37b51d194a7513e45b56f6524f2d51f2+3 0:2:a 2:2:b 4:2:b\n",
+	". acbd18db4cc2f85cedef654fccc4a4d8+3 37b51d194a7513e45b56f6524f2d51f2+3 0:6:my\\040file.txt\n",
+	"./dir\\040one acbd18db4cc2f85cedef654fccc4a4d8+3+K@zzzzz 0:3:sub/file\\134name.txt 3:0:empty\n",
+	". fdba98970961edb29f88241b9d99d890+6 0:3:a\\134040b 3:3:del\\177\n./tab\\011dir acbd18db4cc2f85cedef654fccc4a4d8+3 0:3:new\\012line.txt\n",
+}
+
+// Limits on the trees taken from fuzzed manifests, to keep each round
+// trip quick.
+const (
+	roundTripMaxFiles = 100
+	roundTripMaxBytes = 1 << 20
+)
+
+// treeSizes returns the size of each file in the manifest mt, keyed by
+// path relative to the collection root.
+func treeSizes(mt string) (map[string]int, error) {
+	streams, err := ParseManifest(mt)
+	if err != nil {
+		return nil, err
+	}
+	files := make(map[string]int)
+	for _, st := range streams {
+		for _, seg := range st.FileStreamSegments {
+			if seg.Name == emptyDirMarker && seg.SegLen == 0 {
+				continue
+			}
+			path := seg.Name
+			if st.StreamName != "." {
+				path = st.StreamName[2:] + "/" + path
+			}
+			files[path] += int(seg.SegLen)
+		}
+	}
+	return files, nil
+}
+
+// uploadSizes uploads a file of each of the given sizes, keyed by path,
+// and returns the manifest text.  The content of each file is made
+// from its path.
+func uploadSizes(files map[string]int) (string, error) {
+	var paths []string
+	for path := range files {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+
+	cw := CollectionWriter{IKeepClient: &KeepTestClient{}, BlockSize: 1024}
+	wu := cw.BeginUpload(context.Background(), "", log.New(&bytes.Buffer{}, "", 0))
+	for _, path := range paths {
+		dir, fn := splitManifestPath(path)
+		data := bytes.Repeat([]byte(path), files[path]/len(path)+1)[:files[path]]
+		if err := wu.UploadReader("./"+dir, fn, bytes.NewReader(data)); err != nil {
+			wu.Abort()
+			return "", err
+		}
+	}
+	if err := cw.EndUpload(wu); err != nil {
+		return "", err
+	}
+	return cw.ManifestText()
+}
+
+// checkRoundTrip writes a manifest for a tree of files with the given
+// sizes, and checks that the manifest is valid, that parsing it gives
+// back the same tree, and that writing that tree again (or rewriting
+// the manifest as a BaseManifest) gives the same manifest.
+func checkRoundTrip(files map[string]int) error {
+	mt, err := uploadSizes(files)
+	if err != nil {
+		return fmt.Errorf("writing %v: %s", files, err)
+	}
+	if err := ValidateManifest(mt); err != nil {
+		return fmt.Errorf("writing %v: %s in %q", files, err, mt)
+	}
+	parsed, err := treeSizes(mt)
+	if err != nil {
+		return fmt.Errorf("parsing %q: %s", mt, err)
+	}
+	if !reflect.DeepEqual(parsed, files) && !(len(parsed) == 0 && len(files) == 0) {
+		return fmt.Errorf("parsing %q gave %v instead of %v", mt, parsed, files)
+	}
+	again, err := uploadSizes(parsed)
+	if err != nil {
+		return fmt.Errorf("writing %v again: %s", parsed, err)
+	}
+	if again != mt {
+		return fmt.Errorf("writing %v again gave %q instead of %q", parsed, again, mt)
+	}
+	cw := CollectionWriter{IKeepClient: &KeepTestClient{}, BaseManifest: mt}
+	again, err = cw.ManifestText()
+	if err != nil {
+		return fmt.Errorf("rewriting %q: %s", mt, err)
+	}
+	if again != mt {
+		return fmt.Errorf("rewriting %q gave %q", mt, again)
+	}
+	return nil
+}
+
+// seedTree returns the file tree of the manifest mt, or nil if mt is
+// not a valid manifest or its tree is too big for a quick round trip.
+func seedTree(mt string) map[string]int {
+	if ValidateManifest(mt) != nil {
+		return nil
+	}
+	files, err := treeSizes(mt)
+	if err != nil || len(files) > roundTripMaxFiles {
+		return nil
+	}
+	total := 0
+	for _, size := range files {
+		total += size
+	}
+	if total > roundTripMaxBytes {
+		return nil
+	}
+	return files
+}
+
+// randomTree returns a tree of up to 20 files, with names made of
+// characters that need escaping in manifests, nested up to 3 levels
+// deep.  Directory names start with "d" and file names with "f", so no
+// file has the same path as a directory.
+func randomTree(r *rand.Rand) map[string]int {
+	const chars = "ab.\\ \t\n\x7f:+é"
+	name := func(prefix string) string {
+		b := []byte(prefix)
+		for i := r.Intn(4); i > 0; i-- {
+			b = append(b, chars[r.Intn(len(chars))])
+		}
+		return string(b)
+	}
+	files := make(map[string]int)
+	for i := r.Intn(20); i > 0; i-- {
+		var dirs []string
+		for j := r.Intn(4); j > 0; j-- {
+			dirs = append(dirs, name("d"))
+		}
+		path := strings.Join(append(dirs, name("f")), "/")
+		files[path] = r.Intn(3000)
+	}
+	return files
+}
+
+func (s *TestSuite) TestManifestRoundTrip(c *C) {
+	for _, mt := range roundTripSeeds {
+		files := seedTree(mt)
+		c.Assert(files, NotNil, Commentf("%q", mt))
+		c.Check(checkRoundTrip(files), IsNil)
+	}
+	r := rand.New(rand.NewSource(1))
+	for i := 0; i < 100; i++ {
+		c.Check(checkRoundTrip(randomTree(r)), IsNil)
+	}
+}
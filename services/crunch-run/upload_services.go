@@ -0,0 +1,57 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package main
+
+import (
+	"hash/fnv"
+)
+
+// ServiceKeepClient is implemented by Keep clients that can write a
+// block to a given Keep service.  Each attempt to write a block (see
+// CollectionWriter.MaxRetries) then goes to the service after the one
+// used by the previous attempt, so retries are not spent on a service
+// that is failing.
+type ServiceKeepClient interface {
+	// KeepServices returns the services that blocks can be
+	// written to (e.g., their root URLs), in the same order each
+	// time.
+	KeepServices() []string
+
+	// PutHBService is like PutHB, but writes to the given
+	// service only.
+	PutHBService(service, hash string, buf []byte) (string, int, error)
+}
+
+// serviceClient is an IKeepClient that writes blocks to one service of
+// a ServiceKeepClient.
+type serviceClient struct {
+	IKeepClient
+	skc     ServiceKeepClient
+	service string
+}
+
+func (kc serviceClient) PutHB(hash string, buf []byte) (string, int, error) {
+	return kc.skc.PutHBService(kc.service, hash, buf)
+}
+
+// attemptClient returns the client to use for the given attempt (0 for
+// the first) to write the block with the given hash.  If the Keep client
+// is a ServiceKeepClient, the first attempt goes to a service chosen by
+// the hash, so blocks are spread among the services, and each retry to
+// the next one.  Otherwise, it is the Keep client itself.
+func (m *CollectionFileWriter) attemptClient(hash string, attempt int) IKeepClient {
+	skc, ok := unwrapClient(m.IKeepClient).(ServiceKeepClient)
+	if !ok {
+		return m.IKeepClient
+	}
+	services := skc.KeepServices()
+	if len(services) == 0 {
+		return m.IKeepClient
+	}
+	h := fnv.New32a()
+	h.Write([]byte(hash))
+	i := (int(h.Sum32()%uint32(len(services))) + attempt) % len(services)
+	return serviceClient{IKeepClient: m.IKeepClient, skc: skc, service: services[i]}
+}
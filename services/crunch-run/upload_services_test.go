@@ -0,0 +1,94 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	. "gopkg.in/check.v1"
+)
+
+// KeepServiceTestClient has several Keep services, and fails to write
+// to the ones in "failing".  It records the services each block was
+// written to.
+type KeepServiceTestClient struct {
+	KeepTestClient
+	services []string
+	failing  map[string]bool
+	mtx      sync.Mutex
+	tried    map[string][]string
+}
+
+func (client *KeepServiceTestClient) KeepServices() []string {
+	return client.services
+}
+
+func (client *KeepServiceTestClient) PutHBService(service, hash string, buf []byte) (string, int, error) {
+	client.mtx.Lock()
+	if client.tried == nil {
+		client.tried = make(map[string][]string)
+	}
+	client.tried[hash] = append(client.tried[hash], service)
+	client.mtx.Unlock()
+	if client.failing[service] {
+		return "", 0, tempError{errors.New("503 Service Unavailable"), true}
+	}
+	return client.KeepTestClient.PutHB(hash, buf)
+}
+
+func (client *KeepServiceTestClient) PutHB(hash string, buf []byte) (string, int, error) {
+	return "", 0, errors.New("PutHB should not be called")
+}
+
+func (s *TestSuite) TestUploadRetryOtherServices(c *C) {
+	tmpdir, _ := ioutil.TempDir("", "")
+	defer func() {
+		os.RemoveAll(tmpdir)
+	}()
+
+	ioutil.WriteFile(tmpdir+"/"+"file1.txt", []byte("foo"), 0600)
+	ioutil.WriteFile(tmpdir+"/"+"file2.txt", []byte("bar"), 0600)
+	os.Mkdir(tmpdir+"/subdir", 0700)
+	ioutil.WriteFile(tmpdir+"/subdir/file3.txt", []byte("baz"), 0600)
+
+	services := []string{"keep0", "keep1", "keep2", "keep3"}
+	kc := &KeepServiceTestClient{
+		services: services,
+		failing:  map[string]bool{"keep0": true, "keep1": true, "keep2": true},
+	}
+	cw := CollectionWriter{IKeepClient: kc, MaxRetries: 3, RetryDelay: time.Millisecond}
+	_, err := writeTree(&cw, tmpdir, log.New(os.Stdout, "", 0))
+	c.Check(err, IsNil)
+	c.Assert(kc.tried, HasLen, 2)
+	for hash, tried := range kc.tried {
+		// Each attempt went to a different service, until
+		// the one that works.
+		seen := make(map[string]bool)
+		for _, service := range tried {
+			c.Check(seen[service], Equals, false, Commentf("%s: %v", hash, tried))
+			seen[service] = true
+		}
+		c.Check(tried[len(tried)-1], Equals, "keep3")
+	}
+
+	// With too few retries to reach a working service, the upload
+	// fails after trying that many services.
+	kc = &KeepServiceTestClient{
+		services: services,
+		failing:  map[string]bool{"keep0": true, "keep1": true, "keep2": true, "keep3": true},
+	}
+	cw = CollectionWriter{IKeepClient: kc, MaxRetries: 2, RetryDelay: time.Millisecond}
+	_, err = writeTree(&cw, tmpdir, log.New(os.Stdout, "", 0))
+	c.Check(err, ErrorMatches, `Upload put failed for "file1.txt": 503 Service Unavailable\nUpload put failed for "subdir/file3.txt": 503 Service Unavailable`)
+	for _, tried := range kc.tried {
+		c.Check(tried, HasLen, 3)
+		c.Check(tried[0] != tried[1] && tried[1] != tried[2] && tried[0] != tried[2], Equals, true)
+	}
+}
@@ -0,0 +1,128 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package main
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"git.curoverse.com/arvados.git/sdk/go/arvados"
+	"git.curoverse.com/arvados.git/sdk/go/arvadosclient"
+	"git.curoverse.com/arvados.git/sdk/go/keepclient"
+	"git.curoverse.com/arvados.git/sdk/go/manifest"
+)
+
+// defaultSessionTTL is the default KeepSession.TTL, the same as the
+// lifetime of the Keep services list cached by keepclient.
+const defaultSessionTTL = 5 * time.Minute
+
+// sessionRetryDelay is how long a KeepSession keeps using an expired
+// client after failing to replace it.
+const sessionRetryDelay = 3 * time.Second
+
+// KeepSession shares one Keep client among many uploads (see
+// CollectionWriter.Session), so they reuse its connections and its
+// list of Keep services instead of each setting up a client of its
+// own.  The client is replaced by a new one when it is older than TTL.
+//
+// A KeepSession is safe for concurrent use.
+type KeepSession struct {
+	// Discover returns a new Keep client, configured with the
+	// current list of Keep services.
+	Discover func() (IKeepClient, error)
+
+	// TTL is how long a client returned by Discover is used
+	// before it is replaced.  The default is 5 minutes.  If TTL
+	// is negative, the client is never replaced.
+	TTL time.Duration
+
+	mtx     sync.Mutex
+	kc      IKeepClient
+	expires time.Time
+}
+
+// NewKeepSession returns a KeepSession whose clients use the Keep
+// services of the given API server.  The clients share keepclient's
+// default HTTP client, and thereby its pool of idle connections.
+// Replacing an expired client reloads the list of Keep services.
+func NewKeepSession(arv *arvadosclient.ArvadosClient, retries int) *KeepSession {
+	s := &KeepSession{}
+	s.Discover = func() (IKeepClient, error) {
+		if s.kc != nil {
+			keepclient.RefreshServiceDiscovery()
+		}
+		kc, err := keepclient.MakeKeepClient(arv)
+		if err != nil {
+			return nil, err
+		}
+		kc.Retries = retries
+		return kc, nil
+	}
+	return s
+}
+
+// Client returns the current Keep client, calling Discover if there is
+// none yet or it has expired.  If Discover fails after an earlier call
+// succeeded, Client returns the expired client (whose list of services
+// is probably still usable), and tries Discover again a few seconds
+// later.
+func (s *KeepSession) Client() (IKeepClient, error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	if s.kc != nil && (s.TTL < 0 || time.Now().Before(s.expires)) {
+		return s.kc, nil
+	}
+	if s.Discover == nil {
+		return nil, errors.New("KeepSession has no Discover func")
+	}
+	kc, err := s.Discover()
+	if err != nil {
+		if s.kc != nil {
+			s.expires = time.Now().Add(sessionRetryDelay)
+			return s.kc, nil
+		}
+		return nil, err
+	}
+	ttl := s.TTL
+	if ttl == 0 {
+		ttl = defaultSessionTTL
+	}
+	s.kc, s.expires = kc, time.Now().Add(ttl)
+	return kc, nil
+}
+
+// keepClient returns the Keep client to use for a new upload: a client
+// writing to BlockStore if set, or the current client of Session if
+// set, otherwise IKeepClient.  If the session cannot provide a client,
+// the returned client fails every request with the session's error.
+func (m *CollectionWriter) keepClient() IKeepClient {
+	if m.BlockStore != nil {
+		return blockStoreClient{m.BlockStore}
+	}
+	if m.Session == nil {
+		return m.IKeepClient
+	}
+	kc, err := m.Session.Client()
+	if err != nil {
+		return errKeepClient{err}
+	}
+	return kc
+}
+
+// errKeepClient is an IKeepClient whose requests all fail with err.
+type errKeepClient struct {
+	err error
+}
+
+func (kc errKeepClient) PutHB(hash string, buf []byte) (string, int, error) {
+	return "", 0, kc.err
+}
+
+func (kc errKeepClient) ManifestFileReader(m manifest.Manifest, filename string) (arvados.File, error) {
+	return nil, kc.err
+}
+
+func (kc errKeepClient) ClearBlockCache() {}
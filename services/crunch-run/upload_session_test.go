@@ -0,0 +1,67 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"log"
+	"os"
+	"time"
+
+	. "gopkg.in/check.v1"
+)
+
+func (s *TestSuite) TestKeepSession(c *C) {
+	tmpdir, _ := ioutil.TempDir("", "")
+	defer func() {
+		os.RemoveAll(tmpdir)
+	}()
+
+	ioutil.WriteFile(tmpdir+"/"+"file1.txt", []byte("foo"), 0600)
+
+	discovered := 0
+	kc := &KeepCountTestClient{}
+	session := &KeepSession{Discover: func() (IKeepClient, error) {
+		discovered++
+		return kc, nil
+	}}
+
+	// Uploads by different CollectionWriters use the same client,
+	// which is discovered only once.
+	for i := 0; i < 3; i++ {
+		cw := CollectionWriter{Session: session}
+		str, err := writeTree(&cw, tmpdir, log.New(os.Stdout, "", 0))
+		c.Check(err, IsNil)
+		c.Check(str, Equals, ". acbd18db4cc2f85cedef654fccc4a4d8+3 0:3:file1.txt\n")
+	}
+	c.Check(discovered, Equals, 1)
+	c.Check(kc.puts, Equals, 3)
+
+	// An expired client is replaced.
+	session.expires = time.Now()
+	cw := CollectionWriter{Session: session}
+	_, err := writeTree(&cw, tmpdir, log.New(os.Stdout, "", 0))
+	c.Check(err, IsNil)
+	c.Check(discovered, Equals, 2)
+
+	// If discovery fails, the expired client is used again.
+	session.expires = time.Now()
+	session.Discover = func() (IKeepClient, error) {
+		discovered++
+		return nil, errors.New("discovery failed")
+	}
+	cw = CollectionWriter{Session: session}
+	_, err = writeTree(&cw, tmpdir, log.New(os.Stdout, "", 0))
+	c.Check(err, IsNil)
+	c.Check(discovered, Equals, 3)
+	c.Check(kc.puts, Equals, 5)
+
+	// Without any client, uploads fail with the discovery error.
+	session = &KeepSession{Discover: session.Discover}
+	cw = CollectionWriter{Session: session}
+	_, err = writeTree(&cw, tmpdir, log.New(os.Stdout, "", 0))
+	c.Check(err, ErrorMatches, `.*discovery failed.*`)
+}
@@ -0,0 +1,150 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package main
+
+import (
+	"io"
+)
+
+// sparseHole is a range of a sparse file that reads as zeros and has
+// no data stored on disk.
+type sparseHole struct {
+	offset, length int64
+}
+
+// findHoles returns the holes in the part of the file r (which must be
+// an open file, see findFileHoles) between start and size, or nil if
+// there are none or they cannot be found.  The file offset is left at
+// start.
+func findHoles(r io.Reader, start, size int64) []sparseHole {
+	f, ok := r.(interface {
+		io.Seeker
+		Fd() uintptr
+	})
+	if !ok || size <= start {
+		return nil
+	}
+	holes := findFileHoles(f.Fd(), start, size)
+	if _, err := f.Seek(start, io.SeekStart); err != nil {
+		return nil
+	}
+	return holes
+}
+
+// copySparse copies r, which reads from file, to the current file of
+// fileWriter like io.Copy, except that holes are skipped without
+// reading them and written with writeZeros.  The zeros are also written
+// to h and counted by pr, if they are not nil.  file must be positioned
+// at the current length of fileWriter's file.
+func copySparse(fileWriter *CollectionFileWriter, r io.Reader, file io.Seeker, holes []sparseHole, h io.Writer, pr *progressReader) error {
+	for _, hole := range holes {
+		_, err := io.CopyN(fileWriter, r, hole.offset-int64(fileWriter.length))
+		if err == io.EOF {
+			// The file was truncated.  Let the caller check
+			// its size.
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if _, err := file.Seek(hole.offset+hole.length, io.SeekStart); err != nil {
+			return err
+		}
+		if err := fileWriter.writeZeros(hole.length); err != nil {
+			return err
+		}
+		if h != nil {
+			io.CopyN(h, zeroReader{}, hole.length)
+		}
+		if pr != nil {
+			pr.n += hole.length
+			pr.report(pr.path, pr.n, pr.total)
+		}
+	}
+	_, err := io.Copy(fileWriter, r)
+	return err
+}
+
+// writeZeros adds n zero bytes to the current file.  Instead of writing
+// blocks that contain only zeros, it refers to a single stored block
+// of zeros, so the manifest is the same as if the zeros had been
+// written but they are neither hashed nor stored again.
+func (m *CollectionFileWriter) writeZeros(n int64) error {
+	blockSize := int64(m.cw.blockSize())
+	if m.Block != nil && m.Block.offset > 0 {
+		// Fill the current block first.
+		fill := blockSize - m.Block.offset
+		if fill > n {
+			fill = n
+		}
+		if _, err := m.ReadFrom(io.LimitReader(zeroReader{}, fill)); err != nil {
+			return err
+		}
+		n -= fill
+	}
+	for ; n >= blockSize; n -= blockSize {
+		locator, err := m.zeroBlock()
+		if err != nil {
+			return err
+		}
+		if err := m.cw.addPackedBytes(int(blockSize)); err != nil {
+			return err
+		}
+		block := &Block{
+			offset:  blockSize,
+			path:    streamPath(m.StreamName, m.fn),
+			locator: locator,
+		}
+		if err := m.sendBlock(block); err != nil {
+			return err
+		}
+		m.length += uint64(blockSize)
+	}
+	_, err := m.ReadFrom(io.LimitReader(zeroReader{}, n))
+	return err
+}
+
+// zeroBlock returns the locator of a block of BlockSize zeros, writing
+// it to Keep the first time it is needed with the stream's replication
+// and storage classes.
+func (m *CollectionFileWriter) zeroBlock() (string, error) {
+	cw := m.cw
+	cw.storedMtx.Lock()
+	hash := cw.zeroHash
+	locator := ""
+	if hash != "" {
+		locator = cw.zeroLocators[m.storedKey(hash)]
+	}
+	cw.storedMtx.Unlock()
+	if locator != "" {
+		return locator, nil
+	}
+
+	data := make([]byte, cw.blockSize())
+	if hash == "" {
+		hash = cw.hash(data)
+	}
+	locator, err := m.putBlock(hash, data)
+	if err != nil {
+		return "", err
+	}
+	cw.storedMtx.Lock()
+	if cw.zeroLocators == nil {
+		cw.zeroLocators = make(map[string]string)
+	}
+	cw.zeroHash = hash
+	cw.zeroLocators[m.storedKey(hash)] = locator
+	cw.storedMtx.Unlock()
+	return locator, nil
+}
+
+// zeroReader is an endless source of zeros.
+type zeroReader struct{}
+
+func (zeroReader) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = 0
+	}
+	return len(p), nil
+}
@@ -0,0 +1,39 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package main
+
+import (
+	"golang.org/x/sys/unix"
+)
+
+// findFileHoles returns the holes between start and size in the file
+// open as fd, using SEEK_DATA and SEEK_HOLE.  It returns nil if the
+// file system does not support them.  It changes the file offset.
+func findFileHoles(fd uintptr, start, size int64) []sparseHole {
+	var holes []sparseHole
+	for pos := start; pos < size; {
+		data, err := unix.Seek(int(fd), pos, unix.SEEK_DATA)
+		if err == unix.ENXIO {
+			// No more data
+			data = size
+		} else if err != nil {
+			return nil
+		}
+		if data > size {
+			data = size
+		}
+		if data > pos {
+			holes = append(holes, sparseHole{pos, data - pos})
+		}
+		if data == size {
+			break
+		}
+		pos, err = unix.Seek(int(fd), data, unix.SEEK_HOLE)
+		if err != nil {
+			return nil
+		}
+	}
+	return holes
+}
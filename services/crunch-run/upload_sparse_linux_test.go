@@ -0,0 +1,155 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+
+	. "gopkg.in/check.v1"
+)
+
+// KeepBytesTestClient counts the bytes written by PutHB.
+type KeepBytesTestClient struct {
+	KeepTestClient
+	mtx   sync.Mutex
+	bytes int
+}
+
+func (client *KeepBytesTestClient) PutHB(hash string, buf []byte) (string, int, error) {
+	client.mtx.Lock()
+	defer client.mtx.Unlock()
+	client.bytes += len(buf)
+	return client.KeepTestClient.PutHB(hash, buf)
+}
+
+// readCountFileSystem counts the bytes read from the files it opens.
+type readCountFileSystem struct {
+	osFileSystem
+	n *int64
+}
+
+func (fs readCountFileSystem) Open(name string) (FSFile, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	return &readCountFile{f, fs.n}, nil
+}
+
+// readCountFile has only the methods of *os.File needed by uploads, so
+// all reads go through Read.
+type readCountFile struct {
+	f *os.File
+	n *int64
+}
+
+func (f *readCountFile) Read(p []byte) (int, error) {
+	n, err := f.f.Read(p)
+	*f.n += int64(n)
+	return n, err
+}
+
+func (f *readCountFile) Seek(offset int64, whence int) (int64, error) {
+	return f.f.Seek(offset, whence)
+}
+
+func (f *readCountFile) Close() error {
+	return f.f.Close()
+}
+
+func (f *readCountFile) Readdirnames(n int) ([]string, error) {
+	return f.f.Readdirnames(n)
+}
+
+func (f *readCountFile) Fd() uintptr {
+	return f.f.Fd()
+}
+
+func (s *TestSuite) TestUploadSparseFile(c *C) {
+	tmpdir, _ := ioutil.TempDir("", "")
+	defer func() {
+		os.RemoveAll(tmpdir)
+	}()
+
+	const size = 1<<20 + 3
+	f, err := os.Create(tmpdir + "/sparse.bin")
+	c.Assert(err, IsNil)
+	f.Write([]byte("foo"))
+	f.WriteAt([]byte("bar"), size-3)
+	holes := findFileHoles(f.Fd(), 0, size)
+	f.Close()
+	if len(holes) == 0 {
+		c.Skip("file system does not support SEEK_HOLE")
+	}
+	content, err := ioutil.ReadFile(tmpdir + "/sparse.bin")
+	c.Assert(err, IsNil)
+
+	var nread int64
+	kc := &KeepBytesTestClient{}
+	cw := CollectionWriter{IKeepClient: kc, BlockSize: 65536}
+	walkUpload := cw.BeginUpload(context.Background(), tmpdir, log.New(os.Stdout, "", 0))
+	walkUpload.FileSystem = readCountFileSystem{n: &nread}
+	c.Check(walkUpload.Walk(), IsNil)
+	c.Check(cw.EndUpload(walkUpload), IsNil)
+	str, err := cw.ManifestText()
+	c.Check(err, IsNil)
+	c.Check(nread < size/2, Equals, true)
+	c.Check(kc.bytes < size/2, Equals, true)
+
+	// The manifest is the same as for the same data without holes.
+	cw = CollectionWriter{IKeepClient: &KeepTestClient{}, BlockSize: 65536}
+	walkUpload = cw.BeginUpload(context.Background(), tmpdir, log.New(os.Stdout, "", 0))
+	c.Check(walkUpload.UploadReader(".", "sparse.bin", bytes.NewReader(content)), IsNil)
+	c.Check(cw.EndUpload(walkUpload), IsNil)
+	expect, err := cw.ManifestText()
+	c.Check(err, IsNil)
+	c.Check(str, Equals, expect)
+}
+
+func (s *TestSuite) TestUploadSparseFileStreamPolicies(c *C) {
+	tmpdir, _ := ioutil.TempDir("", "")
+	defer func() {
+		os.RemoveAll(tmpdir)
+	}()
+
+	const size = 1<<20 + 3
+	for _, dir := range []string{"", "/archive"} {
+		os.Mkdir(tmpdir+dir, 0700)
+		f, err := os.Create(tmpdir + dir + "/sparse.bin")
+		c.Assert(err, IsNil)
+		f.WriteAt([]byte("bar"), size-3)
+		holes := findFileHoles(f.Fd(), 0, size)
+		f.Close()
+		if len(holes) == 0 {
+			c.Skip("file system does not support SEEK_HOLE")
+		}
+	}
+
+	// The block of zeros is written once for each policy.
+	kc := &KeepClassTestClient{}
+	cw := CollectionWriter{IKeepClient: kc, BlockSize: 65536, StreamPolicies: map[string]StreamPolicy{
+		"./archive": {Replication: 3, StorageClasses: []string{"archive"}},
+	}}
+	_, err := writeTree(&cw, tmpdir, log.New(os.Stdout, "", 0))
+	c.Check(err, IsNil)
+	zero := fmt.Sprintf("%x", md5.Sum(make([]byte, 65536)))
+	var zeroPuts []string
+	for _, key := range kc.puts {
+		if strings.HasPrefix(key, zero+" ") {
+			zeroPuts = append(zeroPuts, key)
+		}
+	}
+	sort.Strings(zeroPuts)
+	c.Check(zeroPuts, DeepEquals, []string{zero + " 0 ", zero + " 3 archive"})
+}
@@ -0,0 +1,12 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+// +build !linux
+
+package main
+
+// findFileHoles returns nil: finding holes is only supported on Linux.
+func findFileHoles(fd uintptr, start, size int64) []sparseHole {
+	return nil
+}
@@ -0,0 +1,47 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+)
+
+// spilledBlock is a block that waits in SpillDir for a free worker, to
+// be stored as ManifestStream.Blocks[index].
+type spilledBlock struct {
+	block *Block
+	index int
+}
+
+// spillBlock writes the data of block to a file in SpillDir and
+// releases its buffer.  If that fails, the block keeps its buffer.
+func (m *CollectionFileWriter) spillBlock(block *Block) {
+	f, err := ioutil.TempFile(m.cw.SpillDir, "block-")
+	if err != nil {
+		m.status.Warnf("Cannot spill block to disk: %v", err)
+		return
+	}
+	_, err = f.Write(block.data[:block.offset])
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		m.status.Warnf("Cannot spill block to disk: %v", err)
+		os.Remove(f.Name())
+		return
+	}
+	m.releaseBlock(block)
+	block.spill = f.Name()
+}
+
+// blockData returns the data of block, reading it back from its spill
+// file if it was spilled.
+func (m *CollectionFileWriter) blockData(block *Block) ([]byte, error) {
+	if block.spill == "" {
+		return block.data[:block.offset], nil
+	}
+	return ioutil.ReadFile(block.spill)
+}
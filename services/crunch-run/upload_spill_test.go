@@ -0,0 +1,137 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package main
+
+import (
+	"bytes"
+	"crypto/md5"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	. "gopkg.in/check.v1"
+)
+
+// KeepSpillTestClient writes blocks slowly, and records the largest
+// number of files seen in spillDir while writing.
+type KeepSpillTestClient struct {
+	KeepTestClient
+	spillDir   string
+	err        error
+	mtx        sync.Mutex
+	maxSpilled int
+}
+
+func (client *KeepSpillTestClient) PutHB(hash string, buf []byte) (string, int, error) {
+	time.Sleep(10 * time.Millisecond)
+	files, _ := ioutil.ReadDir(client.spillDir)
+	client.mtx.Lock()
+	if len(files) > client.maxSpilled {
+		client.maxSpilled = len(files)
+	}
+	client.mtx.Unlock()
+	if client.err != nil {
+		return "", 0, client.err
+	}
+	return fmt.Sprintf("%x+%d", md5.Sum(buf), len(buf)), 1, nil
+}
+
+func (s *TestSuite) TestUploadSpillDir(c *C) {
+	tmpdir, _ := ioutil.TempDir("", "")
+	defer func() {
+		os.RemoveAll(tmpdir)
+	}()
+	spilldir, _ := ioutil.TempDir("", "")
+	defer func() {
+		os.RemoveAll(spilldir)
+	}()
+
+	var buf bytes.Buffer
+	for i := 0; i < 1600; i++ {
+		fmt.Fprintf(&buf, "%04d\n", i)
+	}
+	os.Mkdir(tmpdir+"/data", 0700)
+	ioutil.WriteFile(tmpdir+"/data/file1.txt", buf.Bytes(), 0600)
+
+	kc := &KeepSpillTestClient{spillDir: spilldir}
+	cw := CollectionWriter{IKeepClient: kc, BlockSize: 1024, MaxWriters: 1, MaxBufferedBlocks: 2, SpillDir: spilldir}
+	str, err := writeTree(&cw, tmpdir, log.New(os.Stdout, "", 0))
+	c.Check(err, IsNil)
+	c.Check(strings.Count(str, "+1024 "), Equals, 7)
+	c.Check(str, Matches, `\./data( [0-9a-f]{32}\+1024){7} [0-9a-f]{32}\+832 0:8000:file1\.txt\n`)
+	c.Check(kc.maxSpilled > 0, Equals, true)
+	files, _ := ioutil.ReadDir(spilldir)
+	c.Check(files, HasLen, 0)
+
+	// Spill files are removed when the upload fails, too.
+	kc = &KeepSpillTestClient{spillDir: spilldir, err: errors.New("503 Service Unavailable")}
+	cw = CollectionWriter{IKeepClient: kc, BlockSize: 1024, MaxWriters: 1, SpillDir: spilldir}
+	_, err = writeTree(&cw, tmpdir, log.New(os.Stdout, "", 0))
+	c.Check(err, NotNil)
+	c.Check(kc.maxSpilled > 0, Equals, true)
+	files, _ = ioutil.ReadDir(spilldir)
+	c.Check(files, HasLen, 0)
+}
+
+// KeepBlockedTestClient does not finish any PutHB call until release
+// is closed.
+type KeepBlockedTestClient struct {
+	KeepTestClient
+	release chan struct{}
+}
+
+func (client *KeepBlockedTestClient) PutHB(hash string, buf []byte) (string, int, error) {
+	<-client.release
+	return fmt.Sprintf("%x+%d", md5.Sum(buf), len(buf)), 1, nil
+}
+
+func (s *TestSuite) TestUploadSpillDirQueue(c *C) {
+	tmpdir, _ := ioutil.TempDir("", "")
+	defer func() {
+		os.RemoveAll(tmpdir)
+	}()
+	spilldir, _ := ioutil.TempDir("", "")
+	defer func() {
+		os.RemoveAll(spilldir)
+	}()
+
+	var buf bytes.Buffer
+	for i := 0; i < 1600; i++ {
+		fmt.Fprintf(&buf, "%04d\n", i)
+	}
+	ioutil.WriteFile(tmpdir+"/file1.txt", buf.Bytes(), 0600)
+
+	// While the only writer is busy with the first block, all the
+	// other blocks of the stream are spilled.
+	kc := &KeepBlockedTestClient{release: make(chan struct{})}
+	cw := CollectionWriter{IKeepClient: kc, BlockSize: 1024, MaxWriters: 1, MaxBufferedBlocks: 2, SpillDir: spilldir}
+	type result struct {
+		str string
+		err error
+	}
+	finished := make(chan result, 1)
+	go func() {
+		str, err := writeTree(&cw, tmpdir, log.New(os.Stdout, "", 0))
+		finished <- result{str, err}
+	}()
+	var spilled int
+	for deadline := time.Now().Add(10 * time.Second); spilled < 7 && time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+		files, _ := ioutil.ReadDir(spilldir)
+		spilled = len(files)
+	}
+	c.Check(spilled, Equals, 7)
+	close(kc.release)
+
+	res := <-finished
+	c.Check(res.err, IsNil)
+	c.Check(res.str, Matches, `\.( [0-9a-f]{32}\+1024){7} [0-9a-f]{32}\+832 0:8000:file1\.txt\n`)
+	files, _ := ioutil.ReadDir(spilldir)
+	c.Check(files, HasLen, 0)
+}
@@ -0,0 +1,58 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package main
+
+import (
+	"errors"
+
+	"git.curoverse.com/arvados.git/sdk/go/arvados"
+	"git.curoverse.com/arvados.git/sdk/go/manifest"
+)
+
+// BlockStore is the storage used by a CollectionWriter to write data
+// blocks (see CollectionWriter.BlockStore), like keepclient.KeepClient.
+//
+// PutB stores buf and returns its locator, i.e., the hash of buf
+// computed by the writer's Hasher (MD5 by default) and its size
+// ("hash+size", optionally followed by hints such as a permission
+// signature), and the number of replicas stored.  It must be safe to
+// call from several goroutines at once.
+//
+// A BlockStore can also implement BlockGetter, to support
+// VerifyAfterWrite and DiffBase; BlockAsker, to support
+// SkipExistingBlocks; and LocatorSigner, to support SignatureTTL.
+type BlockStore interface {
+	PutB(buf []byte) (string, int, error)
+}
+
+// errNoManifestReader is the error returned by
+// blockStoreClient.ManifestFileReader.
+var errNoManifestReader = errors.New("BlockStore does not support reading files")
+
+// blockStoreClient is an IKeepClient that writes blocks to a
+// BlockStore.
+type blockStoreClient struct {
+	BlockStore
+}
+
+func (kc blockStoreClient) PutHB(hash string, buf []byte) (string, int, error) {
+	return kc.PutB(buf)
+}
+
+func (kc blockStoreClient) ManifestFileReader(m manifest.Manifest, filename string) (arvados.File, error) {
+	return nil, errNoManifestReader
+}
+
+func (kc blockStoreClient) ClearBlockCache() {}
+
+// unwrapClient returns the BlockStore that kc writes to, if it is a
+// blockStoreClient, otherwise kc itself, for checking whether it
+// implements the optional interfaces documented for BlockStore.
+func unwrapClient(kc IKeepClient) interface{} {
+	if kc, ok := kc.(blockStoreClient); ok {
+		return kc.BlockStore
+	}
+	return kc
+}
@@ -0,0 +1,89 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package main
+
+import (
+	"bytes"
+	"crypto/md5"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+	"sync"
+
+	. "gopkg.in/check.v1"
+)
+
+// memBlockStore is a BlockStore that keeps blocks in memory.
+type memBlockStore struct {
+	mtx    sync.Mutex
+	blocks map[string][]byte
+	puts   int
+	gets   int
+}
+
+func (bs *memBlockStore) PutB(buf []byte) (string, int, error) {
+	bs.mtx.Lock()
+	defer bs.mtx.Unlock()
+	if bs.blocks == nil {
+		bs.blocks = make(map[string][]byte)
+	}
+	locator := fmt.Sprintf("%x+%d", md5.Sum(buf), len(buf))
+	bs.blocks[locator] = append([]byte(nil), buf...)
+	bs.puts++
+	return locator, 1, nil
+}
+
+func (bs *memBlockStore) Get(locator string) (io.ReadCloser, int64, string, error) {
+	bs.mtx.Lock()
+	defer bs.mtx.Unlock()
+	bs.gets++
+	data, ok := bs.blocks[blockKey(locator)]
+	if !ok {
+		return nil, 0, "", errors.New("404 Not Found")
+	}
+	return ioutil.NopCloser(bytes.NewReader(data)), int64(len(data)), "", nil
+}
+
+func (bs *memBlockStore) Ask(locator string) (int64, string, error) {
+	bs.mtx.Lock()
+	defer bs.mtx.Unlock()
+	data, ok := bs.blocks[blockKey(locator)]
+	if !ok {
+		return 0, "", errors.New("404 Not Found")
+	}
+	return int64(len(data)), "", nil
+}
+
+func (s *TestSuite) TestUploadBlockStore(c *C) {
+	tmpdir, _ := ioutil.TempDir("", "")
+	defer func() {
+		os.RemoveAll(tmpdir)
+	}()
+
+	ioutil.WriteFile(tmpdir+"/"+"file1.txt", []byte("foo"), 0600)
+	os.Mkdir(tmpdir+"/subdir", 0700)
+	ioutil.WriteFile(tmpdir+"/subdir/file2.txt", []byte(strings.Repeat("x", 1500)), 0600)
+
+	bs := &memBlockStore{}
+	cw := CollectionWriter{BlockStore: bs, BlockSize: 1024, VerifyAfterWrite: true}
+	str, err := writeTree(&cw, tmpdir, log.New(os.Stdout, "", 0))
+	c.Check(err, IsNil)
+	c.Check(str, Equals, `. acbd18db4cc2f85cedef654fccc4a4d8+3 0:3:file1.txt
+./subdir 7265f4d211b56873a381d321f586e4a9+1024 d52f0917a96b330b9d15237c84ff70f6+476 0:1500:file2.txt
+`)
+	c.Check(bs.puts, Equals, 3)
+	c.Check(bs.gets, Equals, 3)
+
+	// Blocks already in the store are not written again.
+	cw = CollectionWriter{BlockStore: bs, BlockSize: 1024, SkipExistingBlocks: true}
+	again, err := writeTree(&cw, tmpdir, log.New(os.Stdout, "", 0))
+	c.Check(err, IsNil)
+	c.Check(again, Equals, str)
+	c.Check(bs.puts, Equals, 3)
+}
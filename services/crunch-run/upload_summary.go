@@ -0,0 +1,73 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// UploadSummary describes a finished upload, see FinishUpload.
+type UploadSummary struct {
+	// TotalBytes is the size of the collection's blocks
+	// (BytesWritten).
+	TotalBytes int64
+
+	// UniqueBytes is the number of bytes written to Keep, after
+	// deduplication (UniqueBytesStored).
+	UniqueBytes int64
+
+	// Blocks is the number of blocks in the collection
+	// (BlocksWritten).
+	Blocks int
+
+	// Files is the number of files in the collection.
+	Files int
+
+	// Warnings are the files the upload skipped (see
+	// WalkUpload.Warnings).
+	Warnings []UploadWarning
+
+	// Elapsed is the time from BeginUpload to the end of the
+	// upload.
+	Elapsed time.Duration
+}
+
+// String returns the summary as a one-line message for the log.
+func (s UploadSummary) String() string {
+	return fmt.Sprintf("%d files, %d bytes in %d blocks (%d bytes stored), %d skipped, in %v",
+		s.Files, s.TotalBytes, s.Blocks, s.UniqueBytes, len(s.Warnings), s.Elapsed/time.Millisecond*time.Millisecond)
+}
+
+// FinishUpload ends the upload like EndUpload, and returns the manifest
+// text of the collection (see ManifestText) along with a summary of
+// the upload.  The byte, block and file counts are those of the whole
+// collection, which are the upload's own when the collection was
+// written by a single upload.
+//
+// FinishUpload is meant for the last upload to a collection: like
+// ManifestText, it waits for all of the collection's blocks to be
+// written.  Use EndUpload to end uploads that are followed by others.
+func (cw *CollectionWriter) FinishUpload(wu *WalkUpload) (string, UploadSummary, error) {
+	var mt string
+	err := cw.EndUpload(wu)
+	if err == nil {
+		mt, err = cw.ManifestText()
+	}
+	summary := UploadSummary{
+		TotalBytes:  cw.BytesWritten(),
+		UniqueBytes: cw.UniqueBytesStored(),
+		Blocks:      cw.BlocksWritten(),
+		Warnings:    wu.Warnings(),
+		Elapsed:     time.Since(wu.started),
+	}
+	cw.storedMtx.Lock()
+	summary.Files = cw.fileCount
+	cw.storedMtx.Unlock()
+	if err != nil {
+		return "", summary, err
+	}
+	return mt, summary, nil
+}
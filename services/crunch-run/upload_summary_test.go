@@ -0,0 +1,72 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"log"
+	"os"
+	"syscall"
+	"time"
+
+	. "gopkg.in/check.v1"
+)
+
+func (s *TestSuite) TestFinishUploadSummary(c *C) {
+	tmpdir, _ := ioutil.TempDir("", "")
+	defer func() {
+		os.RemoveAll(tmpdir)
+	}()
+	os.Mkdir(tmpdir+"/subdir", 0700)
+	ioutil.WriteFile(tmpdir+"/file1.txt", []byte("foo"), 0600)
+	ioutil.WriteFile(tmpdir+"/subdir/file2.txt", []byte("foo"), 0600)
+	ioutil.WriteFile(tmpdir+"/subdir/file3.txt", []byte("bar"), 0600)
+	c.Assert(syscall.Mkfifo(tmpdir+"/pipe", 0600), IsNil)
+
+	cw := CollectionWriter{IKeepClient: &KeepTestClient{}}
+	t0 := time.Now()
+	wu := cw.BeginUpload(context.Background(), tmpdir, log.New(os.Stdout, "", 0))
+	c.Assert(wu.Walk(), IsNil)
+	mt, summary, err := cw.FinishUpload(wu)
+	c.Assert(err, IsNil)
+	c.Check(mt, Equals, ". acbd18db4cc2f85cedef654fccc4a4d8+3 0:3:file1.txt\n"+
+		"./subdir 3858f62230ac3c915f300c664312c63f+6 0:3:file2.txt 3:3:file3.txt\n")
+	c.Check(summary.TotalBytes, Equals, int64(9))
+	c.Check(summary.UniqueBytes, Equals, int64(9))
+	c.Check(summary.Blocks, Equals, 2)
+	c.Check(summary.Files, Equals, 3)
+	c.Check(summary.Warnings, DeepEquals, []UploadWarning{{Path: "pipe", Reason: "special file (fifo)"}})
+	c.Check(summary.Elapsed > 0, Equals, true)
+	c.Check(summary.Elapsed <= time.Since(t0), Equals, true)
+	c.Check(summary.String(), Matches, `3 files, 9 bytes in 2 blocks \(9 bytes stored\), 1 skipped, in [0-9.]+m?s`)
+
+	// A second upload of the same content stores nothing new.
+	cw = CollectionWriter{IKeepClient: &KeepTestClient{}}
+	wu = cw.BeginUpload(context.Background(), tmpdir, log.New(os.Stdout, "", 0))
+	wu.TargetPrefix = "./a"
+	c.Assert(wu.Walk(), IsNil)
+	c.Assert(cw.EndUpload(wu), IsNil)
+	wu = cw.BeginUpload(context.Background(), tmpdir, log.New(os.Stdout, "", 0))
+	wu.TargetPrefix = "./b"
+	c.Assert(wu.Walk(), IsNil)
+	_, summary, err = cw.FinishUpload(wu)
+	c.Assert(err, IsNil)
+	c.Check(summary.TotalBytes, Equals, int64(18))
+	c.Check(summary.UniqueBytes, Equals, int64(9))
+	c.Check(summary.Blocks, Equals, 4)
+	c.Check(summary.Files, Equals, 6)
+	c.Check(summary.Warnings, DeepEquals, []UploadWarning{{Path: "b/pipe", Reason: "special file (fifo)"}})
+
+	// After a failed upload, the summary is still returned.
+	cw = CollectionWriter{IKeepClient: &KeepErrorTestClient{}}
+	wu = cw.BeginUpload(context.Background(), tmpdir, log.New(os.Stdout, "", 0))
+	wu.Walk()
+	mt, summary, err = cw.FinishUpload(wu)
+	c.Check(err, NotNil)
+	c.Check(mt, Equals, "")
+	c.Check(summary.Blocks, Equals, 0)
+	c.Check(summary.Warnings, HasLen, 1)
+}
@@ -0,0 +1,203 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"compress/gzip"
+	"fmt"
+	"io"
+	pathpkg "path"
+	"sort"
+
+	"git.curoverse.com/arvados.git/sdk/go/manifest"
+)
+
+// UploadTar stores the files in the tar archive read from r (which may
+// be compressed with gzip) under destPrefix (e.g., "." or "./data",
+// relative to the collection root), without extracting them to disk.
+// Regular files go through the same block packing as UploadFile, and
+// entries are otherwise treated as Walk treats the files on disk:
+//
+// Symbolic links are handled according to SymlinkMode.  With
+// SymlinkFollow, a link to a file stored earlier from the same archive
+// in the same directory refers to its content (as a hard link does);
+// other links are left out, with an UploadWarning.  Hard links are
+// handled the same way.  Directories are recorded only with
+// PreserveEmptyDirs, if nothing in the archive is under them.  Special
+// files (devices and named pipes) are handled according to
+// SpecialFilePolicy.  Extended (pax and GNU) headers are not files and
+// are ignored; entries of other types are left out, with an
+// UploadWarning.  Modes,
+// modification times, and extended attributes are taken from the
+// archive as configured by PreserveMode, PreserveMtime, and
+// PreserveXattrs.  Names in the archive cannot refer to anything
+// outside destPrefix: ".." at the top is ignored.
+func (m *WalkUpload) UploadTar(r io.Reader, destPrefix string) error {
+	if err := m.ctx.Err(); err != nil {
+		return err
+	}
+	m.addMtx.Lock()
+	defer m.addMtx.Unlock()
+	br := bufio.NewReader(r)
+	if magic, err := br.Peek(2); err == nil && magic[0] == 0x1f && magic[1] == 0x8b {
+		zr, err := gzip.NewReader(br)
+		if err != nil {
+			return err
+		}
+		defer zr.Close()
+		r = zr
+	} else {
+		r = br
+	}
+
+	prefix := m.normalizeName(cleanDestPath(destPrefix))
+	stored := make(map[string]hardlink)
+	dirs := make(map[string]bool)
+	nonEmpty := make(map[string]bool)
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return fmt.Errorf("Error reading tar archive: %v", err)
+		}
+		if err := m.ctx.Err(); err != nil {
+			return err
+		}
+		switch hdr.Typeflag {
+		case tar.TypeXGlobalHeader, tar.TypeXHeader, tar.TypeGNULongName, tar.TypeGNULongLink:
+			// These only describe other entries (e.g., the
+			// pax_global_header written by "git archive").
+			continue
+		}
+		path := cleanDestPath(prefix + "/" + m.normalizeName(hdr.Name))
+		if path == prefix || path == "/" {
+			continue
+		}
+		dir, fn := splitManifestPath(path[1:])
+		if dir == "" {
+			dir = "."
+		}
+		for d := dir; d != "." && !nonEmpty[d]; d = pathpkg.Dir(d) {
+			nonEmpty[d] = true
+		}
+		dir, fn, err = m.sanitizePath(dir, fn)
+		if err != nil {
+			return err
+		}
+
+		info := hdr.FileInfo()
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			dirs[path[1:]] = true
+		case tar.TypeReg, tar.TypeRegA:
+			if err := m.uploadReader(dir, fn, tr, hdr.Size); err != nil {
+				return err
+			}
+			fw, err := m.getStream(dir)
+			if err != nil {
+				return err
+			}
+			stored[path] = hardlink{dir: dir, offset: fw.offset, length: fw.length, path: streamPath(dir, fn)}
+			if err := m.recordTarMetadata(dir, fn, hdr); err != nil {
+				return err
+			}
+		case tar.TypeSymlink:
+			switch m.cw.SymlinkMode {
+			case SymlinkSkip:
+			case SymlinkStore:
+				m.symlinks[streamPath(dir, fn)] = hdr.Linkname
+			default:
+				linkname := m.normalizeName(hdr.Linkname)
+				target := pathpkg.Join(pathpkg.Dir(path), linkname)
+				if pathpkg.IsAbs(linkname) {
+					target = cleanDestPath(prefix + "/" + linkname)
+				}
+				if err := m.tarLink(dir, fn, hdr, stored[target]); err != nil {
+					return err
+				}
+			}
+		case tar.TypeLink:
+			target := cleanDestPath(prefix + "/" + m.normalizeName(hdr.Linkname))
+			if err := m.tarLink(dir, fn, hdr, stored[target]); err != nil {
+				return err
+			}
+		case tar.TypeChar, tar.TypeBlock, tar.TypeFifo:
+			if err := m.specialFile(dir, fn, info); err != nil {
+				return err
+			}
+		default:
+			if err := m.skipFile(dir, fn, fmt.Sprintf("unsupported tar entry type %q", hdr.Typeflag)); err != nil {
+				return err
+			}
+		}
+	}
+	if m.cw.PreserveEmptyDirs {
+		var empty []string
+		for dir := range dirs {
+			if !nonEmpty[dir] {
+				empty = append(empty, dir)
+			}
+		}
+		sort.Strings(empty)
+		for _, dir := range empty {
+			if err := m.addEmptyStream(dir); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// tarLink stores the link hdr as file fn in stream dir, referring to
+// hl, the content of a file stored earlier by UploadTar.  The file is
+// left out if hl is not in the same stream (or was not stored at all).
+func (m *WalkUpload) tarLink(dir, fn string, hdr *tar.Header, hl hardlink) error {
+	if hl.dir != dir {
+		return m.skipFile(dir, fn, fmt.Sprintf("link to %q, which is not a file stored earlier in the same directory", hdr.Linkname))
+	}
+	fw, err := m.getStream(dir)
+	if err != nil {
+		return err
+	}
+	fn, err = m.resolveConflict(fw, dir, fn)
+	if err != nil {
+		return err
+	}
+	if err := m.countFile(dir, fn); err != nil {
+		return err
+	}
+	m.status.WithField("path", streamPath(dir, fn)).Infof("Uploading %v/%v (link)", dir, fn)
+	fw.ManifestStream.FileStreamSegments = append(fw.ManifestStream.FileStreamSegments,
+		manifest.FileStreamSegment{hl.offset, hl.length, fn})
+	if hash, ok := m.hashes[hl.path]; ok {
+		m.hashes[streamPath(dir, fn)] = hash
+	}
+	if digest, ok := m.sha256s[hl.path]; ok {
+		m.sha256s[streamPath(dir, fn)] = digest
+	}
+	if sum, ok := m.md5s[hl.path]; ok {
+		m.md5s[streamPath(dir, fn)] = sum
+	}
+	return m.recordTarMetadata(dir, fn, hdr)
+}
+
+// recordTarMetadata records the FileMetadata of a file stored by
+// UploadTar, taken from its header in the archive.
+func (m *WalkUpload) recordTarMetadata(dir, fn string, hdr *tar.Header) error {
+	path := streamPath(dir, fn)
+	m.recordFileInfo(path, hdr.FileInfo())
+	if m.cw.PreserveXattrs && len(hdr.Xattrs) > 0 {
+		attrs := make(map[string]string)
+		for k, v := range hdr.Xattrs {
+			attrs[k] = v
+		}
+		m.fileMetadata(path).Xattrs = attrs
+	}
+	return nil
+}
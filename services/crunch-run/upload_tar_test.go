@@ -0,0 +1,132 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+
+	. "gopkg.in/check.v1"
+)
+
+// tarEntry is a file to put in a tar archive built by makeTar.
+type tarEntry struct {
+	hdr  tar.Header
+	data string
+}
+
+func makeTar(c *C, entries []tarEntry) []byte {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, e := range entries {
+		hdr := e.hdr
+		hdr.Size = int64(len(e.data))
+		if hdr.Mode == 0 && hdr.Typeflag != tar.TypeXGlobalHeader {
+			hdr.Mode = 0644
+		}
+		c.Assert(tw.WriteHeader(&hdr), IsNil)
+		_, err := tw.Write([]byte(e.data))
+		c.Assert(err, IsNil)
+	}
+	c.Assert(tw.Close(), IsNil)
+	return buf.Bytes()
+}
+
+func (s *TestSuite) TestUploadTar(c *C) {
+	tmpdir, _ := ioutil.TempDir("", "")
+	defer func() {
+		os.RemoveAll(tmpdir)
+	}()
+
+	os.Mkdir(tmpdir+"/subdir", 0700)
+	ioutil.WriteFile(tmpdir+"/"+"file1.txt", []byte("foo"), 0600)
+	ioutil.WriteFile(tmpdir+"/subdir/file2.txt", []byte(strings.Repeat("x", 1500)), 0600)
+	os.Mkdir(tmpdir+"/empty", 0700)
+
+	cw := CollectionWriter{IKeepClient: &KeepTestClient{}, BlockSize: 1024, PreserveEmptyDirs: true}
+	walkUpload := cw.BeginUpload(context.Background(), tmpdir, log.New(os.Stdout, "", 0))
+	walkUpload.TargetPrefix = "./data"
+	c.Check(walkUpload.Walk(), IsNil)
+	c.Check(cw.EndUpload(walkUpload), IsNil)
+	expected, err := cw.ManifestText()
+	c.Check(err, IsNil)
+
+	archive := makeTar(c, []tarEntry{
+		{tar.Header{Name: "./", Typeflag: tar.TypeDir}, ""},
+		{tar.Header{Name: "./file1.txt", Typeflag: tar.TypeReg}, "foo"},
+		{tar.Header{Name: "./empty/", Typeflag: tar.TypeDir}, ""},
+		{tar.Header{Name: "./subdir/", Typeflag: tar.TypeDir}, ""},
+		{tar.Header{Name: "./subdir/file2.txt", Typeflag: tar.TypeReg}, strings.Repeat("x", 1500)},
+	})
+	var gz bytes.Buffer
+	zw := gzip.NewWriter(&gz)
+	zw.Write(archive)
+	zw.Close()
+
+	for _, data := range [][]byte{archive, gz.Bytes()} {
+		cw := CollectionWriter{IKeepClient: &KeepTestClient{}, BlockSize: 1024, PreserveEmptyDirs: true}
+		walkUpload := cw.BeginUpload(context.Background(), tmpdir, log.New(os.Stdout, "", 0))
+		c.Check(walkUpload.UploadTar(bytes.NewReader(data), "./data"), IsNil)
+		c.Check(cw.EndUpload(walkUpload), IsNil)
+		str, err := cw.ManifestText()
+		c.Check(err, IsNil)
+		c.Check(str, Equals, expected)
+	}
+}
+
+func (s *TestSuite) TestUploadTarLinks(c *C) {
+	archive := makeTar(c, []tarEntry{
+		{tar.Header{Name: "file1.txt", Typeflag: tar.TypeReg}, "foo"},
+		{tar.Header{Name: "hardlink.txt", Typeflag: tar.TypeLink, Linkname: "file1.txt"}, ""},
+		{tar.Header{Name: "symlink.txt", Typeflag: tar.TypeSymlink, Linkname: "file1.txt"}, ""},
+		{tar.Header{Name: "subdir/outside", Typeflag: tar.TypeSymlink, Linkname: "../file1.txt"}, ""},
+		{tar.Header{Name: "fifo", Typeflag: tar.TypeFifo}, ""},
+	})
+
+	cw := CollectionWriter{IKeepClient: &KeepTestClient{}}
+	walkUpload := cw.BeginUpload(context.Background(), ".", log.New(os.Stdout, "", 0))
+	c.Check(walkUpload.UploadTar(bytes.NewReader(archive), "."), IsNil)
+	c.Check(cw.EndUpload(walkUpload), IsNil)
+	str, err := cw.ManifestText()
+	c.Check(err, IsNil)
+	c.Check(str, Equals, ". acbd18db4cc2f85cedef654fccc4a4d8+3 0:3:file1.txt 0:3:hardlink.txt 0:3:symlink.txt\n")
+	c.Check(walkUpload.Warnings(), DeepEquals, []UploadWarning{
+		{Path: "subdir/outside", Reason: `link to "../file1.txt", which is not a file stored earlier in the same directory`},
+		{Path: "fifo", Reason: "special file (fifo)"},
+	})
+
+	cw = CollectionWriter{IKeepClient: &KeepTestClient{}, SymlinkMode: SymlinkStore}
+	walkUpload = cw.BeginUpload(context.Background(), ".", log.New(os.Stdout, "", 0))
+	c.Check(walkUpload.UploadTar(bytes.NewReader(archive), "."), IsNil)
+	c.Check(cw.EndUpload(walkUpload), IsNil)
+	str, err = cw.ManifestText()
+	c.Check(err, IsNil)
+	c.Check(str, Equals, ". acbd18db4cc2f85cedef654fccc4a4d8+3 0:3:file1.txt 0:3:hardlink.txt\n")
+	c.Check(cw.Symlinks(), DeepEquals, map[string]string{"symlink.txt": "file1.txt", "subdir/outside": "../file1.txt"})
+}
+
+func (s *TestSuite) TestUploadTarPAXGlobalHeader(c *C) {
+	archive := makeTar(c, []tarEntry{
+		{tar.Header{Typeflag: tar.TypeXGlobalHeader, PAXRecords: map[string]string{"comment": "0123456789abcdef"}}, ""},
+		{tar.Header{Name: "file1.txt", Typeflag: tar.TypeReg}, "foo"},
+	})
+	for _, policy := range []SpecialFilePolicy{SpecialFileSkip, SpecialFileError, SpecialFileRecord} {
+		cw := CollectionWriter{IKeepClient: &KeepTestClient{}, SpecialFilePolicy: policy}
+		walkUpload := cw.BeginUpload(context.Background(), "", log.New(os.Stdout, "", 0))
+		c.Check(walkUpload.UploadTar(bytes.NewReader(archive), "."), IsNil)
+		c.Check(cw.EndUpload(walkUpload), IsNil)
+		str, err := cw.ManifestText()
+		c.Check(err, IsNil)
+		c.Check(str, Equals, ". acbd18db4cc2f85cedef654fccc4a4d8+3 0:3:file1.txt\n")
+		c.Check(walkUpload.Warnings(), HasLen, 0)
+		c.Check(cw.FileMetadata(), HasLen, 0)
+	}
+}
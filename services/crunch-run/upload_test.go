@@ -5,13 +5,25 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"crypto/sha1"
+	"errors"
+	"fmt"
 	. "gopkg.in/check.v1"
 	"io/ioutil"
 	"log"
+	"net"
 	"os"
-	"path/filepath"
+	"sort"
+	"strings"
 	"sync"
 	"syscall"
+	"time"
+
+	"git.curoverse.com/arvados.git/sdk/go/arvados"
+	"git.curoverse.com/arvados.git/sdk/go/manifest"
 )
 
 type UploadTestSuite struct{}
@@ -20,15 +32,9 @@ type UploadTestSuite struct{}
 var _ = Suite(&UploadTestSuite{})
 
 func writeTree(cw *CollectionWriter, root string, status *log.Logger) (mt string, err error) {
-	walkUpload := cw.BeginUpload(root, status)
+	walkUpload := cw.BeginUpload(context.Background(), root, status)
 
-	err = filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
-		info, _ = os.Stat(path)
-		if info.Mode().IsRegular() {
-			return walkUpload.UploadFile(path, path)
-		}
-		return nil
-	})
+	err = walkUpload.Walk()
 
 	cw.EndUpload(walkUpload)
 	if err != nil {
@@ -46,7 +52,7 @@ func (s *TestSuite) TestSimpleUpload(c *C) {
 
 	ioutil.WriteFile(tmpdir+"/"+"file1.txt", []byte("foo"), 0600)
 
-	cw := CollectionWriter{0, &KeepTestClient{}, nil, nil, sync.Mutex{}}
+	cw := CollectionWriter{IKeepClient: &KeepTestClient{}}
 	str, err := writeTree(&cw, tmpdir, log.New(os.Stdout, "", 0))
 	c.Check(err, IsNil)
 	c.Check(str, Equals, ". acbd18db4cc2f85cedef654fccc4a4d8+3 0:3:file1.txt\n")
@@ -67,7 +73,7 @@ func (s *TestSuite) TestUploadThreeFiles(c *C) {
 		c.Assert(err, IsNil)
 	}
 
-	cw := CollectionWriter{0, &KeepTestClient{}, nil, nil, sync.Mutex{}}
+	cw := CollectionWriter{IKeepClient: &KeepTestClient{}}
 	str, err := writeTree(&cw, tmpdir, log.New(os.Stdout, "", 0))
 
 	c.Check(err, IsNil)
@@ -85,20 +91,254 @@ func (s *TestSuite) TestSimpleUploadSubdir(c *C) {
 	ioutil.WriteFile(tmpdir+"/"+"file1.txt", []byte("foo"), 0600)
 	ioutil.WriteFile(tmpdir+"/subdir/file2.txt", []byte("bar"), 0600)
 
-	cw := CollectionWriter{0, &KeepTestClient{}, nil, nil, sync.Mutex{}}
+	cw := CollectionWriter{IKeepClient: &KeepTestClient{}}
 	str, err := writeTree(&cw, tmpdir, log.New(os.Stdout, "", 0))
 
 	c.Check(err, IsNil)
 
-	// streams can get added in either order because of scheduling
-	// of goroutines.
-	if str != `. acbd18db4cc2f85cedef654fccc4a4d8+3 0:3:file1.txt
+	c.Check(str, Equals, `. acbd18db4cc2f85cedef654fccc4a4d8+3 0:3:file1.txt
 ./subdir 37b51d194a7513e45b56f6524f2d51f2+3 0:3:file2.txt
-` && str != `./subdir 37b51d194a7513e45b56f6524f2d51f2+3 0:3:file2.txt
-. acbd18db4cc2f85cedef654fccc4a4d8+3 0:3:file1.txt
-` {
-		c.Error("Did not get expected manifest text")
+`)
+}
+
+func (s *TestSuite) TestUploadStreamsStartNewBlocks(c *C) {
+	tmpdir, _ := ioutil.TempDir("", "")
+	defer func() {
+		os.RemoveAll(tmpdir)
+	}()
+
+	for _, dir := range []string{"a", "b"} {
+		os.Mkdir(tmpdir+"/"+dir, 0700)
+		for i := 0; i < 3; i++ {
+			ioutil.WriteFile(fmt.Sprintf("%s/%s/file%d.txt", tmpdir, dir, i), bytes.Repeat([]byte(dir), 400+i), 0600)
+		}
+	}
+
+	cw := CollectionWriter{IKeepClient: &KeepTestClient{}, BlockSize: 1024}
+	str, err := writeTree(&cw, tmpdir, log.New(os.Stdout, "", 0))
+	c.Check(err, IsNil)
+	streams, err := ParseManifest(str)
+	c.Assert(err, IsNil)
+	c.Assert(streams, HasLen, 2)
+	// Neither stream has a block with data from the other.
+	c.Check(streams[0].Blocks, HasLen, 2)
+	c.Check(streams[1].Blocks, HasLen, 2)
+	for _, a := range streams[0].Blocks {
+		for _, b := range streams[1].Blocks {
+			c.Check(a, Not(Equals), b)
+		}
+	}
+	c.Check(streams[0].FileStreamSegments[0].SegPos, Equals, uint64(0))
+	c.Check(streams[1].FileStreamSegments[0].SegPos, Equals, uint64(0))
+}
+
+func (s *TestSuite) TestUploadSingleFileRoot(c *C) {
+	tmpdir, _ := ioutil.TempDir("", "")
+	defer func() {
+		os.RemoveAll(tmpdir)
+	}()
+
+	os.Mkdir(tmpdir+"/subdir", 0700)
+	ioutil.WriteFile(tmpdir+"/subdir/file2.txt", []byte("bar"), 0600)
+	ioutil.WriteFile(tmpdir+"/subdir/file3.txt", []byte("baz"), 0600)
+
+	for _, readers := range []int{0, 4} {
+		cw := CollectionWriter{IKeepClient: &KeepTestClient{}, MaxReaders: readers}
+		str, err := writeTree(&cw, tmpdir+"/subdir/file2.txt", log.New(os.Stdout, "", 0))
+		c.Check(err, IsNil)
+		c.Check(str, Equals, ". 37b51d194a7513e45b56f6524f2d51f2+3 0:3:file2.txt\n")
+	}
+}
+
+func (s *TestSuite) TestUploadNormalizedOrder(c *C) {
+	tmpdir, _ := ioutil.TempDir("", "")
+	defer func() {
+		os.RemoveAll(tmpdir)
+	}()
+
+	os.Mkdir(tmpdir+"/subdir", 0700)
+
+	ioutil.WriteFile(tmpdir+"/"+"file1.txt", []byte("foo"), 0600)
+	ioutil.WriteFile(tmpdir+"/"+"file2.txt", []byte("bar"), 0600)
+	ioutil.WriteFile(tmpdir+"/subdir/file3.txt", []byte("baz"), 0600)
+
+	cw := CollectionWriter{IKeepClient: &KeepTestClient{}}
+	walkUpload := cw.BeginUpload(context.Background(), tmpdir, log.New(os.Stdout, "", 0))
+	for _, fn := range []string{"/subdir/file3.txt", "/file2.txt", "/file1.txt"} {
+		c.Check(walkUpload.UploadFile(tmpdir+fn, fn), IsNil)
+	}
+	cw.EndUpload(walkUpload)
+	str, err := cw.ManifestText()
+
+	c.Check(err, IsNil)
+	c.Check(str, Equals, `. 96948aad3fcae80c08a35c9b5958cd89+6 3:3:file1.txt 0:3:file2.txt
+./subdir 73feffa4b7f6bb68e44cf984c85f6e88+3 0:3:file3.txt
+`)
+}
+
+func (s *TestSuite) TestUploadRawManifestText(c *C) {
+	tmpdir, _ := ioutil.TempDir("", "")
+	defer func() {
+		os.RemoveAll(tmpdir)
+	}()
+
+	os.Mkdir(tmpdir+"/subdir", 0700)
+
+	ioutil.WriteFile(tmpdir+"/"+"file1.txt", []byte("foo"), 0600)
+	ioutil.WriteFile(tmpdir+"/"+"file2.txt", []byte("bar"), 0600)
+	ioutil.WriteFile(tmpdir+"/subdir/file3.txt", []byte("baz"), 0600)
+
+	cw := CollectionWriter{IKeepClient: &KeepTestClient{}}
+	walkUpload := cw.BeginUpload(context.Background(), tmpdir, log.New(os.Stdout, "", 0))
+	for _, fn := range []string{"/subdir/file3.txt", "/file2.txt", "/file1.txt"} {
+		c.Check(walkUpload.UploadFile(tmpdir+fn, fn), IsNil)
+	}
+	cw.EndUpload(walkUpload)
+
+	raw, err := cw.RawManifestText()
+	c.Check(err, IsNil)
+	c.Check(raw, Equals, `./subdir 73feffa4b7f6bb68e44cf984c85f6e88+3 0:3:file3.txt
+. 96948aad3fcae80c08a35c9b5958cd89+6 0:3:file2.txt 3:3:file1.txt
+`)
+
+	str, err := cw.ManifestText()
+	c.Check(err, IsNil)
+	c.Check(str, Equals, `. 96948aad3fcae80c08a35c9b5958cd89+6 3:3:file1.txt 0:3:file2.txt
+./subdir 73feffa4b7f6bb68e44cf984c85f6e88+3 0:3:file3.txt
+`)
+}
+
+func (s *TestSuite) TestEndUploadTwice(c *C) {
+	tmpdir, _ := ioutil.TempDir("", "")
+	defer func() {
+		os.RemoveAll(tmpdir)
+	}()
+
+	os.Mkdir(tmpdir+"/subdir", 0700)
+	ioutil.WriteFile(tmpdir+"/"+"file1.txt", []byte("foo"), 0600)
+	ioutil.WriteFile(tmpdir+"/subdir/file2.txt", []byte("bar"), 0600)
+
+	cw := CollectionWriter{IKeepClient: &KeepTestClient{}}
+	walkUpload := cw.BeginUpload(context.Background(), tmpdir, log.New(os.Stdout, "", 0))
+	c.Check(walkUpload.Walk(), IsNil)
+	c.Check(cw.EndUpload(walkUpload), IsNil)
+	str1, err := cw.ManifestText()
+	c.Check(err, IsNil)
+	c.Check(cw.EndUpload(walkUpload), IsNil)
+	str2, err := cw.ManifestText()
+	c.Check(err, IsNil)
+	c.Check(str2, Equals, str1)
+	raw, err := cw.RawManifestText()
+	c.Check(err, IsNil)
+	c.Check(raw, Equals, str1)
+
+	// A failed upload returns the same error again.
+	kc := &KeepFlakyTestClient{failures: 1, err: tempError{errors.New("403 Forbidden"), false}}
+	cw = CollectionWriter{IKeepClient: kc}
+	walkUpload = cw.BeginUpload(context.Background(), tmpdir, log.New(os.Stdout, "", 0))
+	c.Check(walkUpload.Walk(), IsNil)
+	err = cw.EndUpload(walkUpload)
+	c.Check(err, NotNil)
+	c.Check(cw.EndUpload(walkUpload), Equals, err)
+}
+
+func (s *TestSuite) TestUploadAbort(c *C) {
+	tmpdir, _ := ioutil.TempDir("", "")
+	defer func() {
+		os.RemoveAll(tmpdir)
+	}()
+
+	ioutil.WriteFile(tmpdir+"/"+"file1.txt", []byte(strings.Repeat("x", 1500)), 0600)
+	ioutil.WriteFile(tmpdir+"/"+"file2.txt", []byte("bar"), 0600)
+
+	kc := &KeepCountTestClient{}
+	cw := CollectionWriter{IKeepClient: kc, BlockSize: 1024, MaxBufferedBlocks: 1, MaxCollectionBytes: 1600}
+	walkUpload := cw.BeginUpload(context.Background(), tmpdir, log.New(os.Stdout, "", 0))
+	c.Check(walkUpload.UploadFile(tmpdir+"/file1.txt", "file1.txt"), IsNil)
+	walkUpload.Abort()
+	c.Check(cw.EndUpload(walkUpload), ErrorMatches, `Upload was aborted`)
+	walkUpload.Abort()
+
+	// The buffer and the size limit used by the aborted upload
+	// are available to the next one, which is the only one in
+	// the collection.
+	walkUpload = cw.BeginUpload(context.Background(), tmpdir, log.New(os.Stdout, "", 0))
+	c.Check(walkUpload.UploadFile(tmpdir+"/file1.txt", "file1.txt"), IsNil)
+	c.Check(walkUpload.UploadFile(tmpdir+"/file2.txt", "file2.txt"), IsNil)
+	c.Check(cw.EndUpload(walkUpload), IsNil)
+	str, err := cw.ManifestText()
+	c.Check(err, IsNil)
+	c.Check(str, Matches, `\. [0-9a-f]{32}\+1024 [0-9a-f]{32}\+479 0:1500:file1\.txt 1500:3:file2\.txt\n`)
+	c.Check(cw.Streams, HasLen, 1)
+}
+func (s *TestSuite) TestWriteManifest(c *C) {
+	tmpdir, _ := ioutil.TempDir("", "")
+	defer func() {
+		os.RemoveAll(tmpdir)
+	}()
+
+	os.MkdirAll(tmpdir+"/subdir/deeper", 0700)
+	os.Mkdir(tmpdir+"/empty", 0700)
+	ioutil.WriteFile(tmpdir+"/"+"file1.txt", []byte("foo"), 0600)
+	ioutil.WriteFile(tmpdir+"/subdir/file2.txt", []byte("bar"), 0600)
+	ioutil.WriteFile(tmpdir+"/subdir/deeper/file3.txt", []byte("baz"), 0600)
+	ioutil.WriteFile(tmpdir+"/subdir/deeper/file4.txt", []byte("foo"), 0600)
+
+	cw := CollectionWriter{
+		IKeepClient:       &KeepTestClient{},
+		PreserveEmptyDirs: true,
+		BaseManifest:      ". 37b51d194a7513e45b56f6524f2d51f2+3 0:3:file0.txt 0:3:file1.txt\n./other 37b51d194a7513e45b56f6524f2d51f2+3 0:3:x.txt\n",
 	}
+	walkUpload := cw.BeginUpload(context.Background(), tmpdir, log.New(os.Stdout, "", 0))
+	c.Check(walkUpload.Walk(), IsNil)
+	c.Check(cw.EndUpload(walkUpload), IsNil)
+	fw := cw.Open("subdir/deeper/file5.txt")
+	fw.Write([]byte("qux"))
+	fw.Close()
+
+	var buf bytes.Buffer
+	c.Check(cw.WriteManifest(&buf), IsNil)
+	str, err := cw.ManifestText()
+	c.Check(err, IsNil)
+	c.Check(buf.String(), Equals, str)
+
+	base, err := cw.baseStreamTexts()
+	c.Assert(err, IsNil)
+	raw := strings.Join(append(base, cw.rawStreamTexts()...), "")
+	c.Check(str, Equals, escapeEmptyDirMarkers(manifest.Manifest{Text: raw}.Extract(".", ".").Text))
+	c.Check(str, Equals, `. 37b51d194a7513e45b56f6524f2d51f2+3 acbd18db4cc2f85cedef654fccc4a4d8+3 0:3:file0.txt 3:3:file1.txt
+./empty d41d8cd98f00b204e9800998ecf8427e+0 0:0:\056
+./other 37b51d194a7513e45b56f6524f2d51f2+3 0:3:x.txt
+./subdir 37b51d194a7513e45b56f6524f2d51f2+3 0:3:file2.txt
+./subdir/deeper b6a013d5e2c00f894584ad577249dbc7+6 d85b1213473c2fd7c2045020a6b9c62b+3 0:3:file3.txt 3:3:file4.txt 6:3:file5.txt
+`)
+}
+
+func (s *TestSuite) TestUploadFileDestination(c *C) {
+	tmpdir, _ := ioutil.TempDir("", "")
+	defer func() {
+		os.RemoveAll(tmpdir)
+	}()
+	srcdir, _ := ioutil.TempDir("", "")
+	defer func() {
+		os.RemoveAll(srcdir)
+	}()
+
+	ioutil.WriteFile(srcdir+"/"+"file1.txt", []byte("foo"), 0600)
+	ioutil.WriteFile(tmpdir+"/"+"file2.txt", []byte("bar"), 0600)
+
+	cw := CollectionWriter{IKeepClient: &KeepTestClient{}}
+	walkUpload := cw.BeginUpload(context.Background(), tmpdir, log.New(os.Stdout, "", 0))
+	c.Check(walkUpload.UploadFile(srcdir+"/file1.txt", "./renamed/out.txt"), IsNil)
+	c.Check(walkUpload.UploadFile(tmpdir+"/file2.txt", "/flat.txt"), IsNil)
+	c.Check(walkUpload.UploadFile(tmpdir+"/file2.txt", "./"), ErrorMatches, `Invalid destination path "\./"`)
+	c.Check(cw.EndUpload(walkUpload), IsNil)
+	str, err := cw.ManifestText()
+
+	c.Check(err, IsNil)
+	c.Check(str, Equals, `. 37b51d194a7513e45b56f6524f2d51f2+3 0:3:flat.txt
+./renamed acbd18db4cc2f85cedef654fccc4a4d8+3 0:3:out.txt
+`)
 }
 
 func (s *TestSuite) TestSimpleUploadLarge(c *C) {
@@ -119,11 +359,18 @@ func (s *TestSuite) TestSimpleUploadLarge(c *C) {
 
 	ioutil.WriteFile(tmpdir+"/"+"file2.txt", []byte("bar"), 0600)
 
-	cw := CollectionWriter{0, &KeepTestClient{}, nil, nil, sync.Mutex{}}
+	cw := CollectionWriter{IKeepClient: &KeepTestClient{}}
 	str, err := writeTree(&cw, tmpdir, log.New(os.Stdout, "", 0))
 
 	c.Check(err, IsNil)
 	c.Check(str, Equals, ". 00ecf01e0d93385115c9f8bed757425d+67108864 485cd630387b6b1846fe429f261ea05f+1048514 0:68157375:file1.txt 68157375:3:file2.txt\n")
+	c.Check(cw.BytesWritten(), Equals, int64(68157378))
+	c.Check(cw.BlocksWritten(), Equals, 2)
+	c.Check(cw.UniqueBytesStored(), Equals, int64(68157378))
+	c.Check(cw.UniqueLocators(), DeepEquals, []string{
+		"00ecf01e0d93385115c9f8bed757425d+67108864",
+		"485cd630387b6b1846fe429f261ea05f+1048514",
+	})
 }
 
 func (s *TestSuite) TestUploadEmptySubdir(c *C) {
@@ -136,7 +383,7 @@ func (s *TestSuite) TestUploadEmptySubdir(c *C) {
 
 	ioutil.WriteFile(tmpdir+"/"+"file1.txt", []byte("foo"), 0600)
 
-	cw := CollectionWriter{0, &KeepTestClient{}, nil, nil, sync.Mutex{}}
+	cw := CollectionWriter{IKeepClient: &KeepTestClient{}}
 	str, err := writeTree(&cw, tmpdir, log.New(os.Stdout, "", 0))
 
 	c.Check(err, IsNil)
@@ -144,6 +391,65 @@ func (s *TestSuite) TestUploadEmptySubdir(c *C) {
 `)
 }
 
+func (s *TestSuite) TestUploadOnlySpecialFiles(c *C) {
+	tmpdir, _ := ioutil.TempDir("", "")
+	defer func() {
+		os.RemoveAll(tmpdir)
+	}()
+	os.Mkdir(tmpdir+"/subdir", 0700)
+	c.Assert(syscall.Mkfifo(tmpdir+"/subdir/pipe", 0600), IsNil)
+	ioutil.WriteFile(tmpdir+"/subdir/build.log", []byte("excluded"), 0600)
+
+	for _, trial := range []struct {
+		policy SpecialFilePolicy
+		index  bool
+	}{
+		{SpecialFileSkip, false},
+		{SpecialFileRecord, false},
+		{SpecialFileSkip, true},
+	} {
+		cw := CollectionWriter{IKeepClient: &KeepTestClient{}, SpecialFilePolicy: trial.policy, Exclude: []string{"*.log"}, WriteIndex: trial.index}
+		walkUpload := cw.BeginUpload(context.Background(), tmpdir, log.New(os.Stdout, "", 0))
+		c.Check(walkUpload.Walk(), IsNil)
+		c.Check(cw.EndUpload(walkUpload), IsNil)
+		str, err := cw.ManifestText()
+		c.Check(err, IsNil)
+		c.Check(str, Equals, "")
+		raw, err := cw.RawManifestText()
+		c.Check(err, IsNil)
+		c.Check(raw, Equals, "")
+		pdh, err := cw.PortableDataHash()
+		c.Check(err, IsNil)
+		c.Check(pdh, Equals, "d41d8cd98f00b204e9800998ecf8427e+0")
+		c.Check(cw.BlocksWritten(), Equals, 0)
+	}
+}
+
+func (s *TestSuite) TestUploadPreserveEmptyDirs(c *C) {
+	tmpdir, _ := ioutil.TempDir("", "")
+	defer func() {
+		os.RemoveAll(tmpdir)
+	}()
+
+	os.Mkdir(tmpdir+"/subdir", 0700)
+	os.MkdirAll(tmpdir+"/subdir2/empty dir", 0700)
+	ioutil.WriteFile(tmpdir+"/"+"file1.txt", []byte("foo"), 0600)
+
+	cw := CollectionWriter{IKeepClient: &KeepTestClient{}, PreserveEmptyDirs: true}
+	str, err := writeTree(&cw, tmpdir, log.New(os.Stdout, "", 0))
+	c.Check(err, IsNil)
+	c.Check(str, Equals, `. acbd18db4cc2f85cedef654fccc4a4d8+3 0:3:file1.txt
+./subdir d41d8cd98f00b204e9800998ecf8427e+0 0:0:\056
+./subdir2/empty\040dir d41d8cd98f00b204e9800998ecf8427e+0 0:0:\056
+`)
+
+	streams, err := ParseManifest(str)
+	c.Assert(err, IsNil)
+	c.Check(streams, HasLen, 3)
+	c.Check(streams[1].StreamName, Equals, "./subdir")
+	c.Check(streams[1].FileStreamSegments, DeepEquals, []manifest.FileStreamSegment{{0, 0, "."}})
+}
+
 func (s *TestSuite) TestUploadEmptyFile(c *C) {
 	tmpdir, _ := ioutil.TempDir("", "")
 	defer func() {
@@ -152,7 +458,7 @@ func (s *TestSuite) TestUploadEmptyFile(c *C) {
 
 	ioutil.WriteFile(tmpdir+"/"+"file1.txt", []byte(""), 0600)
 
-	cw := CollectionWriter{0, &KeepTestClient{}, nil, nil, sync.Mutex{}}
+	cw := CollectionWriter{IKeepClient: &KeepTestClient{}}
 	str, err := writeTree(&cw, tmpdir, log.New(os.Stdout, "", 0))
 
 	c.Check(err, IsNil)
@@ -160,6 +466,27 @@ func (s *TestSuite) TestUploadEmptyFile(c *C) {
 `)
 }
 
+func (s *TestSuite) TestUploadManyEmptyFiles(c *C) {
+	tmpdir, _ := ioutil.TempDir("", "")
+	defer func() {
+		os.RemoveAll(tmpdir)
+	}()
+
+	for i := 1; i <= 5; i++ {
+		ioutil.WriteFile(fmt.Sprintf("%s/file%d.txt", tmpdir, i), nil, 0600)
+	}
+
+	kc := &KeepCountTestClient{}
+	cw := CollectionWriter{IKeepClient: kc}
+	str, err := writeTree(&cw, tmpdir, log.New(os.Stdout, "", 0))
+
+	c.Check(err, IsNil)
+	c.Check(str, Equals, `. d41d8cd98f00b204e9800998ecf8427e+0 0:0:file1.txt 0:0:file2.txt 0:0:file3.txt 0:0:file4.txt 0:0:file5.txt
+`)
+	c.Check(kc.puts, Equals, 0)
+	c.Check(cw.BlocksWritten(), Equals, 0)
+}
+
 func (s *TestSuite) TestUploadError(c *C) {
 	tmpdir, _ := ioutil.TempDir("", "")
 	defer func() {
@@ -168,9 +495,1842 @@ func (s *TestSuite) TestUploadError(c *C) {
 
 	ioutil.WriteFile(tmpdir+"/"+"file1.txt", []byte("foo"), 0600)
 
-	cw := CollectionWriter{0, &KeepErrorTestClient{}, nil, nil, sync.Mutex{}}
+	cw := CollectionWriter{IKeepClient: &KeepErrorTestClient{}}
 	str, err := writeTree(&cw, tmpdir, log.New(os.Stdout, "", 0))
 
 	c.Check(err, NotNil)
 	c.Check(str, Equals, "")
+
+	uerr, ok := err.(*UploadError)
+	c.Assert(ok, Equals, true)
+	c.Check(uerr.Path, Equals, "file1.txt")
+	c.Check(uerr.Phase, Equals, UploadPhasePut)
+	c.Check(uerr.Err, ErrorMatches, "KeepError")
+}
+
+func (s *TestSuite) TestUploadErrorMultipleFiles(c *C) {
+	tmpdir, _ := ioutil.TempDir("", "")
+	defer func() {
+		os.RemoveAll(tmpdir)
+	}()
+
+	os.Mkdir(tmpdir+"/subdir", 0700)
+	ioutil.WriteFile(tmpdir+"/"+"file1.txt", []byte("foo"), 0600)
+	ioutil.WriteFile(tmpdir+"/subdir/file2.txt", []byte("bar"), 0600)
+
+	cw := CollectionWriter{IKeepClient: &KeepErrorTestClient{}}
+	_, err := writeTree(&cw, tmpdir, log.New(os.Stdout, "", 0))
+
+	errs, ok := err.(UploadErrors)
+	c.Assert(ok, Equals, true)
+	var paths []string
+	for _, err := range errs {
+		uerr, ok := err.(*UploadError)
+		c.Assert(ok, Equals, true)
+		c.Check(uerr.Phase, Equals, UploadPhasePut)
+		paths = append(paths, uerr.Path)
+	}
+	sort.Strings(paths)
+	c.Check(paths, DeepEquals, []string{"file1.txt", "subdir/file2.txt"})
+}
+
+type KeepCountTestClient struct {
+	KeepTestClient
+	mtx  sync.Mutex
+	puts int
+}
+
+func (client *KeepCountTestClient) PutHB(hash string, buf []byte) (string, int, error) {
+	client.mtx.Lock()
+	defer client.mtx.Unlock()
+	client.puts++
+	return client.KeepTestClient.PutHB(hash, buf)
+}
+
+func (s *TestSuite) TestConcurrentUploads(c *C) {
+	tmpdir, _ := ioutil.TempDir("", "")
+	defer func() {
+		os.RemoveAll(tmpdir)
+	}()
+
+	os.MkdirAll(tmpdir+"/a/sub", 0700)
+	os.Mkdir(tmpdir+"/b", 0700)
+	ioutil.WriteFile(tmpdir+"/a/file1.txt", []byte("foo"), 0600)
+	ioutil.WriteFile(tmpdir+"/a/sub/file2.txt", []byte("bar"), 0600)
+	ioutil.WriteFile(tmpdir+"/b/file3.txt", []byte("foo"), 0600)
+
+	for i := 0; i < 10; i++ {
+		kc := &KeepCountTestClient{}
+		cw := CollectionWriter{IKeepClient: kc}
+		var wg sync.WaitGroup
+		for _, dir := range []string{"a", "b"} {
+			wg.Add(1)
+			go func(dir string) {
+				defer wg.Done()
+				walkUpload := cw.BeginUpload(context.Background(), tmpdir+"/"+dir, log.New(os.Stdout, "", 0))
+				walkUpload.TargetPrefix = "./" + dir
+				c.Check(walkUpload.Walk(), IsNil)
+				c.Check(cw.EndUpload(walkUpload), IsNil)
+			}(dir)
+		}
+		wg.Wait()
+		str, err := cw.ManifestText()
+		c.Check(err, IsNil)
+		c.Check(str, Equals, `./a acbd18db4cc2f85cedef654fccc4a4d8+3 0:3:file1.txt
+./a/sub 37b51d194a7513e45b56f6524f2d51f2+3 0:3:file2.txt
+./b acbd18db4cc2f85cedef654fccc4a4d8+3 0:3:file3.txt
+`)
+		// The block shared by both uploads is written once.
+		c.Check(kc.puts, Equals, 2)
+	}
+}
+
+func (s *TestSuite) TestConcurrentUploadFile(c *C) {
+	tmpdir, _ := ioutil.TempDir("", "")
+	defer func() {
+		os.RemoveAll(tmpdir)
+	}()
+
+	content := make(map[string][]byte)
+	for i := 0; i < 200; i++ {
+		data := bytes.Repeat([]byte(fmt.Sprintf("%03d", i)), 1+i*i)
+		if i == 17 {
+			// A file too big to be read ahead
+			data = bytes.Repeat(data, 1+(1<<20)/len(data))
+		}
+		content[fmt.Sprintf("dir%d/file%03d.txt", i%5, i)] = data
+		ioutil.WriteFile(fmt.Sprintf("%s/%03d", tmpdir, i), data, 0600)
+	}
+
+	kc := &KeepStoreTestClient{}
+	cw := CollectionWriter{IKeepClient: kc, BlockSize: 1 << 16, MaxWriters: 4}
+	walkUpload := cw.BeginUpload(context.Background(), tmpdir, log.New(ioutil.Discard, "", 0))
+	todo := make(chan string)
+	var wg sync.WaitGroup
+	for w := 0; w < 8; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for dest := range todo {
+				src := tmpdir + "/" + strings.TrimSuffix(strings.Split(dest, "/file")[1], ".txt")
+				c.Check(walkUpload.UploadFile(src, dest), IsNil)
+			}
+		}()
+	}
+	for dest := range content {
+		todo <- dest
+	}
+	close(todo)
+	wg.Wait()
+	c.Assert(cw.EndUpload(walkUpload), IsNil)
+	mt, err := cw.ManifestText()
+	c.Assert(err, IsNil)
+	c.Check(ValidateManifest(mt), IsNil)
+
+	// Each file has the right content.
+	idx, err := collectionIndex(mt)
+	c.Assert(err, IsNil)
+	c.Check(idx.Files, HasLen, len(content))
+	for _, f := range idx.Files {
+		var data []byte
+		for _, seg := range f.Segments {
+			block := kc.blocks[strings.Split(seg.Block, "+")[0]]
+			data = append(data, block[seg.Offset:seg.Offset+seg.Length]...)
+		}
+		c.Check(bytes.Equal(data, content[f.Path]), Equals, true, Commentf("%s", f.Path))
+	}
+}
+
+func (s *TestSuite) TestUploadCancel(c *C) {
+	tmpdir, _ := ioutil.TempDir("", "")
+	defer func() {
+		os.RemoveAll(tmpdir)
+	}()
+
+	ioutil.WriteFile(tmpdir+"/"+"file1.txt", []byte("foo"), 0600)
+	ioutil.WriteFile(tmpdir+"/"+"file2.txt", []byte("bar"), 0600)
+
+	kc := &KeepCountTestClient{}
+	cw := CollectionWriter{IKeepClient: kc}
+	ctx, cancel := context.WithCancel(context.Background())
+	walkUpload := cw.BeginUpload(ctx, tmpdir, log.New(os.Stdout, "", 0))
+
+	c.Check(walkUpload.UploadFile(tmpdir+"/file1.txt", "file1.txt"), IsNil)
+	cancel()
+	c.Check(walkUpload.UploadFile(tmpdir+"/file2.txt", "file2.txt"), Equals, context.Canceled)
+	c.Check(cw.EndUpload(walkUpload), Equals, context.Canceled)
+
+	str, err := cw.ManifestText()
+	c.Check(err, NotNil)
+	c.Check(str, Equals, "")
+	c.Check(kc.puts, Equals, 0)
+}
+
+func (s *TestSuite) TestUploadSymlinkModes(c *C) {
+	tmpdir, _ := ioutil.TempDir("", "")
+	defer func() {
+		os.RemoveAll(tmpdir)
+	}()
+
+	for _, err := range []error{
+		ioutil.WriteFile(tmpdir+"/"+"file1.txt", []byte("foo"), 0600),
+		os.Symlink("./file1.txt", tmpdir+"/link-rel.txt"),
+		os.Symlink(tmpdir+"/file1.txt", tmpdir+"/link-abs.txt"),
+	} {
+		c.Assert(err, IsNil)
+	}
+
+	cw := CollectionWriter{IKeepClient: &KeepTestClient{}}
+	str, err := writeTree(&cw, tmpdir, log.New(os.Stdout, "", 0))
+	c.Check(err, IsNil)
+	c.Check(str, Equals, ". 216d7c020d0732def6775af81f6dc44f+9 0:3:file1.txt 3:3:link-abs.txt 6:3:link-rel.txt\n")
+	c.Check(cw.Symlinks(), HasLen, 0)
+
+	cw = CollectionWriter{IKeepClient: &KeepTestClient{}, SymlinkMode: SymlinkSkip}
+	str, err = writeTree(&cw, tmpdir, log.New(os.Stdout, "", 0))
+	c.Check(err, IsNil)
+	c.Check(str, Equals, ". acbd18db4cc2f85cedef654fccc4a4d8+3 0:3:file1.txt\n")
+	c.Check(cw.Symlinks(), HasLen, 0)
+
+	cw = CollectionWriter{IKeepClient: &KeepTestClient{}, SymlinkMode: SymlinkStore}
+	str, err = writeTree(&cw, tmpdir, log.New(os.Stdout, "", 0))
+	c.Check(err, IsNil)
+	c.Check(str, Equals, ". acbd18db4cc2f85cedef654fccc4a4d8+3 0:3:file1.txt\n")
+	c.Check(cw.Symlinks(), DeepEquals, map[string]string{
+		"link-rel.txt": "./file1.txt",
+		"link-abs.txt": tmpdir + "/file1.txt",
+	})
+}
+
+func (s *TestSuite) TestUploadSymlinkDanglingOrOutside(c *C) {
+	tmpdir, _ := ioutil.TempDir("", "")
+	defer func() {
+		os.RemoveAll(tmpdir)
+	}()
+	outside, _ := ioutil.TempFile("", "")
+	outside.Close()
+	defer os.Remove(outside.Name())
+
+	os.Mkdir(tmpdir+"/subdir", 0700)
+	for _, err := range []error{
+		ioutil.WriteFile(tmpdir+"/"+"file1.txt", []byte("foo"), 0600),
+		os.Symlink("./missing.txt", tmpdir+"/subdir/dangling.txt"),
+		os.Symlink(outside.Name(), tmpdir+"/outside.txt"),
+	} {
+		c.Assert(err, IsNil)
+	}
+
+	cw := CollectionWriter{IKeepClient: &KeepTestClient{}}
+	_, err := writeTree(&cw, tmpdir, log.New(os.Stdout, "", 0))
+	c.Check(err, ErrorMatches, `Symlink ".*/outside.txt" points to .*, which is outside the upload root .*`)
+
+	os.Remove(tmpdir + "/outside.txt")
+	cw = CollectionWriter{IKeepClient: &KeepTestClient{}}
+	_, err = writeTree(&cw, tmpdir, log.New(os.Stdout, "", 0))
+	c.Check(err, ErrorMatches, `Cannot follow symlink ".*/subdir/dangling.txt": .*`)
+
+	os.Symlink(outside.Name(), tmpdir+"/outside.txt")
+	for _, mode := range []SymlinkMode{SymlinkSkip, SymlinkStore} {
+		cw = CollectionWriter{IKeepClient: &KeepTestClient{}, SymlinkMode: mode}
+		str, err := writeTree(&cw, tmpdir, log.New(os.Stdout, "", 0))
+		c.Check(err, IsNil)
+		c.Check(str, Equals, ". acbd18db4cc2f85cedef654fccc4a4d8+3 0:3:file1.txt\n")
+	}
+	c.Check(cw.Symlinks(), DeepEquals, map[string]string{
+		"subdir/dangling.txt": "./missing.txt",
+		"outside.txt":         outside.Name(),
+	})
+}
+
+func (s *TestSuite) TestUploadSymlinkDir(c *C) {
+	tmpdir, _ := ioutil.TempDir("", "")
+	defer func() {
+		os.RemoveAll(tmpdir)
+	}()
+
+	os.Mkdir(tmpdir+"/subdir", 0700)
+	for _, err := range []error{
+		ioutil.WriteFile(tmpdir+"/subdir/file1.txt", []byte("foo"), 0600),
+		os.Symlink("subdir", tmpdir+"/linkdir"),
+	} {
+		c.Assert(err, IsNil)
+	}
+
+	cw := CollectionWriter{IKeepClient: &KeepTestClient{}}
+	str, err := writeTree(&cw, tmpdir, log.New(os.Stdout, "", 0))
+	c.Check(err, IsNil)
+	c.Check(str, Matches, `(?s).*\./linkdir acbd18db4cc2f85cedef654fccc4a4d8\+3 0:3:file1.txt\n.*`)
+	c.Check(str, Matches, `(?s).*\./subdir acbd18db4cc2f85cedef654fccc4a4d8\+3 0:3:file1.txt\n.*`)
+}
+
+func (s *TestSuite) TestUploadSymlinkLoop(c *C) {
+	tmpdir, _ := ioutil.TempDir("", "")
+	defer func() {
+		os.RemoveAll(tmpdir)
+	}()
+
+	os.Mkdir(tmpdir+"/subdir", 0700)
+	for _, err := range []error{
+		ioutil.WriteFile(tmpdir+"/subdir/file1.txt", []byte("foo"), 0600),
+		os.Symlink("..", tmpdir+"/subdir/loop"),
+	} {
+		c.Assert(err, IsNil)
+	}
+
+	cw := CollectionWriter{IKeepClient: &KeepTestClient{}}
+	_, err := writeTree(&cw, tmpdir, log.New(os.Stdout, "", 0))
+	c.Check(err, ErrorMatches, `Symlink loop detected at ".*/subdir/loop"`)
+
+	cw = CollectionWriter{IKeepClient: &KeepTestClient{}, SymlinkMode: SymlinkSkip}
+	str, err := writeTree(&cw, tmpdir, log.New(os.Stdout, "", 0))
+	c.Check(err, IsNil)
+	c.Check(str, Equals, "./subdir acbd18db4cc2f85cedef654fccc4a4d8+3 0:3:file1.txt\n")
+}
+
+func (s *TestSuite) TestUploadSymlinkDepth(c *C) {
+	tmpdir, _ := ioutil.TempDir("", "")
+	defer func() {
+		os.RemoveAll(tmpdir)
+	}()
+
+	c.Assert(ioutil.WriteFile(tmpdir+"/link0", []byte("foo"), 0600), IsNil)
+	for i := 1; i <= 50; i++ {
+		c.Assert(os.Symlink(fmt.Sprintf("link%d", i-1), fmt.Sprintf("%s/link%d", tmpdir, i)), IsNil)
+	}
+
+	for _, trial := range []struct {
+		maxDepth int
+		ok       string
+		tooDeep  string
+	}{
+		{0, "link40", "link41"},
+		{5, "link5", "link6"},
+	} {
+		cw := CollectionWriter{IKeepClient: &KeepTestClient{}, MaxSymlinkDepth: trial.maxDepth}
+		walkUpload := cw.BeginUpload(context.Background(), tmpdir, log.New(os.Stdout, "", 0))
+		c.Check(walkUpload.UploadFile(tmpdir+"/"+trial.ok, "ok.txt"), IsNil)
+		err := walkUpload.UploadFile(tmpdir+"/"+trial.tooDeep, "toodeep.txt")
+		c.Check(err, ErrorMatches, `Cannot follow symlink ".*/`+trial.tooDeep+`": more than [0-9]+ links in chain`)
+		c.Check(cw.EndUpload(walkUpload), IsNil)
+		str, err := cw.ManifestText()
+		c.Check(err, IsNil)
+		c.Check(str, Equals, ". acbd18db4cc2f85cedef654fccc4a4d8+3 0:3:ok.txt\n")
+	}
+
+	cw := CollectionWriter{IKeepClient: &KeepTestClient{}}
+	_, err := writeTree(&cw, tmpdir, log.New(os.Stdout, "", 0))
+	c.Check(err, ErrorMatches, `Cannot follow symlink ".*/link41": more than 40 links in chain`)
+}
+
+func (s *TestSuite) TestUploadProgress(c *C) {
+	tmpdir, _ := ioutil.TempDir("", "")
+	defer func() {
+		os.RemoveAll(tmpdir)
+	}()
+
+	file, _ := os.Create(tmpdir + "/" + "file1.txt")
+	data := make([]byte, 1024*1024-1)
+	for i := range data {
+		data[i] = byte(i % 10)
+	}
+	for i := 0; i < 65; i++ {
+		file.Write(data)
+	}
+	file.Close()
+
+	type progress struct {
+		path            string
+		uploaded, total int64
+	}
+	var calls []progress
+	cw := CollectionWriter{IKeepClient: &KeepTestClient{}}
+	cw.OnProgress = func(path string, uploaded, total int64) {
+		calls = append(calls, progress{path, uploaded, total})
+	}
+	_, err := writeTree(&cw, tmpdir, log.New(os.Stdout, "", 0))
+	c.Check(err, IsNil)
+
+	c.Assert(len(calls) > 1, Equals, true)
+	for i, p := range calls {
+		c.Check(p.path, Equals, "file1.txt")
+		c.Check(p.total, Equals, int64(68157375))
+		if i > 0 {
+			c.Check(p.uploaded >= calls[i-1].uploaded, Equals, true)
+		}
+	}
+	c.Check(calls[len(calls)-1].uploaded, Equals, int64(68157375))
+}
+
+func (s *TestSuite) TestUploadBlockSize(c *C) {
+	tmpdir, _ := ioutil.TempDir("", "")
+	defer func() {
+		os.RemoveAll(tmpdir)
+	}()
+
+	data := make([]byte, 5*1024*1024)
+	for i := range data {
+		data[i] = byte(i % 10)
+	}
+	ioutil.WriteFile(tmpdir+"/"+"file1.txt", data, 0600)
+
+	cw := CollectionWriter{IKeepClient: &KeepCountTestClient{}, BlockSize: 1024 * 1024}
+	str, err := writeTree(&cw, tmpdir, log.New(os.Stdout, "", 0))
+	c.Check(err, IsNil)
+	c.Check(str, Matches, `\.( [0-9a-f]{32}\+1048576){5} 0:5242880:file1.txt\n`)
+
+	ioutil.WriteFile(tmpdir+"/"+"file2.txt", []byte("bar"), 0600)
+	cw = CollectionWriter{IKeepClient: &KeepCountTestClient{}, BlockSize: 1024 * 1024}
+	str, err = writeTree(&cw, tmpdir, log.New(os.Stdout, "", 0))
+	c.Check(err, IsNil)
+	c.Check(str, Matches, `\.( [0-9a-f]{32}\+1048576){5} 37b51d194a7513e45b56f6524f2d51f2\+3 0:5242880:file1.txt 5242880:3:file2.txt\n`)
+}
+
+// KeepSlowTestClient records the maximum number of concurrent PutHB
+// calls.  Each call takes longer than the one before, so later blocks
+// finish before earlier ones.
+type KeepSlowTestClient struct {
+	mtx       sync.Mutex
+	puts      int
+	active    int
+	maxActive int
+}
+
+func (client *KeepSlowTestClient) PutHB(hash string, buf []byte) (string, int, error) {
+	client.mtx.Lock()
+	client.puts++
+	delay := time.Duration(20-client.puts) * time.Millisecond
+	client.active++
+	if client.active > client.maxActive {
+		client.maxActive = client.active
+	}
+	client.mtx.Unlock()
+
+	time.Sleep(delay)
+
+	client.mtx.Lock()
+	client.active--
+	client.mtx.Unlock()
+	return fmt.Sprintf("%x+%d", md5.Sum(buf), len(buf)), 1, nil
+}
+
+func (*KeepSlowTestClient) ManifestFileReader(m manifest.Manifest, filename string) (arvados.File, error) {
+	return nil, nil
+}
+
+func (*KeepSlowTestClient) ClearBlockCache() {
+}
+
+func (s *TestSuite) TestUploadConcurrentWriters(c *C) {
+	tmpdir, _ := ioutil.TempDir("", "")
+	defer func() {
+		os.RemoveAll(tmpdir)
+	}()
+
+	data := make([]byte, 10*1024)
+	for i := range data {
+		data[i] = byte(i / 1024)
+	}
+	ioutil.WriteFile(tmpdir+"/"+"file1.txt", data, 0600)
+
+	kc := &KeepSlowTestClient{}
+	cw := CollectionWriter{IKeepClient: kc, BlockSize: 1024, MaxWriters: 3}
+	str, err := writeTree(&cw, tmpdir, log.New(os.Stdout, "", 0))
+	c.Check(err, IsNil)
+	c.Check(kc.puts, Equals, 10)
+	c.Check(kc.maxActive, Equals, 3)
+
+	expect := "."
+	for i := 0; i < 10; i++ {
+		expect += fmt.Sprintf(" %x+1024", md5.Sum(data[i*1024:(i+1)*1024]))
+	}
+	expect += " 0:10240:file1.txt\n"
+	c.Check(str, Equals, expect)
+}
+
+func (s *TestSuite) TestUploadPreserveMode(c *C) {
+	tmpdir, _ := ioutil.TempDir("", "")
+	defer func() {
+		os.RemoveAll(tmpdir)
+	}()
+
+	os.Mkdir(tmpdir+"/subdir", 0700)
+	ioutil.WriteFile(tmpdir+"/"+"script.sh", []byte("foo"), 0700)
+	os.Chmod(tmpdir+"/"+"script.sh", 0755)
+	ioutil.WriteFile(tmpdir+"/subdir/file1.txt", []byte("bar"), 0644)
+	os.Chmod(tmpdir+"/subdir/file1.txt", 0644)
+
+	cw := CollectionWriter{IKeepClient: &KeepTestClient{}}
+	_, err := writeTree(&cw, tmpdir, log.New(os.Stdout, "", 0))
+	c.Check(err, IsNil)
+	c.Check(cw.FileMetadata(), HasLen, 0)
+
+	cw = CollectionWriter{IKeepClient: &KeepTestClient{}, PreserveMode: true}
+	_, err = writeTree(&cw, tmpdir, log.New(os.Stdout, "", 0))
+	c.Check(err, IsNil)
+	c.Check(cw.FileMetadata(), DeepEquals, map[string]*FileMetadata{
+		"script.sh":        {Mode: 0755},
+		"subdir/file1.txt": {Mode: 0644},
+	})
+}
+
+func (s *TestSuite) TestUploadRecordSHA256(c *C) {
+	tmpdir, _ := ioutil.TempDir("", "")
+	defer func() {
+		os.RemoveAll(tmpdir)
+	}()
+
+	os.Mkdir(tmpdir+"/subdir", 0700)
+	ioutil.WriteFile(tmpdir+"/"+"file1.txt", []byte("foo"), 0600)
+	os.Link(tmpdir+"/"+"file1.txt", tmpdir+"/"+"file2.txt")
+
+	cw := CollectionWriter{IKeepClient: &KeepTestClient{}, RecordSHA256: true}
+	walkUpload := cw.BeginUpload(context.Background(), tmpdir, log.New(os.Stdout, "", 0))
+	c.Check(walkUpload.Walk(), IsNil)
+	c.Check(walkUpload.UploadReader("./subdir", "summary.txt", strings.NewReader("barbaz")), IsNil)
+	c.Check(cw.EndUpload(walkUpload), IsNil)
+	c.Check(cw.SHA256Digests(), DeepEquals, map[string]string{
+		"file1.txt":          "2c26b46b68ffc68ff99b453c1d30413413422d706483bfa0f98a5e886266e7ae",
+		"file2.txt":          "2c26b46b68ffc68ff99b453c1d30413413422d706483bfa0f98a5e886266e7ae",
+		"subdir/summary.txt": "c8f8b724728a6d6684106e5e64e94ce811c9965d19dd44dd073cf86cf43bc238",
+	})
+
+	// Nothing is recorded by default.
+	cw = CollectionWriter{IKeepClient: &KeepTestClient{}}
+	_, err := writeTree(&cw, tmpdir, log.New(os.Stdout, "", 0))
+	c.Check(err, IsNil)
+	c.Check(cw.SHA256Digests(), HasLen, 0)
+}
+
+func (s *TestSuite) TestUploadRecordMD5(c *C) {
+	tmpdir, _ := ioutil.TempDir("", "")
+	defer func() {
+		os.RemoveAll(tmpdir)
+	}()
+
+	os.Mkdir(tmpdir+"/subdir", 0700)
+	ioutil.WriteFile(tmpdir+"/"+"file1.txt", []byte("foo"), 0600)
+	os.Link(tmpdir+"/"+"file1.txt", tmpdir+"/"+"file2.txt")
+	ioutil.WriteFile(tmpdir+"/"+"subdir/big.txt", []byte("0123456789"), 0600)
+
+	cw := CollectionWriter{IKeepClient: &KeepTestClient{}, RecordMD5: true, BlockSize: 4}
+	walkUpload := cw.BeginUpload(context.Background(), tmpdir, log.New(os.Stdout, "", 0))
+	c.Check(walkUpload.Walk(), IsNil)
+	c.Check(cw.EndUpload(walkUpload), IsNil)
+	c.Check(cw.FileChecksums(), DeepEquals, map[string]string{
+		"file1.txt":      "acbd18db4cc2f85cedef654fccc4a4d8:3",
+		"file2.txt":      "acbd18db4cc2f85cedef654fccc4a4d8:3",
+		"subdir/big.txt": "781e5e245d69b566979b86e28d23f2c7:10",
+	})
+
+	// The file spans several blocks, none of which has the file's
+	// digest.
+	mt, err := cw.ManifestText()
+	c.Assert(err, IsNil)
+	streams, err := ParseManifest(mt)
+	c.Assert(err, IsNil)
+	c.Assert(streams, HasLen, 2)
+	c.Check(streams[1].Blocks, HasLen, 3)
+	for _, locator := range streams[1].Blocks {
+		c.Check(strings.HasPrefix(locator, "781e5e245d69b566979b86e28d23f2c7"), Equals, false, Commentf("%s", locator))
+	}
+
+	// Nothing is recorded by default.
+	cw = CollectionWriter{IKeepClient: &KeepTestClient{}}
+	_, err = writeTree(&cw, tmpdir, log.New(os.Stdout, "", 0))
+	c.Check(err, IsNil)
+	c.Check(cw.FileChecksums(), HasLen, 0)
+}
+
+func (s *TestSuite) TestUploadPreserveMtime(c *C) {
+	tmpdir, _ := ioutil.TempDir("", "")
+	defer func() {
+		os.RemoveAll(tmpdir)
+	}()
+
+	os.Mkdir(tmpdir+"/subdir", 0700)
+	ioutil.WriteFile(tmpdir+"/"+"file1.txt", []byte("foo"), 0600)
+	ioutil.WriteFile(tmpdir+"/subdir/file2.txt", []byte("bar"), 0600)
+	mtime := time.Date(2017, 3, 14, 15, 9, 26, 535897000, time.UTC)
+	os.Chtimes(tmpdir+"/subdir/file2.txt", mtime, mtime)
+
+	cw := CollectionWriter{IKeepClient: &KeepTestClient{}, PreserveMtime: true}
+	_, err := writeTree(&cw, tmpdir, log.New(os.Stdout, "", 0))
+	c.Check(err, IsNil)
+	md := cw.FileMetadata()
+	c.Check(md, HasLen, 2)
+	for _, path := range []string{"file1.txt", "subdir/file2.txt"} {
+		info, err := os.Stat(tmpdir + "/" + path)
+		c.Assert(err, IsNil)
+		c.Assert(md[path], NotNil)
+		c.Assert(md[path].Mtime, NotNil)
+		c.Check(md[path].Mtime.Equal(info.ModTime()), Equals, true, Commentf("%s: %v != %v", path, md[path].Mtime, info.ModTime()))
+	}
+	c.Check(md["subdir/file2.txt"].Mtime.Equal(mtime), Equals, true)
+}
+
+func (s *TestSuite) TestUploadFileFilter(c *C) {
+	tmpdir, _ := ioutil.TempDir("", "")
+	defer func() {
+		os.RemoveAll(tmpdir)
+	}()
+
+	os.Mkdir(tmpdir+"/subdir", 0700)
+	ioutil.WriteFile(tmpdir+"/"+"file1.txt", []byte("foo"), 0600)
+	ioutil.WriteFile(tmpdir+"/"+"secret.key", []byte("bar"), 0600)
+	ioutil.WriteFile(tmpdir+"/subdir/file2.txt", []byte("baz"), 0600)
+
+	var seen []string
+	cw := CollectionWriter{IKeepClient: &KeepTestClient{}}
+	walkUpload := cw.BeginUpload(context.Background(), tmpdir, log.New(os.Stdout, "", 0))
+	walkUpload.FileFilter = func(info os.FileInfo, relPath string) (string, bool) {
+		seen = append(seen, relPath)
+		switch {
+		case strings.HasSuffix(relPath, ".key"):
+			return "", false
+		case relPath == "file1.txt":
+			return "renamed/first.txt", true
+		}
+		return relPath, true
+	}
+	c.Check(walkUpload.Walk(), IsNil)
+	c.Check(cw.EndUpload(walkUpload), IsNil)
+	str, err := cw.ManifestText()
+	c.Check(err, IsNil)
+	c.Check(str, Equals, `./renamed acbd18db4cc2f85cedef654fccc4a4d8+3 0:3:first.txt
+./subdir 73feffa4b7f6bb68e44cf984c85f6e88+3 0:3:file2.txt
+`)
+	c.Check(seen, DeepEquals, []string{"file1.txt", "secret.key", "subdir/file2.txt"})
+
+	// A filter that changes nothing gives the same manifest as no
+	// filter.
+	cw = CollectionWriter{IKeepClient: &KeepTestClient{}}
+	expect, err := writeTree(&cw, tmpdir, log.New(os.Stdout, "", 0))
+	c.Assert(err, IsNil)
+	cw = CollectionWriter{IKeepClient: &KeepTestClient{}}
+	walkUpload = cw.BeginUpload(context.Background(), tmpdir, log.New(os.Stdout, "", 0))
+	walkUpload.FileFilter = func(info os.FileInfo, relPath string) (string, bool) {
+		return relPath, true
+	}
+	c.Check(walkUpload.Walk(), IsNil)
+	c.Check(cw.EndUpload(walkUpload), IsNil)
+	str, err = cw.ManifestText()
+	c.Check(err, IsNil)
+	c.Check(str, Equals, expect)
+}
+
+func (s *TestSuite) TestUploadConflictPolicy(c *C) {
+	tmpdir, _ := ioutil.TempDir("", "")
+	defer func() {
+		os.RemoveAll(tmpdir)
+	}()
+
+	ioutil.WriteFile(tmpdir+"/"+"file1.txt", []byte("foo"), 0600)
+	ioutil.WriteFile(tmpdir+"/"+"file2.txt", []byte("bar"), 0600)
+
+	upload := func(policy ConflictPolicy) (string, error) {
+		cw := CollectionWriter{IKeepClient: &KeepTestClient{}, ConflictPolicy: policy}
+		walkUpload := cw.BeginUpload(context.Background(), tmpdir, log.New(os.Stdout, "", 0))
+		c.Check(walkUpload.UploadFile(tmpdir+"/file1.txt", "out/data.txt"), IsNil)
+		err := walkUpload.UploadFile(tmpdir+"/file2.txt", "out/data.txt")
+		c.Check(cw.EndUpload(walkUpload), IsNil)
+		if err != nil {
+			return "", err
+		}
+		return cw.ManifestText()
+	}
+
+	_, err := upload(ConflictError)
+	c.Assert(err, NotNil)
+	c.Check(err.(*UploadError).Path, Equals, "out/data.txt")
+	c.Check(err, ErrorMatches, `.*already stored at out/data.txt.*`)
+
+	str, err := upload(ConflictOverwrite)
+	c.Check(err, IsNil)
+	c.Check(str, Equals, `./out 3858f62230ac3c915f300c664312c63f+6 3:3:data.txt
+`)
+
+	str, err = upload(ConflictRename)
+	c.Check(err, IsNil)
+	c.Check(str, Equals, `./out 3858f62230ac3c915f300c664312c63f+6 0:3:data.txt 3:3:data~1.txt
+`)
+}
+
+func (s *TestSuite) TestUploadConflictUnreadable(c *C) {
+	tmpdir, _ := ioutil.TempDir("", "")
+	defer func() {
+		os.RemoveAll(tmpdir)
+	}()
+
+	ioutil.WriteFile(tmpdir+"/"+"secret.txt", []byte("foo"), 0600)
+	ioutil.WriteFile(tmpdir+"/"+"file2.txt", []byte("bar"), 0600)
+
+	// The skipped file does not take the path from the next one.
+	for _, policy := range []ConflictPolicy{ConflictError, ConflictOverwrite, ConflictRename} {
+		cw := CollectionWriter{IKeepClient: &KeepTestClient{}, ConflictPolicy: policy}
+		walkUpload := cw.BeginUpload(context.Background(), tmpdir, log.New(os.Stdout, "", 0))
+		walkUpload.FileSystem = denyFileSystem{deny: map[string]bool{
+			tmpdir + "/secret.txt": true,
+		}}
+		c.Check(walkUpload.UploadFile(tmpdir+"/secret.txt", "out/data.txt"), IsNil)
+		c.Check(walkUpload.UploadFile(tmpdir+"/file2.txt", "out/data.txt"), IsNil)
+		c.Check(cw.EndUpload(walkUpload), IsNil)
+		str, err := cw.ManifestText()
+		c.Check(err, IsNil)
+		c.Check(str, Equals, "./out 37b51d194a7513e45b56f6524f2d51f2+3 0:3:data.txt\n")
+		c.Check(walkUpload.Warnings(), HasLen, 1)
+	}
+}
+
+func (s *TestSuite) TestUploadConflictOverwriteMaxFiles(c *C) {
+	tmpdir, _ := ioutil.TempDir("", "")
+	defer func() {
+		os.RemoveAll(tmpdir)
+	}()
+
+	ioutil.WriteFile(tmpdir+"/"+"file1.txt", []byte("foo"), 0600)
+
+	// A replaced file does not count against MaxFiles.
+	cw := CollectionWriter{IKeepClient: &KeepTestClient{}, ConflictPolicy: ConflictOverwrite, MaxFiles: 1}
+	walkUpload := cw.BeginUpload(context.Background(), tmpdir, log.New(os.Stdout, "", 0))
+	for i := 0; i < 3; i++ {
+		c.Check(walkUpload.UploadFile(tmpdir+"/file1.txt", "out/data.txt"), IsNil)
+	}
+	str, summary, err := cw.FinishUpload(walkUpload)
+	c.Check(err, IsNil)
+	c.Check(str, Equals, "./out 216d7c020d0732def6775af81f6dc44f+9 6:3:data.txt\n")
+	c.Check(summary.Files, Equals, 1)
+}
+
+func (s *TestSuite) TestUploadReader(c *C) {
+	tmpdir, _ := ioutil.TempDir("", "")
+	defer func() {
+		os.RemoveAll(tmpdir)
+	}()
+
+	os.Mkdir(tmpdir+"/subdir", 0700)
+	ioutil.WriteFile(tmpdir+"/"+"file1.txt", []byte("foo"), 0600)
+	ioutil.WriteFile(tmpdir+"/subdir/summary.json", []byte(strings.Repeat("bar", 1000)), 0600)
+
+	cw := CollectionWriter{IKeepClient: &KeepCountTestClient{}, BlockSize: 1024}
+	expect, err := writeTree(&cw, tmpdir, log.New(os.Stdout, "", 0))
+	c.Assert(err, IsNil)
+
+	os.Remove(tmpdir + "/subdir/summary.json")
+	cw = CollectionWriter{IKeepClient: &KeepCountTestClient{}, BlockSize: 1024}
+	walkUpload := cw.BeginUpload(context.Background(), tmpdir, log.New(os.Stdout, "", 0))
+	c.Check(walkUpload.UploadFile(tmpdir+"/file1.txt", "file1.txt"), IsNil)
+	c.Check(walkUpload.UploadReader("./subdir", "summary.json", strings.NewReader(strings.Repeat("bar", 1000))), IsNil)
+	cw.EndUpload(walkUpload)
+	str, err := cw.ManifestText()
+	c.Check(err, IsNil)
+	c.Check(str, Equals, expect)
+	c.Check(strings.Count(str, "+1024 "), Equals, 2)
+}
+
+func (s *TestSuite) TestUploadDedup(c *C) {
+	tmpdir, _ := ioutil.TempDir("", "")
+	defer func() {
+		os.RemoveAll(tmpdir)
+	}()
+
+	for _, dir := range []string{"a", "b", "c"} {
+		os.Mkdir(tmpdir+"/"+dir, 0700)
+		ioutil.WriteFile(tmpdir+"/"+dir+"/report.txt", []byte("foo"), 0600)
+	}
+
+	kc := &KeepCountTestClient{}
+	cw := CollectionWriter{IKeepClient: kc}
+	str, err := writeTree(&cw, tmpdir, log.New(os.Stdout, "", 0))
+	c.Check(err, IsNil)
+	c.Check(str, Equals, `./a acbd18db4cc2f85cedef654fccc4a4d8+3 0:3:report.txt
+./b acbd18db4cc2f85cedef654fccc4a4d8+3 0:3:report.txt
+./c acbd18db4cc2f85cedef654fccc4a4d8+3 0:3:report.txt
+`)
+	c.Check(kc.puts, Equals, 1)
+	c.Check(cw.BytesWritten(), Equals, int64(9))
+	c.Check(cw.BlocksWritten(), Equals, 3)
+	c.Check(cw.UniqueBytesStored(), Equals, int64(3))
+	c.Check(cw.UniqueLocators(), DeepEquals, []string{"acbd18db4cc2f85cedef654fccc4a4d8+3"})
+}
+
+func (s *TestSuite) TestUploadSameNameInSiblingDirs(c *C) {
+	tmpdir, _ := ioutil.TempDir("", "")
+	defer func() {
+		os.RemoveAll(tmpdir)
+	}()
+
+	os.Mkdir(tmpdir+"/a", 0700)
+	os.Mkdir(tmpdir+"/b", 0700)
+	ioutil.WriteFile(tmpdir+"/a/file1.txt", []byte("foo"), 0600)
+	ioutil.WriteFile(tmpdir+"/b/file1.txt", []byte("barbaz"), 0600)
+
+	expect := `./a acbd18db4cc2f85cedef654fccc4a4d8+3 0:3:file1.txt
+./b c3c23db5285662ef7172373df0003206+6 0:6:file1.txt
+`
+	// Each file gets its own stream and block, whatever order
+	// the files are read and the blocks are written in.
+	for i := 0; i < 10; i++ {
+		cw := CollectionWriter{IKeepClient: &KeepTestClient{}, MaxReaders: 2, MaxWriters: 2, PreserveMode: true}
+		str, err := writeTree(&cw, tmpdir, log.New(os.Stdout, "", 0))
+		c.Check(err, IsNil)
+		c.Check(str, Equals, expect)
+		c.Check(cw.FileMetadata(), HasLen, 2)
+	}
+
+	// The same holds for files passed to UploadFile, which are
+	// not conflicts.
+	cw := CollectionWriter{IKeepClient: &KeepTestClient{}}
+	walkUpload := cw.BeginUpload(context.Background(), tmpdir, log.New(os.Stdout, "", 0))
+	c.Check(walkUpload.UploadFile(tmpdir+"/b/file1.txt", "b/file1.txt"), IsNil)
+	c.Check(walkUpload.UploadFile(tmpdir+"/a/file1.txt", "a/file1.txt"), IsNil)
+	c.Check(cw.EndUpload(walkUpload), IsNil)
+	str, err := cw.ManifestText()
+	c.Check(err, IsNil)
+	c.Check(str, Equals, expect)
+}
+
+func (s *TestSuite) TestUploadHardlinks(c *C) {
+	tmpdir, _ := ioutil.TempDir("", "")
+	defer func() {
+		os.RemoveAll(tmpdir)
+	}()
+
+	ioutil.WriteFile(tmpdir+"/"+"file1.txt", []byte("foo"), 0600)
+	ioutil.WriteFile(tmpdir+"/"+"file2.txt", []byte("bar"), 0600)
+	c.Assert(os.Link(tmpdir+"/file1.txt", tmpdir+"/file3.txt"), IsNil)
+
+	kc := &KeepCountTestClient{}
+	cw := CollectionWriter{IKeepClient: kc}
+	str, err := writeTree(&cw, tmpdir, log.New(os.Stdout, "", 0))
+	c.Check(err, IsNil)
+	c.Check(str, Equals, ". 3858f62230ac3c915f300c664312c63f+6 0:3:file1.txt 3:3:file2.txt 0:3:file3.txt\n")
+	c.Check(kc.puts, Equals, 1)
+}
+
+func (s *TestSuite) TestUploadDryRun(c *C) {
+	tmpdir, _ := ioutil.TempDir("", "")
+	defer func() {
+		os.RemoveAll(tmpdir)
+	}()
+
+	for _, err := range []error{
+		ioutil.WriteFile(tmpdir+"/"+"file1.txt", []byte("foo"), 0600),
+		ioutil.WriteFile(tmpdir+"/"+"file2.txt", []byte("bar"), 0600),
+		os.Symlink("./file2.txt", tmpdir+"/file3.txt"),
+	} {
+		c.Assert(err, IsNil)
+	}
+
+	cw := CollectionWriter{IKeepClient: &KeepTestClient{}}
+	expect, err := writeTree(&cw, tmpdir, log.New(os.Stdout, "", 0))
+	c.Check(err, IsNil)
+
+	kc := &KeepCountTestClient{}
+	cw = CollectionWriter{IKeepClient: kc, DryRun: true}
+	str, err := writeTree(&cw, tmpdir, log.New(os.Stdout, "", 0))
+	c.Check(err, IsNil)
+	c.Check(str, Equals, expect)
+	c.Check(kc.puts, Equals, 0)
+}
+
+// KeepAskTestClient is a Keep client that already has the blocks in
+// existing.
+type KeepAskTestClient struct {
+	KeepCountTestClient
+	existing map[string]bool
+	asks     int
+}
+
+func (client *KeepAskTestClient) Ask(locator string) (int64, string, error) {
+	client.mtx.Lock()
+	defer client.mtx.Unlock()
+	client.asks++
+	if !client.existing[locator] {
+		return 0, "", fmt.Errorf("Block not found")
+	}
+	var size int64
+	fmt.Sscanf(locator[33:], "%d", &size)
+	return size, "http://keep.zzzzz.example:25107/" + locator, nil
+}
+
+func (s *TestSuite) TestUploadSkipExistingBlocks(c *C) {
+	tmpdir, _ := ioutil.TempDir("", "")
+	defer func() {
+		os.RemoveAll(tmpdir)
+	}()
+
+	os.Mkdir(tmpdir+"/subdir", 0700)
+	ioutil.WriteFile(tmpdir+"/"+"file1.txt", []byte("foo"), 0600)
+	ioutil.WriteFile(tmpdir+"/subdir/file2.txt", []byte("bar"), 0600)
+	expect := `. acbd18db4cc2f85cedef654fccc4a4d8+3 0:3:file1.txt
+./subdir 37b51d194a7513e45b56f6524f2d51f2+3 0:3:file2.txt
+`
+
+	for _, skip := range []bool{false, true} {
+		kc := &KeepAskTestClient{existing: map[string]bool{"acbd18db4cc2f85cedef654fccc4a4d8+3": true}}
+		cw := CollectionWriter{IKeepClient: kc, SkipExistingBlocks: skip}
+		str, err := writeTree(&cw, tmpdir, log.New(os.Stdout, "", 0))
+		c.Check(err, IsNil)
+		c.Check(str, Equals, expect)
+		c.Check(cw.BlocksWritten(), Equals, 2)
+		if skip {
+			c.Check(kc.asks, Equals, 2)
+			c.Check(kc.puts, Equals, 1)
+			c.Check(cw.UniqueBytesStored(), Equals, int64(3))
+		} else {
+			c.Check(kc.asks, Equals, 0)
+			c.Check(kc.puts, Equals, 2)
+			c.Check(cw.UniqueBytesStored(), Equals, int64(6))
+		}
+	}
+}
+
+type KeepSignTestClient struct {
+	KeepTestClient
+	expiry time.Time
+}
+
+func (client *KeepSignTestClient) PutHB(hash string, buf []byte) (string, int, error) {
+	return fmt.Sprintf("%s+%d+Aoldsignature@00000000", hash, len(buf)), len(buf), nil
+}
+
+func (client *KeepSignTestClient) SignLocator(locator string, expiry time.Time) string {
+	client.expiry = expiry
+	return locator + "+Asignature@12345678"
+}
+
+func (s *TestSuite) TestUploadSignLocators(c *C) {
+	tmpdir, _ := ioutil.TempDir("", "")
+	defer func() {
+		os.RemoveAll(tmpdir)
+	}()
+
+	os.Mkdir(tmpdir+"/subdir", 0700)
+	ioutil.WriteFile(tmpdir+"/"+"file1.txt", []byte("foo"), 0600)
+	ioutil.WriteFile(tmpdir+"/subdir/file2.txt", []byte("bar"), 0600)
+
+	kc := &KeepSignTestClient{}
+	cw := CollectionWriter{IKeepClient: kc, SignatureTTL: time.Hour}
+	str, err := writeTree(&cw, tmpdir, log.New(os.Stdout, "", 0))
+	c.Check(err, IsNil)
+	c.Check(str, Equals, `. acbd18db4cc2f85cedef654fccc4a4d8+3+Asignature@12345678 0:3:file1.txt
+./subdir 37b51d194a7513e45b56f6524f2d51f2+3+Asignature@12345678 0:3:file2.txt
+`)
+	c.Check(kc.expiry.After(time.Now().Add(59*time.Minute)), Equals, true)
+	c.Check(kc.expiry.Before(time.Now().Add(time.Hour)), Equals, true)
+
+	// Signing again gives the same result.
+	str2, err := cw.ManifestText()
+	c.Check(err, IsNil)
+	c.Check(str2, Equals, str)
+}
+
+type KeepReplicasTestClient struct {
+	KeepTestClient
+	mtx      sync.Mutex
+	replicas []int
+	stored   int
+}
+
+func (client *KeepReplicasTestClient) PutHBReplicas(hash string, buf []byte, replicas int) (string, int, error) {
+	client.mtx.Lock()
+	defer client.mtx.Unlock()
+	client.replicas = append(client.replicas, replicas)
+	locator, _, err := client.KeepTestClient.PutHB(hash, buf)
+	return locator, client.stored, err
+}
+
+func (s *TestSuite) TestUploadDesiredReplication(c *C) {
+	tmpdir, _ := ioutil.TempDir("", "")
+	defer func() {
+		os.RemoveAll(tmpdir)
+	}()
+
+	os.Mkdir(tmpdir+"/subdir", 0700)
+	ioutil.WriteFile(tmpdir+"/"+"file1.txt", []byte("foo"), 0600)
+	ioutil.WriteFile(tmpdir+"/subdir/file2.txt", []byte("bar"), 0600)
+
+	kc := &KeepReplicasTestClient{stored: 3}
+	cw := CollectionWriter{IKeepClient: kc, DesiredReplication: 3}
+	_, err := writeTree(&cw, tmpdir, log.New(os.Stdout, "", 0))
+	c.Check(err, IsNil)
+	c.Check(kc.replicas, DeepEquals, []int{3, 3})
+
+	kc = &KeepReplicasTestClient{stored: 1}
+	cw = CollectionWriter{IKeepClient: kc, DesiredReplication: 2}
+	walkUpload := cw.BeginUpload(context.Background(), tmpdir, log.New(os.Stdout, "", 0))
+	c.Check(walkUpload.Walk(), IsNil)
+	err = cw.EndUpload(walkUpload)
+	c.Check(err, ErrorMatches, `(?s).*Could not write sufficient replicas: wanted 2, wrote 1.*`)
+	_, err = cw.ManifestText()
+	c.Check(err, NotNil)
+}
+
+func (s *TestSuite) TestUploadUnderReplication(c *C) {
+	tmpdir, _ := ioutil.TempDir("", "")
+	defer func() {
+		os.RemoveAll(tmpdir)
+	}()
+
+	os.Mkdir(tmpdir+"/subdir", 0700)
+	ioutil.WriteFile(tmpdir+"/"+"file1.txt", []byte("foo"), 0600)
+	ioutil.WriteFile(tmpdir+"/subdir/file2.txt", []byte("bar"), 0600)
+
+	// By default, the upload fails.
+	kc := &KeepReplicasTestClient{stored: 1}
+	cw := CollectionWriter{IKeepClient: kc, DesiredReplication: 2}
+	_, err := writeTree(&cw, tmpdir, log.New(os.Stdout, "", 0))
+	c.Check(err, ErrorMatches, `(?s).*Could not write sufficient replicas: wanted 2, wrote 1.*`)
+	c.Check(cw.UnderReplicatedBlocks(), HasLen, 0)
+
+	// With UnderReplicationWarn, it succeeds, and the blocks are
+	// listed.
+	logger := newTestLogger()
+	kc = &KeepReplicasTestClient{stored: 1}
+	cw = CollectionWriter{IKeepClient: kc, DesiredReplication: 2, UnderReplicationPolicy: UnderReplicationWarn, Logger: logger}
+	str, err := writeTree(&cw, tmpdir, log.New(os.Stdout, "", 0))
+	c.Check(err, IsNil)
+	c.Check(str, Equals, `. acbd18db4cc2f85cedef654fccc4a4d8+3 0:3:file1.txt
+./subdir 37b51d194a7513e45b56f6524f2d51f2+3 0:3:file2.txt
+`)
+	c.Check(cw.UnderReplicatedBlocks(), DeepEquals, map[string]int{
+		"acbd18db4cc2f85cedef654fccc4a4d8+3": 1,
+		"37b51d194a7513e45b56f6524f2d51f2+3": 1,
+	})
+	warnings := 0
+	for _, ent := range *logger.entries {
+		if ent.level == "warn" {
+			c.Check(ent.message, Matches, `Block [0-9a-f]{32}\+3 is under-replicated: wanted 2 replicas, wrote 1`)
+			warnings++
+		}
+	}
+	c.Check(warnings, Equals, 2)
+
+	// A block with no replicas at all is still an error.
+	kc = &KeepReplicasTestClient{stored: 0}
+	cw = CollectionWriter{IKeepClient: kc, DesiredReplication: 2, UnderReplicationPolicy: UnderReplicationWarn}
+	_, err = writeTree(&cw, tmpdir, log.New(os.Stdout, "", 0))
+	c.Check(err, ErrorMatches, `(?s).*Could not write sufficient replicas: wanted 2, wrote 0.*`)
+}
+
+type fakeReporter struct {
+	mtx       sync.Mutex
+	bytes     int64
+	blocks    int
+	errors    int
+	latencies int
+}
+
+func (r *fakeReporter) IncBytes(n int64) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	r.bytes += n
+}
+
+func (r *fakeReporter) IncBlocks(n int) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	r.blocks += n
+}
+
+func (r *fakeReporter) IncErrors(n int) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	r.errors += n
+}
+
+func (r *fakeReporter) ObserveBlockLatency(time.Duration) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	r.latencies++
+}
+
+// KeepFailHashTestClient fails to write blocks with the given hash.
+type KeepFailHashTestClient struct {
+	KeepCountTestClient
+	failHash string
+}
+
+func (client *KeepFailHashTestClient) PutHB(hash string, buf []byte) (string, int, error) {
+	if hash == client.failHash {
+		return "", 0, errors.New("KeepError")
+	}
+	return client.KeepCountTestClient.PutHB(hash, buf)
+}
+
+func (s *TestSuite) TestUploadReporter(c *C) {
+	tmpdir, _ := ioutil.TempDir("", "")
+	defer func() {
+		os.RemoveAll(tmpdir)
+	}()
+
+	os.Mkdir(tmpdir+"/a", 0700)
+	os.Mkdir(tmpdir+"/b", 0700)
+	os.Mkdir(tmpdir+"/c", 0700)
+	ioutil.WriteFile(tmpdir+"/a/file1.txt", []byte("foo"), 0600)
+	ioutil.WriteFile(tmpdir+"/b/file2.txt", []byte("barbaz"), 0600)
+	ioutil.WriteFile(tmpdir+"/c/file3.txt", []byte("fail"), 0600)
+
+	reporter := &fakeReporter{}
+	kc := &KeepFailHashTestClient{failHash: fmt.Sprintf("%x", md5.Sum([]byte("fail")))}
+	cw := CollectionWriter{IKeepClient: kc, Reporter: reporter}
+	_, err := writeTree(&cw, tmpdir, log.New(os.Stdout, "", 0))
+	c.Check(err, ErrorMatches, `Upload put failed for "c/file3.txt": KeepError`)
+	c.Check(reporter.bytes, Equals, int64(9))
+	c.Check(reporter.blocks, Equals, 2)
+	c.Check(reporter.errors, Equals, 1)
+	c.Check(reporter.latencies, Equals, 3)
+}
+
+func (s *TestSuite) TestUploadBaseManifest(c *C) {
+	tmpdir, _ := ioutil.TempDir("", "")
+	defer func() {
+		os.RemoveAll(tmpdir)
+	}()
+
+	ioutil.WriteFile(tmpdir+"/"+"file2.txt", []byte("bar"), 0600)
+	os.Mkdir(tmpdir+"/subdir", 0700)
+	ioutil.WriteFile(tmpdir+"/subdir/file3.txt", []byte("baz"), 0600)
+
+	cw := CollectionWriter{
+		IKeepClient: &KeepTestClient{},
+		BaseManifest: ". acbd18db4cc2f85cedef654fccc4a4d8+3 0:3:file1.txt\n" +
+			"./subdir acbd18db4cc2f85cedef654fccc4a4d8+3 0:3:file3.txt 0:3:file\\0404.txt\n",
+	}
+	str, err := writeTree(&cw, tmpdir, log.New(os.Stdout, "", 0))
+	c.Check(err, IsNil)
+	c.Check(str, Equals, ". acbd18db4cc2f85cedef654fccc4a4d8+3 37b51d194a7513e45b56f6524f2d51f2+3 0:3:file1.txt 3:3:file2.txt\n"+
+		"./subdir acbd18db4cc2f85cedef654fccc4a4d8+3 73feffa4b7f6bb68e44cf984c85f6e88+3 0:3:file\\0404.txt 3:3:file3.txt\n")
+}
+
+func (s *TestSuite) TestUploadTargetPrefix(c *C) {
+	tmpdir, _ := ioutil.TempDir("", "")
+	defer func() {
+		os.RemoveAll(tmpdir)
+	}()
+
+	os.Mkdir(tmpdir+"/subdir", 0700)
+	ioutil.WriteFile(tmpdir+"/"+"file1.txt", []byte("foo"), 0600)
+	ioutil.WriteFile(tmpdir+"/subdir/file2.txt", []byte("bar"), 0600)
+
+	cw := CollectionWriter{IKeepClient: &KeepTestClient{}}
+	walkUpload := cw.BeginUpload(context.Background(), tmpdir, log.New(os.Stdout, "", 0))
+	walkUpload.TargetPrefix = "./results"
+	c.Check(walkUpload.Walk(), IsNil)
+	c.Check(cw.EndUpload(walkUpload), IsNil)
+	str, err := cw.ManifestText()
+	c.Check(err, IsNil)
+	c.Check(str, Equals, `./results acbd18db4cc2f85cedef654fccc4a4d8+3 0:3:file1.txt
+./results/subdir 37b51d194a7513e45b56f6524f2d51f2+3 0:3:file2.txt
+`)
+}
+
+func (s *TestSuite) TestUploadTrees(c *C) {
+	tmpdir, _ := ioutil.TempDir("", "")
+	defer func() {
+		os.RemoveAll(tmpdir)
+	}()
+
+	os.MkdirAll(tmpdir+"/out1/subdir", 0700)
+	os.Mkdir(tmpdir+"/out2", 0700)
+	ioutil.WriteFile(tmpdir+"/out1/file1.txt", []byte("foo"), 0600)
+	ioutil.WriteFile(tmpdir+"/out1/subdir/file2.txt", []byte("bar"), 0600)
+	ioutil.WriteFile(tmpdir+"/out2/file1.txt", []byte("baz"), 0600)
+
+	trees := []UploadTree{{tmpdir + "/out1", "./a"}, {tmpdir + "/out2", "./b"}}
+	cw := CollectionWriter{IKeepClient: &KeepTestClient{}}
+	str, err := cw.UploadTrees(context.Background(), trees, log.New(os.Stdout, "", 0))
+	c.Check(err, IsNil)
+	c.Check(str, Equals, `./a acbd18db4cc2f85cedef654fccc4a4d8+3 0:3:file1.txt
+./a/subdir 37b51d194a7513e45b56f6524f2d51f2+3 0:3:file2.txt
+./b 73feffa4b7f6bb68e44cf984c85f6e88+3 0:3:file1.txt
+`)
+
+	// The order of the trees does not matter.
+	cw = CollectionWriter{IKeepClient: &KeepTestClient{}}
+	again, err := cw.UploadTrees(context.Background(), []UploadTree{trees[1], trees[0]}, log.New(os.Stdout, "", 0))
+	c.Check(err, IsNil)
+	c.Check(again, Equals, str)
+
+	// A tree that cannot be uploaded is left out.
+	cw = CollectionWriter{IKeepClient: &KeepTestClient{}}
+	_, err = cw.UploadTrees(context.Background(), []UploadTree{trees[0], {tmpdir + "/missing", "./c"}}, log.New(os.Stdout, "", 0))
+	c.Check(err, NotNil)
+	str, err = cw.ManifestText()
+	c.Check(err, IsNil)
+	c.Check(str, Matches, `\./a .*\n\./a/subdir .*\n`)
+}
+
+func (s *TestSuite) TestUploadEscapeNames(c *C) {
+	tmpdir, _ := ioutil.TempDir("", "")
+	defer func() {
+		os.RemoveAll(tmpdir)
+	}()
+
+	names := []string{"my file.txt", "tab\tfile", "new\nline", " leading", "trailing "}
+	os.Mkdir(tmpdir+"/sub dir", 0700)
+	for _, name := range names {
+		ioutil.WriteFile(tmpdir+"/sub dir/"+name, []byte("foo"), 0600)
+	}
+	ioutil.WriteFile(tmpdir+"/my file.txt", []byte("foo"), 0600)
+
+	cw := CollectionWriter{IKeepClient: &KeepTestClient{}}
+	str, err := writeTree(&cw, tmpdir, log.New(os.Stdout, "", 0))
+	c.Check(err, IsNil)
+	c.Check(str, Matches, `(?s)\. acbd18db4cc2f85cedef654fccc4a4d8\+3 0:3:my\\040file\.txt\n\./sub\\040dir .*`)
+
+	var found []string
+	m := manifest.Manifest{Text: str}
+	for st := range m.StreamIter() {
+		c.Check(st.Err, IsNil)
+		for _, seg := range st.FileStreamSegments {
+			found = append(found, st.StreamName+"/"+seg.Name)
+		}
+	}
+	var expect []string
+	expect = append(expect, "./my file.txt")
+	for _, name := range names {
+		expect = append(expect, "./sub dir/"+name)
+	}
+	sort.Strings(found)
+	sort.Strings(expect)
+	c.Check(found, DeepEquals, expect)
+}
+
+type tempError struct {
+	error
+	temp bool
+}
+
+func (e tempError) Temporary() bool {
+	return e.temp
+}
+
+// KeepFlakyTestClient returns err from the first failures calls to
+// PutHB.
+type KeepFlakyTestClient struct {
+	KeepTestClient
+	mtx      sync.Mutex
+	attempts int
+	failures int
+	err      error
+}
+
+func (client *KeepFlakyTestClient) PutHB(hash string, buf []byte) (string, int, error) {
+	client.mtx.Lock()
+	defer client.mtx.Unlock()
+	client.attempts++
+	if client.attempts <= client.failures {
+		return "", 0, client.err
+	}
+	return client.KeepTestClient.PutHB(hash, buf)
+}
+
+func (s *TestSuite) TestUploadRetry(c *C) {
+	tmpdir, _ := ioutil.TempDir("", "")
+	defer func() {
+		os.RemoveAll(tmpdir)
+	}()
+
+	ioutil.WriteFile(tmpdir+"/"+"file1.txt", []byte("foo"), 0600)
+
+	kc := &KeepFlakyTestClient{failures: 2, err: tempError{errors.New("503 Service Unavailable"), true}}
+	cw := CollectionWriter{IKeepClient: kc, MaxRetries: 3, RetryDelay: time.Millisecond}
+	str, err := writeTree(&cw, tmpdir, log.New(os.Stdout, "", 0))
+	c.Check(err, IsNil)
+	c.Check(str, Equals, ". acbd18db4cc2f85cedef654fccc4a4d8+3 0:3:file1.txt\n")
+	c.Check(kc.attempts, Equals, 3)
+
+	kc = &KeepFlakyTestClient{failures: 2, err: tempError{errors.New("403 Forbidden"), false}}
+	cw = CollectionWriter{IKeepClient: kc, MaxRetries: 3, RetryDelay: time.Millisecond}
+	_, err = writeTree(&cw, tmpdir, log.New(os.Stdout, "", 0))
+	c.Check(err, ErrorMatches, `Upload put failed for "file1.txt": 403 Forbidden`)
+	c.Check(kc.attempts, Equals, 1)
+}
+
+// KeepHangTestClient takes delay to return from the first hangs calls
+// to PutHB.
+type KeepHangTestClient struct {
+	KeepTestClient
+	mtx      sync.Mutex
+	attempts int
+	hangs    int
+	delay    time.Duration
+}
+
+func (client *KeepHangTestClient) PutHB(hash string, buf []byte) (string, int, error) {
+	client.mtx.Lock()
+	client.attempts++
+	hang := client.attempts <= client.hangs
+	client.mtx.Unlock()
+	if hang {
+		time.Sleep(client.delay)
+	}
+	return client.KeepTestClient.PutHB(hash, buf)
+}
+
+func (client *KeepHangTestClient) getAttempts() int {
+	client.mtx.Lock()
+	defer client.mtx.Unlock()
+	return client.attempts
+}
+
+func (s *TestSuite) TestUploadPutTimeout(c *C) {
+	tmpdir, _ := ioutil.TempDir("", "")
+	defer func() {
+		os.RemoveAll(tmpdir)
+	}()
+
+	ioutil.WriteFile(tmpdir+"/"+"file1.txt", []byte("foo"), 0600)
+
+	var logbuf bytes.Buffer
+	kc := &KeepHangTestClient{hangs: 1, delay: time.Second}
+	cw := CollectionWriter{IKeepClient: kc, PutTimeout: 10 * time.Millisecond}
+	_, err := writeTree(&cw, tmpdir, log.New(&logbuf, "", 0))
+	c.Check(err, ErrorMatches, `Upload put failed for "file1.txt": Timed out writing block acbd18db4cc2f85cedef654fccc4a4d8\+3 after .*`)
+	c.Check(logbuf.String(), Matches, `(?s).*Timed out writing block acbd18db4cc2f85cedef654fccc4a4d8\+3 after [0-9.]+ms\n.*`)
+	c.Check(kc.getAttempts(), Equals, 1)
+
+	// Retried after the timeout.  (The abandoned write from the
+	// first upload is still using the first CollectionWriter.)
+	kc = &KeepHangTestClient{hangs: 1, delay: time.Second}
+	cw2 := CollectionWriter{IKeepClient: kc, PutTimeout: 10 * time.Millisecond, MaxRetries: 1, RetryDelay: time.Millisecond}
+	str, err := writeTree(&cw2, tmpdir, log.New(os.Stdout, "", 0))
+	c.Check(err, IsNil)
+	c.Check(str, Equals, ". acbd18db4cc2f85cedef654fccc4a4d8+3 0:3:file1.txt\n")
+	c.Check(kc.getAttempts(), Equals, 2)
+}
+
+func (s *TestSuite) TestUploadBytesPerSecond(c *C) {
+	tmpdir, _ := ioutil.TempDir("", "")
+	defer func() {
+		os.RemoveAll(tmpdir)
+	}()
+
+	// Six different blocks of 1000 bytes
+	var data bytes.Buffer
+	for i := 0; i < 1200; i++ {
+		fmt.Fprintf(&data, "%04d\n", i)
+	}
+	ioutil.WriteFile(tmpdir+"/"+"file1.txt", data.Bytes()[:3000], 0600)
+	ioutil.WriteFile(tmpdir+"/"+"file2.txt", data.Bytes()[3000:], 0600)
+
+	// 6000 bytes at 50000 bytes per second take at least 120ms.
+	kc := &KeepCountTestClient{}
+	cw := CollectionWriter{IKeepClient: kc, BlockSize: 1000, BytesPerSecond: 50000, MaxWriters: 4}
+	t0 := time.Now()
+	_, err := writeTree(&cw, tmpdir, log.New(os.Stdout, "", 0))
+	elapsed := time.Since(t0)
+	c.Check(err, IsNil)
+	c.Check(kc.puts, Equals, 6)
+	c.Check(elapsed >= 120*time.Millisecond, Equals, true, Commentf("elapsed %v", elapsed))
+	c.Check(elapsed < time.Second, Equals, true, Commentf("elapsed %v", elapsed))
+}
+
+func (s *TestSuite) TestUploadRetryCancel(c *C) {
+	tmpdir, _ := ioutil.TempDir("", "")
+	defer func() {
+		os.RemoveAll(tmpdir)
+	}()
+
+	ioutil.WriteFile(tmpdir+"/"+"file1.txt", []byte("foo"), 0600)
+
+	kc := &KeepFlakyTestClient{failures: 100, err: tempError{errors.New("503 Service Unavailable"), true}}
+	cw := CollectionWriter{IKeepClient: kc, MaxRetries: 100, RetryDelay: time.Hour}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		// Cancel while waiting to retry
+		for {
+			kc.mtx.Lock()
+			attempts := kc.attempts
+			kc.mtx.Unlock()
+			if attempts > 0 {
+				cancel()
+				return
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}()
+	walkUpload := cw.BeginUpload(ctx, tmpdir, log.New(os.Stdout, "", 0))
+	c.Check(walkUpload.Walk(), IsNil)
+	c.Check(cw.EndUpload(walkUpload), Equals, context.Canceled)
+	c.Check(kc.attempts, Equals, 1)
+}
+
+func (s *TestSuite) TestPutFile(c *C) {
+	tmpdir, _ := ioutil.TempDir("", "")
+	defer func() {
+		os.RemoveAll(tmpdir)
+	}()
+
+	ioutil.WriteFile(tmpdir+"/"+"file1.txt", []byte("foo"), 0600)
+	ioutil.WriteFile(tmpdir+"/"+"file2.txt", []byte("foobarbaz"), 0600)
+	ioutil.WriteFile(tmpdir+"/"+"empty.txt", nil, 0600)
+
+	cw := CollectionWriter{IKeepClient: &KeepCountTestClient{}}
+	locator, err := cw.PutFile(tmpdir + "/file1.txt")
+	c.Check(err, IsNil)
+	c.Check(locator, Equals, "acbd18db4cc2f85cedef654fccc4a4d8+3")
+
+	cw = CollectionWriter{IKeepClient: &KeepCountTestClient{}, BlockSize: 6}
+	locator, err = cw.PutFile(tmpdir + "/file2.txt")
+	c.Check(err, IsNil)
+	c.Check(locator, Equals, "3858f62230ac3c915f300c664312c63f+6 73feffa4b7f6bb68e44cf984c85f6e88+3")
+
+	locator, err = cw.PutFile(tmpdir + "/empty.txt")
+	c.Check(err, IsNil)
+	c.Check(locator, Equals, "d41d8cd98f00b204e9800998ecf8427e+0")
+
+	_, err = cw.PutFile(tmpdir + "/nonexistent")
+	c.Check(err, FitsTypeOf, &UploadError{})
+
+	cw = CollectionWriter{IKeepClient: &KeepErrorTestClient{}}
+	_, err = cw.PutFile(tmpdir + "/file1.txt")
+	c.Check(err, ErrorMatches, `Upload put failed for ".*/file1.txt": KeepError`)
+}
+
+func (s *TestSuite) TestParseManifest(c *C) {
+	streams, err := ParseManifest(normalizedManifestWithSubdirs)
+	c.Assert(err, IsNil)
+	c.Assert(streams, HasLen, 3)
+	c.Check(streams[0].StreamName, Equals, ".")
+	c.Check(streams[1].StreamName, Equals, "./subdir1")
+	c.Check(streams[2].StreamName, Equals, "./subdir1/subdir2")
+	c.Check(streams[1].Blocks, DeepEquals, []string{"3e426d509afffb85e06c4c96a7c15e91+27+Aa124ac75e5168396cabcdefghij6419876543234@569fa8c4"})
+	c.Check(streams[0].FileStreamSegments, DeepEquals, []manifest.FileStreamSegment{
+		{0, 9, "file1_in_main.txt"},
+		{9, 18, "file2_in_main.txt"},
+		{0, 27, "zzzzz-8i9sb-bcdefghijkdhvnk.log.txt"},
+	})
+	c.Check(streams[2].FileStreamSegments[1], DeepEquals, manifest.FileStreamSegment{9, 18, "file2_in_subdir2.txt"})
+
+	streams, err = ParseManifest(". acbd18db4cc2f85cedef654fccc4a4d8+3 37b51d194a7513e45b56f6524f2d51f2+3 0:6:my\\040file.txt\n")
+	c.Assert(err, IsNil)
+	c.Check(streams[0].Blocks, HasLen, 2)
+	c.Check(streams[0].FileStreamSegments, DeepEquals, []manifest.FileStreamSegment{{0, 6, "my file.txt"}})
+
+	_, err = ParseManifest(". acbd18db4cc2f85cedef654fccc4a4d8+3 0:6:file.txt\n")
+	c.Check(err, NotNil)
+}
+
+func (s *TestSuite) TestParseManifestRoundTrip(c *C) {
+	tmpdir, _ := ioutil.TempDir("", "")
+	defer func() {
+		os.RemoveAll(tmpdir)
+	}()
+
+	os.Mkdir(tmpdir+"/sub dir", 0700)
+	ioutil.WriteFile(tmpdir+"/"+"file1.txt", []byte("foo"), 0600)
+	ioutil.WriteFile(tmpdir+"/"+"file2.txt", []byte("bar"), 0600)
+	ioutil.WriteFile(tmpdir+"/sub dir/file 3.txt", []byte("baz"), 0600)
+
+	cw := CollectionWriter{IKeepClient: &KeepTestClient{}}
+	str, err := writeTree(&cw, tmpdir, log.New(os.Stdout, "", 0))
+	c.Assert(err, IsNil)
+
+	streams, err := ParseManifest(str)
+	c.Assert(err, IsNil)
+	c.Assert(streams, HasLen, 2)
+	c.Check(streams[0].StreamName, Equals, ".")
+	c.Check(streams[0].Blocks, DeepEquals, []string{"3858f62230ac3c915f300c664312c63f+6"})
+	c.Check(streams[0].FileStreamSegments, DeepEquals, []manifest.FileStreamSegment{{0, 3, "file1.txt"}, {3, 3, "file2.txt"}})
+	c.Check(streams[1].StreamName, Equals, "./sub dir")
+	c.Check(streams[1].FileStreamSegments, DeepEquals, []manifest.FileStreamSegment{{0, 3, "file 3.txt"}})
+}
+
+func (s *TestSuite) TestUploadSpecialFilePolicy(c *C) {
+	tmpdir, _ := ioutil.TempDir("", "")
+	defer func() {
+		os.RemoveAll(tmpdir)
+	}()
+
+	ioutil.WriteFile(tmpdir+"/"+"file1.txt", []byte("foo"), 0600)
+	c.Assert(syscall.Mkfifo(tmpdir+"/pipe", 0600), IsNil)
+	ln, err := net.Listen("unix", tmpdir+"/socket")
+	c.Assert(err, IsNil)
+	defer ln.Close()
+
+	cw := CollectionWriter{IKeepClient: &KeepTestClient{}}
+	str, err := writeTree(&cw, tmpdir, log.New(os.Stdout, "", 0))
+	c.Check(err, IsNil)
+	c.Check(str, Equals, ". acbd18db4cc2f85cedef654fccc4a4d8+3 0:3:file1.txt\n")
+	c.Check(cw.FileMetadata(), HasLen, 0)
+
+	cw = CollectionWriter{IKeepClient: &KeepTestClient{}, SpecialFilePolicy: SpecialFileRecord}
+	str, err = writeTree(&cw, tmpdir, log.New(os.Stdout, "", 0))
+	c.Check(err, IsNil)
+	c.Check(str, Equals, ". acbd18db4cc2f85cedef654fccc4a4d8+3 0:3:file1.txt\n")
+	c.Check(cw.FileMetadata(), DeepEquals, map[string]*FileMetadata{
+		"pipe":   {Type: "fifo"},
+		"socket": {Type: "socket"},
+	})
+
+	for _, name := range []string{"pipe", "socket"} {
+		cw = CollectionWriter{IKeepClient: &KeepTestClient{}, SpecialFilePolicy: SpecialFileError}
+		walkUpload := cw.BeginUpload(context.Background(), tmpdir, log.New(os.Stdout, "", 0))
+		err = walkUpload.UploadFile(tmpdir+"/"+name, name)
+		c.Check(err, ErrorMatches, `Upload read failed for "`+name+`": Cannot upload special file \((fifo|socket)\)`)
+		cw.EndUpload(walkUpload)
+	}
+
+	cw = CollectionWriter{IKeepClient: &KeepTestClient{}, SpecialFilePolicy: SpecialFileError}
+	_, err = writeTree(&cw, tmpdir, log.New(os.Stdout, "", 0))
+	c.Check(err, ErrorMatches, `Upload read failed for "pipe": .*`)
+}
+
+// denyFileSystem is the local file system, except that opening the
+// files in deny fails as if they were not readable.
+type denyFileSystem struct {
+	osFileSystem
+	deny map[string]bool
+}
+
+func (fs denyFileSystem) Open(name string) (FSFile, error) {
+	if fs.deny[name] {
+		return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrPermission}
+	}
+	return fs.osFileSystem.Open(name)
+}
+
+func (s *TestSuite) TestUploadWarnings(c *C) {
+	tmpdir, _ := ioutil.TempDir("", "")
+	defer func() {
+		os.RemoveAll(tmpdir)
+	}()
+
+	os.Mkdir(tmpdir+"/subdir", 0700)
+	ioutil.WriteFile(tmpdir+"/"+"file1.txt", []byte("foo"), 0600)
+	ioutil.WriteFile(tmpdir+"/subdir/secret.txt", []byte("bar"), 0600)
+	ioutil.WriteFile(tmpdir+"/subdir/file2.txt", []byte("baz"), 0600)
+	os.Mkdir(tmpdir+"/subdir/private", 0700)
+	ioutil.WriteFile(tmpdir+"/subdir/private/file3.txt", []byte("qux"), 0600)
+	c.Assert(syscall.Mkfifo(tmpdir+"/pipe", 0600), IsNil)
+
+	for _, readers := range []int{1, 4} {
+		cw := CollectionWriter{IKeepClient: &KeepTestClient{}, MaxReaders: readers}
+		walkUpload := cw.BeginUpload(context.Background(), tmpdir, log.New(os.Stdout, "", 0))
+		walkUpload.FileSystem = denyFileSystem{deny: map[string]bool{
+			tmpdir + "/subdir/secret.txt": true,
+			tmpdir + "/subdir/private":    true,
+		}}
+		c.Check(walkUpload.Walk(), IsNil)
+		c.Check(cw.EndUpload(walkUpload), IsNil)
+		str, err := cw.ManifestText()
+		c.Check(err, IsNil)
+		c.Check(str, Equals, `. acbd18db4cc2f85cedef654fccc4a4d8+3 0:3:file1.txt
+./subdir 73feffa4b7f6bb68e44cf984c85f6e88+3 0:3:file2.txt
+`)
+		// With MaxReaders > 1, directories are listed before
+		// files are read, so warnings come in a different order.
+		warnings := walkUpload.Warnings()
+		sort.Slice(warnings, func(i, j int) bool { return warnings[i].Path < warnings[j].Path })
+		c.Check(warnings, DeepEquals, []UploadWarning{
+			{Path: "pipe", Reason: "special file (fifo)"},
+			{Path: "subdir/private", Reason: "open " + tmpdir + "/subdir/private: permission denied"},
+			{Path: "subdir/secret.txt", Reason: "open " + tmpdir + "/subdir/secret.txt: permission denied"},
+		})
+		c.Check(walkUpload.Err(), ErrorMatches, `(?s)(Skipped "(pipe|subdir/private|subdir/secret.txt)": [^\n]*\n?){3}`)
+	}
+
+	cw := CollectionWriter{IKeepClient: &KeepTestClient{}, SpecialFilePolicy: SpecialFileRecord}
+	walkUpload := cw.BeginUpload(context.Background(), tmpdir, log.New(os.Stdout, "", 0))
+	c.Check(walkUpload.Walk(), IsNil)
+	c.Check(cw.EndUpload(walkUpload), IsNil)
+	c.Check(walkUpload.Warnings(), HasLen, 0)
+	c.Check(walkUpload.Err(), IsNil)
+}
+
+func (s *TestSuite) TestUploadStrictReadability(c *C) {
+	tmpdir, _ := ioutil.TempDir("", "")
+	defer func() {
+		os.RemoveAll(tmpdir)
+	}()
+
+	os.Mkdir(tmpdir+"/subdir", 0700)
+	ioutil.WriteFile(tmpdir+"/"+"file1.txt", []byte("foo"), 0600)
+	ioutil.WriteFile(tmpdir+"/subdir/secret.txt", []byte("bar"), 0600)
+	ioutil.WriteFile(tmpdir+"/subdir/file2.txt", []byte("baz"), 0600)
+	os.Mkdir(tmpdir+"/subdir/private", 0700)
+
+	for _, trial := range []struct {
+		deny string
+		err  string
+	}{
+		{"/subdir/secret.txt", `Upload read failed for "subdir/secret.txt": open .*/subdir/secret.txt: permission denied`},
+		{"/subdir/private", `Upload read failed for "subdir/private": open .*/subdir/private: permission denied`},
+	} {
+		for _, readers := range []int{1, 4} {
+			cw := CollectionWriter{IKeepClient: &KeepTestClient{}, MaxReaders: readers, StrictReadability: true}
+			walkUpload := cw.BeginUpload(context.Background(), tmpdir, log.New(os.Stdout, "", 0))
+			walkUpload.FileSystem = denyFileSystem{deny: map[string]bool{tmpdir + trial.deny: true}}
+			c.Check(walkUpload.Walk(), ErrorMatches, trial.err)
+			cw.EndUpload(walkUpload)
+			c.Check(walkUpload.Warnings(), HasLen, 0)
+		}
+	}
+}
+
+func (s *TestSuite) TestUploadModifiedSince(c *C) {
+	tmpdir, _ := ioutil.TempDir("", "")
+	defer func() {
+		os.RemoveAll(tmpdir)
+	}()
+
+	os.MkdirAll(tmpdir+"/subdir/deeper", 0700)
+	ioutil.WriteFile(tmpdir+"/file1.txt", []byte("foo"), 0600)
+	ioutil.WriteFile(tmpdir+"/subdir/file2.txt", []byte("bar"), 0600)
+	ioutil.WriteFile(tmpdir+"/subdir/deeper/file3.txt", []byte("baz"), 0600)
+	old := time.Now().Add(-time.Hour)
+	for _, path := range []string{"file1.txt", "subdir/file2.txt", "subdir/deeper/file3.txt", "subdir/deeper", "subdir"} {
+		os.Chtimes(tmpdir+"/"+path, old, old)
+	}
+	since := time.Now().Add(-time.Minute)
+
+	cw := CollectionWriter{IKeepClient: &KeepTestClient{}, ModifiedSince: since}
+	str, err := writeTree(&cw, tmpdir, log.New(os.Stdout, "", 0))
+	c.Check(err, IsNil)
+	c.Check(str, Equals, "")
+
+	// Touching a file in a directory does not change the
+	// directory's modification time, but the file is found.
+	os.Chtimes(tmpdir+"/subdir/deeper/file3.txt", time.Now(), time.Now())
+	cw = CollectionWriter{IKeepClient: &KeepTestClient{}, ModifiedSince: since}
+	str, err = writeTree(&cw, tmpdir, log.New(os.Stdout, "", 0))
+	c.Check(err, IsNil)
+	c.Check(str, Equals, "./subdir/deeper 73feffa4b7f6bb68e44cf984c85f6e88+3 0:3:file3.txt\n")
+
+	cw = CollectionWriter{IKeepClient: &KeepTestClient{}}
+	str, err = writeTree(&cw, tmpdir, log.New(os.Stdout, "", 0))
+	c.Check(err, IsNil)
+	c.Check(strings.Count(str, ".txt"), Equals, 3)
+}
+
+func (s *TestSuite) TestUploadUnreadableDir(c *C) {
+	if os.Getuid() == 0 {
+		c.Skip("root can read directories without permission")
+	}
+	tmpdir, _ := ioutil.TempDir("", "")
+	defer func() {
+		os.Chmod(tmpdir+"/subdir", 0700)
+		os.RemoveAll(tmpdir)
+	}()
+
+	os.Mkdir(tmpdir+"/subdir", 0700)
+	ioutil.WriteFile(tmpdir+"/"+"file1.txt", []byte("foo"), 0600)
+	ioutil.WriteFile(tmpdir+"/subdir/file2.txt", []byte("bar"), 0600)
+	os.Chmod(tmpdir+"/subdir", 0)
+
+	cw := CollectionWriter{IKeepClient: &KeepTestClient{}}
+	walkUpload := cw.BeginUpload(context.Background(), tmpdir, log.New(os.Stdout, "", 0))
+	c.Check(walkUpload.Walk(), IsNil)
+	c.Check(cw.EndUpload(walkUpload), IsNil)
+	str, err := cw.ManifestText()
+	c.Check(err, IsNil)
+	c.Check(str, Equals, ". acbd18db4cc2f85cedef654fccc4a4d8+3 0:3:file1.txt\n")
+	c.Check(walkUpload.Warnings(), DeepEquals, []UploadWarning{
+		{Path: "subdir", Reason: "open " + tmpdir + "/subdir: permission denied"},
+	})
+
+	// The upload root itself must be readable.
+	cw = CollectionWriter{IKeepClient: &KeepTestClient{}}
+	_, err = writeTree(&cw, tmpdir+"/subdir", log.New(os.Stdout, "", 0))
+	c.Check(err, ErrorMatches, `open .*/subdir: permission denied`)
+}
+
+func (s *TestSuite) TestUploadCustomHasher(c *C) {
+	tmpdir, _ := ioutil.TempDir("", "")
+	defer func() {
+		os.RemoveAll(tmpdir)
+	}()
+
+	os.Mkdir(tmpdir+"/subdir", 0700)
+	ioutil.WriteFile(tmpdir+"/"+"file1.txt", []byte("foo"), 0600)
+	ioutil.WriteFile(tmpdir+"/subdir/file2.txt", []byte("barbaz"), 0600)
+
+	cw := CollectionWriter{IKeepClient: &KeepTestClient{}, Hasher: sha1.New}
+	str, err := writeTree(&cw, tmpdir, log.New(os.Stdout, "", 0))
+	c.Check(err, IsNil)
+	c.Check(str, Equals, `. 0beec7b5ea3f0fdbc95d0dd47f3c5bc275da8a33+3 0:3:file1.txt
+./subdir 32b1bf1853e6c39e4a1c3dae941ab7094ff1d293+6 0:6:file2.txt
+`)
+	c.Check(str, Matches, `(?s)(.* [0-9a-f]{40}\+[0-9]+ .*)+`)
+}
+
+func (s *TestSuite) TestUploadNoSplitSmallFiles(c *C) {
+	tmpdir, _ := ioutil.TempDir("", "")
+	defer func() {
+		os.RemoveAll(tmpdir)
+	}()
+
+	data1 := make([]byte, 40<<20)
+	data2 := make([]byte, 40<<20)
+	for i := range data1 {
+		data1[i] = byte(i % 10)
+		data2[i] = byte(i % 11)
+	}
+	ioutil.WriteFile(tmpdir+"/"+"file1.txt", data1, 0600)
+	ioutil.WriteFile(tmpdir+"/"+"file2.txt", data2, 0600)
+
+	cw := CollectionWriter{IKeepClient: &KeepCountTestClient{}, NoSplitSmallFiles: true}
+	str, err := writeTree(&cw, tmpdir, log.New(os.Stdout, "", 0))
+	c.Check(err, IsNil)
+	c.Check(str, Equals, fmt.Sprintf(". %x+41943040 %x+41943040 0:41943040:file1.txt 41943040:41943040:file2.txt\n", md5.Sum(data1), md5.Sum(data2)))
+
+	// Files larger than SmallFileSize are split as usual
+	cw = CollectionWriter{IKeepClient: &KeepCountTestClient{}, NoSplitSmallFiles: true, SmallFileSize: 1 << 20}
+	str, err = writeTree(&cw, tmpdir, log.New(os.Stdout, "", 0))
+	c.Check(err, IsNil)
+	c.Check(str, Matches, `\. [0-9a-f]{32}\+67108864 [0-9a-f]{32}\+16777216 0:41943040:file1.txt 41943040:41943040:file2.txt\n`)
+}
+
+func (s *TestSuite) TestUploadSizeChange(c *C) {
+	tmpdir, _ := ioutil.TempDir("", "")
+	defer func() {
+		os.RemoveAll(tmpdir)
+	}()
+
+	data := make([]byte, 1<<20)
+	for i := range data {
+		data[i] = byte(i % 10)
+	}
+	for _, policy := range []SizeChangePolicy{SizeChangeRecordActual, SizeChangeError} {
+		ioutil.WriteFile(tmpdir+"/"+"file1.txt", data, 0600)
+		cw := CollectionWriter{
+			IKeepClient:      &KeepCountTestClient{},
+			BlockSize:        1024,
+			SizeChangePolicy: policy,
+			OnProgress: func(path string, n, total int64) {
+				// Truncate the file after the first read
+				if n == 1024 {
+					os.Truncate(tmpdir+"/file1.txt", 2048)
+				}
+			},
+		}
+		str, err := writeTree(&cw, tmpdir, log.New(os.Stdout, "", 0))
+		if policy == SizeChangeError {
+			c.Check(err, ErrorMatches, `Upload read failed for "file1.txt": File size changed during upload: expected 1048576 bytes, read 2048`)
+		} else {
+			c.Check(err, IsNil)
+			c.Check(str, Matches, `\. [0-9a-f]{32}\+1024 [0-9a-f]{32}\+1024 0:2048:file1.txt\n`)
+		}
+	}
+}
+
+func (s *TestSuite) TestUploadMaxBufferedBlocks(c *C) {
+	tmpdir, _ := ioutil.TempDir("", "")
+	defer func() {
+		os.RemoveAll(tmpdir)
+	}()
+
+	os.Mkdir(tmpdir+"/subdir", 0700)
+	data := make([]byte, 5*1024+100)
+	for i := range data {
+		data[i] = byte(i / 1024)
+	}
+	for _, fn := range []string{"file1.txt", "file2.txt", "subdir/file3.txt", "subdir/file4.txt", "zzz.txt"} {
+		ioutil.WriteFile(tmpdir+"/"+fn, data, 0600)
+	}
+
+	kc := &KeepSlowTestClient{}
+	cw := CollectionWriter{IKeepClient: kc, BlockSize: 1024, MaxWriters: 3}
+	_, err := writeTree(&cw, tmpdir, log.New(os.Stdout, "", 0))
+	c.Check(err, IsNil)
+	c.Check(cw.peakBuffers > 1, Equals, true)
+
+	kc = &KeepSlowTestClient{}
+	cw = CollectionWriter{IKeepClient: kc, BlockSize: 1024, MaxWriters: 3, MaxBufferedBlocks: 1}
+	str, err := writeTree(&cw, tmpdir, log.New(os.Stdout, "", 0))
+	c.Check(err, IsNil)
+	c.Check(cw.peakBuffers, Equals, 1)
+	c.Check(cw.buffersInUse, Equals, 0)
+	c.Check(kc.maxActive, Equals, 1)
+
+	streams, err := ParseManifest(str)
+	c.Assert(err, IsNil)
+	var total uint64
+	for _, stream := range streams {
+		for _, seg := range stream.FileStreamSegments {
+			total += seg.SegLen
+		}
+	}
+	c.Check(total, Equals, uint64(5*len(data)))
+}
+
+func (s *TestSuite) TestUploadMaxCollectionBytes(c *C) {
+	tmpdir, _ := ioutil.TempDir("", "")
+	defer func() {
+		os.RemoveAll(tmpdir)
+	}()
+
+	ioutil.WriteFile(tmpdir+"/"+"file1.txt", []byte("foo"), 0600)
+	ioutil.WriteFile(tmpdir+"/"+"file2.txt", []byte("bar"), 0600)
+	ioutil.WriteFile(tmpdir+"/"+"file3.txt", []byte("baz"), 0600)
+
+	cw := CollectionWriter{IKeepClient: &KeepTestClient{}, MaxCollectionBytes: 9}
+	str, err := writeTree(&cw, tmpdir, log.New(os.Stdout, "", 0))
+	c.Check(err, IsNil)
+	c.Check(str, Equals, ". 6df23dc03f9b54cc38a0fc1483df6e21+9 0:3:file1.txt 3:3:file2.txt 6:3:file3.txt\n")
+
+	for _, bs := range []int{0, 2} {
+		cw = CollectionWriter{IKeepClient: &KeepTestClient{}, MaxCollectionBytes: 5, BlockSize: bs}
+		str, err = writeTree(&cw, tmpdir, log.New(os.Stdout, "", 0))
+		c.Check(err, ErrorMatches, `Upload pack failed for "file2.txt": Collection size limit exceeded: wrote 6 bytes, limit is 5 bytes`)
+		c.Check(str, Equals, "")
+		str, err = cw.ManifestText()
+		c.Check(err, ErrorMatches, `Collection size limit exceeded: .*`)
+		c.Check(str, Equals, "")
+	}
+}
+
+func (s *TestSuite) TestUploadMaxFiles(c *C) {
+	tmpdir, _ := ioutil.TempDir("", "")
+	defer func() {
+		os.RemoveAll(tmpdir)
+	}()
+
+	ioutil.WriteFile(tmpdir+"/"+"file1.txt", []byte("foo"), 0600)
+	ioutil.WriteFile(tmpdir+"/"+"file2.txt", []byte("bar"), 0600)
+	os.Mkdir(tmpdir+"/subdir", 0700)
+	ioutil.WriteFile(tmpdir+"/subdir/file3.txt", []byte("baz"), 0600)
+	os.Symlink("file1.txt", tmpdir+"/link")
+
+	cw := CollectionWriter{IKeepClient: &KeepTestClient{}, MaxFiles: 3, SymlinkMode: SymlinkStore}
+	_, err := writeTree(&cw, tmpdir, log.New(os.Stdout, "", 0))
+	c.Check(err, IsNil)
+
+	for _, readers := range []int{0, 4} {
+		cw = CollectionWriter{IKeepClient: &KeepTestClient{}, MaxFiles: 2, MaxReaders: readers}
+		str, err := writeTree(&cw, tmpdir, log.New(os.Stdout, "", 0))
+		c.Check(err, ErrorMatches, `Upload pack failed for "link": File count limit exceeded: more than 2 files`)
+		c.Check(str, Equals, "")
+		_, err = cw.ManifestText()
+		c.Check(err, ErrorMatches, `File count limit exceeded: .*`)
+	}
+}
+
+func (s *TestSuite) TestUploadMaxFilesUnreadable(c *C) {
+	tmpdir, _ := ioutil.TempDir("", "")
+	defer func() {
+		os.RemoveAll(tmpdir)
+	}()
+
+	ioutil.WriteFile(tmpdir+"/"+"file1.txt", []byte("foo"), 0600)
+	ioutil.WriteFile(tmpdir+"/"+"file2.txt", []byte("bar"), 0600)
+	ioutil.WriteFile(tmpdir+"/"+"secret.txt", []byte("baz"), 0600)
+
+	// The unreadable file is skipped, so it does not count
+	for _, readers := range []int{1, 4} {
+		cw := CollectionWriter{IKeepClient: &KeepTestClient{}, MaxFiles: 2, MaxReaders: readers}
+		walkUpload := cw.BeginUpload(context.Background(), tmpdir, log.New(os.Stdout, "", 0))
+		walkUpload.FileSystem = denyFileSystem{deny: map[string]bool{
+			tmpdir + "/secret.txt": true,
+		}}
+		c.Check(walkUpload.Walk(), IsNil)
+		c.Check(cw.EndUpload(walkUpload), IsNil)
+		str, err := cw.ManifestText()
+		c.Check(err, IsNil)
+		c.Check(str, Equals, ". 3858f62230ac3c915f300c664312c63f+6 0:3:file1.txt 3:3:file2.txt\n")
+		c.Check(walkUpload.Warnings(), HasLen, 1)
+	}
 }
@@ -0,0 +1,95 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+var transformHintRe = regexp.MustCompile(`^Z[A-Za-z0-9@_-]*$`)
+
+// storeBlock writes data (whose hash is hash) to Keep, or only computes
+// its locator with DryRun, applying BlockTransform if set.  It returns
+// the locator and the number of bytes stored.
+func (m *CollectionFileWriter) storeBlock(hash string, data []byte) (string, int, error) {
+	stored, hint := data, ""
+	if m.cw.BlockTransform != nil {
+		var err error
+		stored, hint, err = m.cw.BlockTransform(data)
+		if err != nil {
+			return "", 0, fmt.Errorf("Block transform failed: %v", err)
+		}
+		if !transformHintRe.MatchString(hint) {
+			return "", 0, fmt.Errorf("Invalid block transform hint %q", hint)
+		}
+		hash = m.cw.hash(stored)
+	}
+
+	var locator string
+	if m.cw.DryRun {
+		locator = fmt.Sprintf("%s+%d", hash, len(stored))
+	} else {
+		var err error
+		locator, err = m.putRetry(hash, stored)
+		if err != nil {
+			return "", 0, err
+		}
+	}
+	if hint != "" {
+		locator = transformedLocator(locator, len(data), hint)
+	}
+	return locator, len(stored), nil
+}
+
+// transformedLocator returns the locator of a stored block, with the
+// size replaced by the size of the untransformed data and the transform
+// hint added.
+func transformedLocator(locator string, size int, hint string) string {
+	parts := strings.Split(locator, "+")
+	if len(parts) < 2 {
+		parts = append(parts, "")
+	}
+	parts[1] = strconv.Itoa(size)
+	parts = append(parts[:2], append([]string{hint}, parts[2:]...)...)
+	return strings.Join(parts, "+")
+}
+
+// ReadTransformedBlock reads the block with the given locator and
+// returns its original content.  If the locator has a transform hint
+// (see CollectionWriter.BlockTransform), the stored data and the hint
+// are passed to untransform, which must undo the transformation.
+func ReadTransformedBlock(kc BlockGetter, locator string, untransform func(data []byte, hint string) ([]byte, error)) ([]byte, error) {
+	parts := strings.Split(locator, "+")
+	var hint string
+	for _, part := range parts[1:] {
+		if transformHintRe.MatchString(part) {
+			hint = part
+		}
+	}
+
+	rdr, _, _, err := kc.Get(locator)
+	if err != nil {
+		return nil, err
+	}
+	defer rdr.Close()
+	data, err := ioutil.ReadAll(rdr)
+	if err != nil {
+		return nil, err
+	}
+	if hint != "" {
+		data, err = untransform(data, hint)
+		if err != nil {
+			return nil, fmt.Errorf("While reading block %s: %v", locator, err)
+		}
+	}
+	if len(parts) > 1 && parts[1] != strconv.Itoa(len(data)) {
+		return nil, fmt.Errorf("While reading block %s: got %d bytes", locator, len(data))
+	}
+	return data, nil
+}
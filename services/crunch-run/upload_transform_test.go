@@ -0,0 +1,91 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+
+	. "gopkg.in/check.v1"
+)
+
+func gzipBlock(data []byte) ([]byte, string, error) {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if _, err := zw.Write(data); err != nil {
+		return nil, "", err
+	}
+	if err := zw.Close(); err != nil {
+		return nil, "", err
+	}
+	return buf.Bytes(), "Zgzip", nil
+}
+
+func untransformBlock(data []byte, hint string) ([]byte, error) {
+	switch hint {
+	case "Zidentity":
+		return data, nil
+	case "Zgzip":
+		zr, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		return ioutil.ReadAll(zr)
+	default:
+		return nil, fmt.Errorf("unknown transform %q", hint)
+	}
+}
+
+func (s *TestSuite) TestUploadBlockTransform(c *C) {
+	tmpdir, _ := ioutil.TempDir("", "")
+	defer func() {
+		os.RemoveAll(tmpdir)
+	}()
+
+	data := []byte(strings.Repeat("compressible text\n", 200))
+	ioutil.WriteFile(tmpdir+"/"+"file1.txt", data, 0600)
+
+	for _, trial := range []struct {
+		transform func([]byte) ([]byte, string, error)
+		hint      string
+	}{
+		{func(data []byte) ([]byte, string, error) { return data, "Zidentity", nil }, "Zidentity"},
+		{gzipBlock, "Zgzip"},
+	} {
+		kc := &KeepStoreTestClient{}
+		cw := CollectionWriter{IKeepClient: kc, BlockSize: 1024, BlockTransform: trial.transform}
+		str, err := writeTree(&cw, tmpdir, log.New(os.Stdout, "", 0))
+		c.Assert(err, IsNil)
+		c.Check(str, Matches, `\. ([0-9a-f]{32}\+1024\+`+trial.hint+` ){3}[0-9a-f]{32}\+528\+`+trial.hint+` 0:3600:file1.txt\n`)
+
+		streams, err := ParseManifest(str)
+		c.Assert(err, IsNil)
+		var got []byte
+		for _, locator := range streams[0].Blocks {
+			block, err := ReadTransformedBlock(kc, locator, untransformBlock)
+			c.Assert(err, IsNil)
+			got = append(got, block...)
+		}
+		c.Check(got, DeepEquals, data)
+
+		if trial.hint == "Zgzip" {
+			c.Check(cw.UniqueBytesStored() < int64(len(data)), Equals, true)
+		}
+	}
+
+	cw := CollectionWriter{
+		IKeepClient: &KeepStoreTestClient{},
+		BlockTransform: func(data []byte) ([]byte, string, error) {
+			return data, "gzip", nil
+		},
+	}
+	_, err := writeTree(&cw, tmpdir, log.New(os.Stdout, "", 0))
+	c.Check(err, ErrorMatches, `Upload put failed for "file1.txt": Invalid block transform hint "gzip"`)
+}
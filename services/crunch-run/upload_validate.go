@@ -0,0 +1,218 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"git.curoverse.com/arvados.git/sdk/go/manifest"
+)
+
+// maxBlockSize is the largest block Keep stores.
+const maxBlockSize = 1 << 26
+
+// ManifestError is returned by ValidateManifest for the first problem
+// found in a manifest.  Line is the line number (starting at 1) of the
+// stream with the problem.
+type ManifestError struct {
+	Line int
+	Msg  string
+}
+
+func (e *ManifestError) Error() string {
+	return fmt.Sprintf("Invalid manifest at line %d: %s", e.Line, e.Msg)
+}
+
+var (
+	validLocatorRe = regexp.MustCompile(`^[0-9a-f]{32}\+([0-9]+)(\+[A-Z][-A-Za-z0-9@_]*)*$`)
+	validSegmentRe = regexp.MustCompile(`^([0-9]+):([0-9]+):(.+)$`)
+	escapeSeqRe    = regexp.MustCompile(`\\([0-9]{3}|\\)`)
+)
+
+// validEscapes returns whether the escape sequences in name are ones
+// manifest.UnescapeName can unescape: a backslash followed by another
+// backslash, or by the three octal digits of a byte value.  Other
+// backslashes are taken literally.
+func validEscapes(name string) bool {
+	for _, seq := range escapeSeqRe.FindAllString(name, -1) {
+		if seq == `\\` {
+			continue
+		}
+		if _, err := strconv.ParseUint(seq[1:], 8, 8); err != nil {
+			return false
+		}
+	}
+	return true
+}
+
+// ValidateManifest checks that text is a well-formed manifest, e.g.,
+// before it is saved in a collection:
+//
+// Each line is a stream name, one or more block locators, and one or
+// more file segments, separated by single spaces, and ends with a
+// newline.
+//
+// Names contain no whitespace or control characters except as octal
+// escapes (like "\040"), every escape has a valid octal byte value, and
+// their path components are not empty, "." or ".." (except the name "."
+// of an empty directory marker).
+//
+// Each segment lies within the stream's blocks, whose total size is
+// given by the sizes in their locators.
+//
+// No file appears more than once or has the same path as a directory,
+// although a file may consist of several consecutive segments, which
+// may continue on the next line (see MaxLocatorsPerLine).
+//
+// Manifests written by a CollectionWriter pass, as do normalized
+// manifests merged from several (see BaseManifest).
+func ValidateManifest(text string) error {
+	if text == "" {
+		return nil
+	}
+	if !strings.HasSuffix(text, "\n") {
+		return &ManifestError{Line: strings.Count(text, "\n") + 1, Msg: "missing newline at end of manifest"}
+	}
+	v := manifestValidator{files: make(map[string]int), dirs: make(map[string]int)}
+	for i, line := range strings.Split(text[:len(text)-1], "\n") {
+		err := v.validateStream(line, i+1)
+		if err != "" {
+			return &ManifestError{Line: i + 1, Msg: err}
+		}
+	}
+	var conflicts []string
+	for path := range v.files {
+		if _, ok := v.dirs[path]; ok {
+			conflicts = append(conflicts, path)
+		}
+	}
+	if len(conflicts) > 0 {
+		sort.Strings(conflicts)
+		return &ManifestError{Line: v.files[conflicts[0]], Msg: fmt.Sprintf("%q is both a file and a directory", conflicts[0])}
+	}
+	return nil
+}
+
+// manifestValidator holds the paths seen so far by ValidateManifest.
+type manifestValidator struct {
+	files map[string]int // line where each file was seen first
+	dirs  map[string]int // line where each directory was seen first
+	prev  string         // last file seen
+}
+
+// addDirs records dir and its ancestors (except ".") as directories.
+func (v *manifestValidator) addDirs(dir string, line int) {
+	for ; dir != "."; dir = dir[:strings.LastIndex(dir, "/")] {
+		if _, ok := v.dirs[dir]; ok {
+			return
+		}
+		v.dirs[dir] = line
+	}
+}
+
+// validateStream checks line number n of a manifest, and records the
+// paths of its files and directories.  It returns a description of the
+// first problem found, or "" if there is none.
+func (v *manifestValidator) validateStream(line string, n int) string {
+	if line == "" {
+		return "empty line"
+	}
+	tokens := strings.Split(line, " ")
+	for _, tok := range tokens {
+		if tok == "" {
+			return "empty token (extra space)"
+		}
+		for _, r := range tok {
+			if r < ' ' || r == 0x7f {
+				return fmt.Sprintf("unescaped control character in %q", tok)
+			}
+		}
+	}
+
+	stream := tokens[0]
+	if !validEscapes(stream) {
+		return fmt.Sprintf("invalid escape sequence in stream name %q", stream)
+	}
+	stream = manifest.UnescapeName(stream)
+	if stream != "." && !strings.HasPrefix(stream, "./") {
+		return fmt.Sprintf("stream name %q does not start with \"./\"", stream)
+	}
+	if stream != "." && !validComponents(stream[2:]) {
+		return fmt.Sprintf("invalid stream name %q", stream)
+	}
+
+	var streamSize uint64
+	i := 1
+	for ; i < len(tokens); i++ {
+		if strings.Contains(tokens[i], ":") {
+			break
+		}
+		m := validLocatorRe.FindStringSubmatch(tokens[i])
+		if m == nil {
+			return fmt.Sprintf("invalid block locator %q", tokens[i])
+		}
+		size, err := strconv.ParseUint(m[1], 10, 64)
+		if err != nil || size > maxBlockSize {
+			return fmt.Sprintf("block size of %q is larger than %d bytes", tokens[i], maxBlockSize)
+		}
+		streamSize += size
+	}
+	if i == 1 {
+		return "no block locators"
+	}
+	if i == len(tokens) {
+		return "no file segments"
+	}
+
+	v.addDirs(stream, n)
+	for _, tok := range tokens[i:] {
+		m := validSegmentRe.FindStringSubmatch(tok)
+		if m == nil {
+			return fmt.Sprintf("invalid file segment %q", tok)
+		}
+		offset, err1 := strconv.ParseUint(m[1], 10, 64)
+		length, err2 := strconv.ParseUint(m[2], 10, 64)
+		if err1 != nil || err2 != nil {
+			return fmt.Sprintf("invalid file segment %q", tok)
+		}
+		if offset > streamSize || length > streamSize-offset {
+			return fmt.Sprintf("file segment %q extends past end of stream (%d bytes)", tok, streamSize)
+		}
+		if !validEscapes(m[3]) {
+			return fmt.Sprintf("invalid escape sequence in file name %q", m[3])
+		}
+		name := manifest.UnescapeName(m[3])
+		if name == emptyDirMarker && length == 0 {
+			continue
+		}
+		if !validComponents(name) {
+			return fmt.Sprintf("invalid file name %q", name)
+		}
+		path := stream + "/" + name
+		if _, seen := v.files[path]; seen && path != v.prev {
+			return fmt.Sprintf("file %q appears more than once", path)
+		} else if !seen {
+			v.files[path] = n
+			v.addDirs(path[:strings.LastIndex(path, "/")], n)
+		}
+		v.prev = path
+	}
+	return ""
+}
+
+// validComponents returns whether path (a slash-separated path relative
+// to a stream) has no empty, "." or ".." components.
+func validComponents(path string) bool {
+	for _, part := range strings.Split(path, "/") {
+		if part == "" || part == "." || part == ".." {
+			return false
+		}
+	}
+	return true
+}
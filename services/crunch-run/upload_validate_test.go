@@ -0,0 +1,72 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package main
+
+import (
+	"io/ioutil"
+	"log"
+	"os"
+
+	. "gopkg.in/check.v1"
+)
+
+func (s *TestSuite) TestValidateManifest(c *C) {
+	for _, mt := range []string{
+		"",
+		". acbd18db4cc2f85cedef654fccc4a4d8+3 0:3:file1.txt\n",
+		normalizedManifestWithSubdirs,
+		". d41d8cd98f00b204e9800998ecf8427e+0 0:0:\\056\n./empty d41d8cd98f00b204e9800998ecf8427e+0 0:0:\\056\n",
+		". acbd18db4cc2f85cedef654fccc4a4d8+3 37b51d194a7513e45b56f6524f2d51f2+3 0:2:a 2:2:b 4:2:b\n",
+		". acbd18db4cc2f85cedef654fccc4a4d8+3 0:3:big\n. 37b51d194a7513e45b56f6524f2d51f2+3 0:3:big\n",
+		"./dir\\040one acbd18db4cc2f85cedef654fccc4a4d8+3+K@zzzzz 0:3:sub/file\\134name.txt 3:0:empty\n",
+	} {
+		c.Check(ValidateManifest(mt), IsNil, Commentf("%q", mt))
+	}
+
+	for _, trial := range []struct {
+		mt   string
+		line int
+		msg  string
+	}{
+		{". acbd18db4cc2f85cedef654fccc4a4d8+3 0:3:file1.txt", 1, `missing newline at end of manifest`},
+		{". acbd18db4cc2f85cedef654fccc4a4d8+3 0:3:file1.txt\n\n", 2, `empty line`},
+		{". acbd18db4cc2f85cedef654fccc4a4d8+3  0:3:file1.txt\n", 1, `empty token \(extra space\)`},
+		{". acbd18db4cc2f85cedef654fccc4a4d8+3 0:3:file\t1.txt\n", 1, `unescaped control character in "0:3:file\\t1.txt"`},
+		{"subdir acbd18db4cc2f85cedef654fccc4a4d8+3 0:3:file1.txt\n", 1, `stream name "subdir" does not start with "./"`},
+		{"./a/../b acbd18db4cc2f85cedef654fccc4a4d8+3 0:3:file1.txt\n", 1, `invalid stream name "./a/../b"`},
+		{". acbd18db4cc2f85cedef654fccc4a4d8 0:3:file1.txt\n", 1, `invalid block locator "acbd18db4cc2f85cedef654fccc4a4d8"`},
+		{". acbd18db4cc2f85cedef654fccc4a4d8+67108865 0:3:file1.txt\n", 1, `block size of "acbd18db4cc2f85cedef654fccc4a4d8\+67108865" is larger than 67108864 bytes`},
+		{". 0:3:file1.txt\n", 1, `no block locators`},
+		{". acbd18db4cc2f85cedef654fccc4a4d8+3\n", 1, `no file segments`},
+		{". acbd18db4cc2f85cedef654fccc4a4d8+3 0:3\n", 1, `invalid file segment "0:3"`},
+		{". acbd18db4cc2f85cedef654fccc4a4d8+3 0:3:file1.txt\n. acbd18db4cc2f85cedef654fccc4a4d8+3 1:3:file2.txt\n", 2, `file segment "1:3:file2.txt" extends past end of stream \(3 bytes\)`},
+		{". acbd18db4cc2f85cedef654fccc4a4d8+3 0:3:file\\908.txt\n", 1, `invalid escape sequence in file name "file\\\\908.txt"`},
+		{".\\400 acbd18db4cc2f85cedef654fccc4a4d8+3 0:3:file1.txt\n", 1, `invalid escape sequence in stream name ".\\\\400"`},
+		{". acbd18db4cc2f85cedef654fccc4a4d8+3 0:3:a//b\n", 1, `invalid file name "a//b"`},
+		{". acbd18db4cc2f85cedef654fccc4a4d8+3 0:1:a 1:1:b 2:1:a\n", 1, `file "./a" appears more than once`},
+		{". acbd18db4cc2f85cedef654fccc4a4d8+3 0:3:a\n./sub acbd18db4cc2f85cedef654fccc4a4d8+3 0:3:x\n. acbd18db4cc2f85cedef654fccc4a4d8+3 0:3:a\n", 3, `file "./a" appears more than once`},
+		{". acbd18db4cc2f85cedef654fccc4a4d8+3 0:3:subdir\n./subdir/deeper acbd18db4cc2f85cedef654fccc4a4d8+3 0:3:x\n", 1, `"./subdir" is both a file and a directory`},
+	} {
+		err := ValidateManifest(trial.mt)
+		c.Check(err, ErrorMatches, `Invalid manifest at line [0-9]+: `+trial.msg, Commentf("%q", trial.mt))
+		if err, ok := err.(*ManifestError); ok {
+			c.Check(err.Line, Equals, trial.line, Commentf("%q", trial.mt))
+		}
+	}
+
+	// Manifests written by CollectionWriter are valid.
+	tmpdir, _ := ioutil.TempDir("", "")
+	defer func() {
+		os.RemoveAll(tmpdir)
+	}()
+	os.MkdirAll(tmpdir+"/sub dir/empty", 0700)
+	ioutil.WriteFile(tmpdir+"/file1.txt", []byte("foo"), 0600)
+	ioutil.WriteFile(tmpdir+"/sub dir/file\\2.txt", []byte("bar"), 0600)
+	ioutil.WriteFile(tmpdir+"/sub dir/empty.txt", nil, 0600)
+	cw := CollectionWriter{IKeepClient: &KeepTestClient{}, PreserveEmptyDirs: true, MaxLocatorsPerLine: 1}
+	mt, err := writeTree(&cw, tmpdir, log.New(os.Stdout, "", 0))
+	c.Assert(err, IsNil)
+	c.Check(ValidateManifest(mt), IsNil, Commentf("%q", mt))
+}
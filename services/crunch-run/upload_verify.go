@@ -0,0 +1,121 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// BlockGetter is implemented by Keep clients that can read blocks back
+// from Keep, like keepclient.KeepClient.
+type BlockGetter interface {
+	Get(locator string) (io.ReadCloser, int64, string, error)
+}
+
+// verifyBlocks reads back each block written by the CollectionWriter
+// that has not been verified already, and checks that its content
+// matches the hash in the locator.
+func (m *CollectionWriter) verifyBlocks() error {
+	if m.DryRun {
+		return nil
+	}
+	getter, ok := unwrapClient(m.keepClient()).(BlockGetter)
+	if !ok {
+		return fmt.Errorf("Cannot verify blocks: Keep client does not support reading blocks")
+	}
+
+	var locators []string
+	m.mtx.Lock()
+	for _, st := range m.Streams {
+		locators = append(locators, st.Blocks...)
+	}
+	m.mtx.Unlock()
+
+	for _, locator := range locators {
+		hash := strings.SplitN(locator, "+", 2)[0]
+		m.storedMtx.Lock()
+		done := m.verified[hash]
+		m.storedMtx.Unlock()
+		if done {
+			continue
+		}
+
+		if err := m.verifyBlock(getter, locator, hash); err != nil {
+			return err
+		}
+
+		m.storedMtx.Lock()
+		if m.verified == nil {
+			m.verified = make(map[string]bool)
+		}
+		m.verified[hash] = true
+		m.storedMtx.Unlock()
+	}
+	return nil
+}
+
+func (m *CollectionWriter) verifyBlock(getter BlockGetter, locator, hash string) error {
+	rdr, _, _, err := getter.Get(locator)
+	if err != nil {
+		return fmt.Errorf("While verifying block %s: %v", locator, err)
+	}
+	defer rdr.Close()
+	h := m.newHash()
+	if _, err := io.Copy(h, rdr); err != nil {
+		return fmt.Errorf("While verifying block %s: %v", locator, err)
+	}
+	if got := fmt.Sprintf("%x", h.Sum(nil)); got != hash {
+		return fmt.Errorf("Block %s failed verification: stored data has hash %s", locator, got)
+	}
+	return nil
+}
+
+// VerifyTree checks, without writing or reading anything in Keep,
+// whether the tree at root has the given portable data hash, e.g., to
+// confirm that a tree on disk matches a collection.  It computes the
+// manifest by uploading the tree with the writer it is called on, so
+// the writer's options, such as BlockSize, must be the same as those of
+// the upload that made the collection.
+//
+// The writer must have DryRun set (VerifyTree fails otherwise) and
+// hold no streams yet.  VerifyTree adds the tree's streams to it, so
+// use a new writer for each call, not one that is writing a real
+// collection.
+//
+// If the portable data hashes differ and DiffBase is set (to the
+// manifest text of the collection), VerifyTree also returns the
+// differences between the tree and the collection, as returned by Diff.
+func (m *CollectionWriter) VerifyTree(ctx context.Context, root, pdh string) (bool, *ManifestDiff, error) {
+	if !m.DryRun {
+		return false, nil, errors.New("VerifyTree requires DryRun")
+	}
+	wu := m.BeginUpload(ctx, root, nil)
+	if err := wu.Walk(); err != nil {
+		wu.Abort()
+		return false, nil, err
+	}
+	if err := m.EndUpload(wu); err != nil {
+		return false, nil, err
+	}
+	got, err := m.PortableDataHash()
+	if err != nil {
+		return false, nil, err
+	}
+	if got == pdh {
+		return true, nil, nil
+	}
+	if m.DiffBase == "" {
+		return false, nil, nil
+	}
+	diff, _, err := m.Diff()
+	if err != nil {
+		return false, nil, err
+	}
+	return false, diff, nil
+}
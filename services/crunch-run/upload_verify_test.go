@@ -0,0 +1,138 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+	"sync"
+
+	. "gopkg.in/check.v1"
+)
+
+// KeepStoreTestClient stores blocks in memory, and corrupts the
+// content of the block with hash corruptHash when it is read back.
+type KeepStoreTestClient struct {
+	KeepTestClient
+	mtx         sync.Mutex
+	blocks      map[string][]byte
+	gets        int
+	corruptHash string
+}
+
+func (client *KeepStoreTestClient) PutHB(hash string, buf []byte) (string, int, error) {
+	client.mtx.Lock()
+	defer client.mtx.Unlock()
+	if client.blocks == nil {
+		client.blocks = make(map[string][]byte)
+	}
+	client.blocks[hash] = append([]byte(nil), buf...)
+	return client.KeepTestClient.PutHB(hash, buf)
+}
+
+func (client *KeepStoreTestClient) Get(locator string) (io.ReadCloser, int64, string, error) {
+	client.mtx.Lock()
+	defer client.mtx.Unlock()
+	client.gets++
+	hash := strings.SplitN(locator, "+", 2)[0]
+	data := client.blocks[hash]
+	if hash == client.corruptHash {
+		data = append([]byte("x"), data[1:]...)
+	}
+	return ioutil.NopCloser(bytes.NewReader(data)), int64(len(data)), "", nil
+}
+
+func (s *TestSuite) TestUploadVerifyAfterWrite(c *C) {
+	tmpdir, _ := ioutil.TempDir("", "")
+	defer func() {
+		os.RemoveAll(tmpdir)
+	}()
+
+	os.Mkdir(tmpdir+"/subdir", 0700)
+	ioutil.WriteFile(tmpdir+"/"+"file1.txt", []byte("foo"), 0600)
+	ioutil.WriteFile(tmpdir+"/subdir/file2.txt", []byte("bar"), 0600)
+	os.Mkdir(tmpdir+"/subdir2", 0700)
+	ioutil.WriteFile(tmpdir+"/subdir2/file3.txt", []byte("bar"), 0600)
+
+	kc := &KeepStoreTestClient{}
+	cw := CollectionWriter{IKeepClient: kc, VerifyAfterWrite: true}
+	_, err := writeTree(&cw, tmpdir, log.New(os.Stdout, "", 0))
+	c.Check(err, IsNil)
+	c.Check(kc.gets, Equals, 2)
+
+	// Already verified blocks are not read again
+	_, err = cw.ManifestText()
+	c.Check(err, IsNil)
+	c.Check(kc.gets, Equals, 2)
+
+	kc = &KeepStoreTestClient{corruptHash: "37b51d194a7513e45b56f6524f2d51f2"}
+	cw = CollectionWriter{IKeepClient: kc, VerifyAfterWrite: true}
+	_, err = writeTree(&cw, tmpdir, log.New(os.Stdout, "", 0))
+	c.Check(err, ErrorMatches, "Block 37b51d194a7513e45b56f6524f2d51f2\\+3 failed verification: .*")
+}
+
+func (s *TestSuite) TestUploadVerifyUnsupported(c *C) {
+	tmpdir, _ := ioutil.TempDir("", "")
+	defer func() {
+		os.RemoveAll(tmpdir)
+	}()
+
+	ioutil.WriteFile(tmpdir+"/"+"file1.txt", []byte("foo"), 0600)
+
+	cw := CollectionWriter{IKeepClient: &KeepTestClient{}, VerifyAfterWrite: true}
+	_, err := writeTree(&cw, tmpdir, log.New(os.Stdout, "", 0))
+	c.Check(err, ErrorMatches, "Cannot verify blocks: .*")
+}
+
+func (s *TestSuite) TestVerifyTree(c *C) {
+	tmpdir, _ := ioutil.TempDir("", "")
+	defer func() {
+		os.RemoveAll(tmpdir)
+	}()
+
+	os.MkdirAll(tmpdir+"/subdir/deeper", 0700)
+	ioutil.WriteFile(tmpdir+"/file1.txt", []byte("foo"), 0600)
+	ioutil.WriteFile(tmpdir+"/subdir/file2.txt", []byte("bar"), 0600)
+	ioutil.WriteFile(tmpdir+"/subdir/deeper/file3.txt", []byte("baz"), 0600)
+
+	cw := CollectionWriter{IKeepClient: &KeepStoreTestClient{}}
+	mt, err := writeTree(&cw, tmpdir, log.New(os.Stdout, "", 0))
+	c.Assert(err, IsNil)
+	pdh, err := cw.PortableDataHash()
+	c.Assert(err, IsNil)
+
+	// Nothing is written to Keep.
+	kc := &KeepCountTestClient{}
+	cw = CollectionWriter{IKeepClient: kc, DryRun: true}
+	ok, diff, err := cw.VerifyTree(context.Background(), tmpdir, pdh)
+	c.Check(err, IsNil)
+	c.Check(ok, Equals, true)
+	c.Check(diff, IsNil)
+	c.Check(kc.puts, Equals, 0)
+
+	// A changed file is found.
+	ioutil.WriteFile(tmpdir+"/subdir/file2.txt", []byte("BAR"), 0600)
+	cw = CollectionWriter{DryRun: true}
+	ok, diff, err = cw.VerifyTree(context.Background(), tmpdir, pdh)
+	c.Check(err, IsNil)
+	c.Check(ok, Equals, false)
+	c.Check(diff, IsNil)
+
+	cw = CollectionWriter{DryRun: true, DiffBase: mt}
+	ok, diff, err = cw.VerifyTree(context.Background(), tmpdir, pdh)
+	c.Check(err, IsNil)
+	c.Check(ok, Equals, false)
+	c.Check(diff.Modified, DeepEquals, []string{"subdir/file2.txt"})
+	c.Check(diff.Unchanged, DeepEquals, []string{"file1.txt", "subdir/deeper/file3.txt"})
+
+	cw = CollectionWriter{IKeepClient: kc}
+	_, _, err = cw.VerifyTree(context.Background(), tmpdir, pdh)
+	c.Check(err, ErrorMatches, `VerifyTree requires DryRun`)
+}
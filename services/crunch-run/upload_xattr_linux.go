@@ -0,0 +1,57 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package main
+
+import (
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+func (osFileSystem) Xattrs(name string) (map[string]string, error) {
+	buf, err := readXattr(name, func(dest []byte) (int, error) {
+		return unix.Listxattr(name, dest)
+	})
+	if err == unix.ENOTSUP {
+		return nil, nil
+	} else if err != nil || len(buf) == 0 {
+		return nil, err
+	}
+
+	attrs := make(map[string]string)
+	for _, attr := range strings.Split(strings.TrimRight(string(buf), "\x00"), "\x00") {
+		val, err := readXattr(name, func(dest []byte) (int, error) {
+			return unix.Getxattr(name, attr, dest)
+		})
+		if err == unix.ENODATA {
+			// Removed since it was listed
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		attrs[attr] = string(val)
+	}
+	return attrs, nil
+}
+
+// readXattr calls get (Listxattr or Getxattr) first to find the size
+// of the result and then to read it, trying again if the result grows
+// in between.
+func readXattr(name string, get func(dest []byte) (int, error)) ([]byte, error) {
+	for {
+		size, err := get(nil)
+		if err != nil || size == 0 {
+			return nil, err
+		}
+		buf := make([]byte, size)
+		size, err = get(buf)
+		if err == unix.ERANGE {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		return buf[:size], nil
+	}
+}
@@ -0,0 +1,46 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package main
+
+import (
+	"io/ioutil"
+	"log"
+	"os"
+
+	"golang.org/x/sys/unix"
+	. "gopkg.in/check.v1"
+)
+
+func (s *TestSuite) TestUploadPreserveXattrs(c *C) {
+	tmpdir, _ := ioutil.TempDir("", "")
+	defer func() {
+		os.RemoveAll(tmpdir)
+	}()
+
+	os.Mkdir(tmpdir+"/subdir", 0700)
+	ioutil.WriteFile(tmpdir+"/"+"file1.txt", []byte("foo"), 0600)
+	ioutil.WriteFile(tmpdir+"/subdir/file2.txt", []byte("bar"), 0600)
+	err := unix.Setxattr(tmpdir+"/subdir/file2.txt", "user.checksum", []byte("md5:37b51d194a7513e45b56f6524f2d51f2"), 0)
+	if err == unix.ENOTSUP {
+		c.Skip("file system does not support user xattrs")
+	}
+	c.Assert(err, IsNil)
+	c.Assert(unix.Setxattr(tmpdir+"/subdir/file2.txt", "user.source", []byte("sequencer-1"), 0), IsNil)
+
+	cw := CollectionWriter{IKeepClient: &KeepTestClient{}}
+	_, err = writeTree(&cw, tmpdir, log.New(os.Stdout, "", 0))
+	c.Check(err, IsNil)
+	c.Check(cw.FileMetadata(), HasLen, 0)
+
+	cw = CollectionWriter{IKeepClient: &KeepTestClient{}, PreserveXattrs: true}
+	_, err = writeTree(&cw, tmpdir, log.New(os.Stdout, "", 0))
+	c.Check(err, IsNil)
+	c.Check(cw.FileMetadata(), DeepEquals, map[string]*FileMetadata{
+		"subdir/file2.txt": {Xattrs: map[string]string{
+			"user.checksum": "md5:37b51d194a7513e45b56f6524f2d51f2",
+			"user.source":   "sequencer-1",
+		}},
+	})
+}